@@ -0,0 +1,173 @@
+package dtls_tunnel
+
+import (
+	"crypto/x509"
+	"path"
+	"strings"
+
+	"github.com/pion/dtls/v3"
+)
+
+/*
+ * 服务端的访问控制
+ * 按顺序匹配规则, 第一个命中的规则决定是否允许以及转发到哪些上游地址
+ * 没有配置规则时允许所有客户端并转发到 RemoteAddress, 配置了规则但都没命中时拒绝
+ */
+
+const ACL_ACTION_ALLOW = "allow"
+const ACL_ACTION_DENY = "deny"
+
+// PeerIdentity 是从握手结果中取出的客户端身份
+type PeerIdentity struct {
+	CommonName          string
+	OrganizationalUnits []string
+	SANs                []string // DNS, Email, IP, URI
+	PSKIdentity         string
+}
+
+func PeerIdentityFromState(state *dtls.State) PeerIdentity {
+	identity := PeerIdentity{
+		PSKIdentity: string(state.IdentityHint),
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return identity
+	}
+
+	cert, err := x509.ParseCertificate(state.PeerCertificates[0])
+	if err != nil {
+		return identity
+	}
+
+	identity.CommonName = cert.Subject.CommonName
+	identity.OrganizationalUnits = cert.Subject.OrganizationalUnit
+
+	identity.SANs = append(identity.SANs, cert.DNSNames...)
+	identity.SANs = append(identity.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		identity.SANs = append(identity.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		identity.SANs = append(identity.SANs, uri.String())
+	}
+
+	return identity
+}
+
+func (id PeerIdentity) String() string {
+	if id.PSKIdentity != "" {
+		return FormatString("psk:%s", id.PSKIdentity)
+	}
+
+	if len(id.OrganizationalUnits) > 0 {
+		return FormatString("CN=%s,OU=%s", id.CommonName, strings.Join(id.OrganizationalUnits, "+"))
+	}
+
+	return FormatString("CN=%s", id.CommonName)
+}
+
+// ACLRule 中为空的字段不参与匹配, 其余字段都要命中, 支持 path.Match 的通配符
+type ACLRule struct {
+	Name               string
+	CommonName         string
+	OrganizationalUnit string
+	SAN                string
+	PSKIdentity        string
+
+	Allow bool
+
+	// 为 nil 时使用 RemoteAddress
+	Upstreams *Upstreams
+
+	// 允许客户端指定的目标地址, 为 nil 时不允许客户端指定
+	DestinationAllowlist *DestinationAllowlist
+}
+
+func (r *ACLRule) Match(identity PeerIdentity) bool {
+	if r.CommonName != "" && !matchPattern(r.CommonName, identity.CommonName) {
+		return false
+	}
+
+	if r.OrganizationalUnit != "" && !matchAnyPattern(r.OrganizationalUnit, identity.OrganizationalUnits) {
+		return false
+	}
+
+	if r.SAN != "" && !matchAnyPattern(r.SAN, identity.SANs) {
+		return false
+	}
+
+	if r.PSKIdentity != "" && !matchPattern(r.PSKIdentity, identity.PSKIdentity) {
+		return false
+	}
+
+	return true
+}
+
+func matchPattern(pattern string, value string) bool {
+	isMatched, err := path.Match(pattern, value)
+	return err == nil && isMatched
+}
+
+func matchAnyPattern(pattern string, values []string) bool {
+	for _, value := range values {
+		if matchPattern(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidateACLPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return MakeErrorWithErrMsg("invalid pattern %q", pattern)
+	}
+	return nil
+}
+
+type ACL struct {
+	rules []*ACLRule
+}
+
+func NewACL(rules []*ACLRule) *ACL {
+	return &ACL{rules: rules}
+}
+
+// Evaluate 返回命中的规则, 没有规则时返回 nil, true
+func (acl *ACL) Evaluate(identity PeerIdentity) (*ACLRule, bool) {
+	if acl == nil || len(acl.rules) == 0 {
+		return nil, true
+	}
+
+	for _, rule := range acl.rules {
+		if rule.Match(identity) {
+			return rule, rule.Allow
+		}
+	}
+
+	return nil, false
+}
+
+// Upstreams 返回规则中配置的上游地址, 用于健康检查
+func (acl *ACL) Upstreams() []*Upstreams {
+	upstreams := make([]*Upstreams, 0)
+	if acl == nil {
+		return upstreams
+	}
+
+	for _, rule := range acl.rules {
+		if rule.Upstreams != nil {
+			upstreams = append(upstreams, rule.Upstreams)
+		}
+	}
+	return upstreams
+}
+
+// Authorize 用于握手阶段的 VerifyConnection 回调
+func (acl *ACL) Authorize(state *dtls.State) error {
+	identity := PeerIdentityFromState(state)
+	if _, isAllowed := acl.Evaluate(identity); !isAllowed {
+		logger.Warn(FormatString("Rejected by acl: %s", identity.String()))
+		return MakeErrorWithErrMsg("%s is not allowed", identity.String())
+	}
+	return nil
+}
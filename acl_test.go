@@ -0,0 +1,105 @@
+package dtls_tunnel
+
+import "testing"
+
+func TestACLRuleMatch(t *testing.T) {
+	identity := PeerIdentity{
+		CommonName:          "alice.ops",
+		OrganizationalUnits: []string{"staff", "ops"},
+		SANs:                []string{"alice.example.com", "10.0.0.1"},
+	}
+
+	cases := []struct {
+		name    string
+		rule    ACLRule
+		isMatch bool
+	}{
+		{"empty rule", ACLRule{}, true},
+		{"common name", ACLRule{CommonName: "alice.ops"}, true},
+		{"common name wildcard", ACLRule{CommonName: "*.ops"}, true},
+		{"common name mismatch", ACLRule{CommonName: "bob.ops"}, false},
+		{"any ou", ACLRule{OrganizationalUnit: "ops"}, true},
+		{"no ou", ACLRule{OrganizationalUnit: "dev"}, false},
+		{"any san", ACLRule{SAN: "10.0.0.*"}, true},
+		{"no san", ACLRule{SAN: "*.example.org"}, false},
+		{"all fields", ACLRule{CommonName: "alice*", OrganizationalUnit: "staff", SAN: "*.example.com"}, true},
+		{"one field mismatch", ACLRule{CommonName: "alice*", OrganizationalUnit: "dev"}, false},
+		{"psk identity", ACLRule{PSKIdentity: "alice"}, false},
+		{"bad pattern", ACLRule{CommonName: "["}, false},
+	}
+
+	for _, c := range cases {
+		if isMatch := c.rule.Match(identity); isMatch != c.isMatch {
+			t.Errorf("%s: Match() = %v, want %v", c.name, isMatch, c.isMatch)
+		}
+	}
+
+	// path.Match 的 * 不匹配 /
+	if (&ACLRule{CommonName: "*"}).Match(PeerIdentity{CommonName: "a/b"}) {
+		t.Error("* matches a common name containing /")
+	}
+
+	if !(&ACLRule{PSKIdentity: "edge-*"}).Match(PeerIdentity{PSKIdentity: "edge-1"}) {
+		t.Error("edge-* does not match psk identity edge-1")
+	}
+}
+
+func TestACLEvaluate(t *testing.T) {
+	var nilACL *ACL
+	if rule, isAllowed := nilACL.Evaluate(PeerIdentity{CommonName: "alice"}); rule != nil || !isAllowed {
+		t.Errorf("nil acl: Evaluate() = %v, %v, want nil, true", rule, isAllowed)
+	}
+
+	if rule, isAllowed := NewACL(nil).Evaluate(PeerIdentity{CommonName: "alice"}); rule != nil || !isAllowed {
+		t.Errorf("empty acl: Evaluate() = %v, %v, want nil, true", rule, isAllowed)
+	}
+
+	acl := NewACL([]*ACLRule{
+		{Name: "deny-mallory", CommonName: "mallory", Allow: false},
+		{Name: "ops", OrganizationalUnit: "ops", Allow: true},
+		{Name: "deny-ops-intern", CommonName: "intern", OrganizationalUnit: "ops", Allow: false},
+		{Name: "psk", PSKIdentity: "edge-*", Allow: true},
+	})
+
+	cases := []struct {
+		name      string
+		identity  PeerIdentity
+		rule      string
+		isAllowed bool
+	}{
+		{"deny rule", PeerIdentity{CommonName: "mallory", OrganizationalUnits: []string{"ops"}}, "deny-mallory", false},
+		// 第一个命中的规则生效, 后面更具体的规则不起作用
+		{"first match wins", PeerIdentity{CommonName: "intern", OrganizationalUnits: []string{"ops"}}, "ops", true},
+		{"psk", PeerIdentity{PSKIdentity: "edge-1"}, "psk", true},
+		{"no match", PeerIdentity{CommonName: "bob"}, "", false},
+	}
+
+	for _, c := range cases {
+		rule, isAllowed := acl.Evaluate(c.identity)
+		if isAllowed != c.isAllowed {
+			t.Errorf("%s: allowed %v, want %v", c.name, isAllowed, c.isAllowed)
+		}
+
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		if name != c.rule {
+			t.Errorf("%s: matched rule %q, want %q", c.name, name, c.rule)
+		}
+	}
+}
+
+func TestPeerIdentityString(t *testing.T) {
+	cases := map[string]PeerIdentity{
+		"psk:edge-1":            {CommonName: "ignored", PSKIdentity: "edge-1"},
+		"CN=alice,OU=staff+ops": {CommonName: "alice", OrganizationalUnits: []string{"staff", "ops"}},
+		"CN=bob":                {CommonName: "bob"},
+	}
+
+	for want, identity := range cases {
+		if s := identity.String(); s != want {
+			t.Errorf("String() = %q, want %q", s, want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * 本地管理接口, 监听 unix socket ("unix:/path/to/admin.sock") 或者回环地址
+ * GET  /tunnels                       所有隧道
+ * GET  /mappers?tunnel=name           所有映射, 不指定 tunnel 时返回全部
+ * POST /mappers/close?tunnel=name&id= 关闭一个映射, id 是映射的来源地址
+ * POST /drain?tunnel=name             排空隧道, 不指定 tunnel 时排空全部
+ * GET  /payload_pool                  payload 池的统计
+ * GET  /rate_limits?tunnel=name       限速的范围和计数, 不指定 tunnel 时返回全部
+ */
+
+const ADMIN_UNIX_PREFIX = "unix:"
+
+type MapperInfo struct {
+	Tunnel string `json:"tunnel"`
+
+	// Client: 本地应用的地址, Server: 客户端的地址
+	ID string `json:"id"`
+
+	// 对端证书或 PSK 的身份
+	Peer string `json:"peer"`
+
+	// Client: 服务端地址, Server: 目标地址, 多路复用时为空
+	Destination string `json:"destination,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	LastRead  time.Time `json:"last_read"`
+	LastWrite time.Time `json:"last_write"`
+
+	UpstreamBytes   uint64 `json:"upstream_bytes"`
+	DownstreamBytes uint64 `json:"downstream_bytes"`
+
+	// 仅 Client
+	ReadQueue  int `json:"read_queue"`
+	WriteQueue int `json:"write_queue"`
+
+	// 仅 Client, writeQueue 满了被丢弃的数据报数量
+	WriteDropped uint64 `json:"write_dropped,omitempty"`
+
+	// 仅 Client, 源地址所在的监听 socket 的序号, listen_sockets 大于 1 时才有意义
+	Socket int `json:"socket"`
+
+	Multiplexed bool `json:"multiplexed"`
+
+	// 仅 Client, 连接断开后正在重新连接
+	Reconnecting bool `json:"reconnecting,omitempty"`
+
+	// 仅 Server 的多路复用模式
+	Flows int `json:"flows,omitempty"`
+}
+
+// RateLimiterInfo 是一个限速范围在一个方向上的配置和计数
+type RateLimiterInfo struct {
+	Tunnel string `json:"tunnel"`
+
+	// global, source (Client 的源地址) 或 identity (Server 的客户端身份)
+	Scope string `json:"scope"`
+	Key   string `json:"key,omitempty"`
+
+	Direction        string `json:"direction"`
+	PacketsPerSecond int64  `json:"packets_per_second,omitempty"`
+	BytesPerSecond   int64  `json:"bytes_per_second,omitempty"`
+
+	// 因为这个范围的限制被丢弃和等待过的数据报数量
+	Dropped uint64 `json:"dropped"`
+	Queued  uint64 `json:"queued"`
+}
+
+type TunnelInfo struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Address string `json:"address"`
+	Mappers int    `json:"mappers"`
+}
+
+// ValidateAdminAddress 只允许 unix socket 和回环地址, 管理接口没有认证
+func ValidateAdminAddress(address string) error {
+	if strings.HasPrefix(address, ADMIN_UNIX_PREFIX) {
+		if strings.TrimPrefix(address, ADMIN_UNIX_PREFIX) == "" {
+			return MakeErrorWithErrMsg("admin socket path is empty")
+		}
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return MakeErrorWithErrMsg("admin address must be \"unix:/path\" or \"host:port\", got %q", address)
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return MakeErrorWithErrMsg("admin address must be a loopback address, got %q", host)
+	}
+
+	return nil
+}
+
+type AdminServer struct {
+	manager *TunnelManager
+	address string
+	server  *http.Server
+}
+
+func NewAdminServer(manager *TunnelManager, address string) *AdminServer {
+	admin := &AdminServer{
+		manager: manager,
+		address: address,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", admin.handleTunnels)
+	mux.HandleFunc("/mappers", admin.handleMappers)
+	mux.HandleFunc("/mappers/close", admin.handleCloseMapper)
+	mux.HandleFunc("/drain", admin.handleDrain)
+	mux.HandleFunc("/payload_pool", admin.handlePayloadPool)
+	mux.HandleFunc("/rate_limits", admin.handleRateLimits)
+
+	admin.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	return admin
+}
+
+func (a *AdminServer) listen() (net.Listener, error) {
+	if !strings.HasPrefix(a.address, ADMIN_UNIX_PREFIX) {
+		return net.Listen("tcp", a.address)
+	}
+
+	// 上次异常退出时留下的 socket 文件
+	path := strings.TrimPrefix(a.address, ADMIN_UNIX_PREFIX)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (a *AdminServer) Run() error {
+	listener, err := a.listen()
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to run admin server: %s", err.Error())
+	}
+
+	logger.Info(FormatString("The admin server is running on %s", a.address))
+
+	if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return MakeErrorWithErrMsg("Failed to run admin server: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (a *AdminServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	_ = a.server.Shutdown(ctx)
+}
+
+func (a *AdminServer) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, a.manager.TunnelInfos())
+}
+
+func (a *AdminServer) handlePayloadPool(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, a.manager.PayloadPoolStats())
+}
+
+func (a *AdminServer) handleMappers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	infos, err := a.manager.MapperInfos(r.URL.Query().Get("tunnel"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, infos)
+}
+
+func (a *AdminServer) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	infos, err := a.manager.RateLimiterInfos(r.URL.Query().Get("tunnel"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, infos)
+}
+
+func (a *AdminServer) handleCloseMapper(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("tunnel") == "" || query.Get("id") == "" {
+		writeAdminError(w, http.StatusBadRequest, "tunnel and id are required")
+		return
+	}
+
+	if err := a.manager.CloseMapper(query.Get("tunnel"), query.Get("id")); err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"closed": true})
+}
+
+func (a *AdminServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if err := a.manager.Drain(r.URL.Query().Get("tunnel")); err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"draining": true})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		logger.Warn(FormatString("Failed to write admin response: %s", err.Error()))
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, errMsg string) {
+	writeAdminJSON(w, status, map[string]string{"error": errMsg})
+}
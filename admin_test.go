@@ -0,0 +1,201 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateAdminAddress(t *testing.T) {
+	cases := []struct {
+		address string
+		isValid bool
+	}{
+		{"unix:/run/dtls_tunnel/admin.sock", true},
+		{"unix:", false},
+		{"127.0.0.1:9000", true},
+		{"[::1]:9000", true},
+		{"localhost:9000", true},
+		{"0.0.0.0:9000", false},
+		{"[::]:9000", false},
+		{":9000", false},
+		{"192.0.2.1:9000", false},
+		{"example.com:9000", false},
+		{"127.0.0.1", false},
+	}
+
+	for _, c := range cases {
+		if err := ValidateAdminAddress(c.address); (err == nil) != c.isValid {
+			t.Errorf("ValidateAdminAddress(%q) = %v, want valid %v", c.address, err, c.isValid)
+		}
+	}
+}
+
+// adminTestClient 通过 unix socket 访问管理接口
+type adminTestClient struct {
+	t      *testing.T
+	client *http.Client
+}
+
+func newAdminTestClient(t *testing.T, path string) *adminTestClient {
+	return &adminTestClient{
+		t: t,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			},
+			Timeout: TEST_ROUND_TRIP_TIMEOUT,
+		},
+	}
+}
+
+// do 发送请求并把响应解析到 value 中, 返回状态码
+func (c *adminTestClient) do(method string, path string, value any) int {
+	c.t.Helper()
+
+	request, err := http.NewRequest(method, "http://admin"+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if value != nil && response.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(value); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+
+	return response.StatusCode
+}
+
+// waitMappers 等待隧道的映射数量变为 count
+func (c *adminTestClient) waitMappers(tunnel string, count int) []*MapperInfo {
+	c.t.Helper()
+
+	deadline := time.Now().Add(TEST_ROUND_TRIP_TIMEOUT)
+	for {
+		var infos []*MapperInfo
+		if status := c.do(http.MethodGet, "/mappers?tunnel="+tunnel, &infos); status != http.StatusOK {
+			c.t.Fatalf("GET /mappers: status %d", status)
+		}
+
+		if len(infos) == count {
+			return infos
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%d mappers, want %d", len(infos), count)
+		}
+		time.Sleep(TEST_ROUND_TRIP_RETRY)
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+	newTestServer(t, serverConfig)
+
+	clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+	clientConfig.Name = "admin"
+	manager, err := NewTunnelManager([]*CommonConfig{toTestCommonConfig(t, clientConfig)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestTunnel(t, manager)
+	client := manager.tunnels[0].tunnel.(*Client)
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	runTestTunnel(t, NewAdminServer(manager, ADMIN_UNIX_PREFIX+path))
+
+	// 管理接口没有认证, socket 只有当前用户可以访问
+	deadline := time.Now().Add(TEST_ROUND_TRIP_TIMEOUT)
+	for {
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().Perm() == 0600 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("admin socket is not ready: %v", err)
+		}
+		time.Sleep(TEST_ROUND_TRIP_RETRY)
+	}
+	admin := newAdminTestClient(t, path)
+
+	first := dialTestUDP(t, clientConfig.Listen)
+	testRoundTrip(t, first, "first")
+	second := dialTestUDP(t, clientConfig.Listen)
+	testRoundTrip(t, second, "second")
+
+	var tunnels []*TunnelInfo
+	admin.do(http.MethodGet, "/tunnels", &tunnels)
+	if len(tunnels) != 1 || tunnels[0].Name != "admin" || tunnels[0].Role != "client" || tunnels[0].Mappers != 2 {
+		t.Errorf("GET /tunnels = %+v", tunnels)
+	}
+
+	ids := make(map[string]bool)
+	for _, info := range admin.waitMappers("admin", 2) {
+		ids[info.ID] = true
+		if info.Tunnel != "admin" || info.UpstreamBytes == 0 || info.DownstreamBytes == 0 {
+			t.Errorf("mapper %+v", info)
+		}
+	}
+	if !ids[first.LocalAddr().String()] || !ids[second.LocalAddr().String()] {
+		t.Errorf("mappers %v, want the addresses of both sockets", ids)
+	}
+
+	// 错误的请求
+	for _, c := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/mappers?tunnel=missing", http.StatusNotFound},
+		{http.MethodGet, "/mappers/close?tunnel=admin&id=" + first.LocalAddr().String(), http.StatusMethodNotAllowed},
+		{http.MethodPost, "/mappers/close?tunnel=admin", http.StatusBadRequest},
+		{http.MethodPost, "/mappers/close?tunnel=admin&id=127.0.0.1:1", http.StatusNotFound},
+		{http.MethodPost, "/drain?tunnel=missing", http.StatusNotFound},
+	} {
+		if status := admin.do(c.method, c.path, nil); status != c.status {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.path, status, c.status)
+		}
+	}
+
+	// 关闭一个映射
+	if status := admin.do(http.MethodPost, "/mappers/close?tunnel=admin&id="+first.LocalAddr().String(), nil); status != http.StatusOK {
+		t.Fatalf("POST /mappers/close: status %d", status)
+	}
+	if infos := admin.waitMappers("admin", 1); infos[0].ID != second.LocalAddr().String() {
+		t.Errorf("mapper %s is left, want %s", infos[0].ID, second.LocalAddr().String())
+	}
+
+	// 排空后新的来源地址不再建立映射, 现有的映射仍然转发
+	if status := admin.do(http.MethodPost, "/drain?tunnel=admin", nil); status != http.StatusOK {
+		t.Fatalf("POST /drain: status %d", status)
+	}
+
+	third := dialTestUDP(t, clientConfig.Listen)
+	if _, err := third.Write([]byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	testRoundTrip(t, second, "second")
+	admin.waitMappers("admin", 1)
+
+	// 最后一个映射结束后客户端关闭
+	admin.do(http.MethodPost, "/mappers/close?tunnel=admin&id="+second.LocalAddr().String(), nil)
+	select {
+	case <-client.ctx.Done():
+	case <-time.After(TEST_ROUND_TRIP_TIMEOUT):
+		t.Error("drained client is not shut down after its last mapper is closed")
+	}
+}
@@ -1,109 +1,316 @@
 package dtls_tunnel
 
 import (
-	"crypto/x509"
 	"flag"
-	"github.com/pion/dtls/v2/examples/util"
-	"net"
+	"time"
 )
 
-func ParseCommonConfig() (*CommonConfig, error) {
-	config := &CommonConfig{}
+const DEFAULT_CLIENT_HANDSHAKE_TIMEOUT = time.Second * 10
+const DEFAULT_SERVER_HANDSHAKE_TIMEOUT = time.Second * 30
 
-	var listenAddressWithPort string
-	var remoteAddressWithPort string
+// ParseProcessConfig 解析命令行和配置文件, 每个隧道对应一个 CommonConfig
+// 配置了 tunnels 时, 命令行参数作为所有隧道的默认值
+func ParseProcessConfig() (*ProcessConfig, error) {
+	// flagConfig 只用来接收命令行参数, 显式指定的参数才会覆盖 fileConfig
+	fileConfig := DefaultFileConfig()
+	flagConfig := DefaultFileConfig()
 
-	var keyPath string
-	var certPath string
-	var rootCertPath string
+	var configPath string
+	var handshakeTimeout time.Duration
+	var reloadInterval time.Duration
+	var crlReloadInterval time.Duration
+	var readTimeout, writeTimeout, idleTimeout, gcInterval time.Duration
+	var keepaliveInterval time.Duration
+	var reconnectTimeout time.Duration
+	var sessionTTL time.Duration
+	var warmMaxIdle time.Duration
+	var writeOverflowTimeout time.Duration
+	var payloadPoolTimeout time.Duration
+	var probeInterval time.Duration
+	var healthCheckInterval, healthCheckTimeout time.Duration
+	var healthCheckPayload, healthCheckExpect string
+	var rateLimit RateLimitFileConfig
+	var rateLimitBurst, rateLimitMaxDelay time.Duration
 
 	var serverMode bool = false
 	var clientMode bool = false
 
-	flag.BoolVar(&clientMode, "c", false, "")
-	flag.BoolVar(&serverMode, "s", false, "")
+	flag.StringVar(&configPath, "config", "", "path of config file (.json, .yaml, .yml or .toml)")
 
-	flag.IntVar(&config.PackageBufferSize, "pbs", 1500, "")
-	flag.IntVar(&config.PackageBufferCount, "pbc", 1500, "")
+	flag.BoolVar(&clientMode, "c", false, "run as client")
+	flag.BoolVar(&serverMode, "s", false, "run as server")
 
-	flag.StringVar(&listenAddressWithPort, "l", "0.0.0.0:10000", "")
-	flag.StringVar(&remoteAddressWithPort, "r", "127.0.0.1:10000", "")
+	flag.IntVar(&flagConfig.PackageBufferSize, "pbs", flagConfig.PackageBufferSize, "size of each packet buffer in bytes")
+	flag.IntVar(&flagConfig.PackageBufferCount, "pbc", flagConfig.PackageBufferCount, "number of packets buffered in each queue")
+	flag.IntVar(&flagConfig.UDPBatchSize, "ubs", flagConfig.UDPBatchSize, "max UDP datagrams per recvmmsg/sendmmsg on the client listener and server upstream sockets, 1 disables batching")
+	flag.BoolVar(&flagConfig.UDPOffload, "uo", flagConfig.UDPOffload, "use UDP GRO/GSO when the kernel supports it (linux)")
+	flag.IntVar(&flagConfig.ListenSockets, "ls", flagConfig.ListenSockets, "number of SO_REUSEPORT sockets on the listen address, each with its own workers (client, linux)")
 
-	flag.StringVar(&keyPath, "key", "", "")
-	flag.StringVar(&certPath, "cert", "", "")
-	flag.StringVar(&rootCertPath, "rc", "", "root cert")
+	flag.StringVar(&flagConfig.Listen, "l", flagConfig.Listen, "client: UDP listen address, server: DTLS listen address")
+	flag.StringVar(&flagConfig.Remote, "r", flagConfig.Remote, "client: DTLS server addresses separated by commas in priority order, server: UDP forward addresses separated by commas")
+	flag.StringVar(&flagConfig.ServerStrategy, "rs", flagConfig.ServerStrategy, "how to choose among multiple servers: priority, round_robin or lowest_rtt (client)")
+
+	flag.DurationVar(&probeInterval, "rpi", DEFAULT_PROBE_INTERVAL, "interval to probe servers when there are more than one (client)")
+
+	flag.StringVar(&flagConfig.UpstreamPolicy, "up", flagConfig.UpstreamPolicy, "how to choose among multiple forward addresses: round_robin, hash or least_flows (server)")
+	flag.DurationVar(&healthCheckInterval, "hci", 0, "interval of health checks on forward addresses, requires -hcp (server)")
+	flag.DurationVar(&healthCheckTimeout, "hct", DEFAULT_HEALTH_CHECK_TIMEOUT, "timeout of each health check (server)")
+	flag.StringVar(&healthCheckPayload, "hcp", "", "hex encoded payload of health checks (server)")
+	flag.StringVar(&healthCheckExpect, "hce", "", "hex encoded prefix expected in health check replies, empty accepts any reply (server)")
+
+	flag.DurationVar(&handshakeTimeout, "hst", 0, "DTLS handshake timeout (default 10s for client, 30s for server)")
+	flag.DurationVar(&readTimeout, "rt", DEFAULT_READ_TIMEOUT, "deadline of each read, also bounds how long shutdown waits")
+	flag.DurationVar(&writeTimeout, "wt", DEFAULT_WRITE_TIMEOUT, "deadline of each write")
+	flag.DurationVar(&idleTimeout, "idle", DEFAULT_IDLE_TIMEOUT, "close mappers and flows idle for longer than this")
+	flag.StringVar(&flagConfig.IdlePolicy, "idlep", flagConfig.IdlePolicy, "idle policy: either (any direction idle) or both (both directions idle)")
+	flag.DurationVar(&gcInterval, "gci", DEFAULT_GC_INTERVAL, "interval to check for idle mappers and flows")
+
+	flag.BoolVar(&flagConfig.Multiplex, "mux", false, "multiplex flows over shared DTLS connections (client)")
+	flag.IntVar(&flagConfig.MultiplexConnections, "muxc", flagConfig.MultiplexConnections, "number of DTLS connections in multiplex mode (client)")
+
+	flag.DurationVar(&keepaliveInterval, "ka", 0, "interval of keepalive on each DTLS connection, 0 disables it (client)")
+	flag.IntVar(&flagConfig.KeepaliveMisses, "kam", flagConfig.KeepaliveMisses, "missed keepalive intervals before reconnecting (client)")
+
+	flag.DurationVar(&reconnectTimeout, "rct", 0, "keep flows and reconnect for up to this long when the tunnel drops, 0 disables it (client)")
+	flag.StringVar(&flagConfig.WriteOverflow, "wo", flagConfig.WriteOverflow, "what to do when the write queue of a flow is full: drop_newest, drop_oldest or block (client)")
+	flag.DurationVar(&writeOverflowTimeout, "wot", DEFAULT_WRITE_OVERFLOW_TIMEOUT, "longest wait for a full write queue with -wo block, other flows wait as well (client)")
+	flag.IntVar(&flagConfig.WarmConnections, "warm", 0, "number of idle pre-handshaked DTLS connections kept for new flows, 0 disables it (client)")
+	flag.DurationVar(&warmMaxIdle, "warmi", DEFAULT_WARM_MAX_IDLE, "replace warm connections idle for longer than this, keep it below the server handshake timeout (client)")
+	flag.DurationVar(&sessionTTL, "sttl", 0, "how long DTLS sessions are cached for abbreviated handshakes, 0 disables resumption (psk auth only)")
+
+	flag.Int64Var(&rateLimit.Global.PacketsPerSecond, "rlgp", 0, "max packets per second of the whole tunnel in each direction, 0 is unlimited")
+	flag.Int64Var(&rateLimit.Global.BytesPerSecond, "rlgb", 0, "max bytes per second of the whole tunnel in each direction, 0 is unlimited")
+	flag.Int64Var(&rateLimit.Source.PacketsPerSecond, "rlsp", 0, "max packets per second of each source address in each direction, 0 is unlimited (client)")
+	flag.Int64Var(&rateLimit.Source.BytesPerSecond, "rlsb", 0, "max bytes per second of each source address in each direction, 0 is unlimited (client)")
+	flag.Int64Var(&rateLimit.Identity.PacketsPerSecond, "rlip", 0, "max packets per second of each client identity in each direction, 0 is unlimited (server)")
+	flag.Int64Var(&rateLimit.Identity.BytesPerSecond, "rlib", 0, "max bytes per second of each client identity in each direction, 0 is unlimited (server)")
+	flag.StringVar(&rateLimit.Action, "rla", RATE_LIMIT_ACTION_DROP, "what to do with packets over a rate limit: drop or queue")
+	flag.DurationVar(&rateLimitBurst, "rlbu", DEFAULT_RATE_LIMIT_BURST, "burst allowed by rate limits, as time at the limited rate")
+	flag.DurationVar(&rateLimitMaxDelay, "rlmd", DEFAULT_RATE_LIMIT_MAX_DELAY, "longest wait of a packet over a rate limit with -rla queue, longer waits are dropped")
+
+	flag.StringVar(&flagConfig.Destination, "d", "", "destination host:port requested from the server (client)")
+
+	flag.StringVar(&flagConfig.Auth, "auth", flagConfig.Auth, "authentication mode: cert or psk")
+
+	flag.StringVar(&flagConfig.Key, "key", "", "path of private key")
+	flag.StringVar(&flagConfig.Cert, "cert", "", "path of certificate")
+	flag.StringVar(&flagConfig.RootCert, "rc", "", "path of root certificate")
+	flag.StringVar(&flagConfig.CRL, "crl", "", "path of CRL file or directory of CRL files")
+	flag.DurationVar(&crlReloadInterval, "crlri", DEFAULT_CRL_RELOAD_INTERVAL, "interval to check CRL files for changes (0 checks them with -ri)")
+
+	flag.StringVar(&flagConfig.PSKFile, "pskf", "", "path of psk file with \"identity:hexkey\" lines")
+	flag.StringVar(&flagConfig.PSKIdentity, "pski", "", "psk identity sent to the server (client)")
+	flag.StringVar(&flagConfig.PSKHint, "pskh", "", "psk identity hint sent to clients (server)")
+
+	flag.StringVar(&flagConfig.MetricsListen, "metrics", "", "HTTP listen address of the prometheus /metrics endpoint")
+	flag.StringVar(&flagConfig.AdminListen, "admin", "", "admin API address, \"unix:/path/to/socket\" or a loopback \"host:port\"")
+
+	flag.IntVar(&flagConfig.PayloadPoolLimit, "ppl", 0, "max packet buffers in use across all client tunnels, 0 is unbounded")
+	flag.StringVar(&flagConfig.PayloadPoolExhausted, "ppe", flagConfig.PayloadPoolExhausted, "what to do when all packet buffers are in use with -ppl: block or fail")
+	flag.DurationVar(&payloadPoolTimeout, "ppt", DEFAULT_PAYLOAD_POOL_TIMEOUT, "longest wait for a free packet buffer with -ppe block")
+	flag.BoolVar(&flagConfig.PayloadPoolDebug, "ppd", false, "detect packet buffers put twice or written after put (slow, for debugging)")
+
+	flag.DurationVar(&reloadInterval, "ri", 0, "interval to check certificate or psk files for changes (0 reloads only on SIGHUP)")
 
 	flag.Parse()
 
-	if serverMode == clientMode {
-		return nil, MakeErrorWithErrMsg("Cannot run both mode as some time")
+	if configPath != "" {
+		if err := LoadFileConfig(configPath, fileConfig); err != nil {
+			return nil, err
+		}
 	}
 
-	if serverMode {
-		config.RunMethod = "server"
-	} else if clientMode {
-		config.RunMethod = "client"
+	if serverMode && clientMode {
+		return nil, MakeErrorWithErrMsg("Cannot run both mode as same time")
 	}
 
-	address, err := net.ResolveUDPAddr("udp", listenAddressWithPort)
-	if err != nil {
-		return nil, MakeErrorWithErrMsg("Failed to parse listen address of client: %s", err.Error())
+	overrides := map[string]func(){
+		"c":       func() { fileConfig.Mode = "client" },
+		"s":       func() { fileConfig.Mode = "server" },
+		"pbs":     func() { fileConfig.PackageBufferSize = flagConfig.PackageBufferSize },
+		"pbc":     func() { fileConfig.PackageBufferCount = flagConfig.PackageBufferCount },
+		"ubs":     func() { fileConfig.UDPBatchSize = flagConfig.UDPBatchSize },
+		"uo":      func() { fileConfig.UDPOffload = flagConfig.UDPOffload },
+		"ls":      func() { fileConfig.ListenSockets = flagConfig.ListenSockets },
+		"l":       func() { fileConfig.Listen = flagConfig.Listen },
+		"r":       func() { fileConfig.Remote = flagConfig.Remote },
+		"rs":      func() { fileConfig.ServerStrategy = flagConfig.ServerStrategy },
+		"rpi":     func() { fileConfig.ProbeInterval = Duration(probeInterval) },
+		"up":      func() { fileConfig.UpstreamPolicy = flagConfig.UpstreamPolicy },
+		"hci":     func() { fileConfig.healthCheck().Interval = Duration(healthCheckInterval) },
+		"hct":     func() { fileConfig.healthCheck().Timeout = Duration(healthCheckTimeout) },
+		"hcp":     func() { fileConfig.healthCheck().Payload = healthCheckPayload },
+		"hce":     func() { fileConfig.healthCheck().Expect = healthCheckExpect },
+		"hst":     func() { fileConfig.HandshakeTimeout = Duration(handshakeTimeout) },
+		"rt":      func() { fileConfig.ReadTimeout = Duration(readTimeout) },
+		"wt":      func() { fileConfig.WriteTimeout = Duration(writeTimeout) },
+		"idle":    func() { fileConfig.IdleTimeout = Duration(idleTimeout) },
+		"idlep":   func() { fileConfig.IdlePolicy = flagConfig.IdlePolicy },
+		"gci":     func() { fileConfig.GCInterval = Duration(gcInterval) },
+		"mux":     func() { fileConfig.Multiplex = flagConfig.Multiplex },
+		"muxc":    func() { fileConfig.MultiplexConnections = flagConfig.MultiplexConnections },
+		"ka":      func() { fileConfig.KeepaliveInterval = Duration(keepaliveInterval) },
+		"kam":     func() { fileConfig.KeepaliveMisses = flagConfig.KeepaliveMisses },
+		"rct":     func() { fileConfig.ReconnectTimeout = Duration(reconnectTimeout) },
+		"wo":      func() { fileConfig.WriteOverflow = flagConfig.WriteOverflow },
+		"wot":     func() { fileConfig.WriteOverflowTimeout = Duration(writeOverflowTimeout) },
+		"warm":    func() { fileConfig.WarmConnections = flagConfig.WarmConnections },
+		"warmi":   func() { fileConfig.WarmMaxIdle = Duration(warmMaxIdle) },
+		"sttl":    func() { fileConfig.SessionTTL = Duration(sessionTTL) },
+		"rlgp":    func() { fileConfig.rateLimit().Global.PacketsPerSecond = rateLimit.Global.PacketsPerSecond },
+		"rlgb":    func() { fileConfig.rateLimit().Global.BytesPerSecond = rateLimit.Global.BytesPerSecond },
+		"rlsp":    func() { fileConfig.rateLimit().Source.PacketsPerSecond = rateLimit.Source.PacketsPerSecond },
+		"rlsb":    func() { fileConfig.rateLimit().Source.BytesPerSecond = rateLimit.Source.BytesPerSecond },
+		"rlip":    func() { fileConfig.rateLimit().Identity.PacketsPerSecond = rateLimit.Identity.PacketsPerSecond },
+		"rlib":    func() { fileConfig.rateLimit().Identity.BytesPerSecond = rateLimit.Identity.BytesPerSecond },
+		"rla":     func() { fileConfig.rateLimit().Action = rateLimit.Action },
+		"rlbu":    func() { fileConfig.rateLimit().Burst = Duration(rateLimitBurst) },
+		"rlmd":    func() { fileConfig.rateLimit().MaxDelay = Duration(rateLimitMaxDelay) },
+		"d":       func() { fileConfig.Destination = flagConfig.Destination },
+		"auth":    func() { fileConfig.Auth = flagConfig.Auth },
+		"key":     func() { fileConfig.Key = flagConfig.Key },
+		"cert":    func() { fileConfig.Cert = flagConfig.Cert },
+		"rc":      func() { fileConfig.RootCert = flagConfig.RootCert },
+		"crl":     func() { fileConfig.CRL = flagConfig.CRL },
+		"crlri":   func() { fileConfig.CRLReloadInterval = Duration(crlReloadInterval) },
+		"pskf":    func() { fileConfig.PSKFile = flagConfig.PSKFile },
+		"pski":    func() { fileConfig.PSKIdentity = flagConfig.PSKIdentity },
+		"pskh":    func() { fileConfig.PSKHint = flagConfig.PSKHint },
+		"ri":      func() { fileConfig.ReloadInterval = Duration(reloadInterval) },
+		"metrics": func() { fileConfig.MetricsListen = flagConfig.MetricsListen },
+		"admin":   func() { fileConfig.AdminListen = flagConfig.AdminListen },
+		"ppl":     func() { fileConfig.PayloadPoolLimit = flagConfig.PayloadPoolLimit },
+		"ppe":     func() { fileConfig.PayloadPoolExhausted = flagConfig.PayloadPoolExhausted },
+		"ppt":     func() { fileConfig.PayloadPoolTimeout = Duration(payloadPoolTimeout) },
+		"ppd":     func() { fileConfig.PayloadPoolDebug = flagConfig.PayloadPoolDebug },
 	}
-	config.ListenAddress = address
 
-	address, err = net.ResolveUDPAddr("udp", remoteAddressWithPort)
-	if err != nil {
-		return nil, MakeErrorWithErrMsg("Failed to parse listen address of server: %s", err.Error())
-	}
-	config.RemoteAddress = address
+	flag.Visit(func(f *flag.Flag) {
+		if override, isExist := overrides[f.Name]; isExist {
+			override()
+		}
+	})
 
-	cert, err := util.LoadKeyAndCertificate(keyPath, certPath)
+	tunnelConfigs, err := fileConfig.TunnelConfigs()
 	if err != nil {
-		return nil, MakeErrorWithErrMsg("Failed to load key or cert: %s", err.Error())
+		return nil, err
 	}
-	config.Cert = cert
 
-	rootCert, err := util.LoadCertificate(rootCertPath)
-	if err != nil {
-		return nil, MakeErrorWithErrMsg("Failed to load root cert: %s", err.Error())
+	processConfig := &ProcessConfig{
+		MetricsAddress: fileConfig.MetricsListen,
+		AdminAddress:   fileConfig.AdminListen,
+		Tunnels:        make([]*CommonConfig, 0, len(tunnelConfigs)),
 	}
 
-	rootCertParsed, err := x509.ParseCertificate(rootCert.Certificate[0])
-	if err != nil {
-		return nil, MakeErrorWithErrMsg("Failed to parse root cert: %s", err.Error())
+	processConfig.PayloadPool = &PayloadPoolConfig{
+		Limit:           fileConfig.PayloadPoolLimit,
+		ExhaustedPolicy: fileConfig.PayloadPoolExhausted,
+		Timeout:         fileConfig.PayloadPoolTimeout.Duration(),
+		Debug:           fileConfig.PayloadPoolDebug,
 	}
 
-	rootCertPool := x509.NewCertPool()
-	rootCertPool.AddCert(rootCertParsed)
-	config.RootCerts = rootCertPool
+	for _, tunnelConfig := range tunnelConfigs {
+		config, err := tunnelConfig.ToCommonConfig()
+		if err != nil {
+			return nil, err
+		}
+		processConfig.Tunnels = append(processConfig.Tunnels, config)
+	}
 
-	return config, nil
+	return processConfig, nil
 }
 
 func ParseClientConfig(commonConfig *CommonConfig) (*ClientConfig, error) {
 	config := &ClientConfig{}
-	config.PackageBufferSize = commonConfig.PackageBufferCount
+	config.Name = commonConfig.Name
+	config.RunMethod = commonConfig.RunMethod
+	config.PackageBufferSize = commonConfig.PackageBufferSize
 	config.PackageBufferCount = commonConfig.PackageBufferCount
+	config.UDPBatchSize = commonConfig.UDPBatchSize
+	config.UDPOffload = commonConfig.UDPOffload
 
 	config.ListenAddress = commonConfig.ListenAddress
+	config.ListenSockets = commonConfig.ListenSockets
 	config.RemoteAddress = commonConfig.RemoteAddress
+	config.RemoteAddresses = commonConfig.RemoteAddresses
+	config.ServerStrategy = commonConfig.ServerStrategy
+	config.ProbeInterval = commonConfig.ProbeInterval
+
+	config.HandshakeTimeout = commonConfig.HandshakeTimeout
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = DEFAULT_CLIENT_HANDSHAKE_TIMEOUT
+	}
+
+	config.ReadTimeout = commonConfig.ReadTimeout
+	config.WriteTimeout = commonConfig.WriteTimeout
+	config.IdleTimeout = commonConfig.IdleTimeout
+	config.IdlePolicy = commonConfig.IdlePolicy
+	config.GCInterval = commonConfig.GCInterval
 
-	config.Cert = commonConfig.Cert
-	config.RootCerts = commonConfig.RootCerts
+	config.Multiplex = commonConfig.Multiplex
+	config.MultiplexConnections = commonConfig.MultiplexConnections
+	config.KeepaliveInterval = commonConfig.KeepaliveInterval
+	config.KeepaliveMisses = commonConfig.KeepaliveMisses
+	config.ReconnectTimeout = commonConfig.ReconnectTimeout
+	config.SessionTTL = commonConfig.SessionTTL
+	config.WriteOverflowPolicy = commonConfig.WriteOverflowPolicy
+	config.WriteOverflowTimeout = commonConfig.WriteOverflowTimeout
+	config.WarmConnections = commonConfig.WarmConnections
+	config.WarmMaxIdle = commonConfig.WarmMaxIdle
+	config.Destination = commonConfig.Destination
+	config.RateLimit = commonConfig.RateLimit
+
+	config.AuthMode = commonConfig.AuthMode
+	config.Certificates = commonConfig.Certificates
+	config.CRL = commonConfig.CRL
+	config.CRLReloadInterval = commonConfig.CRLReloadInterval
+	config.PSKKeys = commonConfig.PSKKeys
+	config.PSKIdentity = commonConfig.PSKIdentity
+	config.PSKIdentityHint = commonConfig.PSKIdentityHint
+	config.ReloadInterval = commonConfig.ReloadInterval
 
 	return config, nil
 }
 
 func ParseServerConfig(commonConfig *CommonConfig) (*ServerConfig, error) {
 	config := &ServerConfig{}
-	config.PackageBufferSize = commonConfig.PackageBufferCount
+	config.Name = commonConfig.Name
+	config.RunMethod = commonConfig.RunMethod
+	config.PackageBufferSize = commonConfig.PackageBufferSize
 	config.PackageBufferCount = commonConfig.PackageBufferCount
+	config.UDPBatchSize = commonConfig.UDPBatchSize
+	config.UDPOffload = commonConfig.UDPOffload
 
 	config.ListenAddress = commonConfig.ListenAddress
 	config.RemoteAddress = commonConfig.RemoteAddress
+	config.RemoteAddresses = commonConfig.RemoteAddresses
+	config.UpstreamPolicy = commonConfig.UpstreamPolicy
+	config.HealthCheck = commonConfig.HealthCheck
+
+	config.HandshakeTimeout = commonConfig.HandshakeTimeout
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = DEFAULT_SERVER_HANDSHAKE_TIMEOUT
+	}
+	config.SessionTTL = commonConfig.SessionTTL
+
+	config.ReadTimeout = commonConfig.ReadTimeout
+	config.WriteTimeout = commonConfig.WriteTimeout
+	config.IdleTimeout = commonConfig.IdleTimeout
+	config.IdlePolicy = commonConfig.IdlePolicy
+	config.GCInterval = commonConfig.GCInterval
+
+	config.AuthMode = commonConfig.AuthMode
+	config.Certificates = commonConfig.Certificates
+	config.CRL = commonConfig.CRL
+	config.CRLReloadInterval = commonConfig.CRLReloadInterval
+	config.PSKKeys = commonConfig.PSKKeys
+	config.PSKIdentity = commonConfig.PSKIdentity
+	config.PSKIdentityHint = commonConfig.PSKIdentityHint
+	config.ReloadInterval = commonConfig.ReloadInterval
 
-	config.Cert = commonConfig.Cert
-	config.RootCerts = commonConfig.RootCerts
+	config.ACL = commonConfig.ACL
+	config.DestinationAllowlist = commonConfig.DestinationAllowlist
+	config.RateLimit = commonConfig.RateLimit
 
 	return config, nil
 }
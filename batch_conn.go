@@ -0,0 +1,342 @@
+package dtls_tunnel
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+)
+
+/*
+ * BatchConn 批量收发 UDP 数据报
+ * Linux 上用 recvmmsg/sendmmsg 一次系统调用收发多个数据报, 内核支持时还会打开 UDP GRO/GSO
+ * GRO: 内核把同一来源的连续等长数据报合并到一个缓冲区, 读取后按段长度拆开
+ * GSO: 连续的发往同一地址的等长数据报合并成一次发送, 由内核 (或网卡) 分段
+ * 其他平台上每次只收发一个数据报
+ *
+ * 地址使用 netip.AddrPort, 收发时和 sockaddr 直接转换, 每个数据报都不需要分配内存
+ */
+
+const DEFAULT_UDP_BATCH_SIZE = 32
+const UDP_MAX_BATCH_SIZE = 1024
+
+// GRO 时每个缓冲区都要能放下内核合并后的数据
+const UDP_GRO_BUFFER_SIZE = 65535
+
+// GSO 一次发送的分段数量和总长度的上限, 总长度减去了 UDP 和 IPv6 的头部
+const UDP_GSO_MAX_SEGMENTS = 64
+const UDP_GSO_MAX_SIZE = 65535 - 8 - 40
+
+// Datagram 是收发的一个数据报, 连接的 socket 上 Addr 为零值
+// 发送失败时 WriteBatch 设置 Err
+type Datagram struct {
+	Data []byte
+	Addr netip.AddrPort
+	Err  error
+}
+
+// batchMessage 是一次系统调用中的一个消息, GRO/GSO 时一个消息包含多个数据报
+type batchMessage struct {
+	buffer []byte
+	oob    []byte
+	addr   netip.AddrPort
+
+	// 读取后设置, 分别是数据和控制消息的长度
+	n    int
+	oobn int
+}
+
+type BatchConn struct {
+	conn *net.UDPConn
+	io   *batchIO
+
+	// ReadBatch 使用内部的缓冲区, 第一次用到时分配, ReadBatchInto 使用调用方的缓冲区
+	readMessages []batchMessage
+	readBuffers  [][]byte
+	readOOB      [][]byte
+	readCount    int
+	bufferSize   int
+	gro          bool
+
+	writeMessages []batchMessage
+	groups        []int // 每个消息包含的数据报数量
+	gso           bool
+	gsoBuffers    [][]byte // 合并发送时使用, 第一次用到时分配
+	gsoOOB        [][]byte
+}
+
+// NewBatchConn 每次最多收发 batchSize 个数据报, bufferSize 是 ReadBatch 读取的一个数据报的最大长度
+// gro 和 gso 为 true 时在支持的平台上打开 GRO/GSO, 打开 GRO 后不能使用 ReadBatchInto
+func NewBatchConn(conn *net.UDPConn, batchSize int, bufferSize int, gro bool, gso bool) *BatchConn {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	c := &BatchConn{
+		conn:       conn,
+		io:         newBatchIO(conn, batchSize),
+		bufferSize: bufferSize,
+		readCount:  batchSize,
+	}
+
+	if gro {
+		c.gro = enableUDPGRO(conn)
+	}
+	if gso {
+		c.gso = isUDPGSOSupported(conn)
+	}
+
+	// GRO 时一个缓冲区能放下多个数据报, 缓冲区的数量按总容量相同换算
+	if c.gro {
+		c.readCount = (batchSize*bufferSize + UDP_GRO_BUFFER_SIZE - 1) / UDP_GRO_BUFFER_SIZE
+		c.bufferSize = UDP_GRO_BUFFER_SIZE
+	}
+
+	c.readMessages = make([]batchMessage, batchSize)
+	c.writeMessages = make([]batchMessage, batchSize)
+	c.groups = make([]int, 0, batchSize)
+
+	return c
+}
+
+func (c *BatchConn) IsOffloaded() (bool, bool) {
+	return c.gro, c.gso
+}
+
+// ReadBatch 读取一批数据报并依次交给 handle, 返回数据报的数量
+// data 只在 handle 期间有效, handle 返回 false 时丢弃这一批剩下的数据报
+func (c *BatchConn) ReadBatch(handle func(data []byte, addr netip.AddrPort) bool) (int, error) {
+	if c.readBuffers == nil {
+		c.readBuffers = make([][]byte, c.readCount)
+		c.readOOB = make([][]byte, c.readCount)
+		for index := range c.readBuffers {
+			c.readBuffers[index] = make([]byte, c.bufferSize)
+			if c.gro {
+				c.readOOB[index] = make([]byte, UDP_OFFLOAD_OOB_SIZE)
+			}
+		}
+	}
+
+	messages := c.readMessages[:c.readCount]
+	for index := range messages {
+		messages[index].buffer = c.readBuffers[index]
+		messages[index].oob = c.readOOB[index]
+	}
+
+	n, err := c.io.recv(messages)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for index := range messages[:n] {
+		message := &messages[index]
+		data := message.buffer[:message.n]
+
+		segmentSize := 0
+		if c.gro {
+			segmentSize = parseUDPGROSegmentSize(message.oob[:message.oobn])
+		}
+		if segmentSize <= 0 {
+			segmentSize = len(data)
+		}
+
+		for {
+			size := segmentSize
+			if size > len(data) {
+				size = len(data)
+			}
+
+			count++
+			if !handle(data[:size], message.addr) {
+				return count, nil
+			}
+
+			data = data[size:]
+			if len(data) == 0 {
+				break
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// ReadBatchInto 把数据报直接读到 datagrams 的 Data 中, 每个 Data 放一个数据报, 返回读到的数量
+// 读到的数据报的 Data 截断为实际的长度并设置 Addr, 调用方拥有缓冲区, 读取后不需要拷贝
+func (c *BatchConn) ReadBatchInto(datagrams []Datagram) (int, error) {
+	if c.gro {
+		return 0, MakeErrorWithErrMsg("Failed to read into datagrams: UDP GRO is enabled")
+	}
+
+	messages := c.readMessages
+	if len(datagrams) < len(messages) {
+		messages = messages[:len(datagrams)]
+	}
+	for index := range messages {
+		messages[index].buffer = datagrams[index].Data
+		messages[index].oob = nil
+	}
+
+	n, err := c.io.recv(messages)
+
+	for index := range messages {
+		if index < n {
+			datagrams[index].Data = datagrams[index].Data[:messages[index].n]
+			datagrams[index].Addr = messages[index].addr
+			datagrams[index].Err = nil
+		}
+		// 不再引用调用方的缓冲区
+		messages[index].buffer = nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// WriteBatch 发送所有数据报, 返回成功发送的数量, 发送失败的数据报设置 Err 后跳过
+func (c *BatchConn) WriteBatch(datagrams []Datagram) int {
+	sent := 0
+
+	for start := 0; start < len(datagrams); {
+		messages := c.pack(datagrams[start:])
+
+		n, err := c.io.send(messages)
+		for _, group := range c.groups[:n] {
+			sent += group
+			start += group
+		}
+
+		// 只发送了一部分时从下一个消息继续
+		if err == nil && n > 0 {
+			continue
+		}
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+
+		// 超时后剩下的数据报也发不出去
+		if os.IsTimeout(err) {
+			for index := range datagrams[start:] {
+				datagrams[start+index].Err = err
+			}
+			return sent
+		}
+
+		failed := datagrams[start : start+c.groups[n]]
+		start += c.groups[n]
+
+		if len(failed) == 1 {
+			failed[0].Err = err
+			continue
+		}
+
+		// 合并发送失败时逐个重新发送, 内核或网卡不支持 GSO 时之后不再合并
+		if isUDPGSOError(err) {
+			logger.Warn(FormatString("Disable UDP GSO on %s: %s", c.conn.LocalAddr().String(), err.Error()))
+			c.gso = false
+		}
+		sent += c.writeEach(failed)
+	}
+
+	return sent
+}
+
+// pack 把数据报放进 writeMessages, 每个消息包含的数据报数量记录在 groups
+func (c *BatchConn) pack(datagrams []Datagram) []batchMessage {
+	c.groups = c.groups[:0]
+
+	count := 0
+	for index := 0; index < len(datagrams) && count < len(c.writeMessages); count++ {
+		message := &c.writeMessages[count]
+		datagram := &datagrams[index]
+
+		message.addr = datagram.Addr
+
+		group := 1
+		if c.gso {
+			group = coalescibleCount(datagrams[index:])
+		}
+
+		if group == 1 {
+			message.buffer = datagram.Data
+			message.oob = nil
+		} else {
+			message.buffer = c.coalesce(count, datagrams[index:index+group])
+			message.oob = setUDPGSOSegmentSize(c.gsoOOB[count], len(datagram.Data))
+		}
+
+		c.groups = append(c.groups, group)
+		index += group
+	}
+
+	return c.writeMessages[:count]
+}
+
+func (c *BatchConn) coalesce(slot int, datagrams []Datagram) []byte {
+	if c.gsoBuffers == nil {
+		c.gsoBuffers = make([][]byte, len(c.writeMessages))
+		c.gsoOOB = make([][]byte, len(c.writeMessages))
+	}
+	if c.gsoBuffers[slot] == nil {
+		c.gsoBuffers[slot] = make([]byte, 0, UDP_GSO_MAX_SIZE)
+		c.gsoOOB[slot] = make([]byte, UDP_OFFLOAD_OOB_SIZE)
+	}
+
+	buffer := c.gsoBuffers[slot][:0]
+	for _, datagram := range datagrams {
+		buffer = append(buffer, datagram.Data...)
+	}
+	c.gsoBuffers[slot] = buffer
+
+	return buffer
+}
+
+// coalescibleCount 返回开头可以合并发送的数据报数量
+// 合并的数据报发往同一个地址并且长度相同, 只有最后一个可以更短
+func coalescibleCount(datagrams []Datagram) int {
+	segmentSize := len(datagrams[0].Data)
+	if segmentSize == 0 {
+		return 1
+	}
+
+	count := 1
+	total := segmentSize
+	for count < len(datagrams) && count < UDP_GSO_MAX_SEGMENTS {
+		next := &datagrams[count]
+		if len(next.Data) == 0 || len(next.Data) > segmentSize || total+len(next.Data) > UDP_GSO_MAX_SIZE {
+			break
+		}
+		if next.Addr != datagrams[0].Addr {
+			break
+		}
+
+		count++
+		total += len(next.Data)
+
+		if len(next.Data) < segmentSize {
+			break
+		}
+	}
+
+	return count
+}
+
+func (c *BatchConn) writeEach(datagrams []Datagram) int {
+	sent := 0
+	for index := range datagrams {
+		datagram := &datagrams[index]
+		if !datagram.Addr.IsValid() {
+			_, datagram.Err = c.conn.Write(datagram.Data)
+		} else {
+			_, datagram.Err = c.conn.WriteToUDPAddrPort(datagram.Data, datagram.Addr)
+		}
+
+		if datagram.Err == nil {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,340 @@
+//go:build linux
+
+package dtls_tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// UDP_GRO 和 UDP_SEGMENT 的控制消息都只带一个整数
+var UDP_OFFLOAD_OOB_SIZE = unix.CmsgSpace(4)
+
+// mmsghdr 对应内核的 struct mmsghdr, 结构体末尾的对齐和 C 相同
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+/*
+ * batchIO 直接调用 recvmmsg/sendmmsg
+ * 消息头, iovec 和 sockaddr 在创建时一次分配, 之后每次调用都重复使用
+ * 读到的来源地址直接从 sockaddr 转换成 netip.AddrPort, 不像 net.UDPAddr 那样为每个数据报分配
+ */
+type batchIO struct {
+	rawConn syscall.RawConn
+	err     error
+
+	// socket 的地址族, AF_INET6 的 socket 发往 IPv4 地址时使用映射地址
+	family int
+
+	// 读和写可能在不同的协程中同时进行, 各用一组消息头
+	reader *mmsgCall
+	writer *mmsgCall
+}
+
+// mmsgCall 是一个方向上的消息头和传给 RawConn 的函数
+// 函数和它的参数保存在结构体中, 只创建一次, 每次调用都创建闭包会分配
+type mmsgCall struct {
+	trap   uintptr
+	name   string
+	hdrs   []mmsghdr
+	iovecs []unix.Iovec
+	names  []unix.RawSockaddrInet6
+
+	operate func(fd uintptr) bool
+	count   int
+	n       int
+	errno   syscall.Errno
+}
+
+func newMmsgCall(trap uintptr, name string, batchSize int) *mmsgCall {
+	c := &mmsgCall{
+		trap:   trap,
+		name:   name,
+		hdrs:   make([]mmsghdr, batchSize),
+		iovecs: make([]unix.Iovec, batchSize),
+		names:  make([]unix.RawSockaddrInet6, batchSize),
+	}
+	c.operate = c.syscall
+	return c
+}
+
+// syscall 返回 false 时 RawConn 等待 socket 可读或可写后再次调用, 等待时遵守 socket 的超时
+func (c *mmsgCall) syscall(fd uintptr) bool {
+	for {
+		r, _, errno := unix.Syscall6(c.trap, fd, uintptr(unsafe.Pointer(&c.hdrs[0])), uintptr(c.count), 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno == unix.EAGAIN {
+			return false
+		}
+		c.n, c.errno = int(r), errno
+		return true
+	}
+}
+
+func (c *mmsgCall) result(err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	if c.errno != 0 {
+		return 0, os.NewSyscallError(c.name, c.errno)
+	}
+	return c.n, nil
+}
+
+func newBatchIO(conn *net.UDPConn, batchSize int) *batchIO {
+	b := &batchIO{
+		family: unix.AF_INET6,
+		reader: newMmsgCall(unix.SYS_RECVMMSG, "recvmmsg", batchSize),
+		writer: newMmsgCall(unix.SYS_SENDMMSG, "sendmmsg", batchSize),
+	}
+
+	b.rawConn, b.err = conn.SyscallConn()
+	if b.err != nil {
+		return b
+	}
+
+	_ = b.rawConn.Control(func(fd uintptr) {
+		if family, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN); err == nil {
+			b.family = family
+		}
+	})
+
+	return b
+}
+
+func (b *batchIO) recv(messages []batchMessage) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	c := b.reader
+	c.count, _ = b.prepare(c, messages, true)
+	n, err := c.result(b.rawConn.Read(c.operate))
+	if err != nil {
+		return 0, err
+	}
+
+	for index := range messages[:n] {
+		message := &messages[index]
+		hdr := &c.hdrs[index]
+
+		message.n = int(hdr.len)
+		message.oobn = int(hdr.hdr.Controllen)
+		message.addr = parseSockaddr(&c.names[index])
+	}
+
+	return n, nil
+}
+
+// send 返回发送的消息数量, 地址不能发送的消息之前的消息仍然会发送
+func (b *batchIO) send(messages []batchMessage) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	c := b.writer
+	count, err := b.prepare(c, messages, false)
+	if count == 0 {
+		return 0, err
+	}
+
+	c.count = count
+	return c.result(b.rawConn.Write(c.operate))
+}
+
+// prepare 填写消息头, 返回可以发送的消息数量, 遇到不能发送的地址时停在这个消息
+func (b *batchIO) prepare(c *mmsgCall, messages []batchMessage, isRead bool) (int, error) {
+	for index := range messages {
+		message := &messages[index]
+		hdr := &c.hdrs[index].hdr
+		iovec := &c.iovecs[index]
+
+		c.hdrs[index] = mmsghdr{}
+
+		iovec.Base = nil
+		if len(message.buffer) > 0 {
+			iovec.Base = &message.buffer[0]
+		}
+		iovec.SetLen(len(message.buffer))
+		hdr.Iov = iovec
+		hdr.SetIovlen(1)
+
+		if len(message.oob) > 0 {
+			hdr.Control = &message.oob[0]
+			hdr.SetControllen(len(message.oob))
+		}
+
+		name := &c.names[index]
+		if isRead {
+			hdr.Name = (*byte)(unsafe.Pointer(name))
+			hdr.Namelen = unix.SizeofSockaddrInet6
+			continue
+		}
+
+		if !message.addr.IsValid() {
+			continue
+		}
+
+		namelen, err := b.putSockaddr(name, message.addr)
+		if err != nil {
+			return index, err
+		}
+		hdr.Name = (*byte)(unsafe.Pointer(name))
+		hdr.Namelen = namelen
+	}
+
+	return len(messages), nil
+}
+
+// putSockaddr 按 socket 的地址族把 addr 写入 name, 返回 sockaddr 的长度
+func (b *batchIO) putSockaddr(name *unix.RawSockaddrInet6, addr netip.AddrPort) (uint32, error) {
+	*name = unix.RawSockaddrInet6{}
+	ip := addr.Addr()
+
+	if b.family == unix.AF_INET {
+		ip = ip.Unmap()
+		if !ip.Is4() {
+			return 0, MakeErrorWithErrMsg("Failed to write to %s: not an IPv4 address", addr.String())
+		}
+
+		inet4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		inet4.Family = unix.AF_INET
+		putSockaddrPort(&inet4.Port, addr.Port())
+		inet4.Addr = ip.As4()
+		return unix.SizeofSockaddrInet4, nil
+	}
+
+	name.Family = unix.AF_INET6
+	putSockaddrPort(&name.Port, addr.Port())
+	name.Addr = ip.As16()
+	if zone := ip.Zone(); zone != "" {
+		name.Scope_id = zoneToScopeID(zone)
+	}
+	return unix.SizeofSockaddrInet6, nil
+}
+
+// parseSockaddr 把读到的 sockaddr 转换为 netip.AddrPort, IPv4 的映射地址转换为 IPv4 地址
+func parseSockaddr(name *unix.RawSockaddrInet6) netip.AddrPort {
+	switch name.Family {
+	case unix.AF_INET:
+		inet4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		return netip.AddrPortFrom(netip.AddrFrom4(inet4.Addr), sockaddrPort(&inet4.Port))
+
+	case unix.AF_INET6:
+		ip := netip.AddrFrom16(name.Addr).Unmap()
+		// 只有链路本地地址带有 scope id, 很少出现, 这里的分配可以接受
+		if name.Scope_id != 0 && ip.Is6() {
+			ip = ip.WithZone(strconv.FormatUint(uint64(name.Scope_id), 10))
+		}
+		return netip.AddrPortFrom(ip, sockaddrPort(&name.Port))
+	}
+
+	return netip.AddrPort{}
+}
+
+// sockaddr 中的端口是网络字节序
+func sockaddrPort(port *uint16) uint16 {
+	return binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(port))[:])
+}
+
+func putSockaddrPort(port *uint16, value uint16) {
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(port))[:], value)
+}
+
+// zoneToScopeID 的 zone 是接口的序号或者名字
+func zoneToScopeID(zone string) uint32 {
+	if index, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(index)
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return uint32(ifi.Index)
+	}
+	return 0
+}
+
+// enableUDPGRO 打开 UDP_GRO, 内核不支持时返回 false
+func enableUDPGRO(conn *net.UDPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sockErr error = nil
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1)
+	})
+
+	return err == nil && sockErr == nil
+}
+
+// isUDPGSOSupported 检查内核是否支持 UDP_SEGMENT
+func isUDPGSOSupported(conn *net.UDPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sockErr error = nil
+	err = rawConn.Control(func(fd uintptr) {
+		_, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+	})
+
+	return err == nil && sockErr == nil
+}
+
+// parseUDPGROSegmentSize 返回 GRO 合并的每段的长度, 没有合并时返回 0
+// 直接遍历控制消息, unix.ParseSocketControlMessage 每次都会分配
+func parseUDPGROSegmentSize(oob []byte) int {
+	for len(oob) >= unix.SizeofCmsghdr {
+		header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		length := int(header.Len)
+		if length < unix.SizeofCmsghdr || length > len(oob) {
+			return 0
+		}
+
+		if header.Level == unix.IPPROTO_UDP && header.Type == unix.UDP_GRO && length >= unix.CmsgLen(4) {
+			return int(*(*int32)(unsafe.Pointer(&oob[unix.CmsgLen(0)])))
+		}
+
+		next := unix.CmsgSpace(length - unix.CmsgLen(0))
+		if next >= len(oob) {
+			return 0
+		}
+		oob = oob[next:]
+	}
+
+	return 0
+}
+
+// setUDPGSOSegmentSize 在 oob 中写入 UDP_SEGMENT 控制消息并返回写入的部分
+func setUDPGSOSegmentSize(oob []byte, segmentSize int) []byte {
+	oob = oob[:unix.CmsgSpace(2)]
+	for index := range oob {
+		oob[index] = 0
+	}
+
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = unix.IPPROTO_UDP
+	header.Type = unix.UDP_SEGMENT
+	header.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(segmentSize)
+
+	return oob
+}
+
+// isUDPGSOError 判断是否是内核或网卡不支持这次合并发送
+func isUDPGSOError(err error) bool {
+	return errors.Is(err, unix.EIO) || errors.Is(err, unix.EINVAL)
+}
@@ -0,0 +1,79 @@
+//go:build !linux
+
+package dtls_tunnel
+
+import (
+	"net"
+	"net/netip"
+)
+
+// 其他平台上不使用 GRO/GSO
+var UDP_OFFLOAD_OOB_SIZE = 0
+
+// batchIO 每次只收发一个数据报
+type batchIO struct {
+	conn *net.UDPConn
+}
+
+func newBatchIO(conn *net.UDPConn, batchSize int) *batchIO {
+	return &batchIO{conn: conn}
+}
+
+func (b *batchIO) recv(messages []batchMessage) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	message := &messages[0]
+	n, oobn, _, addr, err := b.conn.ReadMsgUDPAddrPort(message.buffer, message.oob)
+	if err != nil {
+		return 0, err
+	}
+
+	message.n = n
+	message.oobn = oobn
+	message.addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	return 1, nil
+}
+
+func (b *batchIO) send(messages []batchMessage) (int, error) {
+	for index := range messages {
+		message := &messages[index]
+
+		var err error = nil
+		if message.addr.IsValid() {
+			_, err = b.conn.WriteToUDPAddrPort(message.buffer, message.addr)
+		} else {
+			_, err = b.conn.Write(message.buffer)
+		}
+
+		if err != nil {
+			if index > 0 {
+				return index, nil
+			}
+			return 0, err
+		}
+	}
+
+	return len(messages), nil
+}
+
+func enableUDPGRO(conn *net.UDPConn) bool {
+	return false
+}
+
+func isUDPGSOSupported(conn *net.UDPConn) bool {
+	return false
+}
+
+func parseUDPGROSegmentSize(oob []byte) int {
+	return 0
+}
+
+func setUDPGSOSegmentSize(oob []byte, segmentSize int) []byte {
+	return nil
+}
+
+func isUDPGSOError(err error) bool {
+	return false
+}
@@ -0,0 +1,124 @@
+package dtls_tunnel
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestUDPPair(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		receiver.Close()
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+
+	return sender, receiver
+}
+
+func TestBatchConnRoundTrip(t *testing.T) {
+	for _, offload := range []bool{false, true} {
+		sender, receiver := newTestUDPPair(t)
+
+		senderBatch := NewBatchConn(sender, 8, 1500, false, offload)
+		receiverBatch := NewBatchConn(receiver, 8, 1500, offload, false)
+
+		// 等长的数据报在打开 GSO 时合并发送, 最后一个较短的数据报也可以放在同一个消息的末尾
+		datagrams := make([]Datagram, 0, 8)
+		for index := 0; index < 7; index++ {
+			datagrams = append(datagrams, Datagram{Data: bytes.Repeat([]byte{byte(index)}, 100)})
+		}
+		datagrams = append(datagrams, Datagram{Data: []byte{0xff}})
+
+		if n := senderBatch.WriteBatch(datagrams); n != len(datagrams) {
+			t.Fatalf("offload=%t: WriteBatch() = %d, want %d", offload, n, len(datagrams))
+		}
+
+		received := make([][]byte, 0, len(datagrams))
+		for len(received) < len(datagrams) {
+			if err := receiver.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := receiverBatch.ReadBatch(func(data []byte, addr netip.AddrPort) bool {
+				if addr.Port() != uint16(sender.LocalAddr().(*net.UDPAddr).Port) {
+					t.Errorf("offload=%t: datagram from %s", offload, addr.String())
+				}
+				received = append(received, append([]byte(nil), data...))
+				return true
+			})
+			if err != nil {
+				t.Fatalf("offload=%t: %s", offload, err.Error())
+			}
+		}
+
+		for index, datagram := range datagrams {
+			if !bytes.Equal(received[index], datagram.Data) {
+				t.Errorf("offload=%t: datagram %d = %v, want %v", offload, index, received[index], datagram.Data)
+			}
+		}
+	}
+}
+
+// BenchmarkBatchConn 比较逐个收发和批量收发的吞吐量, 一次操作是一个数据报
+func BenchmarkBatchConn(b *testing.B) {
+	cases := []struct {
+		name      string
+		batchSize int
+		offload   bool
+	}{
+		{"single", 1, false},
+		{"batch", DEFAULT_UDP_BATCH_SIZE, false},
+		{"batch-offload", DEFAULT_UDP_BATCH_SIZE, true},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			sender, receiver := newTestUDPPair(b)
+
+			senderBatch := NewBatchConn(sender, c.batchSize, BENCH_DATAGRAM_SIZE, false, c.offload)
+			receiverBatch := NewBatchConn(receiver, c.batchSize, BENCH_DATAGRAM_SIZE, c.offload, false)
+
+			datagrams := make([]Datagram, c.batchSize)
+			for index := range datagrams {
+				datagrams[index].Data = make([]byte, BENCH_DATAGRAM_SIZE)
+			}
+			discard := func(data []byte, _ netip.AddrPort) bool {
+				return true
+			}
+			read := func() (int, error) {
+				return receiverBatch.ReadBatch(discard)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for done := 0; done < b.N; {
+				count := c.batchSize
+				if remaining := b.N - done; remaining < count {
+					count = remaining
+				}
+
+				senderBatch.WriteBatch(datagrams[:count])
+				benchReadCount(b, receiver, count, read)
+				done += count
+			}
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pps")
+		})
+	}
+}
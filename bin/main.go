@@ -16,70 +16,66 @@ func init() {
 	dtls_tunnel.SetLogger(l)
 }
 
-func server(commonConfig *dtls_tunnel.CommonConfig) {
-	config, err := dtls_tunnel.ParseServerConfig(commonConfig)
-	if err != nil {
-		logger.Error(dtls_tunnel.FormatString("Failed to parse config: %s", err.Error()))
-		os.Exit(1)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "pki" {
+		if err := dtls_tunnel.RunPKICommand(os.Args[2:]); err != nil {
+			logger.Error(dtls_tunnel.FormatString("Failed to run pki command: %s", err.Error()))
+			os.Exit(1)
+		}
+		return
 	}
 
-	server := dtls_tunnel.NewServer(config)
-
-	signalChannel := make(chan os.Signal)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-signalChannel
-		server.Shutdown()
-	}()
-
-	if err := server.Run(); err != nil {
-		logger.Error(dtls_tunnel.FormatString("Failed to run server: %s", err.Error()))
+	processConfig, err := dtls_tunnel.ParseProcessConfig()
+	if err != nil {
+		logger.Error(dtls_tunnel.FormatString("Failed to parse common config: %s", err.Error()))
 		os.Exit(1)
 	}
-}
 
-func client(commonConfig *dtls_tunnel.CommonConfig) {
-	config, err := dtls_tunnel.ParseClientConfig(commonConfig)
+	manager, err := dtls_tunnel.NewTunnelManager(processConfig.Tunnels, processConfig.PayloadPool)
 	if err != nil {
 		logger.Error(dtls_tunnel.FormatString("Failed to parse config: %s", err.Error()))
 		os.Exit(1)
 	}
 
-	client := dtls_tunnel.NewClient(config)
-
-	signalChannel := make(chan os.Signal)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		<-signalChannel
-		client.Shutdown()
+		for sig := range signalChannel {
+			if sig == syscall.SIGHUP {
+				manager.Reload()
+				continue
+			}
+
+			manager.Shutdown()
+			return
+		}
 	}()
 
-	if err := client.Run(); err != nil {
-		logger.Error(dtls_tunnel.FormatString("Failed to run client: %s", err.Error()))
-		os.Exit(1)
-	}
-}
+	if processConfig.MetricsAddress != "" {
+		metricsServer := dtls_tunnel.NewMetricsServer(processConfig.MetricsAddress)
+		defer metricsServer.Shutdown()
 
-func main() {
-	commonConfig, err := dtls_tunnel.ParseCommonConfig()
-	if err != nil {
-		logger.Error(dtls_tunnel.FormatString("Failed to parse common config: %s", err.Error()))
-		os.Exit(1)
+		go func() {
+			if err := metricsServer.Run(); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
 	}
 
-	switch commonConfig.RunMethod {
-	case "server":
-		server(commonConfig)
-		break
+	if processConfig.AdminAddress != "" {
+		adminServer := dtls_tunnel.NewAdminServer(manager, processConfig.AdminAddress)
+		defer adminServer.Shutdown()
 
-	case "client":
-		client(commonConfig)
-		break
+		go func() {
+			if err := adminServer.Run(); err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
 
-	default:
-		logger.Error("bad run type...")
+	if err := manager.Run(); err != nil {
+		logger.Error(dtls_tunnel.FormatString("Failed to run: %s", err.Error()))
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,115 @@
+package dtls_tunnel
+
+import (
+	"time"
+)
+
+/*
+ * BoundedPayloadPool 最多同时取出 limit 个 payload, 占用的内存不超过 limit * payloadCapacity
+ * payload 在第一次需要时分配, 归还后放入空闲列表, 不会被 GC 回收
+ * 全部被取出时按 exhaustedPolicy 等待或者立即返回错误, 调用方丢弃这个数据报
+ *
+ * 调试模式下检查 payload 的使用:
+ * 归还时标记 payload 并用 PAYLOAD_POISON 填满缓冲区, 重复归还同一个 payload 时返回错误并且不放回
+ * 再次取出时检查缓冲区是否仍然是 PAYLOAD_POISON, 被改写说明归还后还有人在写入
+ * 归还后的读取无法直接发现, 但读到的内容全是 PAYLOAD_POISON, 容易在抓包中识别
+ */
+type BoundedPayloadPool struct {
+	payloadCapacity int
+	limit           int
+	exhaustedPolicy string
+	timeout         time.Duration
+	debug           bool
+
+	free    chan *Payload
+	counter *payloadPoolCounter
+}
+
+func NewBoundedPayloadPool(payloadCapacity int, config *PayloadPoolConfig) PayloadPooler {
+	return &BoundedPayloadPool{
+		payloadCapacity: payloadCapacity,
+		limit:           config.Limit,
+		exhaustedPolicy: config.ExhaustedPolicy,
+		timeout:         config.Timeout,
+		debug:           config.Debug,
+		free:            make(chan *Payload, config.Limit),
+		counter:         &payloadPoolCounter{},
+	}
+}
+
+func (p *BoundedPayloadPool) Get() (*Payload, error) {
+	select {
+	case payload := <-p.free:
+		return p.acquire(payload), nil
+	default:
+	}
+
+	p.counter.misses.Add(1)
+
+	// 还没有达到上限时分配新的
+	if p.reserve() {
+		return p.acquire(NewPayload(p.payloadCapacity)), nil
+	}
+
+	if p.exhaustedPolicy == POOL_EXHAUSTED_BLOCK {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+
+		select {
+		case payload := <-p.free:
+			return p.acquire(payload), nil
+		case <-timer.C:
+		}
+	}
+
+	p.counter.failures.Add(1)
+	return nil, MakeErrorWithErrMsg("payload pool is exhausted, all %d payloads are in use", p.limit)
+}
+
+func (p *BoundedPayloadPool) Put(payload *Payload) error {
+	if payload.payloadCapacity != p.payloadCapacity {
+		p.counter.violations.Add(1)
+		return MakeErrorWithErrMsg("payload %p of capacity %d does not belong to the pool", payload, payload.payloadCapacity)
+	}
+
+	if p.debug {
+		if err := p.counter.poison(payload); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case p.free <- payload:
+		p.counter.released()
+		return nil
+	default:
+		// 空闲列表能放下所有分配的 payload, 放不下说明有 payload 被重复归还
+		p.counter.violations.Add(1)
+		return MakeErrorWithErrMsg("more payloads are put than taken from the pool")
+	}
+}
+
+func (p *BoundedPayloadPool) Stats() PayloadPoolStats {
+	return p.counter.stats(p.limit)
+}
+
+// reserve 在分配的数量小于 limit 时占用一个名额
+func (p *BoundedPayloadPool) reserve() bool {
+	for {
+		allocated := p.counter.allocated.Load()
+		if allocated >= uint64(p.limit) {
+			return false
+		}
+		if p.counter.allocated.CompareAndSwap(allocated, allocated+1) {
+			return true
+		}
+	}
+}
+
+func (p *BoundedPayloadPool) acquire(payload *Payload) *Payload {
+	if p.debug {
+		p.counter.checkPoison(payload)
+	}
+	p.counter.acquired()
+	return payload
+}
@@ -0,0 +1,163 @@
+package dtls_tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v3/examples/util"
+)
+
+/*
+ * CertificateStore 保存当前使用的证书和根证书, 可以在运行时重新加载
+ * 新的握手通过回调取得最新的证书, 已经建立的连接不受影响
+ */
+
+type CertificateStore struct {
+	keyPath      string
+	certPath     string
+	rootCertPath string
+
+	cert      *tls.Certificate
+	rootCerts *x509.CertPool
+
+	// 上次加载时文件的修改时间, 用于判断文件是否变化
+	modTimes map[string]time.Time
+
+	lock *sync.RWMutex
+}
+
+func LoadCertificateStore(keyPath, certPath, rootCertPath string) (*CertificateStore, error) {
+	store := &CertificateStore{
+		keyPath:      keyPath,
+		certPath:     certPath,
+		rootCertPath: rootCertPath,
+		lock:         &sync.RWMutex{},
+	}
+
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Reload 重新加载全部文件, 任何一个文件加载失败时保留原来的证书
+func (s *CertificateStore) Reload() error {
+	modTimes := FileModTimes(s.keyPath, s.certPath, s.rootCertPath)
+
+	cert, err := util.LoadKeyAndCertificate(s.keyPath, s.certPath)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to load key or cert: %s", err.Error())
+	}
+
+	rootCerts, err := LoadCertPool(s.rootCertPath)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to load root cert: %s", err.Error())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cert = &cert
+	s.rootCerts = rootCerts
+	s.modTimes = modTimes
+
+	return nil
+}
+
+func (s *CertificateStore) Certificate() *tls.Certificate {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.cert
+}
+
+func (s *CertificateStore) RootCerts() *x509.CertPool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.rootCerts
+}
+
+// IsChanged 判断文件在上次加载后是否被修改过
+func (s *CertificateStore) IsChanged() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return IsFilesChanged(s.modTimes)
+}
+
+func (s *CertificateStore) String() string {
+	return s.certPath
+}
+
+// LoadCertPool 加载文件中的所有证书
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	count := 0
+
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		pool.AddCert(cert)
+		count++
+	}
+
+	if count == 0 {
+		return nil, MakeErrorWithErrMsg("no certificate found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// VerifyClientCertificate 和 pion/dtls 对客户端证书的校验一致, 但每次使用最新的根证书
+func VerifyClientCertificate(rawCerts [][]byte, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, MakeErrorWithErrMsg("no client certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	options := x509.VerifyOptions{
+		Roots:         roots,
+		CurrentTime:   time.Now(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	return certs[0].Verify(options)
+}
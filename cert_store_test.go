@@ -0,0 +1,108 @@
+package dtls_tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/selfsign"
+)
+
+// writeTestCertificate 生成 commonName 的自签名证书, 写入 dir 下的 name.key 和 name.crt
+func writeTestCertificate(t *testing.T, dir string, name string, commonName string) (string, string, tls.Certificate) {
+	t.Helper()
+
+	cert, err := selfsign.GenerateSelfSignedWithDNS(commonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, name+".key")
+	certPath := filepath.Join(dir, name+".crt")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyPath, certPath, cert
+}
+
+// handshakeTestServerName 握手并返回服务端出示的证书的 CommonName
+func handshakeTestServerName(t *testing.T, serverConfig *dtls.Config, clientCert tls.Certificate) string {
+	t.Helper()
+
+	var serverName string = ""
+	_, err := testHandshake(t, serverConfig, &dtls.Config{
+		Certificates:         []tls.Certificate{clientCert},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		InsecureSkipVerify:   true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			serverName = cert.Subject.CommonName
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serverName
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	dir := t.TempDir()
+
+	// 自签名的客户端证书同时作为根证书
+	_, rootCertPath, clientCert := writeTestCertificate(t, dir, "client", "client")
+	keyPath, certPath, _ := writeTestCertificate(t, dir, "server", "server a")
+
+	store, err := LoadCertificateStore(keyPath, certPath, rootCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ServerConfig{}
+	config.AuthMode = AUTH_MODE_CERT
+	config.Certificates = store
+	serverConfig := newServerAuthDTLSConfig(config)
+
+	if name := handshakeTestServerName(t, serverConfig, clientCert); name != "server a" {
+		t.Fatalf("server presented %q, want server a", name)
+	}
+
+	// 同一个 dtls.Config 的新握手使用重新加载的证书
+	writeTestCertificate(t, dir, "server", "server b")
+	if !store.IsChanged() {
+		t.Error("IsChanged() = false after the certificate is replaced")
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := handshakeTestServerName(t, serverConfig, clientCert); name != "server b" {
+		t.Errorf("server presented %q after reload, want server b", name)
+	}
+
+	// 加载失败时保留原来的证书
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Error("Reload() of a broken certificate succeeded")
+	}
+	if name := handshakeTestServerName(t, serverConfig, clientCert); name != "server b" {
+		t.Errorf("server presented %q after a failed reload, want server b", name)
+	}
+}
@@ -3,9 +3,12 @@ package dtls_tunnel
 import (
 	"context"
 	"net"
-	"os"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pion/dtls/v3"
 )
 
 type Clienter interface {
@@ -14,47 +17,279 @@ type Clienter interface {
 }
 
 type Client struct {
-	config   *ClientConfig
-	listener *net.UDPConn
-	mappers  Mappers
+	config    *ClientConfig
+	listeners []*ClientListener // 同一个地址上的一个或多个 (SO_REUSEPORT) socket
+	mappers   Mappers
+	sessions  *ClientSessionPool // 仅在多路复用模式下使用
+	servers   *TunnelServers     // 按 ServerStrategy 选择服务端
+
+	// 缓存和每个服务端的会话, 未开启会话恢复时为 nil
+	sessionCache *SessionCache
+
+	// 预热的空闲连接, 未开启时为 nil
+	warmPool *WarmPool
 
 	payloadPool PayloadPooler
-	readQueue   chan *Package
 
 	cancelFunc context.CancelFunc
 	ctx        context.Context
 	wg         *sync.WaitGroup
 	mappersWg  *sync.WaitGroup
+
+	metrics *TunnelMetrics
+
+	// 整个隧道的限速, 每个映射的限速以它为外层, 未配置时为 nil
+	rateLimiters *RateLimiters
+
+	// 排空时不再为新的来源地址建立映射, 现有的映射全部结束后关闭
+	draining atomic.Bool
 }
 
 func NewClient(config *ClientConfig) *Client {
+	return NewClientWithPayloadPool(config, NewPayloadPool(PayloadCapacity(config.PackageBufferSize)))
+}
+
+// NewClientWithPayloadPool 用于多个 Client 共用一个 payloadPool
+// payload 的容量不能小于 PayloadCapacity(config.PackageBufferSize)
+func NewClientWithPayloadPool(config *ClientConfig, payloadPool PayloadPooler) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	client := &Client{
 		config:      config,
 		mappers:     NewMappers(),
-		readQueue:   make(chan *Package, config.PackageBufferCount),
-		payloadPool: NewPayloadPool(config.PackageBufferSize),
+		payloadPool: payloadPool,
 		cancelFunc:  cancel,
 		ctx:         ctx,
 		wg:          &sync.WaitGroup{},
 		mappersWg:   &sync.WaitGroup{},
 	}
 
+	if config.Multiplex {
+		client.sessions = NewClientSessionPool(client, config.MultiplexConnections)
+	}
+
+	remoteAddresses := config.RemoteAddresses
+	if len(remoteAddresses) == 0 {
+		remoteAddresses = []*net.UDPAddr{config.RemoteAddress}
+	}
+	client.servers = NewTunnelServers(config.ServerStrategy, remoteAddresses...)
+
+	if config.SessionTTL > 0 && config.AuthMode == AUTH_MODE_PSK {
+		client.sessionCache = NewSessionCache(config.SessionTTL)
+	}
+
+	if config.WarmConnections > 0 {
+		client.warmPool = NewWarmPool(client, config.WarmConnections, config.WarmMaxIdle)
+	}
+
+	client.metrics = NewTunnelMetrics(config.Name, METRICS_ROLE_CLIENT)
+	if config.RateLimit != nil {
+		client.rateLimiters = NewRateLimiters(config.RateLimit, RATE_LIMIT_SCOPE_GLOBAL, "", config.RateLimit.Global, nil, client.metrics)
+	}
+	client.metrics.RegisterQueueDepth(METRICS_QUEUE_READ, func() float64 {
+		return client.queueDepth(func(mapper *ClientMapper) int { return len(mapper.readQueue) })
+	})
+	client.metrics.RegisterQueueDepth(METRICS_QUEUE_WRITE, func() float64 {
+		return client.queueDepth(func(mapper *ClientMapper) int { return len(mapper.writeQueue) })
+	})
+	if client.warmPool != nil {
+		client.metrics.RegisterWarmConnections(func() float64 {
+			return float64(client.warmPool.Len())
+		})
+	}
+
 	return client
 }
 
+// queueDepth 统计所有映射的队列长度之和
+func (c *Client) queueDepth(length func(mapper *ClientMapper) int) float64 {
+	var depth int = 0
+	c.mappers.Range(func(key netip.AddrPort, mapper *ClientMapper) bool {
+		depth += length(mapper)
+		return true
+	})
+	return float64(depth)
+}
+
+// connect 优先取走预热的连接, 没有时再建立新的连接
+func (c *Client) connect(ctx context.Context) (*dtls.Conn, *TunnelServer, error) {
+	if c.warmPool != nil {
+		tunnel, server, isExist := c.warmPool.Acquire()
+		c.metrics.WarmConnectionAcquired(isExist)
+		if isExist {
+			return tunnel, server, nil
+		}
+	}
+
+	return c.dial(ctx)
+}
+
+// dial 按 ServerStrategy 依次尝试服务端, 返回第一个握手成功的连接并记录握手指标
+func (c *Client) dial(parentCtx context.Context) (*dtls.Conn, *TunnelServer, error) {
+	var lastErr error = nil
+
+	for _, server := range c.servers.Candidates() {
+		start := time.Now()
+		tunnel, err := c.dialServer(parentCtx, server)
+		c.metrics.Handshake(start, err)
+
+		// 映射或客户端关闭导致的失败不代表服务端不可用
+		if parentCtx.Err() != nil {
+			if err == nil {
+				_ = tunnel.Close()
+			}
+			return nil, nil, MakeErrorWithErrMsg("Failed to dial remote server: %s", parentCtx.Err().Error())
+		}
+
+		if c.servers.Report(server, time.Since(start), err) {
+			logger.Warn(FormatString("Server %s is unreachable: %s", server.String(), err.Error()))
+		}
+
+		if err == nil {
+			return tunnel, server, nil
+		}
+
+		lastErr = err
+	}
+
+	return nil, nil, MakeErrorWithErrMsg("Failed to dial remote server: %s", lastErr.Error())
+}
+
+func (c *Client) dialServer(parentCtx context.Context, server *TunnelServer) (*dtls.Conn, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, c.config.HandshakeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	tunnel, err := dtls.Dial("udp", server.Address(), newClientDTLSConfig(c.config, c.sessionCache))
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("%s: %s", server.String(), err.Error())
+	}
+
+	if err := tunnel.HandshakeContext(ctx); err != nil {
+		_ = tunnel.Close()
+		return nil, MakeErrorWithErrMsg("%s: handshake error: %s", server.String(), err.Error())
+	}
+
+	if c.sessionCache != nil {
+		// 服务端没有发送 hint 时 identity 本来就是空的, 客户端不依赖它, 所以忽略错误
+		state, _ := tunnel.ConnectionState()
+		isResumed, _ := c.sessionCache.Resolve(&state, start)
+		c.metrics.SessionResumption(isResumed)
+	}
+
+	return tunnel, nil
+}
+
+// probeServer 握手后发送一次心跳并等待回复, 返回握手的耗时
+func (c *Client) probeServer(ctx context.Context, server *TunnelServer) (time.Duration, error) {
+	start := time.Now()
+	tunnel, err := c.dialServer(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+
+	defer func() {
+		_ = tunnel.Close()
+	}()
+
+	keepalive, err := NewKeepalive(c.config.ProbeInterval, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tunnel.SetDeadline(time.Now().Add(c.config.HandshakeTimeout)); err != nil {
+		return 0, MakeErrorWithErrMsg("%s: Failed to set deadline: %s", server.String(), err.Error())
+	}
+
+	if _, err := tunnel.Write(keepalive.PingFrame()); err != nil {
+		return 0, MakeErrorWithErrMsg("%s: Failed to send keepalive: %s", server.String(), err.Error())
+	}
+
+	buffer := make([]byte, KEEPALIVE_FRAME_SIZE)
+	n, err := tunnel.Read(buffer)
+	if err != nil {
+		return 0, MakeErrorWithErrMsg("%s: Failed to read keepalive: %s", server.String(), err.Error())
+	}
+
+	if !keepalive.IsPong(buffer[:n]) {
+		return 0, MakeErrorWithErrMsg("%s: unexpected reply to keepalive", server.String())
+	}
+
+	return rtt, nil
+}
+
+func (c *Client) serverProber() {
+	defer c.wg.Done()
+
+	probe := func(ctx context.Context, server *TunnelServer) (time.Duration, error) {
+		rtt, err := c.probeServer(ctx, server)
+		c.metrics.ServerProbed(server.String(), rtt, err)
+		return rtt, err
+	}
+
+	c.servers.Probe(c.ctx, c.config.ProbeInterval, probe, c.handleServerDown)
+}
+
+// handleServerDown 断开服务端上所有的连接, 映射重新连接时选择其他服务端
+// 没有开启重新连接时映射直接关闭, 源地址的下一个数据报会在其他服务端上建立新的映射
+func (c *Client) handleServerDown(server *TunnelServer) {
+	if c.warmPool != nil {
+		c.warmPool.handleServerDown(server)
+	}
+
+	if c.sessions != nil {
+		c.sessions.handleServerDown(server)
+		return
+	}
+
+	c.mappers.Range(func(key netip.AddrPort, mapper *ClientMapper) bool {
+		mapper.handleServerDown(server)
+		return true
+	})
+}
+
+// warmPoolKeeper 补充预热连接并替换空闲太久的连接, 直到客户端关闭
+func (c *Client) warmPoolKeeper() {
+	defer c.wg.Done()
+	c.warmPool.Run(c.ctx)
+}
+
 func (c *Client) Run() error {
 	if err := c.init(); err != nil {
 		return MakeErrorWithErrMsg("Failed to run client: %s", err.Error())
 	}
 
-	logger.Info(FormatString("The client is running on %s", c.config.ListenAddress.String()))
+	logger.Info(FormatString("The client is running on %s with %d socket(s)", c.listeners[0].conn.LocalAddr().String(), len(c.listeners)))
 
-	c.wg.Add(3)
+	c.wg.Add(1)
 	go c.mapperGarbageCollector()
-	go c.writeWorker()
-	go c.readWorker()
+
+	for _, listener := range c.listeners {
+		c.wg.Add(2)
+		go listener.writeWorker()
+		go listener.readWorker()
+	}
+
+	if c.config.ReloadInterval > 0 {
+		c.wg.Add(1)
+		go c.reloadWatcher()
+	}
+
+	if c.config.CRL != nil && c.config.CRLReloadInterval > 0 {
+		c.wg.Add(1)
+		go c.crlWatcher()
+	}
+
+	if len(c.servers.Servers()) > 1 {
+		c.wg.Add(1)
+		go c.serverProber()
+	}
+
+	if c.warmPool != nil {
+		c.wg.Add(1)
+		go c.warmPoolKeeper()
+	}
 
 	logger.Info(FormatString("The client is started"))
 
@@ -74,10 +309,35 @@ func (c *Client) Shutdown() {
 	c.cancelFunc()
 }
 
+// Reload 重新加载证书, CRL 或 PSK 密钥, 只影响之后的握手
+func (c *Client) Reload() error {
+	err := ReloadAll(c.config.Reloaders())
+
+	// 缓存的会话可能来自已经更换的密钥
+	c.sessionCache.Clear()
+
+	return err
+}
+
+func (c *Client) reloadWatcher() {
+	defer c.wg.Done()
+	WatchReloaders(c.ctx, c.config.IntervalReloaders(), c.config.ReloadInterval, c.sessionCache.Clear)
+}
+
+// crlWatcher 检查 CRL 的变化, 只影响之后的握手
+func (c *Client) crlWatcher() {
+	defer c.wg.Done()
+	WatchReloaders(c.ctx, []Reloader{c.config.CRL}, c.config.CRLReloadInterval, nil)
+}
+
 func (c *Client) clean() error {
 	c.mappersWg.Wait()
 	c.wg.Wait()
 
+	if c.sessions != nil {
+		c.sessions.Wait()
+	}
+
 	if err := c.unInit(); err != nil {
 		return MakeErrorWithErrMsg("Failed to shutdown client: %s", err.Error())
 	}
@@ -101,87 +361,40 @@ func (c *Client) unInit() error {
 }
 
 func (c *Client) InitListener() error {
-	listener, err := net.ListenUDP(
-		"udp",
-		c.config.ListenAddress,
-	)
-
+	listeners, err := openClientListeners(c, c.config.ListenAddress, c.config.ListenSockets)
 	if err != nil {
 		return MakeErrorWithErrMsg("Failed to init listener: %s", err.Error())
 	}
 
-	c.listener = listener
+	c.listeners = listeners
 
 	return nil
 }
 
 func (c *Client) closeListener() error {
-	err := c.listener.Close()
-	if err != nil {
-		return MakeErrorWithErrMsg("Failed to uninit listener: %s", err.Error())
-	}
-	return nil
-}
-
-func (c *Client) HandleRead(pack *Package) {
-	c.readQueue <- pack
-}
-
-func (c *Client) readWorker() {
-	defer c.wg.Done()
-
-	var pack *Package = nil
-	var err error = nil
-
-	var timer = time.NewTimer(READ_TIMEOUT)
-	defer timer.Stop()
-
-	for {
-		timer.Reset(READ_TIMEOUT)
-		select {
-		case <-c.ctx.Done():
-			return
-
-		case <-timer.C:
-			continue
-
-		case pack = <-c.readQueue:
-			if err := c.listener.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT)); err != nil {
-				logger.Error(FormatString("Failed to set write deadline: %s", err.Error()))
-				c.Shutdown()
-				return
-			}
-			_, err = c.listener.WriteToUDP(
-				pack.Payload.container[:pack.Payload.payloadLength],
-				pack.SrcAddress,
-			)
-
-			if os.IsTimeout(err) {
-				continue
-			}
-
-			if err != nil {
-				logger.Warn(FormatString("Failed to write to %s: %s", pack.SrcAddress.String(), err.Error()))
-				RecoveryPayload(pack.Payload, c.payloadPool)
-				continue
-			}
-
-			RecoveryPayload(pack.Payload, c.payloadPool)
+	var lastErr error = nil
+	for _, listener := range c.listeners {
+		if err := listener.Close(); err != nil {
+			lastErr = err
 		}
 	}
 
+	if lastErr != nil {
+		return MakeErrorWithErrMsg("Failed to uninit listener: %s", lastErr.Error())
+	}
+	return nil
 }
 
 func (c *Client) mapperGarbageCollector() {
 	defer c.wg.Done()
 
-	ticker := time.NewTicker(time.Second * 5)
+	ticker := time.NewTicker(c.config.GCInterval)
 	defer ticker.Stop()
 
-	handler := func(key string, mapper *ClientMapper) bool {
-		if mapper.activeRecorder.IsTimeout(time.Minute * 30) {
-			mapper.Stop()
-			logger.Info(FormatString("Clean mapper: %s", key))
+	handler := func(key netip.AddrPort, mapper *ClientMapper) bool {
+		if mapper.activeRecorder.IsIdle(c.config.IdleTimeout, c.config.IdlePolicy) {
+			mapper.stopWithReason(STOP_REASON_IDLE)
+			logger.Info(FormatString("Clean mapper: %s", key.String()))
 		}
 		return true
 	}
@@ -197,77 +410,109 @@ func (c *Client) mapperGarbageCollector() {
 	}
 }
 
-func (c *Client) handleMapperDestroy(srcAddress *net.UDPAddr) {
-	if srcAddress == nil {
+func (c *Client) handleMapperDestroy(srcAddress netip.AddrPort) {
+	if !c.mappers.Exist(srcAddress) {
 		return
 	}
 
-	srcAddressStr := srcAddress.String()
+	c.mappers.Delete(srcAddress)
 
-	if !c.mappers.Exist(srcAddressStr) {
-		return
+	if c.draining.Load() && c.mapperCount() == 0 {
+		logger.Info(FormatString("The client is drained"))
+		c.Shutdown()
 	}
-
-	c.mappers.Delete(srcAddressStr)
 }
 
-func (c *Client) writeWorker() {
-	defer c.wg.Done()
-
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
-
-		default:
-			payload, err := c.payloadPool.Get()
-			if err != nil {
-				logger.Warn(FormatString("Failed to get payload on pool: %s", payload))
-				continue
-			}
+func (c *Client) mapperCount() int {
+	var count int = 0
+	c.mappers.Range(func(key netip.AddrPort, mapper *ClientMapper) bool {
+		count++
+		return true
+	})
+	return count
+}
 
-			if err := c.listener.SetReadDeadline(time.Now().Add(READ_TIMEOUT)); err != nil {
-				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
-				c.Shutdown()
-				RecoveryPayload(payload, c.payloadPool)
-				return
-			}
-			n, srcAddr, err := c.listener.ReadFromUDP(payload.container)
+// Mappers 返回所有映射的状态
+func (c *Client) Mappers() []*MapperInfo {
+	infos := make([]*MapperInfo, 0)
+	c.mappers.Range(func(key netip.AddrPort, mapper *ClientMapper) bool {
+		infos = append(infos, mapper.Info())
+		return true
+	})
+	return infos
+}
 
-			if os.IsTimeout(err) {
-				RecoveryPayload(payload, c.payloadPool)
-				continue
-			}
+// RateLimiters 返回整个隧道和每个源地址的限速
+func (c *Client) RateLimiters() []*RateLimiterInfo {
+	infos := c.rateLimiters.Infos()
+	c.mappers.Range(func(key netip.AddrPort, mapper *ClientMapper) bool {
+		// 源地址不限速时映射直接使用整个隧道的限速
+		if mapper.rateLimiters != c.rateLimiters {
+			infos = append(infos, mapper.rateLimiters.Infos()...)
+		}
+		return true
+	})
+	return infos
+}
 
-			if err != nil {
-				logger.Warn(FormatString("Failed to read on listener: %s", err.Error()))
+// CloseMapper 关闭来源地址为 id 的映射, 没有找到时返回 false
+func (c *Client) CloseMapper(id string) bool {
+	srcAddress, err := netip.ParseAddrPort(id)
+	if err != nil {
+		return false
+	}
 
-				RecoveryPayload(payload, c.payloadPool)
-				continue
-			}
+	mapper := c.mappers.Get(srcAddress)
+	if mapper == nil {
+		return false
+	}
 
-			payload.payloadLength = n
-			srcAddrStr := srcAddr.String()
+	logger.Info(FormatString("Close mapper %s by admin", id))
+	mapper.stopWithReason(STOP_REASON_ADMIN)
+	return true
+}
 
-			isMapperExist := c.mappers.Exist(srcAddrStr)
-			if isMapperExist {
-				mapper := c.mappers.Get(srcAddrStr)
-				mapper.Write(payload)
-			} else {
-				logger.Info(FormatString("New mapper: %s", srcAddrStr))
-				mapper := NewClientMapper(
-					c,
-					srcAddr,
-					c.ctx,
-				)
+// Drain 不再为新的来源地址建立映射, 现有的映射全部结束后关闭客户端
+func (c *Client) Drain() {
+	if c.draining.Swap(true) {
+		return
+	}
 
-				c.mappers.Set(srcAddrStr, mapper)
+	logger.Info(FormatString("The client is draining"))
 
-				c.mappersWg.Add(1)
-				go mapper.Run(c.mappersWg)
+	if c.mapperCount() == 0 {
+		c.Shutdown()
+	}
+}
 
-				mapper.Write(payload)
+// dispatch 把从 listener 直接读到 payload 中的一个数据报交给来源地址的映射, 没有映射时在 listener 上新建
+// 每个数据报都经过这里, 查找映射使用 netip.AddrPort, 不需要分配
+func (c *Client) dispatch(listener *ClientListener, payload *Payload, srcAddr netip.AddrPort) {
+	c.metrics.Upstream(payload.payloadLength)
+
+	if mapper := c.mappers.Get(srcAddr); mapper != nil {
+		mapper.Write(payload)
+	} else if c.draining.Load() {
+		RecoveryPayload(payload, c.payloadPool)
+	} else {
+		logger.Info(FormatString("New mapper: %s", srcAddr.String()))
+		mapper := NewClientMapper(
+			c,
+			listener,
+			srcAddr,
+			c.ctx,
+		)
+
+		c.mappers.Set(srcAddr, mapper)
+		c.metrics.MapperCreated()
+
+		c.mappersWg.Add(1)
+		go func() {
+			if err := mapper.Run(c.mappersWg); err != nil {
+				logger.Error(FormatString("Failed to run mapper: %s", err.Error()))
 			}
-		}
+		}()
+
+		mapper.Write(payload)
 	}
 }
@@ -0,0 +1,304 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+const MAX_LISTEN_SOCKETS = 256
+
+/*
+ * ClientListener 是 Client 的一个 UDP 监听 socket 和它的一对读写协程
+ * ListenSockets 大于 1 时在同一个地址上用 SO_REUSEPORT 打开多个 socket, 内核按四元组的哈希把数据报分到各个 socket
+ * 同一个源地址的数据报总是到达同一个 socket, 它的映射也只通过这个 socket 返回数据, 各个 socket 可以在不同的核上并行处理
+ *
+ * 读到的数据报放在 payload 池取出的 payload 中, 经过映射的 writeQueue 写入 DTLS 连接后归还, 每个数据报都不需要分配
+ * 没有 GRO 时数据报直接读到 payload 中, 不需要拷贝
+ * 打开 GRO 时合并的数据报先读到 BatchConn 的 64KB 缓冲区, 拆开后各拷贝一次, 来源用 GSO 发送时内核合并节省的开销比拷贝大
+ */
+type ClientListener struct {
+	client *Client
+	index  int
+
+	conn  *net.UDPConn
+	batch *BatchConn
+
+	// 映射从隧道读到的数据, 由 readWorker 发送给源地址
+	readQueue chan Package
+
+	// 没有 GRO 时 writeWorker 直接读取用的 payload, 没有读到数据的留到下一次
+	payloads  []*Payload
+	datagrams []Datagram
+
+	// 打开 GRO 时传给 ReadBatch, 只创建一次
+	copyHandle func(data []byte, srcAddr netip.AddrPort) bool
+}
+
+// openClientListeners 在 address 上打开 count 个 socket, count 大于 1 时使用 SO_REUSEPORT
+func openClientListeners(client *Client, address *net.UDPAddr, count int) ([]*ClientListener, error) {
+	if count <= 1 {
+		conn, err := net.ListenUDP("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		return []*ClientListener{newClientListener(client, 0, conn)}, nil
+	}
+
+	listenConfig := &net.ListenConfig{Control: setReusePort}
+	listeners := make([]*ClientListener, 0, count)
+
+	for index := 0; index < count; index++ {
+		packetConn, err := listenConfig.ListenPacket(context.Background(), "udp", address.String())
+		if err != nil {
+			for _, listener := range listeners {
+				_ = listener.conn.Close()
+			}
+			return nil, err
+		}
+
+		conn := packetConn.(*net.UDPConn)
+		listeners = append(listeners, newClientListener(client, index, conn))
+
+		// 端口为 0 时其他 socket 绑定到第一个 socket 分配到的端口
+		address = conn.LocalAddr().(*net.UDPAddr)
+	}
+
+	return listeners, nil
+}
+
+func newClientListener(client *Client, index int, conn *net.UDPConn) *ClientListener {
+	config := client.config
+
+	listener := &ClientListener{
+		client:    client,
+		index:     index,
+		conn:      conn,
+		batch:     NewBatchConn(conn, config.UDPBatchSize, config.PackageBufferSize, config.UDPOffload, config.UDPOffload),
+		readQueue: make(chan Package, config.PackageBufferCount),
+	}
+
+	if gro, _ := listener.batch.IsOffloaded(); gro {
+		listener.copyHandle = listener.copyAndDispatch
+	} else {
+		count := config.UDPBatchSize
+
+		// 空闲时也占着这些 payload, 有上限的 payload 池最多让所有监听 socket 占用四分之一, 剩下的留给隧道读取
+		if limit := client.payloadPool.Stats().Limit; limit > 0 && count > limit/(4*config.ListenSockets) {
+			count = limit / (4 * config.ListenSockets)
+			if count < 1 {
+				count = 1
+			}
+		}
+
+		listener.payloads = make([]*Payload, count)
+		listener.datagrams = make([]Datagram, count)
+	}
+
+	if gro, gso := listener.batch.IsOffloaded(); gro || gso {
+		logger.Info(FormatString("UDP offload on %s#%d: gro=%t gso=%t", conn.LocalAddr().String(), index, gro, gso))
+	}
+
+	return listener
+}
+
+func (l *ClientListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *ClientListener) HandleRead(pack Package) {
+	l.readQueue <- pack
+}
+
+// readWorker 把 readQueue 中已经有的数据报凑成一批, 一次发送给各自的来源地址
+func (l *ClientListener) readWorker() {
+	c := l.client
+	defer c.wg.Done()
+
+	packs := make([]Package, 0, c.config.UDPBatchSize)
+	datagrams := make([]Datagram, 0, c.config.UDPBatchSize)
+
+	var timer = time.NewTimer(c.config.ReadTimeout)
+	defer timer.Stop()
+
+	for {
+		timer.Reset(c.config.ReadTimeout)
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-timer.C:
+			continue
+
+		case pack := <-l.readQueue:
+			packs = append(packs[:0], pack)
+		collect:
+			for len(packs) < cap(packs) {
+				select {
+				case pack := <-l.readQueue:
+					packs = append(packs, pack)
+				default:
+					break collect
+				}
+			}
+
+			if err := l.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout)); err != nil {
+				logger.Error(FormatString("Failed to set write deadline: %s", err.Error()))
+				c.Shutdown()
+				return
+			}
+			datagrams = l.writeBatch(packs, datagrams)
+		}
+	}
+
+}
+
+// writeBatch 把一批数据报发送给各自的来源地址后归还 payload, datagrams 是重复使用的发送列表
+func (l *ClientListener) writeBatch(packs []Package, datagrams []Datagram) []Datagram {
+	c := l.client
+
+	datagrams = datagrams[:0]
+	for _, pack := range packs {
+		datagrams = append(datagrams, Datagram{
+			Data: pack.Payload.Data(),
+			Addr: pack.SrcAddress,
+		})
+	}
+
+	l.batch.WriteBatch(datagrams)
+
+	for index, pack := range packs {
+		err := datagrams[index].Err
+		if err == nil {
+			c.metrics.Downstream(pack.Payload.payloadLength)
+		} else if !os.IsTimeout(err) {
+			logger.Warn(FormatString("Failed to write to %s: %s", pack.SrcAddress.String(), err.Error()))
+		}
+		RecoveryPayload(pack.Payload, c.payloadPool)
+	}
+
+	return datagrams
+}
+
+func (l *ClientListener) writeWorker() {
+	c := l.client
+	defer c.wg.Done()
+	defer l.releasePayloads()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		default:
+			if err := l.conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout)); err != nil {
+				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
+				c.Shutdown()
+				return
+			}
+
+			_, err := l.readBatch()
+
+			if os.IsTimeout(err) {
+				continue
+			}
+
+			if err != nil {
+				logger.Warn(FormatString("Failed to read on listener: %s", err.Error()))
+				continue
+			}
+		}
+	}
+}
+
+// readBatch 读取一批数据报, 放入 payload 后交给 dispatch
+func (l *ClientListener) readBatch() (int, error) {
+	if l.copyHandle != nil {
+		return l.batch.ReadBatch(l.copyHandle)
+	}
+	return l.readBatchInto()
+}
+
+// copyAndDispatch 把 GRO 拆开的一个数据报拷贝到 payload, payload 池用完时丢弃
+func (l *ClientListener) copyAndDispatch(data []byte, srcAddr netip.AddrPort) bool {
+	c := l.client
+
+	payload, err := c.payloadPool.Get()
+	if err != nil {
+		// payload 池用完时每个数据报都会失败, 次数见 payload 池的统计
+		logger.Debug(FormatString("Failed to get payload on pool: %s", err.Error()))
+		return true
+	}
+
+	payload.SetLength(copy(payload.Buffer(MUX_FRAME_HEADER_SIZE, c.config.PackageBufferSize), data))
+	c.dispatch(l, payload, srcAddr)
+	return true
+}
+
+// readBatchInto 把一批数据报直接读到 payload 中并交给 dispatch, payload 池用完时等待一会儿
+func (l *ClientListener) readBatchInto() (int, error) {
+	c := l.client
+
+	count := l.fillPayloads()
+	if count == 0 {
+		time.Sleep(PAYLOAD_POOL_RETRY_INTERVAL)
+		return 0, nil
+	}
+
+	datagrams := l.datagrams[:count]
+	for index := range datagrams {
+		datagrams[index].Data = l.payloads[index].Buffer(MUX_FRAME_HEADER_SIZE, c.config.PackageBufferSize)
+	}
+
+	n, err := l.batch.ReadBatchInto(datagrams)
+	if err != nil {
+		return 0, err
+	}
+
+	for index := range datagrams[:n] {
+		payload := l.payloads[index]
+		payload.SetLength(len(datagrams[index].Data))
+		c.dispatch(l, payload, datagrams[index].Addr)
+	}
+
+	// 没有用到的 payload 移到前面, 下一次补齐
+	copy(l.payloads, l.payloads[n:])
+	for index := len(l.payloads) - n; index < len(l.payloads); index++ {
+		l.payloads[index] = nil
+	}
+
+	return n, nil
+}
+
+// fillPayloads 从 payload 池补齐读取用的 payload, 返回开头连续可用的数量
+// 多路复用模式下 payload 在数据前面留出了帧头的空间, session 发送时不需要再拷贝
+func (l *ClientListener) fillPayloads() int {
+	c := l.client
+
+	for index, payload := range l.payloads {
+		if payload != nil {
+			continue
+		}
+
+		payload, err := c.payloadPool.Get()
+		if err != nil {
+			// payload 池用完时每个数据报都会失败, 次数见 payload 池的统计
+			logger.Debug(FormatString("Failed to get payload on pool: %s", err.Error()))
+			return index
+		}
+		l.payloads[index] = payload
+	}
+
+	return len(l.payloads)
+}
+
+func (l *ClientListener) releasePayloads() {
+	for index, payload := range l.payloads {
+		if payload != nil {
+			RecoveryPayload(payload, l.client.payloadPool)
+			l.payloads[index] = nil
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package dtls_tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOpenClientListenersReusePort(t *testing.T) {
+	if !IS_REUSE_PORT_SUPPORTED {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+
+	fileConfig := newTestFileConfig(t, "client", freeTestUDPAddress(t))
+	fileConfig.ListenSockets = 4
+	config, err := ParseClientConfig(toTestCommonConfig(t, fileConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 端口为 0 时其他 socket 绑定到第一个 socket 分配到的端口
+	listeners, err := openClientListeners(NewClient(config), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}()
+
+	if len(listeners) != 4 {
+		t.Fatalf("%d listeners, want 4", len(listeners))
+	}
+
+	address := listeners[0].conn.LocalAddr().String()
+	for index, listener := range listeners {
+		if listener.index != index || listener.conn.LocalAddr().String() != address {
+			t.Errorf("listener %d is #%d on %s, want %s", index, listener.index, listener.conn.LocalAddr().String(), address)
+		}
+	}
+
+	// 没有打开 SO_REUSEPORT 的 socket 不能绑定同一个端口
+	if conn, err := net.ListenUDP("udp", listeners[0].conn.LocalAddr().(*net.UDPAddr)); err == nil {
+		_ = conn.Close()
+		t.Error("a socket without SO_REUSEPORT is bound to the same port")
+	}
+}
+
+func TestClientListenSockets(t *testing.T) {
+	if !IS_REUSE_PORT_SUPPORTED {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+	newTestServer(t, serverConfig)
+
+	clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+	clientConfig.ListenSockets = 4
+	client := newTestClient(t, clientConfig)
+
+	// 连接的 socket 只接收来自监听地址的数据报, 所以回显经过了源地址所在的 socket
+	for index := 0; index < 16; index++ {
+		testRoundTrip(t, dialTestUDP(t, clientConfig.Listen), FormatString("source %d", index))
+	}
+
+	// 内核按四元组的哈希分配, 16 个源地址全部落在同一个 socket 上的概率可以忽略
+	sockets := make(map[int]bool)
+	for _, info := range client.Mappers() {
+		sockets[info.Socket] = true
+	}
+	if len(sockets) < 2 {
+		t.Errorf("16 sources are handled by sockets %v, want more than one", sockets)
+	}
+}
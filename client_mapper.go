@@ -2,14 +2,14 @@ package dtls_tunnel
 
 import (
 	"context"
-	"crypto/tls"
 	"io"
-	"net"
+	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v3"
 )
 
 /*
@@ -18,11 +18,27 @@ import (
  */
 
 type ClientMapper struct {
-	client     *Client       // Client 的指针
-	srcAddress *net.UDPAddr  // 源地址
-	tunnel     *dtls.Conn    // DTLS 连接
-	readQueue  chan *Payload // 从 DTLS 连接返回的数据的队列
-	writeQueue chan *Payload // 往 DTLS 连接写入的队列
+	client     *Client         // Client 的指针
+	listener   *ClientListener // 收到源地址数据的 socket, 返回的数据也从这里发送
+	srcAddress netip.AddrPort  // 源地址, 也是 Client 查找映射的键
+	readQueue  chan *Payload   // 从 DTLS 连接返回的数据的队列
+	writeQueue chan *Payload   // 往 DTLS 连接写入的队列
+
+	// 当前使用的连接, 断开后重新连接时整体替换
+	// linkReady 在设置新的连接时关闭并重新创建, 用于等待重新连接完成
+	link      *clientLink
+	linkReady chan struct{}
+	linkLock  *sync.Mutex
+
+	// 正在重新连接, 这时 writeQueue 满了不等待, 不阻塞 Client 的 writeWorker
+	reconnecting atomic.Bool
+
+	// writeQueue 满了被丢弃的数据报数量
+	writeDropped atomic.Uint64
+
+	// 这个源地址的限速, 外层是整个隧道的限速, 都未配置时为 nil
+	// writeQueue 和 readQueue 的数据报在各自的处理协程中取令牌, 等待时数据报留在队列中
+	rateLimiters *RateLimiters
 
 	// 本地的 context 是独立的 基于创建时传入的父 context
 	ctx context.Context
@@ -34,38 +50,82 @@ type ClientMapper struct {
 	wg *sync.WaitGroup
 
 	activeRecorder *ActiveRecorder
+	stopReason     StopReason
+	createdAt      time.Time
+
+	// 服务端的身份, 握手完成后设置, 管理接口会并发读取
+	peerIdentity atomic.Value
 }
 
-func NewClientMapper(client *Client, srcAddress *net.UDPAddr, parentCtx context.Context) *ClientMapper {
+// clientLink 是 ClientMapper 到服务端的一个连接
+// 非多路复用模式下是独立的 DTLS 连接, 多路复用模式下是 session 上的一个流
+type clientLink struct {
+	server    *TunnelServer // 连接的服务端
+	tunnel    *dtls.Conn    // DTLS 连接
+	keepalive *Keepalive    // 非多路复用模式下的心跳, 未开启时为 nil
+
+	session *ClientSession // 多路复用模式下共用的 DTLS 连接
+	flowID  uint32         // 多路复用模式下在 session 上的流 id
+
+	// 连接断开时取消, 关闭这个连接上的读取和心跳携程
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         *sync.WaitGroup
+
+	// 连接断开的原因, 不再重新连接时作为映射结束的原因
+	breakReason StopReason
+}
+
+func NewClientMapper(client *Client, listener *ClientListener, srcAddress netip.AddrPort, parentCtx context.Context) *ClientMapper {
 	ctx, cancel := context.WithCancel(parentCtx)
 
 	clientMapper := &ClientMapper{
 		client:         client,
-		srcAddress:     CloneUdpAddr(srcAddress),
+		listener:       listener,
+		srcAddress:     srcAddress,
 		readQueue:      make(chan *Payload, client.config.PackageBufferCount),
 		writeQueue:     make(chan *Payload, client.config.PackageBufferCount),
+		linkReady:      make(chan struct{}),
+		linkLock:       &sync.Mutex{},
 		ctx:            ctx,
 		cancelFunc:     cancel,
 		wg:             &sync.WaitGroup{},
 		activeRecorder: NewActiveRecorder(time.Now(), time.Now()),
+		createdAt:      time.Now(),
+	}
+
+	if config := client.config.RateLimit; config != nil {
+		clientMapper.rateLimiters = NewRateLimiters(config, RATE_LIMIT_SCOPE_SOURCE, srcAddress.String(), config.Source, client.rateLimiters, client.metrics)
 	}
 
 	return clientMapper
 }
 
 func (cm *ClientMapper) Run(wg *sync.WaitGroup) error {
+	// 队列回收之后才释放等待组, Client 退出时映射取出的 payload 都已经归还
+	defer wg.Done()
+
 	if err := cm.init(); err != nil {
+		// 初始化失败也要删除映射, 否则这个源地址无法再建立映射
+		// 握手期间 writeWorker 放入队列的数据报也要回收
+		cm.Stop()
+		cm.client.handleMapperDestroy(cm.srcAddress)
+		_ = cm.unInit()
+		cm.client.metrics.MapperDestroyed(STOP_REASON_INIT_ERROR)
 		return MakeErrorWithErrMsg("Failed to run client mapper: %s", err.Error())
 	}
 
-	cm.runInLoop(wg)
+	cm.runInLoop()
+
+	// 先删除映射再回收队列, 之后 writeWorker 不会再找到这个映射
+	cm.Stop()
+	cm.client.handleMapperDestroy(cm.srcAddress)
 
 	if err := cm.clean(); err != nil {
 		return err
 	}
 
-	// 删除映射
-	cm.client.handleMapperDestroy(cm.srcAddress)
+	cm.client.metrics.MapperDestroyed(cm.stopReason.Get())
 
 	return nil
 }
@@ -74,6 +134,12 @@ func (cm *ClientMapper) Stop() {
 	cm.cancelFunc()
 }
 
+// stopWithReason 记录原因后关闭, 用于统计映射结束的原因
+func (cm *ClientMapper) stopWithReason(reason string) {
+	cm.stopReason.Set(reason)
+	cm.Stop()
+}
+
 func (cm *ClientMapper) clean() error {
 	// 等待转发携程关闭
 	// Mark:是否必要
@@ -86,34 +152,219 @@ func (cm *ClientMapper) clean() error {
 	return nil
 }
 
-func (cm *ClientMapper) runInLoop(wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	cm.wg.Add(3)
-
+func (cm *ClientMapper) runInLoop() {
+	cm.wg.Add(2)
 	go cm.handleWrite()
-	go cm.handleRead()
 	go cm.handleReadQueue()
 
+	for {
+		link := cm.currentLink()
+		if link == nil {
+			break
+		}
+
+		cm.runLink(link)
+
+		if cm.ctx.Err() != nil {
+			break
+		}
+
+		if !cm.reconnect(link.breakReason.Get()) {
+			cm.stopWithReason(link.breakReason.Get())
+			break
+		}
+	}
+
 	cm.wg.Wait()
 }
 
+// runLink 运行连接上的读取和心跳, 阻塞到连接断开或映射关闭, 返回前关闭连接
+func (cm *ClientMapper) runLink(link *clientLink) {
+	// 多路复用模式下由 session 负责读取和心跳
+	if link.session == nil {
+		link.wg.Add(1)
+		go cm.handleRead(link)
+
+		if link.keepalive != nil {
+			link.wg.Add(1)
+			go cm.handleKeepalive(link)
+		}
+	}
+
+	<-link.ctx.Done()
+	link.wg.Wait()
+
+	cm.closeLink(link)
+}
+
+// breakLink 在连接出错时调用, 没有开启重新连接时直接关闭映射
+func (cm *ClientMapper) breakLink(link *clientLink, reason string) {
+	if cm.client.config.ReconnectTimeout <= 0 {
+		cm.stopWithReason(reason)
+		return
+	}
+
+	link.breakReason.Set(reason)
+	link.cancelFunc()
+}
+
+// reconnect 按指数退避重新连接, 直到成功, 超过 ReconnectTimeout 或者映射关闭
+// 期间源地址的映射保持不变, 数据在 writeQueue 中等待
+func (cm *ClientMapper) reconnect(reason string) bool {
+	if cm.client.config.ReconnectTimeout <= 0 {
+		return false
+	}
+
+	logger.Warn(FormatString("Mapper %s lost its tunnel (%s), reconnecting", cm.srcAddress.String(), reason))
+
+	start := time.Now()
+	cm.reconnecting.Store(true)
+	defer cm.reconnecting.Store(false)
+	cm.client.metrics.OutageStarted()
+
+	for attempt := 0; ; attempt++ {
+		link, err := cm.dialLink()
+		if err == nil {
+			cm.setLink(link)
+			cm.client.metrics.OutageEnded(start, true)
+			logger.Info(FormatString("Mapper %s reconnected after %s", cm.srcAddress.String(), time.Since(start).String()))
+			return true
+		}
+
+		if cm.ctx.Err() != nil {
+			cm.client.metrics.OutageEnded(start, false)
+			return false
+		}
+
+		backoff := ReconnectBackoff(attempt)
+		if time.Since(start)+backoff > cm.client.config.ReconnectTimeout {
+			cm.client.metrics.OutageEnded(start, false)
+			logger.Warn(FormatString("Mapper %s gave up reconnecting: %s", cm.srcAddress.String(), err.Error()))
+			return false
+		}
+
+		logger.Warn(FormatString("Mapper %s failed to reconnect, retry in %s: %s", cm.srcAddress.String(), backoff.String(), err.Error()))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-cm.ctx.Done():
+			timer.Stop()
+			cm.client.metrics.OutageEnded(start, false)
+			return false
+
+		case <-timer.C:
+		}
+	}
+}
+
+func (cm *ClientMapper) setLink(link *clientLink) {
+	cm.linkLock.Lock()
+	defer cm.linkLock.Unlock()
+
+	cm.link = link
+	close(cm.linkReady)
+	cm.linkReady = make(chan struct{})
+}
+
+// currentLink 返回可用的连接, 正在重新连接时等待, 映射关闭后返回 nil
+func (cm *ClientMapper) currentLink() *clientLink {
+	for {
+		cm.linkLock.Lock()
+		link, ready := cm.link, cm.linkReady
+		cm.linkLock.Unlock()
+
+		if link != nil && link.ctx.Err() == nil {
+			return link
+		}
+
+		select {
+		case <-cm.ctx.Done():
+			return nil
+
+		case <-ready:
+		}
+	}
+}
+
+// Write 由 Client 的 writeWorker 调用, writeQueue 满了时按 WriteOverflowPolicy 处理
+// 一个映射最多让 writeWorker 等待 WriteOverflowTimeout, 不会阻塞其他源地址的数据报
 func (cm *ClientMapper) Write(payload *Payload) {
-	cm.writeQueue <- payload
+	// writeWorker 可能在映射删除之前取到它, 在 Run 回收队列之后才放入, 这时由这里回收
+	defer func() {
+		if cm.ctx.Err() != nil {
+			cm.recoverWriteQueue()
+		}
+	}()
+
+	select {
+	case cm.writeQueue <- payload:
+		return
+	default:
+	}
+
+	// 映射已经关闭或者正在重新连接时队列不会很快有空位, 不等待
+	policy := cm.client.config.WriteOverflowPolicy
+	if policy == OVERFLOW_POLICY_BLOCK && (cm.reconnecting.Load() || cm.ctx.Err() != nil) {
+		policy = OVERFLOW_POLICY_DROP_NEWEST
+	}
+
+	switch policy {
+	case OVERFLOW_POLICY_DROP_OLDEST:
+		// writeWorker 是唯一的写入方, 取出一个之后一定有空位
+		select {
+		case oldest := <-cm.writeQueue:
+			cm.dropWrite(oldest)
+		default:
+		}
+
+		select {
+		case cm.writeQueue <- payload:
+			return
+		default:
+		}
+
+	case OVERFLOW_POLICY_BLOCK:
+		timer := time.NewTimer(cm.client.config.WriteOverflowTimeout)
+		defer timer.Stop()
+
+		select {
+		case cm.writeQueue <- payload:
+			return
+		case <-cm.ctx.Done():
+		case <-timer.C:
+		}
+	}
+
+	cm.dropWrite(payload)
+}
+
+// recoverWriteQueue 回收 writeQueue 中剩下的数据, 可以和 handleWrite 同时调用
+func (cm *ClientMapper) recoverWriteQueue() {
+	for {
+		select {
+		case payload := <-cm.writeQueue:
+			RecoveryPayload(payload, cm.client.payloadPool)
+
+		default:
+			return
+		}
+	}
+}
+
+func (cm *ClientMapper) dropWrite(payload *Payload) {
+	cm.writeDropped.Add(1)
+	cm.client.metrics.PacketDropped(METRICS_QUEUE_WRITE)
+	RecoveryPayload(payload, cm.client.payloadPool)
 }
 
 func (cm *ClientMapper) handleWrite() {
 	defer cm.wg.Done()
 
-	var payload *Payload = nil
-	var n int = 0
-	var err error = nil
-
-	var timer = time.NewTimer(READ_TIMEOUT)
+	var timer = time.NewTimer(cm.client.config.ReadTimeout)
 	defer timer.Stop()
 
 	for {
-		timer.Reset(READ_TIMEOUT)
+		timer.Reset(cm.client.config.ReadTimeout)
 		select {
 		// 等待本地的context关闭
 		case <-cm.ctx.Done():
@@ -123,55 +374,124 @@ func (cm *ClientMapper) handleWrite() {
 		case <-timer.C:
 			continue
 
-		case payload = <-cm.writeQueue:
-			n, err = cm.tunnel.Write(payload.Data())
-
-			if err != nil {
-				logger.Error(FormatString("Failed to write to tunnel: %s", err.Error()))
-				cm.Stop()
-
+		case payload := <-cm.writeQueue:
+			if !cm.rateLimiters.Upstream().Wait(cm.ctx, payload.payloadLength) {
 				RecoveryPayload(payload, cm.client.payloadPool)
-				return
+				continue
 			}
 
-			if n != payload.payloadLength {
-				logger.Error(FormatString("Write to tunnel with an error, len of written != payload's len"))
-				cm.Stop()
+			isWritten := cm.writePayload(payload)
+			RecoveryPayload(payload, cm.client.payloadPool)
 
-				RecoveryPayload(payload, cm.client.payloadPool)
+			if !isWritten {
 				return
 			}
+		}
+	}
+}
 
-			cm.activeRecorder.RefreshLastWrite()
-			RecoveryPayload(payload, cm.client.payloadPool)
+// writePayload 写入当前的连接, 失败时等待重新连接后重试, 映射关闭时返回 false
+func (cm *ClientMapper) writePayload(payload *Payload) bool {
+	for {
+		link := cm.currentLink()
+		if link == nil {
+			return false
+		}
+
+		n, err := link.write(payload)
+
+		if err == nil && n != payload.payloadLength {
+			err = MakeErrorWithErrMsg("len of written != payload's len")
+		}
+
+		if err == nil {
+			cm.activeRecorder.RecordWrite(n)
+			return true
 		}
+
+		logger.Error(FormatString("Failed to write to tunnel: %s", err.Error()))
+		cm.breakLink(link, STOP_REASON_WRITE_ERROR)
 	}
 }
 
-func (cm *ClientMapper) handleRead() {
-	defer cm.wg.Done()
+func (link *clientLink) write(payload *Payload) (int, error) {
+	if link.session == nil {
+		return link.tunnel.Write(payload.Data())
+	}
+
+	if err := link.session.WritePayload(link.flowID, payload); err != nil {
+		return 0, err
+	}
 
-	var writeTimer = time.NewTimer(WRITE_TIMEOUT)
+	return payload.payloadLength, nil
+}
+
+// deliver 由 session 调用, payload 中是 session 直接读到的数据, 放入 readQueue 后由映射归还
+// 队列满时直接丢弃, 避免一个慢的流阻塞同一 session 上的其他流
+func (cm *ClientMapper) deliver(payload *Payload) {
+	cm.activeRecorder.RecordRead(payload.payloadLength)
+
+	select {
+	case cm.readQueue <- payload:
+	default:
+		cm.client.metrics.PacketDropped(METRICS_QUEUE_READ)
+		RecoveryPayload(payload, cm.client.payloadPool)
+	}
+}
+
+// handleSessionClosed 由 session 在连接关闭时调用
+func (cm *ClientMapper) handleSessionClosed(session *ClientSession) {
+	cm.linkLock.Lock()
+	link := cm.link
+	cm.linkLock.Unlock()
+
+	if link != nil && link.session == session {
+		cm.breakLink(link, STOP_REASON_SESSION_CLOSED)
+	}
+}
+
+// handleServerDown 在服务端探测失败时由 Client 调用, 多路复用模式下由 session 处理
+func (cm *ClientMapper) handleServerDown(server *TunnelServer) {
+	cm.linkLock.Lock()
+	link := cm.link
+	cm.linkLock.Unlock()
+
+	if link != nil && link.session == nil && link.server == server {
+		cm.breakLink(link, STOP_REASON_SERVER_DOWN)
+	}
+}
+
+func (cm *ClientMapper) handleRead(link *clientLink) {
+	defer link.wg.Done()
+
+	var writeTimer = time.NewTimer(cm.client.config.WriteTimeout)
 	defer writeTimer.Stop()
 
 	for {
 		select {
-		case <-cm.ctx.Done():
+		case <-link.ctx.Done():
 			return
 
 		default:
 			payload, err := cm.client.payloadPool.Get()
 			if err != nil {
-				logger.Warn(FormatString("Failed to get payload on pool: %s", err.Error()))
+				logger.Debug(FormatString("Failed to get payload on pool: %s", err.Error()))
+
+				select {
+				case <-link.ctx.Done():
+					return
+				case <-time.After(PAYLOAD_POOL_RETRY_INTERVAL):
+				}
 				continue
 			}
 
-			if err := cm.tunnel.SetReadDeadline(time.Now().Add(READ_TIMEOUT)); err != nil {
-				logger.Error(FormatString("Failed to set write deadline: %s", err.Error()))
+			if err := link.tunnel.SetReadDeadline(time.Now().Add(cm.client.config.ReadTimeout)); err != nil {
+				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
+				cm.breakLink(link, STOP_REASON_READ_ERROR)
 				RecoveryPayload(payload, cm.client.payloadPool)
 				return
 			}
-			payload.payloadLength, err = cm.tunnel.Read(payload.container)
+			payload.payloadLength, err = link.tunnel.Read(payload.Buffer(0, cm.client.config.PackageBufferSize))
 
 			if os.IsTimeout(err) {
 				RecoveryPayload(payload, cm.client.payloadPool)
@@ -180,22 +500,38 @@ func (cm *ClientMapper) handleRead() {
 
 			if err == io.EOF {
 				RecoveryPayload(payload, cm.client.payloadPool)
-				cm.Stop()
+				cm.breakLink(link, STOP_REASON_EOF)
 				return
 			}
 
 			if err != nil {
 				logger.Error(FormatString("Failed to read from tunnel: %s", err.Error()))
-				cm.Stop()
+				cm.breakLink(link, STOP_REASON_READ_ERROR)
 
 				RecoveryPayload(payload, cm.client.payloadPool)
 				return
 			}
 
-			cm.activeRecorder.RefreshLastRead()
-			writeTimer.Reset(WRITE_TIMEOUT)
+			if link.keepalive != nil {
+				link.keepalive.Received()
+
+				if link.keepalive.IsPong(payload.Data()) {
+					RecoveryPayload(payload, cm.client.payloadPool)
+					continue
+				}
+			}
+
+			// 重发的 OPEN 带来的多余的 OPEN_ACK
+			if cm.client.config.Destination != "" && IsMuxOpenAck(payload.Data(), 0) {
+				RecoveryPayload(payload, cm.client.payloadPool)
+				continue
+			}
+
+			cm.activeRecorder.RecordRead(payload.payloadLength)
+			writeTimer.Reset(cm.client.config.WriteTimeout)
 			select {
 			case <-writeTimer.C:
+				cm.client.metrics.PacketDropped(METRICS_QUEUE_READ)
 				RecoveryPayload(payload, cm.client.payloadPool)
 				continue
 
@@ -206,14 +542,28 @@ func (cm *ClientMapper) handleRead() {
 	}
 }
 
+func (cm *ClientMapper) handleKeepalive(link *clientLink) {
+	defer link.wg.Done()
+
+	ping := func() error {
+		_, err := link.tunnel.Write(link.keepalive.PingFrame())
+		return err
+	}
+
+	link.keepalive.Run(link.ctx, ping, func() {
+		logger.Warn(FormatString("The server of mapper %s is not responding", cm.srcAddress.String()))
+		cm.breakLink(link, STOP_REASON_DEAD_PEER)
+	})
+}
+
 func (cm *ClientMapper) handleReadQueue() {
 	defer cm.wg.Done()
 
-	var timer = time.NewTimer(READ_TIMEOUT)
+	var timer = time.NewTimer(cm.client.config.ReadTimeout)
 	defer timer.Stop()
 
 	for {
-		timer.Reset(READ_TIMEOUT)
+		timer.Reset(cm.client.config.ReadTimeout)
 		select {
 		case <-cm.ctx.Done():
 			return
@@ -222,52 +572,242 @@ func (cm *ClientMapper) handleReadQueue() {
 			continue
 
 		case payload := <-cm.readQueue:
-			cm.client.HandleRead(NewPackage(CloneUdpAddr(cm.srcAddress), nil, payload))
+			if !cm.rateLimiters.Downstream().Wait(cm.ctx, payload.payloadLength) {
+				RecoveryPayload(payload, cm.client.payloadPool)
+				continue
+			}
+
+			cm.listener.HandleRead(NewPackage(cm.srcAddress, payload))
 		}
 	}
 }
 
 func (cm *ClientMapper) init() error {
-
-	if err := cm.initTunnel(); err != nil {
+	link, err := cm.dialLink()
+	if err != nil {
 		return MakeErrorWithErrMsg("Failed to init: %s", err.Error())
 	}
 
+	cm.setLink(link)
+
 	return nil
 }
 
+// unInit 连接在 runLink 返回前已经关闭, 这里只回收队列中剩下的数据
 func (cm *ClientMapper) unInit() error {
-	if err := cm.closeTunnel(); err != nil {
-		return MakeErrorWithErrMsg("Failed to un init client mapper: %s", err.Error())
+	for {
+		select {
+		case payload := <-cm.writeQueue:
+			RecoveryPayload(payload, cm.client.payloadPool)
+
+		case payload := <-cm.readQueue:
+			RecoveryPayload(payload, cm.client.payloadPool)
+
+		default:
+			return nil
+		}
 	}
+}
 
-	return nil
+// dialLink 建立新的连接, 多路复用模式下挂到 session 上
+func (cm *ClientMapper) dialLink() (*clientLink, error) {
+	ctx, cancel := context.WithCancel(cm.ctx)
+
+	link := &clientLink{
+		ctx:        ctx,
+		cancelFunc: cancel,
+		wg:         &sync.WaitGroup{},
+	}
+
+	var err error = nil
+	if cm.client.config.Multiplex {
+		err = cm.initSession(link)
+	} else {
+		err = cm.initTunnel(link)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return link, nil
+}
+
+func (cm *ClientMapper) closeLink(link *clientLink) {
+	link.cancelFunc()
+
+	if link.session != nil {
+		link.session.Unregister(link.flowID)
+		return
+	}
+
+	if err := link.tunnel.Close(); err != nil {
+		logger.Warn(FormatString("Failed to close tunnel: %s", err.Error()))
+	}
 }
 
-func (cm *ClientMapper) initTunnel() error {
-	ctx, cancel := context.WithTimeout(cm.ctx, time.Second*10)
-	defer cancel()
+func (cm *ClientMapper) initSession(link *clientLink) error {
+	session, err := cm.client.sessions.Acquire()
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to acquire session: %s", err.Error())
+	}
 
-	config := &dtls.Config{
-		Certificates:         []tls.Certificate{cm.client.config.Cert},
-		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
-		RootCAs:              cm.client.config.RootCerts,
+	flowID, err := session.Register(cm)
+	if err != nil {
+		return err
 	}
 
-	tunnel, err := dtls.DialWithContext(ctx, "udp", cm.client.config.RemoteAddress, config)
+	link.server = session.server
+	link.session = session
+	link.flowID = flowID
+	cm.peerIdentity.Store(session.peerIdentity)
+
+	// 没有指定目标地址时也要 OPEN, 服务端允许客户端指定目标地址时不接受没有 OPEN 的流
+	if err := session.Open(cm.ctx, flowID, cm.client.config.Destination); err != nil {
+		session.Unregister(flowID)
+		return err
+	}
+
+	return nil
+}
+
+func (cm *ClientMapper) initTunnel(link *clientLink) error {
+	tunnel, server, err := cm.client.connect(cm.ctx)
 	if err != nil {
-		return MakeErrorWithErrMsg("Failed to dial remote server: %s", err.Error())
+		return err
 	}
 
-	cm.tunnel = tunnel
+	link.server = server
+	link.tunnel = tunnel
+
+	state := cm.client.sessionCache.ConnectionState(tunnel)
+	cm.peerIdentity.Store(PeerIdentityFromState(&state))
+
+	// 心跳在 OPEN 帧之前, 服务端在协商时识别
+	if cm.client.config.KeepaliveInterval > 0 {
+		if err := cm.initKeepalive(link); err != nil {
+			_ = tunnel.Close()
+			return err
+		}
+	}
+
+	// 第一个数据报告诉服务端目标地址, 服务端确认之后才发送数据
+	if cm.client.config.Destination != "" {
+		if err := cm.openDestination(link); err != nil {
+			_ = tunnel.Close()
+			return err
+		}
+	}
+
+	// 上面设置的写超时会一直有效, 之后转发和心跳写入时不设置超时, 这里需要清除
+	if err := tunnel.SetWriteDeadline(time.Time{}); err != nil {
+		_ = tunnel.Close()
+		return MakeErrorWithErrMsg("Failed to clear write deadline: %s", err.Error())
+	}
 
 	return nil
 }
 
-func (cm *ClientMapper) closeTunnel() error {
-	if err := cm.tunnel.Close(); err != nil {
-		return MakeErrorWithErrMsg("Failed to close tunnel: %s", err.Error())
+func (cm *ClientMapper) initKeepalive(link *clientLink) error {
+	keepalive, err := NewKeepalive(cm.client.config.KeepaliveInterval, cm.client.config.KeepaliveMisses)
+	if err != nil {
+		return err
+	}
+
+	if err := link.tunnel.SetWriteDeadline(time.Now().Add(cm.client.config.WriteTimeout)); err != nil {
+		return MakeErrorWithErrMsg("Failed to set write deadline: %s", err.Error())
+	}
+
+	if _, err := link.tunnel.Write(keepalive.PingFrame()); err != nil {
+		return MakeErrorWithErrMsg("Failed to send keepalive: %s", err.Error())
 	}
 
+	link.keepalive = keepalive
+
 	return nil
 }
+
+// openDestination 发送 flow id 为 0 的 OPEN 帧并等待服务端的 OPEN_ACK, 没有收到时重发, 最多等待 HandshakeTimeout
+// OPEN 丢失或者迟到时, 先到的数据报会被服务端当作普通的连接转发到服务端的 remote
+func (cm *ClientMapper) openDestination(link *clientLink) error {
+	frame := make([]byte, MUX_FRAME_HEADER_SIZE+len(cm.client.config.Destination))
+	if err := EncodeMuxFrameHeader(frame, MUX_FRAME_TYPE_OPEN, 0); err != nil {
+		return err
+	}
+	copy(frame[MUX_FRAME_HEADER_SIZE:], cm.client.config.Destination)
+
+	buffer := make([]byte, PayloadCapacity(cm.client.config.PackageBufferSize))
+	deadline := time.Now().Add(cm.client.config.HandshakeTimeout)
+
+	for time.Now().Before(deadline) {
+		if err := link.tunnel.SetWriteDeadline(time.Now().Add(cm.client.config.WriteTimeout)); err != nil {
+			return MakeErrorWithErrMsg("Failed to set write deadline: %s", err.Error())
+		}
+
+		if _, err := link.tunnel.Write(frame); err != nil {
+			return MakeErrorWithErrMsg("Failed to send destination: %s", err.Error())
+		}
+
+		retry := time.Now().Add(OPEN_RETRY_INTERVAL)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+
+		if err := link.tunnel.SetReadDeadline(retry); err != nil {
+			return MakeErrorWithErrMsg("Failed to set read deadline: %s", err.Error())
+		}
+
+		// 在 OPEN_ACK 之前只可能收到心跳的 PONG
+		for {
+			n, err := link.tunnel.Read(buffer)
+			if os.IsTimeout(err) {
+				break
+			}
+
+			if err != nil {
+				return MakeErrorWithErrMsg("Failed to read from tunnel: %s", err.Error())
+			}
+
+			if IsMuxOpenAck(buffer[:n], 0) {
+				return nil
+			}
+		}
+
+		if cm.ctx.Err() != nil {
+			return MakeErrorWithErrMsg("Failed to open destination: mapper is stopped")
+		}
+	}
+
+	return MakeErrorWithErrMsg("Failed to open destination %s: no ack from server", cm.client.config.Destination)
+}
+
+func (cm *ClientMapper) Info() *MapperInfo {
+	info := &MapperInfo{
+		ID:              cm.srcAddress.String(),
+		CreatedAt:       cm.createdAt,
+		LastRead:        cm.activeRecorder.LastRead(),
+		LastWrite:       cm.activeRecorder.LastWrite(),
+		UpstreamBytes:   cm.activeRecorder.WriteBytes(),
+		DownstreamBytes: cm.activeRecorder.ReadBytes(),
+		ReadQueue:       len(cm.readQueue),
+		WriteQueue:      len(cm.writeQueue),
+		WriteDropped:    cm.writeDropped.Load(),
+		Socket:          cm.listener.index,
+		Multiplexed:     cm.client.config.Multiplex,
+		Reconnecting:    cm.reconnecting.Load(),
+	}
+
+	cm.linkLock.Lock()
+	if cm.link != nil {
+		info.Destination = cm.link.server.String()
+	}
+	cm.linkLock.Unlock()
+
+	// 握手完成前为空
+	if identity, isSet := cm.peerIdentity.Load().(PeerIdentity); isSet {
+		info.Peer = identity.String()
+	}
+
+	return info
+}
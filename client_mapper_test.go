@@ -0,0 +1,189 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// runTestPoolClient 运行使用 pool 的 Client, 返回的函数关闭 Client 并等待 Run 返回
+func runTestPoolClient(t *testing.T, fileConfig *FileConfig, pool PayloadPooler) (*Client, func()) {
+	t.Helper()
+
+	config, err := ParseClientConfig(toTestCommonConfig(t, fileConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClientWithPayloadPool(config, pool)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run()
+	}()
+
+	return client, func() {
+		client.Shutdown()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run() = %s", err.Error())
+			}
+		case <-time.After(TEST_ROUND_TRIP_TIMEOUT):
+			t.Fatal("client is not stopped after Shutdown")
+		}
+	}
+}
+
+func checkPayloadsRecovered(t *testing.T, pool PayloadPooler) {
+	t.Helper()
+
+	if stats := pool.Stats(); stats.InUse != 0 || stats.Violations != 0 {
+		t.Errorf("%d payloads in use and %d violations after the client is stopped", stats.InUse, stats.Violations)
+	}
+}
+
+func TestClientMapperRecoversPayloadsOnInitError(t *testing.T) {
+	// 服务端不存在, 映射的握手一直等到超时, 期间的数据报留在 writeQueue 中
+	clientConfig := newTestFileConfig(t, "client", freeTestUDPAddress(t))
+	clientConfig.HandshakeTimeout = Duration(time.Millisecond * 200)
+	pool := NewPayloadPoolWithConfig(PayloadCapacity(clientConfig.PackageBufferSize), &PayloadPoolConfig{Debug: true})
+	client, stop := runTestPoolClient(t, clientConfig, pool)
+
+	conn := dialTestUDP(t, clientConfig.Listen)
+	isCreated := false
+	deadline := time.Now().Add(TEST_ROUND_TRIP_TIMEOUT)
+	for time.Now().Before(deadline) && !isCreated {
+		_, _ = conn.Write([]byte("hello"))
+		time.Sleep(time.Millisecond * 10)
+		isCreated = client.mapperCount() == 1
+	}
+	if !isCreated {
+		t.Fatal("no mapper is created")
+	}
+
+	for index := 0; index < 10; index++ {
+		_, _ = conn.Write([]byte("hello"))
+	}
+
+	for time.Now().Before(deadline) && client.mapperCount() != 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if client.mapperCount() != 0 {
+		t.Fatal("mapper is not destroyed after the handshake timeout")
+	}
+
+	stop()
+	checkPayloadsRecovered(t, pool)
+}
+
+func TestClientMapperRecoversPayloadsOnStop(t *testing.T) {
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+	newTestServer(t, serverConfig)
+
+	clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+	pool := NewPayloadPoolWithConfig(PayloadCapacity(clientConfig.PackageBufferSize), &PayloadPoolConfig{Debug: true})
+	_, stop := runTestPoolClient(t, clientConfig, pool)
+
+	conn := dialTestUDP(t, clientConfig.Listen)
+	testRoundTrip(t, conn, "hello")
+
+	// 关闭时映射还在转发
+	for index := 0; index < 10; index++ {
+		_, _ = conn.Write([]byte("hello"))
+	}
+
+	stop()
+	checkPayloadsRecovered(t, pool)
+}
+
+// newTestClientMapper 返回没有连接的映射, 只用于测试 writeQueue, 队列的容量是 size
+func newTestClientMapper(policy string, size int, pool PayloadPooler) *ClientMapper {
+	config := &ClientConfig{}
+	config.WriteOverflowPolicy = policy
+	config.WriteOverflowTimeout = time.Millisecond * 20
+	config.PackageBufferCount = size
+
+	client := &Client{
+		config:      config,
+		payloadPool: pool,
+		metrics:     NewTunnelMetrics("test", METRICS_ROLE_CLIENT),
+	}
+	return NewClientMapper(client, nil, netip.AddrPort{}, context.Background())
+}
+
+func newTestPayload(t *testing.T, pool PayloadPooler, data string) *Payload {
+	t.Helper()
+
+	payload, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload.SetLength(copy(payload.Buffer(0, len(data)), data))
+	return payload
+}
+
+func TestClientMapperWriteOverflow(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy string
+		modify func(mapper *ClientMapper)
+
+		queued  string // 写入 "3" 之后队列中的数据
+		dropped uint64
+		isWait  bool // 是否等待了 WriteOverflowTimeout
+	}{
+		{"drop newest", OVERFLOW_POLICY_DROP_NEWEST, nil, "12", 1, false},
+		{"drop oldest", OVERFLOW_POLICY_DROP_OLDEST, nil, "23", 1, false},
+		{"block timeout", OVERFLOW_POLICY_BLOCK, nil, "12", 1, true},
+		{"block freed", OVERFLOW_POLICY_BLOCK, func(mapper *ClientMapper) {
+			// 等待期间取走一个, 新的数据报放入空出的位置
+			go func() {
+				time.Sleep(time.Millisecond * 5)
+				RecoveryPayload(<-mapper.writeQueue, mapper.client.payloadPool)
+			}()
+		}, "23", 0, false},
+		{"block reconnecting", OVERFLOW_POLICY_BLOCK, func(mapper *ClientMapper) {
+			// 重新连接时队列不会很快有空位, 不等待
+			mapper.reconnecting.Store(true)
+		}, "12", 1, false},
+		{"block stopped", OVERFLOW_POLICY_BLOCK, func(mapper *ClientMapper) {
+			mapper.Stop()
+		}, "", 1, false},
+	}
+
+	for _, c := range cases {
+		pool := NewPayloadPoolWithConfig(TEST_PAYLOAD_CAPACITY, &PayloadPoolConfig{Debug: true})
+		mapper := newTestClientMapper(c.policy, 2, pool)
+		mapper.Write(newTestPayload(t, pool, "1"))
+		mapper.Write(newTestPayload(t, pool, "2"))
+
+		if c.modify != nil {
+			c.modify(mapper)
+		}
+
+		start := time.Now()
+		mapper.Write(newTestPayload(t, pool, "3"))
+		if isWait := time.Since(start) >= mapper.client.config.WriteOverflowTimeout; isWait != c.isWait {
+			t.Errorf("%s: waited %s", c.name, time.Since(start))
+		}
+
+		queued := ""
+		for len(mapper.writeQueue) > 0 {
+			payload := <-mapper.writeQueue
+			queued += string(payload.Data())
+			RecoveryPayload(payload, pool)
+		}
+
+		if queued != c.queued || mapper.writeDropped.Load() != c.dropped {
+			t.Errorf("%s: queued %q and dropped %d, want %q and %d", c.name, queued, mapper.writeDropped.Load(), c.queued, c.dropped)
+		}
+
+		// 丢弃的数据报归还到 payload 池
+		if stats := pool.Stats(); stats.InUse != 0 || stats.Violations != 0 {
+			t.Errorf("%s: %d payloads in use and %d violations", c.name, stats.InUse, stats.Violations)
+		}
+	}
+}
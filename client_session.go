@@ -0,0 +1,456 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+/*
+ * 多路复用模式下, 多个 ClientMapper 共用一个 ClientSession (一个 DTLS 连接)
+ * 每个 ClientMapper 在 session 上注册得到一个 flow id, 数据以 MuxFrame 的形式收发
+ */
+
+type ClientSession struct {
+	client *Client
+	server *TunnelServer
+	tunnel *dtls.Conn
+
+	// flow id -> *ClientMapper
+	flows      *sync.Map
+	opening    *sync.Map // 等待 OPEN_ACK 的 flow id -> chan struct{}
+	flowCount  atomic.Int32
+	nextFlowID atomic.Uint32
+
+	// 多个 ClientMapper 会同时写入, 写缓冲区需要加锁
+	writeLock   *sync.Mutex
+	writeBuffer []byte
+
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+
+	// 服务端的身份, init 成功后不再改变
+	peerIdentity PeerIdentity
+
+	// 心跳, 未开启时为 nil
+	keepalive *Keepalive
+}
+
+func NewClientSession(client *Client, parentCtx context.Context) *ClientSession {
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	session := &ClientSession{
+		client:      client,
+		flows:       &sync.Map{},
+		opening:     &sync.Map{},
+		writeLock:   &sync.Mutex{},
+		writeBuffer: make([]byte, client.config.PackageBufferSize+MUX_FRAME_HEADER_SIZE),
+		ctx:         ctx,
+		cancelFunc:  cancel,
+	}
+
+	return session
+}
+
+// Run 负责从 DTLS 连接读取并分发数据, 需要在 init 成功后调用
+func (s *ClientSession) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	keepaliveWg := &sync.WaitGroup{}
+	if s.keepalive != nil {
+		keepaliveWg.Add(1)
+		go s.handleKeepalive(keepaliveWg)
+	}
+
+	s.handleRead()
+	keepaliveWg.Wait()
+
+	// 连接已经不可用, 让上面所有的流一起退出
+	s.flows.Range(func(key, value any) bool {
+		value.(*ClientMapper).handleSessionClosed(s)
+		return true
+	})
+
+	if err := s.unInit(); err != nil {
+		logger.Warn(FormatString("Failed to clean client session: %s", err.Error()))
+	}
+}
+
+func (s *ClientSession) Stop() {
+	s.cancelFunc()
+}
+
+func (s *ClientSession) IsClosed() bool {
+	return s.ctx.Err() != nil
+}
+
+func (s *ClientSession) FlowCount() int {
+	return int(s.flowCount.Load())
+}
+
+func (s *ClientSession) init() error {
+	tunnel, server, err := s.client.connect(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	s.server = server
+	s.tunnel = tunnel
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.client.config.HandshakeTimeout)
+	defer cancel()
+
+	state := s.client.sessionCache.ConnectionState(tunnel)
+	s.peerIdentity = PeerIdentityFromState(&state)
+
+	if err := s.negotiate(ctx); err != nil {
+		_ = tunnel.Close()
+		return MakeErrorWithErrMsg("Failed to negotiate multiplexing: %s", err.Error())
+	}
+
+	if s.client.config.KeepaliveInterval > 0 {
+		keepalive, err := NewKeepalive(s.client.config.KeepaliveInterval, s.client.config.KeepaliveMisses)
+		if err != nil {
+			_ = tunnel.Close()
+			return err
+		}
+
+		// 立即发送第一个 PING, 让服务端尽早知道心跳周期
+		if err := s.WriteFrame(MUX_FRAME_TYPE_PING, 0, keepalive.Payload()); err != nil {
+			_ = tunnel.Close()
+			return MakeErrorWithErrMsg("Failed to send keepalive: %s", err.Error())
+		}
+		s.keepalive = keepalive
+	}
+
+	return nil
+}
+
+func (s *ClientSession) handleKeepalive(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ping := func() error {
+		return s.WriteFrame(MUX_FRAME_TYPE_PING, 0, s.keepalive.Payload())
+	}
+
+	// 关闭连接后上面的流重新连接或者以 STOP_REASON_SESSION_CLOSED 退出
+	s.keepalive.Run(s.ctx, ping, func() {
+		logger.Warn(FormatString("Session to %s is not responding", s.tunnel.RemoteAddr().String()))
+		s.Stop()
+	})
+}
+
+// negotiate 发送 HELLO 帧并等待服务端回复
+func (s *ClientSession) negotiate(ctx context.Context) error {
+	if err := s.WriteFrame(MUX_FRAME_TYPE_HELLO, 0, []byte(MUX_PROTOCOL)); err != nil {
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := s.tunnel.SetReadDeadline(deadline); err != nil {
+		return MakeErrorWithErrMsg("Failed to set read deadline: %s", err.Error())
+	}
+
+	buffer := make([]byte, MUX_FRAME_HEADER_SIZE+len(MUX_PROTOCOL))
+	n, err := s.tunnel.Read(buffer)
+	if os.IsTimeout(err) {
+		return MakeErrorWithErrMsg("server does not support multiplexing")
+	}
+
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to read from tunnel: %s", err.Error())
+	}
+
+	if !IsMuxHello(buffer[:n]) {
+		return MakeErrorWithErrMsg("unexpected reply from server")
+	}
+
+	return nil
+}
+
+func (s *ClientSession) unInit() error {
+	if err := s.tunnel.Close(); err != nil {
+		return MakeErrorWithErrMsg("Failed to close tunnel: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Register 把 ClientMapper 挂到当前 session 上并返回分配到的 flow id
+func (s *ClientSession) Register(mapper *ClientMapper) (uint32, error) {
+	flowID := s.nextFlowID.Add(1)
+	s.flows.Store(flowID, mapper)
+	s.flowCount.Add(1)
+
+	// Run 退出时先取消 context 再遍历 flows, 这里再检查一次就不会漏掉
+	if s.IsClosed() {
+		s.flows.Delete(flowID)
+		s.flowCount.Add(-1)
+		return 0, MakeErrorWithErrMsg("Failed to register flow: session is closed")
+	}
+
+	return flowID, nil
+}
+
+// Unregister 移除流并通知服务端关闭对应的 UDP 连接
+func (s *ClientSession) Unregister(flowID uint32) {
+	if _, isExist := s.flows.LoadAndDelete(flowID); !isExist {
+		return
+	}
+	s.flowCount.Add(-1)
+
+	if s.IsClosed() {
+		return
+	}
+
+	if err := s.WriteFrame(MUX_FRAME_TYPE_CLOSE, flowID, nil); err != nil {
+		logger.Warn(FormatString("Failed to notify flow close: %s", err.Error()))
+	}
+}
+
+// Open 发送 OPEN 帧并等待服务端的 OPEN_ACK, 没有收到时重发, 最多等待 HandshakeTimeout
+// 映射在 Open 返回之前不发送数据, 数据报留在 writeQueue 中
+func (s *ClientSession) Open(ctx context.Context, flowID uint32, destination string) error {
+	acked := make(chan struct{})
+	s.opening.Store(flowID, acked)
+	defer s.opening.Delete(flowID)
+
+	timeout := time.NewTimer(s.client.config.HandshakeTimeout)
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(OPEN_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := s.WriteFrame(MUX_FRAME_TYPE_OPEN, flowID, []byte(destination)); err != nil {
+			return MakeErrorWithErrMsg("Failed to open flow %d: %s", flowID, err.Error())
+		}
+
+		select {
+		case <-acked:
+			return nil
+		case <-ctx.Done():
+			return MakeErrorWithErrMsg("Failed to open flow %d: mapper is stopped", flowID)
+		case <-s.ctx.Done():
+			return MakeErrorWithErrMsg("Failed to open flow %d: session is closed", flowID)
+		case <-timeout.C:
+			return MakeErrorWithErrMsg("Failed to open flow %d: no ack from server", flowID)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ClientSession) WriteFrame(frameType byte, flowID uint32, data []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if len(data)+MUX_FRAME_HEADER_SIZE > len(s.writeBuffer) {
+		return MakeErrorWithErrMsg("Failed to write frame: payload too large (%d bytes)", len(data))
+	}
+
+	if err := EncodeMuxFrameHeader(s.writeBuffer, frameType, flowID); err != nil {
+		return err
+	}
+	n := copy(s.writeBuffer[MUX_FRAME_HEADER_SIZE:], data) + MUX_FRAME_HEADER_SIZE
+
+	return s.write(s.writeBuffer[:n])
+}
+
+// WritePayload 发送一个 DATA 帧, payload 在数据前面留出了帧头的空间时原地写入帧头, 不需要拷贝
+func (s *ClientSession) WritePayload(flowID uint32, payload *Payload) error {
+	frame, hasHeadroom := payload.Frame()
+	if !hasHeadroom {
+		return s.WriteFrame(MUX_FRAME_TYPE_DATA, flowID, payload.Data())
+	}
+
+	if err := EncodeMuxFrameHeader(frame, MUX_FRAME_TYPE_DATA, flowID); err != nil {
+		return err
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	return s.write(frame)
+}
+
+// write 需要持有 writeLock
+func (s *ClientSession) write(frame []byte) error {
+	if err := s.tunnel.SetWriteDeadline(time.Now().Add(s.client.config.WriteTimeout)); err != nil {
+		return MakeErrorWithErrMsg("Failed to set write deadline: %s", err.Error())
+	}
+
+	if _, err := s.tunnel.Write(frame); err != nil {
+		return MakeErrorWithErrMsg("Failed to write to tunnel: %s", err.Error())
+	}
+
+	return nil
+}
+
+// handleRead 直接读到 payload 中, DATA 帧的 payload 交给对应的映射, 不需要再拷贝
+func (s *ClientSession) handleRead() {
+	var payload *Payload = nil
+	defer func() {
+		if payload != nil {
+			RecoveryPayload(payload, s.client.payloadPool)
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+
+		default:
+			if payload == nil {
+				var err error = nil
+				if payload, err = s.client.payloadPool.Get(); err != nil {
+					logger.Debug(FormatString("Failed to get payload on pool: %s", err.Error()))
+
+					select {
+					case <-s.ctx.Done():
+						return
+					case <-time.After(PAYLOAD_POOL_RETRY_INTERVAL):
+					}
+					continue
+				}
+			}
+
+			if err := s.tunnel.SetReadDeadline(time.Now().Add(s.client.config.ReadTimeout)); err != nil {
+				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
+				s.Stop()
+				return
+			}
+
+			buffer := payload.Buffer(0, PayloadCapacity(s.client.config.PackageBufferSize))
+			n, err := s.tunnel.Read(buffer)
+
+			if os.IsTimeout(err) {
+				continue
+			}
+
+			if err == io.EOF {
+				s.Stop()
+				return
+			}
+
+			if err != nil {
+				logger.Error(FormatString("Failed to read from tunnel: %s", err.Error()))
+				s.Stop()
+				return
+			}
+
+			// PONG 的 flow id 是 0, 不对应任何流, 收到任何数据报都说明服务端还在
+			if s.keepalive != nil {
+				s.keepalive.Received()
+			}
+
+			header, data, err := DecodeMuxFrame(buffer[:n])
+			if err != nil {
+				logger.Warn(err.Error())
+				continue
+			}
+
+			value, isExist := s.flows.Load(header.FlowID)
+			if !isExist {
+				continue
+			}
+			mapper := value.(*ClientMapper)
+
+			switch header.Type {
+			case MUX_FRAME_TYPE_DATA:
+				payload.offset = MUX_FRAME_HEADER_SIZE
+				payload.payloadLength = len(data)
+				mapper.deliver(payload)
+				payload = nil
+
+			case MUX_FRAME_TYPE_OPEN_ACK:
+				// 重发的 OPEN 会带来多个 OPEN_ACK, 只有第一个需要处理
+				if acked, isOpening := s.opening.LoadAndDelete(header.FlowID); isOpening {
+					close(acked.(chan struct{}))
+				}
+
+			case MUX_FRAME_TYPE_CLOSE:
+				mapper.stopWithReason(STOP_REASON_EOF)
+			}
+		}
+	}
+}
+
+/*
+ * ClientSessionPool 维护固定数量的 ClientSession, 新的流挂到负载最低的 session 上
+ */
+
+type ClientSessionPool struct {
+	client   *Client
+	sessions []*ClientSession
+	lock     *sync.Mutex
+	wg       *sync.WaitGroup
+}
+
+func NewClientSessionPool(client *Client, size int) *ClientSessionPool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &ClientSessionPool{
+		client:   client,
+		sessions: make([]*ClientSession, size),
+		lock:     &sync.Mutex{},
+		wg:       &sync.WaitGroup{},
+	}
+
+	return pool
+}
+
+// Acquire 返回一个可用的 session, 有空位时会先建立新连接
+// 握手期间持有锁, 其他新流会等待, 已有的流不受影响
+func (p *ClientSessionPool) Acquire() (*ClientSession, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var selected *ClientSession = nil
+	for index, session := range p.sessions {
+		if session == nil || session.IsClosed() {
+			session = NewClientSession(p.client, p.client.ctx)
+			if err := session.init(); err != nil {
+				session.Stop()
+				return nil, MakeErrorWithErrMsg("Failed to open session: %s", err.Error())
+			}
+
+			p.sessions[index] = session
+			p.wg.Add(1)
+			go session.Run(p.wg)
+
+			logger.Info(FormatString("New session: %s", session.tunnel.RemoteAddr().String()))
+
+			return session, nil
+		}
+
+		if selected == nil || session.FlowCount() < selected.FlowCount() {
+			selected = session
+		}
+	}
+
+	return selected, nil
+}
+
+// handleServerDown 关闭服务端上的 session, 上面的流重新连接时选择其他服务端
+func (p *ClientSessionPool) handleServerDown(server *TunnelServer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, session := range p.sessions {
+		if session != nil && session.server == server {
+			session.Stop()
+		}
+	}
+}
+
+func (p *ClientSessionPool) Wait() {
+	p.wg.Wait()
+}
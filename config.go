@@ -1,12 +1,14 @@
 package dtls_tunnel
 
 import (
-	"crypto/tls"
-	"crypto/x509"
 	"net"
+	"time"
 )
 
 type CommonConfig struct {
+	// 多隧道时用于区分日志和管理, 单隧道时可以为空
+	Name string
+
 	RunMethod string
 	
 	// 在 Read 数据的时候传入的缓冲区大小
@@ -16,6 +18,15 @@ type CommonConfig struct {
 	// 而这个就是设定队列的缓存数量
 	PackageBufferCount int
 
+	// Client 的监听地址和 Server 到上游的连接一次系统调用最多收发的数据报数量, 为 1 时逐个收发
+	// UDPOffload 为 true 时在 Linux 上打开 UDP GRO/GSO, 内核不支持时自动关闭
+	UDPBatchSize int
+	UDPOffload   bool
+
+	// Client: 在 ListenAddress 上用 SO_REUSEPORT 打开的 socket 数量, 内核按四元组把数据报分到各个 socket
+	// 每个 socket 有自己的读写协程, 同一个源地址的映射总是使用同一个 socket
+	ListenSockets int
+
 	// Client: 监听UDP的地址
 	// Server: DTLS Listener 的监听地址
 	ListenAddress *net.UDPAddr
@@ -24,8 +35,120 @@ type CommonConfig struct {
 	// Server: 收到数据后转发的UDP地址
 	RemoteAddress *net.UDPAddr
 
-	Cert      tls.Certificate
-	RootCerts *x509.CertPool
+	// Client: 所有服务端的地址, 按优先级排列, 第一个就是 RemoteAddress
+	// ServerStrategy 决定新的连接选择哪个服务端, 多于一个服务端时每 ProbeInterval 探测一次
+	// Server: 默认的上游地址池, 按 UpstreamPolicy 为新的映射和 flow 选择上游
+	RemoteAddresses []*net.UDPAddr
+	ServerStrategy  string
+	ProbeInterval   time.Duration
+	UpstreamPolicy  string
+
+	// Server: 上游的健康检查, 为 nil 时不检查
+	HealthCheck *HealthCheck
+
+	// DTLS 握手的超时时间
+	HandshakeTimeout time.Duration
+
+	// 每次读写设置的超时时间, 决定了退出时最长的等待时间
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// 映射或 flow 按 IdlePolicy 空闲超过 IdleTimeout 后被回收, 每 GCInterval 检查一次
+	IdleTimeout time.Duration
+	IdlePolicy  string
+	GCInterval  time.Duration
+
+	// Client: 是否把多个 UDP 流复用到少量 DTLS 连接上
+	// Server: 始终支持, 由客户端通过 HELLO 帧协商
+	Multiplex bool
+
+	// Client: 多路复用模式下 DTLS 连接的数量
+	MultiplexConnections int
+
+	// Client: 每个 DTLS 连接上发送心跳的间隔, 为 0 时不发送
+	// 连续 KeepaliveMisses 个间隔没有收到服务端的数据时关闭连接, 下一个数据报会重新建立连接
+	// Server: 按客户端心跳中的参数判断客户端是否失效, 不需要配置
+	KeepaliveInterval time.Duration
+	KeepaliveMisses   int
+
+	// Client: 连接断开后保持源地址的映射并重新连接, 超过这个时间仍未成功时关闭映射
+	// 期间的数据缓存在映射的写队列中, 为 0 时不重新连接
+	ReconnectTimeout time.Duration
+
+	// Client: 映射的写队列满了时的处理方式, OVERFLOW_POLICY_* 之一
+	// OVERFLOW_POLICY_BLOCK 时最多等待 WriteOverflowTimeout
+	WriteOverflowPolicy  string
+	WriteOverflowTimeout time.Duration
+
+	// Client: 后台维持的已经握手完成的空闲连接数量, 新的映射直接取用, 为 0 时不预热
+	// 空闲超过 WarmMaxIdle 的连接被关闭并重新建立, 避免被服务端当作没有数据的连接关闭
+	WarmConnections int
+	WarmMaxIdle     time.Duration
+
+	// 缓存 DTLS 会话的时间, 期间重新连接使用简化握手, 为 0 时不使用会话恢复
+	// 只在 AUTH_MODE_PSK 时生效
+	SessionTTL time.Duration
+
+	// 认证方式, AUTH_MODE_CERT 或 AUTH_MODE_PSK
+	AuthMode string
+
+	// AUTH_MODE_CERT 时使用, 可以在运行时重新加载
+	Certificates *CertificateStore
+
+	// AUTH_MODE_CERT 时检查对端证书是否被吊销, 为 nil 时不检查
+	// 每 CRLReloadInterval 检查一次文件变化, 为 0 时和证书一起按 ReloadInterval 检查
+	CRL               *CRLStore
+	CRLReloadInterval time.Duration
+
+	// AUTH_MODE_PSK 时使用
+	// Client: 发送给服务端的 identity, 并使用 PSKKeys 中对应的密钥
+	// Server: 按客户端的 identity 从 PSKKeys 中选择密钥, 并发送 PSKIdentityHint
+	PSKKeys         *PSKKeyStore
+	PSKIdentity     string
+	PSKIdentityHint string
+
+	// 检查证书或 PSK 文件变化的间隔, 为 0 时只在收到 SIGHUP 时重新加载
+	ReloadInterval time.Duration
+
+	// Client: 要求服务端转发到的 "host:port", 为空时由服务端决定
+	Destination string
+
+	// Server: 允许客户端指定的目标地址, 为 nil 时不允许客户端指定
+	// 配置了 ACL 时按命中的规则, 见 ACLRule.DestinationAllowlist
+	DestinationAllowlist *DestinationAllowlist
+
+	// Server: 按客户端身份决定是否允许以及转发的上游地址, 为 nil 时允许所有客户端
+	ACL *ACL
+
+	// 令牌桶限速, 为 nil 时不限制
+	// Client 限制整个隧道和每个源地址, Server 限制整个隧道和每个客户端身份
+	RateLimit *RateLimit
+}
+
+// ProcessConfig 是整个进程共用的配置, 不属于某一个隧道
+type ProcessConfig struct {
+	// 提供 /metrics 的 HTTP 监听地址, 为空时不启动
+	MetricsAddress string
+
+	// 管理接口的监听地址, "unix:/path" 或回环地址, 为空时不启动
+	AdminAddress string
+
+	// 所有隧道共用的 payload 池
+	PayloadPool *PayloadPoolConfig
+
+	Tunnels []*CommonConfig
+}
+
+// PayloadPoolConfig 决定 payload 池的实现, Limit 为 0 时使用不限数量的 PayloadPool
+type PayloadPoolConfig struct {
+	// 最多同时取出的 payload 数量, 全部取出时按 ExhaustedPolicy (POOL_EXHAUSTED_*) 处理
+	// POOL_EXHAUSTED_BLOCK 时最多等待 Timeout
+	Limit           int
+	ExhaustedPolicy string
+	Timeout         time.Duration
+
+	// 检查重复归还和归还后写入, 有额外的开销, 只用于排查问题
+	Debug bool
 }
 
 type ServerConfig struct {
@@ -35,3 +158,25 @@ type ServerConfig struct {
 type ClientConfig struct {
 	CommonConfig
 }
+
+// Reloaders 返回当前认证方式下可以重新加载的材料
+func (c *CommonConfig) Reloaders() []Reloader {
+	if c.AuthMode == AUTH_MODE_PSK {
+		return []Reloader{c.PSKKeys}
+	}
+
+	if c.CRL != nil {
+		return []Reloader{c.Certificates, c.CRL}
+	}
+
+	return []Reloader{c.Certificates}
+}
+
+// IntervalReloaders 返回按 ReloadInterval 检查的材料, 单独检查的 CRL 不在其中
+func (c *CommonConfig) IntervalReloaders() []Reloader {
+	if c.CRL != nil && c.CRLReloadInterval > 0 {
+		return []Reloader{c.Certificates}
+	}
+
+	return c.Reloaders()
+}
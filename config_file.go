@@ -0,0 +1,1066 @@
+package dtls_tunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * 配置文件支持 JSON, YAML 和 TOML, 按扩展名区分
+ * 字段和命令行参数一一对应, 命令行显式指定的参数会覆盖文件中的值
+ */
+
+// Duration 在配置文件中写成 "10s" "1m30s" 这样的字符串
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *Duration) parse(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return MakeErrorWithErrMsg("invalid duration %q", value)
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return MakeErrorWithErrMsg("duration must be a string like \"10s\"")
+	}
+	return d.parse(value)
+}
+
+func (d *Duration) UnmarshalTOML(value any) error {
+	text, isString := value.(string)
+	if !isString {
+		return MakeErrorWithErrMsg("duration must be a string like \"10s\"")
+	}
+	return d.parse(text)
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return MakeErrorWithErrMsg("line %d: duration must be a string like \"10s\"", node.Line)
+	}
+	return d.parse(value)
+}
+
+// RawTunnel 保存 tunnels 中每一项的原始内容, 以顶层配置为默认值再解析
+type RawTunnel struct {
+	jsonContent json.RawMessage
+	yamlContent *yaml.Node
+	tomlContent map[string]any
+}
+
+func (rt *RawTunnel) UnmarshalJSON(data []byte) error {
+	rt.jsonContent = append(json.RawMessage{}, data...)
+	return nil
+}
+
+func (rt *RawTunnel) UnmarshalYAML(node *yaml.Node) error {
+	rt.yamlContent = node
+	return nil
+}
+
+func (rt *RawTunnel) UnmarshalTOML(value any) error {
+	table, isTable := value.(map[string]any)
+	if !isTable {
+		return MakeErrorWithErrMsg("tunnel must be a table")
+	}
+
+	rt.tomlContent = table
+	return nil
+}
+
+func (rt *RawTunnel) decode(config *FileConfig) error {
+	if rt.tomlContent != nil {
+		// 和 YAML 一样重新编码后解析, 检查未知字段
+		content := &bytes.Buffer{}
+		if err := toml.NewEncoder(content).Encode(rt.tomlContent); err != nil {
+			return err
+		}
+		return decodeTOML(content.Bytes(), config)
+	}
+
+	if rt.yamlContent != nil {
+		// Node.Decode 不检查未知字段, 重新编码后用 decoder 解析
+		content, err := yaml.Marshal(rt.yamlContent)
+		if err != nil {
+			return err
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		return decoder.Decode(config)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(rt.jsonContent))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
+
+type ACLRuleFileConfig struct {
+	Name string `json:"name" yaml:"name" toml:"name"`
+
+	CommonName         string `json:"cn" yaml:"cn" toml:"cn"`
+	OrganizationalUnit string `json:"ou" yaml:"ou" toml:"ou"`
+	SAN                string `json:"san" yaml:"san" toml:"san"`
+	PSKIdentity        string `json:"psk_identity" yaml:"psk_identity" toml:"psk_identity"`
+
+	// allow 或 deny
+	Action string `json:"action" yaml:"action" toml:"action"`
+
+	// 允许时转发的上游地址, 为空时使用 remote
+	Remote []string `json:"remote" yaml:"remote" toml:"remote"`
+
+	// 命中这条规则的客户端可以指定的目标地址, 为空时: remote 也为空则使用顶层的 allow_destinations, 否则不允许客户端指定
+	AllowDestinations []DestinationRuleFileConfig `json:"allow_destinations" yaml:"allow_destinations" toml:"allow_destinations"`
+}
+
+type DestinationRuleFileConfig struct {
+	CIDR  string `json:"cidr" yaml:"cidr" toml:"cidr"`
+	Ports string `json:"ports" yaml:"ports" toml:"ports"` // "53,5000-6000", 为空时允许所有端口
+}
+
+type HealthCheckFileConfig struct {
+	Interval Duration `json:"interval" yaml:"interval" toml:"interval"`
+
+	// 等待回复的时间, 为 0 时使用默认值 1s
+	Timeout Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+
+	// 十六进制编码的探测数据和期望的回复前缀, expect 为空时收到任何回复都算成功
+	Payload string `json:"payload" yaml:"payload" toml:"payload"`
+	Expect  string `json:"expect" yaml:"expect" toml:"expect"`
+
+	// 连续失败多少次后不再使用这个上游, 为 0 时使用默认值 2
+	Failures int `json:"failures" yaml:"failures" toml:"failures"`
+}
+
+func (hc *HealthCheckFileConfig) timeout() time.Duration {
+	if hc.Timeout == 0 {
+		return DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	return hc.Timeout.Duration()
+}
+
+func (hc *HealthCheckFileConfig) failures() int {
+	if hc.Failures == 0 {
+		return DEFAULT_HEALTH_CHECK_FAILURES
+	}
+	return hc.Failures
+}
+
+func (hc *HealthCheckFileConfig) Validate() error {
+	if hc.Interval <= 0 {
+		return MakeErrorWithErrMsg("interval must be positive")
+	}
+
+	if hc.timeout() <= 0 || hc.timeout() > hc.Interval.Duration() {
+		return MakeErrorWithErrMsg("timeout must be positive and not longer than interval")
+	}
+
+	if hc.failures() <= 0 {
+		return MakeErrorWithErrMsg("failures must be positive, got %d", hc.Failures)
+	}
+
+	if hc.Payload == "" {
+		return MakeErrorWithErrMsg("payload is required")
+	}
+
+	if _, err := hex.DecodeString(hc.Payload); err != nil {
+		return MakeErrorWithErrMsg("payload must be hex encoded: %s", err.Error())
+	}
+
+	if _, err := hex.DecodeString(hc.Expect); err != nil {
+		return MakeErrorWithErrMsg("expect must be hex encoded: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (hc *HealthCheckFileConfig) ToHealthCheck() *HealthCheck {
+	payload, _ := hex.DecodeString(hc.Payload)
+	expect, _ := hex.DecodeString(hc.Expect)
+
+	return &HealthCheck{
+		Interval: hc.Interval.Duration(),
+		Timeout:  hc.timeout(),
+		Payload:  payload,
+		Expect:   expect,
+		Failures: hc.failures(),
+	}
+}
+
+type RateFileConfig struct {
+	PacketsPerSecond int64 `json:"packets_per_second" yaml:"packets_per_second" toml:"packets_per_second"`
+	BytesPerSecond   int64 `json:"bytes_per_second" yaml:"bytes_per_second" toml:"bytes_per_second"`
+}
+
+func (rc *RateFileConfig) ToRate() Rate {
+	return Rate{Packets: rc.PacketsPerSecond, Bytes: rc.BytesPerSecond}
+}
+
+type RateLimitFileConfig struct {
+	Global RateFileConfig `json:"global" yaml:"global" toml:"global"`
+
+	// 仅 client, 每个源地址
+	Source RateFileConfig `json:"source" yaml:"source" toml:"source"`
+
+	// 仅 server, 每个客户端身份
+	Identity RateFileConfig `json:"identity" yaml:"identity" toml:"identity"`
+
+	// drop 或 queue, 为空时使用 drop
+	Action string `json:"action" yaml:"action" toml:"action"`
+
+	// 为 0 时使用默认值, burst 100ms, max_delay 50ms
+	Burst    Duration `json:"burst" yaml:"burst" toml:"burst"`
+	MaxDelay Duration `json:"max_delay" yaml:"max_delay" toml:"max_delay"`
+}
+
+func (rc *RateLimitFileConfig) action() string {
+	if rc.Action == "" {
+		return RATE_LIMIT_ACTION_DROP
+	}
+	return rc.Action
+}
+
+func (rc *RateLimitFileConfig) burst() time.Duration {
+	if rc.Burst == 0 {
+		return DEFAULT_RATE_LIMIT_BURST
+	}
+	return rc.Burst.Duration()
+}
+
+func (rc *RateLimitFileConfig) maxDelay() time.Duration {
+	if rc.MaxDelay == 0 {
+		return DEFAULT_RATE_LIMIT_MAX_DELAY
+	}
+	return rc.MaxDelay.Duration()
+}
+
+func (rc *RateLimitFileConfig) Validate(mode string) error {
+	for _, rate := range []*RateFileConfig{&rc.Global, &rc.Source, &rc.Identity} {
+		if rate.PacketsPerSecond < 0 || rate.BytesPerSecond < 0 {
+			return MakeErrorWithErrMsg("packets_per_second and bytes_per_second must not be negative")
+		}
+	}
+
+	if rc.Source.ToRate().IsLimited() && mode != "client" {
+		return MakeErrorWithErrMsg("source is only supported in client mode")
+	}
+
+	if rc.Identity.ToRate().IsLimited() && mode != "server" {
+		return MakeErrorWithErrMsg("identity is only supported in server mode")
+	}
+
+	if rc.action() != RATE_LIMIT_ACTION_DROP && rc.action() != RATE_LIMIT_ACTION_QUEUE {
+		return MakeErrorWithErrMsg("action must be \"drop\" or \"queue\", got %q", rc.Action)
+	}
+
+	if rc.burst() <= 0 {
+		return MakeErrorWithErrMsg("burst must be positive")
+	}
+
+	if rc.maxDelay() <= 0 {
+		return MakeErrorWithErrMsg("max_delay must be positive")
+	}
+
+	return nil
+}
+
+// ToRateLimit 没有任何范围限速时返回 nil
+func (rc *RateLimitFileConfig) ToRateLimit() *RateLimit {
+	rateLimit := &RateLimit{
+		Global:   rc.Global.ToRate(),
+		Source:   rc.Source.ToRate(),
+		Identity: rc.Identity.ToRate(),
+		Action:   rc.action(),
+		Burst:    rc.burst(),
+		MaxDelay: rc.maxDelay(),
+	}
+
+	if !rateLimit.Global.IsLimited() && !rateLimit.Source.IsLimited() && !rateLimit.Identity.IsLimited() {
+		return nil
+	}
+
+	return rateLimit
+}
+
+type FileConfig struct {
+	Name string `json:"name" yaml:"name" toml:"name"`
+	Mode string `json:"mode" yaml:"mode" toml:"mode"`
+
+	Listen string `json:"listen" yaml:"listen" toml:"listen"`
+
+	// 可以是逗号分隔的多个地址, client: 按优先级排列的服务端, server: 上游地址池
+	Remote string `json:"remote" yaml:"remote" toml:"remote"`
+
+	// 仅 client, 多个服务端时的选择策略: priority, round_robin 或 lowest_rtt
+	ServerStrategy string `json:"server_strategy" yaml:"server_strategy" toml:"server_strategy"`
+
+	// 仅 client, 多个服务端时探测服务端是否可用的间隔
+	ProbeInterval Duration `json:"probe_interval" yaml:"probe_interval" toml:"probe_interval"`
+
+	// 仅 server, 多个上游时的选择策略: round_robin, hash (按客户端身份) 或 least_flows
+	UpstreamPolicy string `json:"upstream_policy" yaml:"upstream_policy" toml:"upstream_policy"`
+
+	// 仅 server, 上游的健康检查, 不配置时不检查
+	HealthCheck *HealthCheckFileConfig `json:"health_check" yaml:"health_check" toml:"health_check"`
+
+	// cert 或 psk, 默认 cert
+	Auth string `json:"auth" yaml:"auth" toml:"auth"`
+
+	Key      string `json:"key" yaml:"key" toml:"key"`
+	Cert     string `json:"cert" yaml:"cert" toml:"cert"`
+	RootCert string `json:"root_cert" yaml:"root_cert" toml:"root_cert"`
+
+	// 吊销列表文件或目录, 为空时不检查
+	CRL string `json:"crl" yaml:"crl" toml:"crl"`
+
+	// 检查吊销列表文件变化的间隔, 为 0 时和证书一起按 reload_interval 检查
+	CRLReloadInterval Duration `json:"crl_reload_interval" yaml:"crl_reload_interval" toml:"crl_reload_interval"`
+
+	PSKFile     string `json:"psk_file" yaml:"psk_file" toml:"psk_file"`
+	PSKIdentity string `json:"psk_identity" yaml:"psk_identity" toml:"psk_identity"`
+	PSKHint     string `json:"psk_hint" yaml:"psk_hint" toml:"psk_hint"`
+
+	PackageBufferSize  int `json:"package_buffer_size" yaml:"package_buffer_size" toml:"package_buffer_size"`
+	PackageBufferCount int `json:"package_buffer_count" yaml:"package_buffer_count" toml:"package_buffer_count"`
+
+	// 一次系统调用最多收发的 UDP 数据报数量, 为 1 时逐个收发; udp_offload 在 Linux 上打开 GRO/GSO
+	UDPBatchSize int  `json:"udp_batch_size" yaml:"udp_batch_size" toml:"udp_batch_size"`
+	UDPOffload   bool `json:"udp_offload" yaml:"udp_offload" toml:"udp_offload"`
+
+	// 仅 client, 在 listen 上用 SO_REUSEPORT 打开的 socket 数量, 每个 socket 有自己的读写协程
+	ListenSockets int `json:"listen_sockets" yaml:"listen_sockets" toml:"listen_sockets"`
+
+	// 为 0 时使用默认值, Client 10s, Server 30s
+	HandshakeTimeout Duration `json:"handshake_timeout" yaml:"handshake_timeout" toml:"handshake_timeout"`
+
+	ReadTimeout  Duration `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`
+
+	// 映射或 flow 空闲多久后被回收, either: 任意一个方向空闲, both: 两个方向都空闲
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`
+	IdlePolicy  string   `json:"idle_policy" yaml:"idle_policy" toml:"idle_policy"`
+	GCInterval  Duration `json:"gc_interval" yaml:"gc_interval" toml:"gc_interval"`
+
+	// 检查证书或 PSK 文件变化的间隔, 为 0 时只在收到 SIGHUP 时重新加载
+	ReloadInterval Duration `json:"reload_interval" yaml:"reload_interval" toml:"reload_interval"`
+
+	Multiplex            bool `json:"multiplex" yaml:"multiplex" toml:"multiplex"`
+	MultiplexConnections int  `json:"multiplex_connections" yaml:"multiplex_connections" toml:"multiplex_connections"`
+
+	// 仅 client, 心跳间隔, 为 0 时不发送. 连续 keepalive_misses 次没有回应时重新连接
+	KeepaliveInterval Duration `json:"keepalive_interval" yaml:"keepalive_interval" toml:"keepalive_interval"`
+	KeepaliveMisses   int      `json:"keepalive_misses" yaml:"keepalive_misses" toml:"keepalive_misses"`
+
+	// 仅 client, 连接断开后重新连接的最长时间, 为 0 时不重新连接
+	ReconnectTimeout Duration `json:"reconnect_timeout" yaml:"reconnect_timeout" toml:"reconnect_timeout"`
+
+	// 仅 client, 映射的写队列满了时的处理方式: drop_newest, drop_oldest 或 block
+	WriteOverflow        string   `json:"write_overflow" yaml:"write_overflow" toml:"write_overflow"`
+	WriteOverflowTimeout Duration `json:"write_overflow_timeout" yaml:"write_overflow_timeout" toml:"write_overflow_timeout"`
+
+	// 仅 client, 预热的空闲连接数量和最长空闲时间, 为 0 时不预热
+	WarmConnections int      `json:"warm_connections" yaml:"warm_connections" toml:"warm_connections"`
+	WarmMaxIdle     Duration `json:"warm_max_idle" yaml:"warm_max_idle" toml:"warm_max_idle"`
+
+	// 会话缓存的时间, 为 0 时不使用会话恢复
+	// 只支持 PSK 模式: 客户端出示证书时 pion/dtls 的服务端不保存会话, 证书模式下配置了会报错
+	SessionTTL Duration `json:"session_ttl" yaml:"session_ttl" toml:"session_ttl"`
+
+	// 仅 client, 要求服务端转发到的 "host:port"
+	Destination string `json:"destination" yaml:"destination" toml:"destination"`
+
+	// 仅 server, 允许客户端指定的目标地址
+	AllowDestinations []DestinationRuleFileConfig `json:"allow_destinations" yaml:"allow_destinations" toml:"allow_destinations"`
+
+	// 仅 server, 按顺序匹配的访问控制规则
+	ACL []ACLRuleFileConfig `json:"acl" yaml:"acl" toml:"acl"`
+
+	// 令牌桶限速, 不配置时不限制
+	RateLimit *RateLimitFileConfig `json:"rate_limit" yaml:"rate_limit" toml:"rate_limit"`
+
+	// 仅顶层有效, 提供 /metrics 的 HTTP 监听地址
+	MetricsListen string `json:"metrics_listen" yaml:"metrics_listen" toml:"metrics_listen"`
+
+	// 仅顶层有效, 管理接口的监听地址, "unix:/path" 或回环地址
+	AdminListen string `json:"admin_listen" yaml:"admin_listen" toml:"admin_listen"`
+
+	// 仅顶层有效, 所有 client 隧道共用的 payload 池最多同时取出的数量, 为 0 时不限制
+	// 取完时 block 最多等待 payload_pool_timeout, fail 立即丢弃数据报
+	PayloadPoolLimit     int      `json:"payload_pool_limit" yaml:"payload_pool_limit" toml:"payload_pool_limit"`
+	PayloadPoolExhausted string   `json:"payload_pool_exhausted" yaml:"payload_pool_exhausted" toml:"payload_pool_exhausted"`
+	PayloadPoolTimeout   Duration `json:"payload_pool_timeout" yaml:"payload_pool_timeout" toml:"payload_pool_timeout"`
+	PayloadPoolDebug     bool     `json:"payload_pool_debug" yaml:"payload_pool_debug" toml:"payload_pool_debug"`
+
+	// 同一进程内运行的多个隧道, 未填写的字段继承上面的顶层配置
+	Tunnels []*RawTunnel `json:"tunnels" yaml:"tunnels" toml:"tunnels"`
+
+	// 配置文件所在目录, 用于解析相对路径
+	baseDir string
+}
+
+func DefaultFileConfig() *FileConfig {
+	return &FileConfig{
+		Auth:                 AUTH_MODE_CERT,
+		Listen:               "0.0.0.0:10000",
+		Remote:               "127.0.0.1:10000",
+		PackageBufferSize:    1500,
+		PackageBufferCount:   1500,
+		UDPBatchSize:         DEFAULT_UDP_BATCH_SIZE,
+		UDPOffload:           true,
+		ListenSockets:        1,
+		MultiplexConnections: 1,
+		CRLReloadInterval:    Duration(DEFAULT_CRL_RELOAD_INTERVAL),
+		KeepaliveMisses:      3,
+		ReadTimeout:          Duration(DEFAULT_READ_TIMEOUT),
+		WriteTimeout:         Duration(DEFAULT_WRITE_TIMEOUT),
+		IdleTimeout:          Duration(DEFAULT_IDLE_TIMEOUT),
+		IdlePolicy:           IDLE_POLICY_EITHER,
+		GCInterval:           Duration(DEFAULT_GC_INTERVAL),
+		ServerStrategy:       SERVER_STRATEGY_PRIORITY,
+		ProbeInterval:        Duration(DEFAULT_PROBE_INTERVAL),
+		UpstreamPolicy:       UPSTREAM_POLICY_ROUND_ROBIN,
+		WarmMaxIdle:          Duration(DEFAULT_WARM_MAX_IDLE),
+		WriteOverflow:        OVERFLOW_POLICY_BLOCK,
+		WriteOverflowTimeout: Duration(DEFAULT_WRITE_OVERFLOW_TIMEOUT),
+		PayloadPoolExhausted: POOL_EXHAUSTED_BLOCK,
+		PayloadPoolTimeout:   Duration(DEFAULT_PAYLOAD_POOL_TIMEOUT),
+	}
+}
+
+// LoadFileConfig 读取配置文件, 未出现的字段保留 config 中原来的值
+func LoadFileConfig(path string, config *FileConfig) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to read config file: %s", err.Error())
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+
+	case ".toml":
+		err = decodeTOML(content, config)
+
+	default:
+		return MakeErrorWithErrMsg("Unsupported config file type %q (expected .json, .yaml, .yml or .toml)", filepath.Ext(path))
+	}
+
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to parse config file %s: %s", path, err.Error())
+	}
+
+	baseDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to resolve config file directory: %s", err.Error())
+	}
+	config.baseDir = baseDir
+	config.resolvePaths()
+
+	return nil
+}
+
+// decodeTOML 解析 TOML, 和 JSON, YAML 一样不允许未知的字段
+func decodeTOML(content []byte, config *FileConfig) error {
+	metaData, err := toml.NewDecoder(bytes.NewReader(content)).Decode(config)
+	if err != nil {
+		return err
+	}
+
+	// tunnels 中的字段在 TunnelConfigs 中解码时检查
+	for _, key := range metaData.Undecoded() {
+		if key[0] != "tunnels" {
+			return MakeErrorWithErrMsg("unknown field %q", key.String())
+		}
+	}
+
+	return nil
+}
+
+// resolvePaths 把文件中的相对路径转换为相对于配置文件所在目录的绝对路径
+func (fc *FileConfig) resolvePaths() {
+	if fc.baseDir == "" {
+		return
+	}
+
+	for _, filePath := range []*string{&fc.Key, &fc.Cert, &fc.RootCert, &fc.CRL, &fc.PSKFile} {
+		if *filePath != "" && !filepath.IsAbs(*filePath) {
+			*filePath = filepath.Join(fc.baseDir, *filePath)
+		}
+	}
+}
+
+// TunnelConfigs 展开 tunnels, 没有配置 tunnels 时返回顶层配置本身
+func (fc *FileConfig) TunnelConfigs() ([]*FileConfig, error) {
+	if len(fc.Tunnels) == 0 {
+		return []*FileConfig{fc}, nil
+	}
+
+	configs := make([]*FileConfig, 0, len(fc.Tunnels))
+	names := make(map[string]bool)
+
+	for index, rawTunnel := range fc.Tunnels {
+		config := *fc
+		config.Name = ""
+		config.Tunnels = nil
+
+		// 解码时会写入指针指向的值, 复制一份避免修改顶层配置
+		if fc.HealthCheck != nil {
+			healthCheck := *fc.HealthCheck
+			config.HealthCheck = &healthCheck
+		}
+		if fc.RateLimit != nil {
+			rateLimit := *fc.RateLimit
+			config.RateLimit = &rateLimit
+		}
+
+		// 列表解码时会复用原来的底层数组并和原来的元素合并, 先清空, 隧道没有配置时再继承一份顶层的
+		config.ACL = nil
+		config.AllowDestinations = nil
+
+		if err := rawTunnel.decode(&config); err != nil {
+			return nil, MakeErrorWithErrMsg("Failed to parse tunnels[%d]: %s", index, err.Error())
+		}
+
+		if config.ACL == nil {
+			config.ACL = fc.cloneACL()
+		}
+		if config.AllowDestinations == nil {
+			config.AllowDestinations = append([]DestinationRuleFileConfig(nil), fc.AllowDestinations...)
+		}
+		config.resolvePaths()
+
+		if config.Name == "" {
+			return nil, MakeErrorWithErrMsg("tunnels[%d]: name is required", index)
+		}
+
+		if names[config.Name] {
+			return nil, MakeErrorWithErrMsg("tunnels[%d]: duplicate name %q", index, config.Name)
+		}
+		names[config.Name] = true
+
+		configs = append(configs, &config)
+	}
+
+	return configs, nil
+}
+
+// cloneACL 复制 acl, 每个隧道的规则互不影响
+func (fc *FileConfig) cloneACL() []ACLRuleFileConfig {
+	if fc.ACL == nil {
+		return nil
+	}
+
+	rules := make([]ACLRuleFileConfig, len(fc.ACL))
+	for index, rule := range fc.ACL {
+		rule.Remote = append([]string(nil), rule.Remote...)
+		rule.AllowDestinations = append([]DestinationRuleFileConfig(nil), rule.AllowDestinations...)
+		rules[index] = rule
+	}
+	return rules
+}
+
+// healthCheck 返回 health_check, 没有配置时创建一个, 用于命令行参数覆盖其中的字段
+func (fc *FileConfig) healthCheck() *HealthCheckFileConfig {
+	if fc.HealthCheck == nil {
+		fc.HealthCheck = &HealthCheckFileConfig{}
+	}
+	return fc.HealthCheck
+}
+
+// rateLimit 返回 rate_limit, 没有配置时创建一个, 用于命令行参数覆盖其中的字段
+func (fc *FileConfig) rateLimit() *RateLimitFileConfig {
+	if fc.RateLimit == nil {
+		fc.RateLimit = &RateLimitFileConfig{}
+	}
+	return fc.RateLimit
+}
+
+// RemoteList 拆分逗号分隔的 remote, 忽略空白
+func (fc *FileConfig) RemoteList() []string {
+	remotes := make([]string, 0)
+	for _, remote := range strings.Split(fc.Remote, ",") {
+		if remote = strings.TrimSpace(remote); remote != "" {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes
+}
+
+func (fc *FileConfig) Validate() error {
+	if fc.Mode != "client" && fc.Mode != "server" {
+		return MakeErrorWithErrMsg("mode must be \"client\" or \"server\", got %q", fc.Mode)
+	}
+
+	if fc.Listen == "" {
+		return MakeErrorWithErrMsg("listen is required")
+	}
+
+	if len(fc.RemoteList()) == 0 {
+		return MakeErrorWithErrMsg("remote is required")
+	}
+
+	switch fc.ServerStrategy {
+	case SERVER_STRATEGY_PRIORITY, SERVER_STRATEGY_ROUND_ROBIN, SERVER_STRATEGY_LOWEST_RTT:
+	default:
+		return MakeErrorWithErrMsg("server_strategy must be \"priority\", \"round_robin\" or \"lowest_rtt\", got %q", fc.ServerStrategy)
+	}
+
+	if fc.ProbeInterval <= 0 {
+		return MakeErrorWithErrMsg("probe_interval must be positive")
+	}
+
+	switch fc.UpstreamPolicy {
+	case UPSTREAM_POLICY_ROUND_ROBIN, UPSTREAM_POLICY_HASH, UPSTREAM_POLICY_LEAST_FLOWS:
+	default:
+		return MakeErrorWithErrMsg("upstream_policy must be \"round_robin\", \"hash\" or \"least_flows\", got %q", fc.UpstreamPolicy)
+	}
+
+	if fc.HealthCheck != nil {
+		if fc.Mode != "server" {
+			return MakeErrorWithErrMsg("health_check is only supported in server mode")
+		}
+
+		if err := fc.HealthCheck.Validate(); err != nil {
+			return MakeErrorWithErrMsg("health_check: %s", err.Error())
+		}
+	}
+
+	switch fc.Auth {
+	case AUTH_MODE_CERT:
+		if fc.Key == "" || fc.Cert == "" || fc.RootCert == "" {
+			return MakeErrorWithErrMsg("key, cert and root_cert are required when auth is \"cert\"")
+		}
+
+		// 见 session_cache.go, 证书模式下服务端永远不会恢复会话
+		if fc.SessionTTL > 0 {
+			return MakeErrorWithErrMsg("session_ttl is only supported when auth is \"psk\", pion/dtls does not resume sessions of clients that present a certificate; use multiplex or warm_connections to save handshakes")
+		}
+
+	case AUTH_MODE_PSK:
+		if fc.CRL != "" {
+			return MakeErrorWithErrMsg("crl is only supported when auth is \"cert\"")
+		}
+
+		if fc.PSKFile == "" {
+			return MakeErrorWithErrMsg("psk_file is required when auth is \"psk\"")
+		}
+
+		if fc.Mode == "client" && fc.PSKIdentity == "" {
+			return MakeErrorWithErrMsg("psk_identity is required for client when auth is \"psk\"")
+		}
+
+	default:
+		return MakeErrorWithErrMsg("auth must be \"cert\" or \"psk\", got %q", fc.Auth)
+	}
+
+	if fc.PackageBufferSize <= 0 || fc.PackageBufferSize > 65535 {
+		return MakeErrorWithErrMsg("package_buffer_size must be between 1 and 65535, got %d", fc.PackageBufferSize)
+	}
+
+	if fc.UDPBatchSize < 1 || fc.UDPBatchSize > UDP_MAX_BATCH_SIZE {
+		return MakeErrorWithErrMsg("udp_batch_size must be between 1 and %d, got %d", UDP_MAX_BATCH_SIZE, fc.UDPBatchSize)
+	}
+
+	if fc.ListenSockets < 1 || fc.ListenSockets > MAX_LISTEN_SOCKETS {
+		return MakeErrorWithErrMsg("listen_sockets must be between 1 and %d, got %d", MAX_LISTEN_SOCKETS, fc.ListenSockets)
+	}
+
+	if fc.ListenSockets > 1 && fc.Mode != "client" {
+		return MakeErrorWithErrMsg("listen_sockets is only supported in client mode")
+	}
+
+	if fc.ListenSockets > 1 && !IS_REUSE_PORT_SUPPORTED {
+		return MakeErrorWithErrMsg("listen_sockets greater than 1 requires SO_REUSEPORT, which is only supported on linux")
+	}
+
+	if fc.PackageBufferCount <= 0 {
+		return MakeErrorWithErrMsg("package_buffer_count must be positive, got %d", fc.PackageBufferCount)
+	}
+
+	if fc.HandshakeTimeout < 0 {
+		return MakeErrorWithErrMsg("handshake_timeout must not be negative")
+	}
+
+	if fc.ReadTimeout <= 0 || fc.WriteTimeout <= 0 {
+		return MakeErrorWithErrMsg("read_timeout and write_timeout must be positive")
+	}
+
+	if fc.IdleTimeout <= 0 || fc.GCInterval <= 0 {
+		return MakeErrorWithErrMsg("idle_timeout and gc_interval must be positive")
+	}
+
+	if fc.IdlePolicy != IDLE_POLICY_EITHER && fc.IdlePolicy != IDLE_POLICY_BOTH {
+		return MakeErrorWithErrMsg("idle_policy must be \"either\" or \"both\", got %q", fc.IdlePolicy)
+	}
+
+	if fc.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(fc.MetricsListen); err != nil {
+			return MakeErrorWithErrMsg("metrics_listen must be \"host:port\", got %q", fc.MetricsListen)
+		}
+	}
+
+	if fc.AdminListen != "" {
+		if err := ValidateAdminAddress(fc.AdminListen); err != nil {
+			return MakeErrorWithErrMsg("admin_listen: %s", err.Error())
+		}
+	}
+
+	if fc.PayloadPoolLimit < 0 {
+		return MakeErrorWithErrMsg("payload_pool_limit must not be negative")
+	}
+
+	if fc.PayloadPoolExhausted != POOL_EXHAUSTED_BLOCK && fc.PayloadPoolExhausted != POOL_EXHAUSTED_FAIL {
+		return MakeErrorWithErrMsg("payload_pool_exhausted must be \"block\" or \"fail\", got %q", fc.PayloadPoolExhausted)
+	}
+
+	if fc.PayloadPoolTimeout <= 0 {
+		return MakeErrorWithErrMsg("payload_pool_timeout must be positive")
+	}
+
+	if fc.ReloadInterval < 0 {
+		return MakeErrorWithErrMsg("reload_interval must not be negative")
+	}
+
+	if fc.CRLReloadInterval < 0 {
+		return MakeErrorWithErrMsg("crl_reload_interval must not be negative")
+	}
+
+	if fc.Multiplex && fc.MultiplexConnections <= 0 {
+		return MakeErrorWithErrMsg("multiplex_connections must be positive, got %d", fc.MultiplexConnections)
+	}
+
+	if fc.KeepaliveInterval != 0 {
+		if fc.Mode != "client" {
+			return MakeErrorWithErrMsg("keepalive_interval is only supported in client mode, the server follows the client")
+		}
+
+		if fc.KeepaliveInterval < Duration(time.Second) || fc.KeepaliveInterval > Duration(time.Hour) {
+			return MakeErrorWithErrMsg("keepalive_interval must be between 1s and 1h")
+		}
+
+		if fc.KeepaliveMisses <= 0 || fc.KeepaliveMisses > 255 {
+			return MakeErrorWithErrMsg("keepalive_misses must be between 1 and 255, got %d", fc.KeepaliveMisses)
+		}
+	}
+
+	if fc.ReconnectTimeout < 0 {
+		return MakeErrorWithErrMsg("reconnect_timeout must not be negative")
+	}
+
+	if fc.ReconnectTimeout > 0 && fc.Mode != "client" {
+		return MakeErrorWithErrMsg("reconnect_timeout is only supported in client mode")
+	}
+
+	switch fc.WriteOverflow {
+	case OVERFLOW_POLICY_DROP_NEWEST, OVERFLOW_POLICY_DROP_OLDEST, OVERFLOW_POLICY_BLOCK:
+	default:
+		return MakeErrorWithErrMsg("write_overflow must be \"drop_newest\", \"drop_oldest\" or \"block\", got %q", fc.WriteOverflow)
+	}
+
+	if fc.WriteOverflowTimeout <= 0 {
+		return MakeErrorWithErrMsg("write_overflow_timeout must be positive")
+	}
+
+	if fc.WarmConnections < 0 {
+		return MakeErrorWithErrMsg("warm_connections must not be negative")
+	}
+
+	if fc.WarmConnections > 0 && fc.Mode != "client" {
+		return MakeErrorWithErrMsg("warm_connections is only supported in client mode")
+	}
+
+	if fc.WarmMaxIdle <= 0 {
+		return MakeErrorWithErrMsg("warm_max_idle must be positive")
+	}
+
+	if fc.SessionTTL < 0 {
+		return MakeErrorWithErrMsg("session_ttl must not be negative")
+	}
+
+	if fc.Destination != "" {
+		if fc.Mode != "client" {
+			return MakeErrorWithErrMsg("destination is only supported in client mode")
+		}
+
+		if _, _, err := net.SplitHostPort(fc.Destination); err != nil {
+			return MakeErrorWithErrMsg("destination must be \"host:port\", got %q", fc.Destination)
+		}
+
+		if len(fc.Destination) > fc.PackageBufferSize {
+			return MakeErrorWithErrMsg("destination is too long")
+		}
+	}
+
+	if len(fc.AllowDestinations) > 0 && fc.Mode != "server" {
+		return MakeErrorWithErrMsg("allow_destinations is only supported in server mode")
+	}
+
+	for index, ruleConfig := range fc.AllowDestinations {
+		if _, err := ParseDestinationRule(ruleConfig.CIDR, ruleConfig.Ports); err != nil {
+			return MakeErrorWithErrMsg("allow_destinations[%d]: %s", index, err.Error())
+		}
+	}
+
+	if fc.RateLimit != nil {
+		if err := fc.RateLimit.Validate(fc.Mode); err != nil {
+			return MakeErrorWithErrMsg("rate_limit: %s", err.Error())
+		}
+	}
+
+	if len(fc.ACL) > 0 && fc.Mode != "server" {
+		return MakeErrorWithErrMsg("acl is only supported in server mode")
+	}
+
+	for index, rule := range fc.ACL {
+		if err := rule.Validate(); err != nil {
+			return MakeErrorWithErrMsg("acl[%d]: %s", index, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (rc *ACLRuleFileConfig) Validate() error {
+	if rc.Action != ACL_ACTION_ALLOW && rc.Action != ACL_ACTION_DENY {
+		return MakeErrorWithErrMsg("action must be \"allow\" or \"deny\", got %q", rc.Action)
+	}
+
+	for _, pattern := range []string{rc.CommonName, rc.OrganizationalUnit, rc.SAN, rc.PSKIdentity} {
+		if err := ValidateACLPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	if rc.Action == ACL_ACTION_DENY && len(rc.Remote) > 0 {
+		return MakeErrorWithErrMsg("remote is not allowed in a deny rule")
+	}
+
+	if rc.Action == ACL_ACTION_DENY && len(rc.AllowDestinations) > 0 {
+		return MakeErrorWithErrMsg("allow_destinations is not allowed in a deny rule")
+	}
+
+	for index, ruleConfig := range rc.AllowDestinations {
+		if _, err := ParseDestinationRule(ruleConfig.CIDR, ruleConfig.Ports); err != nil {
+			return MakeErrorWithErrMsg("allow_destinations[%d]: %s", index, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ToACLRule 中的 allowlist 是顶层的 allow_destinations, 只给转发到顶层 remote 的规则使用
+// 有自己上游的规则不能借此访问其他身份的上游
+func (rc *ACLRuleFileConfig) ToACLRule(policy string, allowlist *DestinationAllowlist) (*ACLRule, error) {
+	rule := &ACLRule{
+		Name:               rc.Name,
+		CommonName:         rc.CommonName,
+		OrganizationalUnit: rc.OrganizationalUnit,
+		SAN:                rc.SAN,
+		PSKIdentity:        rc.PSKIdentity,
+		Allow:              rc.Action == ACL_ACTION_ALLOW,
+	}
+
+	if len(rc.AllowDestinations) > 0 {
+		ruleAllowlist, err := ToDestinationAllowlist(rc.AllowDestinations)
+		if err != nil {
+			return nil, err
+		}
+		rule.DestinationAllowlist = ruleAllowlist
+	} else if len(rc.Remote) == 0 {
+		rule.DestinationAllowlist = allowlist
+	}
+
+	if len(rc.Remote) == 0 {
+		return rule, nil
+	}
+
+	addresses := make([]*net.UDPAddr, 0, len(rc.Remote))
+	for _, remote := range rc.Remote {
+		address, err := net.ResolveUDPAddr("udp", remote)
+		if err != nil {
+			return nil, MakeErrorWithErrMsg("Failed to parse remote address: %s", err.Error())
+		}
+		addresses = append(addresses, address)
+	}
+	rule.Upstreams = NewUpstreams(policy, addresses...)
+
+	return rule, nil
+}
+
+// ToDestinationAllowlist 没有配置时返回 nil, 不允许客户端指定目标地址
+func ToDestinationAllowlist(ruleConfigs []DestinationRuleFileConfig) (*DestinationAllowlist, error) {
+	if len(ruleConfigs) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]*DestinationRule, 0, len(ruleConfigs))
+	for _, ruleConfig := range ruleConfigs {
+		rule, err := ParseDestinationRule(ruleConfig.CIDR, ruleConfig.Ports)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return NewDestinationAllowlist(rules), nil
+}
+
+// ToCommonConfig 解析地址并加载证书
+func (fc *FileConfig) ToCommonConfig() (*CommonConfig, error) {
+	if err := fc.Validate(); err != nil {
+		if fc.Name != "" {
+			return nil, MakeErrorWithErrMsg("Invalid config of tunnel %q: %s", fc.Name, err.Error())
+		}
+		return nil, MakeErrorWithErrMsg("Invalid config: %s", err.Error())
+	}
+
+	config := &CommonConfig{
+		Name:                 fc.Name,
+		AuthMode:             fc.Auth,
+		RunMethod:            fc.Mode,
+		PackageBufferSize:    fc.PackageBufferSize,
+		PackageBufferCount:   fc.PackageBufferCount,
+		UDPBatchSize:         fc.UDPBatchSize,
+		UDPOffload:           fc.UDPOffload,
+		ListenSockets:        fc.ListenSockets,
+		HandshakeTimeout:     fc.HandshakeTimeout.Duration(),
+		ReadTimeout:          fc.ReadTimeout.Duration(),
+		WriteTimeout:         fc.WriteTimeout.Duration(),
+		IdleTimeout:          fc.IdleTimeout.Duration(),
+		IdlePolicy:           fc.IdlePolicy,
+		GCInterval:           fc.GCInterval.Duration(),
+		ReloadInterval:       fc.ReloadInterval.Duration(),
+		Multiplex:            fc.Multiplex,
+		MultiplexConnections: fc.MultiplexConnections,
+		KeepaliveInterval:    fc.KeepaliveInterval.Duration(),
+		KeepaliveMisses:      fc.KeepaliveMisses,
+		ReconnectTimeout:     fc.ReconnectTimeout.Duration(),
+		SessionTTL:           fc.SessionTTL.Duration(),
+		WriteOverflowPolicy:  fc.WriteOverflow,
+		WriteOverflowTimeout: fc.WriteOverflowTimeout.Duration(),
+		WarmConnections:      fc.WarmConnections,
+		WarmMaxIdle:          fc.WarmMaxIdle.Duration(),
+		ServerStrategy:       fc.ServerStrategy,
+		ProbeInterval:        fc.ProbeInterval.Duration(),
+		UpstreamPolicy:       fc.UpstreamPolicy,
+	}
+
+	if fc.HealthCheck != nil {
+		config.HealthCheck = fc.HealthCheck.ToHealthCheck()
+	}
+
+	if fc.RateLimit != nil {
+		config.RateLimit = fc.RateLimit.ToRateLimit()
+	}
+
+	address, err := net.ResolveUDPAddr("udp", fc.Listen)
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to parse listen address: %s", err.Error())
+	}
+	config.ListenAddress = address
+
+	for _, remote := range fc.RemoteList() {
+		address, err = net.ResolveUDPAddr("udp", remote)
+		if err != nil {
+			return nil, MakeErrorWithErrMsg("Failed to parse remote address: %s", err.Error())
+		}
+		config.RemoteAddresses = append(config.RemoteAddresses, address)
+	}
+	config.RemoteAddress = config.RemoteAddresses[0]
+
+	config.Destination = fc.Destination
+
+	config.DestinationAllowlist, err = ToDestinationAllowlist(fc.AllowDestinations)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fc.ACL) > 0 {
+		rules := make([]*ACLRule, 0, len(fc.ACL))
+		for index, ruleConfig := range fc.ACL {
+			rule, err := ruleConfig.ToACLRule(fc.UpstreamPolicy, config.DestinationAllowlist)
+			if err != nil {
+				return nil, MakeErrorWithErrMsg("acl[%d]: %s", index, err.Error())
+			}
+			rules = append(rules, rule)
+		}
+		config.ACL = NewACL(rules)
+	}
+
+	if fc.Auth == AUTH_MODE_PSK {
+		if err := fc.loadPSK(config); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+
+	if err := fc.loadCertificates(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (fc *FileConfig) loadPSK(config *CommonConfig) error {
+	keys, err := LoadPSKKeyFile(fc.PSKFile)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to load psk file: %s", err.Error())
+	}
+
+	if fc.Mode == "client" {
+		if _, isExist := keys.Get(fc.PSKIdentity); !isExist {
+			return MakeErrorWithErrMsg("Failed to load psk file: no key for identity %q in %s", fc.PSKIdentity, fc.PSKFile)
+		}
+	}
+
+	config.PSKKeys = keys
+	config.PSKIdentity = fc.PSKIdentity
+	config.PSKIdentityHint = fc.PSKHint
+
+	return nil
+}
+
+func (fc *FileConfig) loadCertificates(config *CommonConfig) error {
+	store, err := LoadCertificateStore(fc.Key, fc.Cert, fc.RootCert)
+	if err != nil {
+		return err
+	}
+	config.Certificates = store
+
+	if fc.CRL != "" {
+		crl, err := LoadCRLStore(fc.CRL)
+		if err != nil {
+			return err
+		}
+		config.CRL = crl
+		config.CRLReloadInterval = fc.CRLReloadInterval.Duration()
+	}
+
+	return nil
+}
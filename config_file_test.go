@@ -0,0 +1,484 @@
+package dtls_tunnel
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func loadTestFileConfig(t *testing.T, name string, content string) *FileConfig {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultFileConfig()
+	if err := LoadFileConfig(path, config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestTunnelConfigsACL(t *testing.T) {
+	topRule := ACLRuleFileConfig{Name: "top", CommonName: "teamA", Action: ACL_ACTION_ALLOW, Remote: []string{"127.0.0.1:1"}}
+	tunnelRule := ACLRuleFileConfig{Name: "a", PSKIdentity: "x", Action: ACL_ACTION_ALLOW}
+
+	files := map[string]string{
+		"config.yaml": `
+mode: server
+acl:
+  - name: top
+    cn: teamA
+    action: allow
+    remote: [127.0.0.1:1]
+tunnels:
+  - name: a
+    acl:
+      - name: a
+        psk_identity: x
+        action: allow
+  - name: b
+  - name: c
+    acl: []
+`,
+		"config.json": `{
+  "mode": "server",
+  "acl": [{"name": "top", "cn": "teamA", "action": "allow", "remote": ["127.0.0.1:1"]}],
+  "tunnels": [
+    {"name": "a", "acl": [{"name": "a", "psk_identity": "x", "action": "allow"}]},
+    {"name": "b"},
+    {"name": "c", "acl": []}
+  ]
+}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			config := loadTestFileConfig(t, name, content)
+
+			tunnels, err := config.TunnelConfigs()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string][]ACLRuleFileConfig{
+				"a": {tunnelRule},
+				"b": {topRule},
+				"c": {},
+			}
+
+			if len(tunnels) != len(expected) {
+				t.Fatalf("got %d tunnels, want %d", len(tunnels), len(expected))
+			}
+
+			for _, tunnel := range tunnels {
+				if !reflect.DeepEqual(tunnel.ACL, expected[tunnel.Name]) {
+					t.Errorf("tunnel %s: acl = %+v, want %+v", tunnel.Name, tunnel.ACL, expected[tunnel.Name])
+				}
+			}
+
+			if !reflect.DeepEqual(config.ACL, []ACLRuleFileConfig{topRule}) {
+				t.Errorf("top level acl changed to %+v", config.ACL)
+			}
+
+			// 隧道之间不共用底层数组
+			tunnels[1].ACL[0].Remote[0] = "127.0.0.1:2"
+			if config.ACL[0].Remote[0] != "127.0.0.1:1" {
+				t.Errorf("tunnel b shares remote with the top level acl")
+			}
+		})
+	}
+}
+
+func TestTunnelConfigsAllowDestinations(t *testing.T) {
+	config := loadTestFileConfig(t, "config.yaml", `
+mode: server
+allow_destinations:
+  - cidr: 10.0.0.0/8
+    ports: "53"
+tunnels:
+  - name: a
+    allow_destinations:
+      - cidr: 192.168.0.0/16
+  - name: b
+`)
+
+	tunnels, err := config.TunnelConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top := []DestinationRuleFileConfig{{CIDR: "10.0.0.0/8", Ports: "53"}}
+
+	if expected := []DestinationRuleFileConfig{{CIDR: "192.168.0.0/16"}}; !reflect.DeepEqual(tunnels[0].AllowDestinations, expected) {
+		t.Errorf("tunnel a: allow_destinations = %+v, want %+v", tunnels[0].AllowDestinations, expected)
+	}
+
+	if !reflect.DeepEqual(tunnels[1].AllowDestinations, top) {
+		t.Errorf("tunnel b: allow_destinations = %+v, want %+v", tunnels[1].AllowDestinations, top)
+	}
+
+	if !reflect.DeepEqual(config.AllowDestinations, top) {
+		t.Errorf("top level allow_destinations changed to %+v", config.AllowDestinations)
+	}
+}
+
+func TestACLRuleDestinationAllowlist(t *testing.T) {
+	global, err := ToDestinationAllowlist([]DestinationRuleFileConfig{{CIDR: "10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	globalAddress := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53}
+	ruleAddress := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 53}
+
+	cases := []struct {
+		name        string
+		rule        ACLRuleFileConfig
+		allowGlobal bool
+		allowRule   bool
+	}{
+		{"default remote", ACLRuleFileConfig{Action: ACL_ACTION_ALLOW}, true, false},
+		{"own remote", ACLRuleFileConfig{Action: ACL_ACTION_ALLOW, Remote: []string{"127.0.0.1:1"}}, false, false},
+		{"own allowlist", ACLRuleFileConfig{Action: ACL_ACTION_ALLOW, AllowDestinations: []DestinationRuleFileConfig{{CIDR: "192.168.0.0/16"}}}, false, true},
+		{"own remote and allowlist", ACLRuleFileConfig{Action: ACL_ACTION_ALLOW, Remote: []string{"127.0.0.1:1"}, AllowDestinations: []DestinationRuleFileConfig{{CIDR: "192.168.0.0/16"}}}, false, true},
+	}
+
+	for _, c := range cases {
+		rule, err := c.rule.ToACLRule(UPSTREAM_POLICY_ROUND_ROBIN, global)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err.Error())
+		}
+
+		if isAllowed := rule.DestinationAllowlist.Allow(globalAddress); isAllowed != c.allowGlobal {
+			t.Errorf("%s: allow %s = %v, want %v", c.name, globalAddress, isAllowed, c.allowGlobal)
+		}
+
+		if isAllowed := rule.DestinationAllowlist.Allow(ruleAddress); isAllowed != c.allowRule {
+			t.Errorf("%s: allow %s = %v, want %v", c.name, ruleAddress, isAllowed, c.allowRule)
+		}
+	}
+}
+
+func TestFileConfigValidateSessionTTL(t *testing.T) {
+	cases := []struct {
+		name    string
+		auth    string
+		ttl     time.Duration
+		isValid bool
+	}{
+		{"cert without resumption", AUTH_MODE_CERT, 0, true},
+		{"cert with resumption", AUTH_MODE_CERT, time.Hour, false},
+		{"psk with resumption", AUTH_MODE_PSK, time.Hour, true},
+		{"negative", AUTH_MODE_PSK, -time.Second, false},
+	}
+
+	for _, c := range cases {
+		config := DefaultFileConfig()
+		config.Mode = "server"
+		config.Auth = c.auth
+		config.Key, config.Cert, config.RootCert = "server.key", "server.crt", "ca.crt"
+		config.PSKFile = "psk.txt"
+		config.SessionTTL = Duration(c.ttl)
+
+		if err := config.Validate(); (err == nil) != c.isValid {
+			t.Errorf("%s: Validate() = %v, want valid %v", c.name, err, c.isValid)
+		}
+	}
+}
+
+func TestLoadFileConfig(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+mode: client
+listen: 127.0.0.1:5353
+key: cert/client.key
+root_cert: /etc/dtls/ca.crt
+read_timeout: 1m30s
+`,
+		"config.json": `{
+  "mode": "client",
+  "listen": "127.0.0.1:5353",
+  "key": "cert/client.key",
+  "root_cert": "/etc/dtls/ca.crt",
+  "read_timeout": "1m30s"
+}`,
+		"config.toml": `
+mode = "client"
+listen = "127.0.0.1:5353"
+key = "cert/client.key"
+root_cert = "/etc/dtls/ca.crt"
+read_timeout = "1m30s"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			config := loadTestFileConfig(t, name, content)
+
+			if config.Mode != "client" || config.Listen != "127.0.0.1:5353" {
+				t.Errorf("mode %q listen %q not loaded", config.Mode, config.Listen)
+			}
+
+			if config.ReadTimeout.Duration() != time.Second*90 {
+				t.Errorf("read_timeout = %s, want 1m30s", config.ReadTimeout.Duration())
+			}
+
+			// 未出现的字段保留默认值
+			if config.Remote != DefaultFileConfig().Remote || config.WriteTimeout.Duration() != DEFAULT_WRITE_TIMEOUT {
+				t.Errorf("remote %q write_timeout %s, want the defaults", config.Remote, config.WriteTimeout.Duration())
+			}
+
+			// 相对路径相对于配置文件所在目录, 绝对路径不变
+			if !filepath.IsAbs(config.Key) || filepath.Join(config.baseDir, "cert/client.key") != config.Key {
+				t.Errorf("key = %q, want it relative to %q", config.Key, config.baseDir)
+			}
+			if config.RootCert != "/etc/dtls/ca.crt" {
+				t.Errorf("root_cert = %q, want it unchanged", config.RootCert)
+			}
+		})
+	}
+}
+
+func TestLoadFileConfigErrors(t *testing.T) {
+	cases := map[string]string{
+		"config.yaml": "mode: client\nlisten_address: 0.0.0.0:1\n",
+		"config.json": `{"mode": "client", "unknown": 1}`,
+		"config.yml":  "read_timeout: 10\n",
+		"config.toml": "mode = \"client\"\nread_timeout = 10\n",
+		"config.ini":  "mode = client\n",
+	}
+
+	for name, content := range cases {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := LoadFileConfig(path, DefaultFileConfig()); err == nil {
+			t.Errorf("%s: LoadFileConfig(%q) succeeded, want error", name, content)
+		}
+	}
+}
+
+// validTestFileConfig 返回能通过 Validate 的服务端配置, 各个测试在此基础上修改
+func validTestFileConfig() *FileConfig {
+	config := DefaultFileConfig()
+	config.Mode = "server"
+	config.Key, config.Cert, config.RootCert = "server.key", "server.crt", "ca.crt"
+	return config
+}
+
+func TestFileConfigValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(config *FileConfig)
+	}{
+		{"mode", func(config *FileConfig) { config.Mode = "proxy" }},
+		{"listen", func(config *FileConfig) { config.Listen = "" }},
+		{"remote", func(config *FileConfig) { config.Remote = " , " }},
+		{"auth", func(config *FileConfig) { config.Auth = "token" }},
+		{"cert files", func(config *FileConfig) { config.RootCert = "" }},
+		{"psk file", func(config *FileConfig) { config.Auth = AUTH_MODE_PSK }},
+		{"package_buffer_size", func(config *FileConfig) { config.PackageBufferSize = 65536 }},
+		{"read_timeout", func(config *FileConfig) { config.ReadTimeout = 0 }},
+		{"idle_policy", func(config *FileConfig) { config.IdlePolicy = "never" }},
+	}
+
+	if err := validTestFileConfig().Validate(); err != nil {
+		t.Fatalf("base config is invalid: %s", err.Error())
+	}
+
+	for _, c := range cases {
+		config := validTestFileConfig()
+		c.modify(config)
+
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: Validate() succeeded, want error", c.name)
+		}
+	}
+}
+
+func TestTunnelConfigsInherit(t *testing.T) {
+	config := loadTestFileConfig(t, "config.yaml", `
+mode: server
+remote: 10.0.0.1:53
+idle_timeout: 5m
+key: server.key
+health_check:
+  interval: 5s
+  payload: "00"
+tunnels:
+  - name: dns
+    listen: 0.0.0.0:10053
+  - name: wireguard
+    listen: 0.0.0.0:10820
+    remote: 10.0.0.1:51820
+    key: wireguard.key
+    health_check:
+      interval: 10s
+`)
+
+	tunnels, err := config.TunnelConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tunnels) != 2 {
+		t.Fatalf("got %d tunnels, want 2", len(tunnels))
+	}
+	dns, wireguard := tunnels[0], tunnels[1]
+
+	if dns.Listen != "0.0.0.0:10053" || dns.Remote != "10.0.0.1:53" || dns.IdleTimeout.Duration() != time.Minute*5 {
+		t.Errorf("dns: listen %q remote %q idle_timeout %s", dns.Listen, dns.Remote, dns.IdleTimeout.Duration())
+	}
+
+	if wireguard.Remote != "10.0.0.1:51820" || wireguard.IdleTimeout.Duration() != time.Minute*5 {
+		t.Errorf("wireguard: remote %q idle_timeout %s", wireguard.Remote, wireguard.IdleTimeout.Duration())
+	}
+
+	// 隧道中的相对路径同样相对于配置文件所在目录
+	if dns.Key != filepath.Join(config.baseDir, "server.key") || wireguard.Key != filepath.Join(config.baseDir, "wireguard.key") {
+		t.Errorf("key paths %q and %q are not resolved", dns.Key, wireguard.Key)
+	}
+
+	// 隧道只覆盖 health_check 中填写的字段, 也不影响顶层和其他隧道
+	if wireguard.HealthCheck.Interval.Duration() != time.Second*10 || wireguard.HealthCheck.Payload != "00" {
+		t.Errorf("wireguard: health_check %+v", wireguard.HealthCheck)
+	}
+	if dns.HealthCheck.Interval.Duration() != time.Second*5 || config.HealthCheck.Interval.Duration() != time.Second*5 {
+		t.Errorf("health_check of the top level or dns changed to %s, %s", config.HealthCheck.Interval.Duration(), dns.HealthCheck.Interval.Duration())
+	}
+
+	if dns.Tunnels != nil || dns.Name != "dns" {
+		t.Errorf("dns: name %q, tunnels %v", dns.Name, dns.Tunnels)
+	}
+}
+
+func TestTunnelConfigsTOML(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.yaml": `
+mode: server
+remote: 10.0.0.1:53
+idle_timeout: 5m
+key: server.key
+acl:
+  - name: team-a
+    ou: team-a
+    action: allow
+health_check:
+  interval: 5s
+  payload: "00"
+tunnels:
+  - name: dns
+    listen: 0.0.0.0:10053
+  - name: wireguard
+    listen: 0.0.0.0:10820
+    remote: 10.0.0.1:51820
+    key: wireguard.key
+    allow_destinations:
+      - cidr: 10.0.0.0/8
+        ports: "53"
+    health_check:
+      interval: 10s
+`,
+		"config.toml": `
+mode = "server"
+remote = "10.0.0.1:53"
+idle_timeout = "5m"
+key = "server.key"
+
+[[acl]]
+name = "team-a"
+ou = "team-a"
+action = "allow"
+
+[health_check]
+interval = "5s"
+payload = "00"
+
+[[tunnels]]
+name = "dns"
+listen = "0.0.0.0:10053"
+
+[[tunnels]]
+name = "wireguard"
+listen = "0.0.0.0:10820"
+remote = "10.0.0.1:51820"
+key = "wireguard.key"
+allow_destinations = [{ cidr = "10.0.0.0/8", ports = "53" }]
+health_check = { interval = "10s" }
+`,
+	}
+
+	tunnels := make(map[string][]*FileConfig)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		config := DefaultFileConfig()
+		if err := LoadFileConfig(path, config); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+
+		var err error
+		if tunnels[name], err = config.TunnelConfigs(); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+	}
+
+	// 同一个目录下的 YAML 和 TOML 解析出相同的隧道
+	if !reflect.DeepEqual(tunnels["config.yaml"], tunnels["config.toml"]) {
+		t.Errorf("TOML tunnels differ from YAML:\n%+v\n%+v", tunnels["config.toml"][1], tunnels["config.yaml"][1])
+	}
+
+	// 隧道中的未知字段同样报错
+	path := filepath.Join(dir, "unknown.toml")
+	if err := os.WriteFile(path, []byte("[[tunnels]]\nname = \"dns\"\nlisten_address = \"0.0.0.0:1\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultFileConfig()
+	if err := LoadFileConfig(path, config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.TunnelConfigs(); err == nil {
+		t.Error("TunnelConfigs() succeeded with an unknown field in a TOML tunnel")
+	}
+}
+
+func TestTunnelConfigsWithoutTunnels(t *testing.T) {
+	config := loadTestFileConfig(t, "config.yaml", "mode: client\n")
+
+	tunnels, err := config.TunnelConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tunnels) != 1 || tunnels[0] != config {
+		t.Errorf("TunnelConfigs() = %v, want the top level config itself", tunnels)
+	}
+}
+
+func TestTunnelConfigsErrors(t *testing.T) {
+	cases := map[string]string{
+		"missing name":   "tunnels:\n  - listen: 0.0.0.0:1\n",
+		"duplicate name": "tunnels:\n  - name: a\n  - name: a\n",
+		"unknown field":  "tunnels:\n  - name: a\n    listen_address: 0.0.0.0:1\n",
+	}
+
+	for name, content := range cases {
+		config := loadTestFileConfig(t, "config.yaml", content)
+
+		if _, err := config.TunnelConfigs(); err == nil {
+			t.Errorf("%s: TunnelConfigs() succeeded, want error", name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package dtls_tunnel
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/*
+ * CRLStore 保存吊销列表, 可以是单个文件或者一个目录下的所有文件
+ * 每个文件可以是 PEM (可包含多个 X509 CRL) 或者 DER 格式
+ * 只有能用证书链中签发者验证签名的 CRL 才会被使用
+ */
+
+// CRL 由 CA 定期重新签发, 不依赖 reload_interval, 默认每分钟检查一次文件是否变化
+const DEFAULT_CRL_RELOAD_INTERVAL = time.Minute
+
+type revocationList struct {
+	list    *x509.RevocationList
+	serials map[string]bool
+}
+
+type CRLStore struct {
+	path  string
+	lists []*revocationList
+
+	// 上次加载时文件的修改时间, 目录本身也在其中, 用于发现新增和删除的文件
+	modTimes map[string]time.Time
+
+	lock *sync.RWMutex
+}
+
+func LoadCRLStore(path string) (*CRLStore, error) {
+	store := &CRLStore{
+		path: path,
+		lock: &sync.RWMutex{},
+	}
+
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Reload 重新加载全部 CRL, 任何一个文件加载失败时保留原来的列表
+func (s *CRLStore) Reload() error {
+	files, err := s.files()
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to load crl: %s", err.Error())
+	}
+
+	modTimes := FileModTimes(append(files, s.path)...)
+
+	var lists []*revocationList
+	for _, file := range files {
+		fileLists, err := loadRevocationLists(file)
+		if err != nil {
+			return MakeErrorWithErrMsg("Failed to load crl %s: %s", file, err.Error())
+		}
+		lists = append(lists, fileLists...)
+	}
+
+	for _, list := range lists {
+		if !list.list.NextUpdate.IsZero() && time.Now().After(list.list.NextUpdate) {
+			logger.Warn(FormatString("CRL issued by %s is outdated since %s", list.list.Issuer.String(), list.list.NextUpdate.String()))
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lists = lists
+	s.modTimes = modTimes
+
+	return nil
+}
+
+func (s *CRLStore) files() ([]string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{s.path}, nil
+	}
+
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		files = append(files, filepath.Join(s.path, entry.Name()))
+	}
+
+	return files, nil
+}
+
+func loadRevocationLists(path string) ([]*revocationList, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ders [][]byte
+	for rest := content; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+
+	// 不是 PEM 时按 DER 处理
+	if len(ders) == 0 {
+		ders = append(ders, content)
+	}
+
+	lists := make([]*revocationList, 0, len(ders))
+	for _, der := range ders {
+		list, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, err
+		}
+
+		serials := make(map[string]bool, len(list.RevokedCertificates))
+		for _, revoked := range list.RevokedCertificates {
+			serials[revoked.SerialNumber.String()] = true
+		}
+
+		lists = append(lists, &revocationList{list: list, serials: serials})
+	}
+
+	return lists, nil
+}
+
+func (s *CRLStore) IsChanged() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return IsFilesChanged(s.modTimes)
+}
+
+func (s *CRLStore) String() string {
+	return s.path
+}
+
+// IsRevoked 判断 cert 是否被 issuer 签发的 CRL 吊销
+func (s *CRLStore) IsRevoked(cert *x509.Certificate, issuer *x509.Certificate) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, list := range s.lists {
+		if !list.serials[cert.SerialNumber.String()] {
+			continue
+		}
+
+		if list.list.CheckSignatureFrom(issuer) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckChains 检查已验证的证书链, 链中除根证书外任何一个证书被吊销都返回错误
+// 为 nil 时不做检查
+func (s *CRLStore) CheckChains(chains [][]*x509.Certificate) error {
+	if s == nil {
+		return nil
+	}
+
+	for _, chain := range chains {
+		for index := 0; index+1 < len(chain); index++ {
+			if s.IsRevoked(chain[index], chain[index+1]) {
+				return MakeErrorWithErrMsg("certificate %s (serial %s) is revoked", chain[index].Subject.String(), chain[index].SerialNumber.String())
+			}
+		}
+	}
+
+	return nil
+}
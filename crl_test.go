@@ -0,0 +1,140 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"encoding/pem"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestPKI(t *testing.T) (*PKI, string) {
+	t.Helper()
+
+	pki := NewPKI(t.TempDir())
+	if err := pki.InitCA("test ca", time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, certPath, err := pki.Issue(&CertificateRequest{
+		Name:       "client",
+		Usage:      PKI_USAGE_CLIENT,
+		CommonName: "client",
+		Validity:   time.Hour,
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pki, certPath
+}
+
+func verifyTestCertificate(t *testing.T, pki *PKI, certPath string) error {
+	t.Helper()
+
+	roots, err := LoadCertPool(pki.path(PKI_CA_CERT_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(content)
+
+	chains, err := VerifyClientCertificate([][]byte{block.Bytes}, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := LoadCRLStore(pki.path(PKI_CRL_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl.CheckChains(chains)
+}
+
+func TestCRLStoreCheckChains(t *testing.T) {
+	pki, certPath := newTestPKI(t)
+
+	if err := verifyTestCertificate(t, pki, certPath); err != nil {
+		t.Fatalf("certificate is revoked before Revoke: %s", err.Error())
+	}
+
+	if err := pki.Revoke(certPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyTestCertificate(t, pki, certPath); err == nil {
+		t.Fatal("certificate is not revoked after Revoke")
+	}
+}
+
+func TestCRLStoreWatch(t *testing.T) {
+	pki, certPath := newTestPKI(t)
+
+	crl, err := LoadCRLStore(pki.path(PKI_CRL_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pki.Revoke(certPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件系统的时间精度可能不够, 直接把修改时间往后调
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(pki.path(PKI_CRL_FILE), future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if !crl.IsChanged() {
+		t.Fatal("IsChanged() = false after the crl file is rewritten")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reloaded := make(chan struct{}, 1)
+	go WatchReloaders(ctx, []Reloader{crl}, time.Millisecond*10, func() {
+		reloaded <- struct{}{}
+	})
+	defer cancel()
+
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("crl is not reloaded")
+	}
+
+	if crl.IsChanged() {
+		t.Error("IsChanged() = true after reload")
+	}
+
+	if len(crl.lists) != 1 || len(crl.lists[0].serials) != 1 {
+		t.Errorf("reloaded crl has %d lists, want 1 with 1 revoked certificate", len(crl.lists))
+	}
+}
+
+func TestIntervalReloaders(t *testing.T) {
+	pki, _ := newTestPKI(t)
+
+	crl, err := LoadCRLStore(pki.path(PKI_CRL_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &CommonConfig{AuthMode: AUTH_MODE_CERT, Certificates: &CertificateStore{}, CRL: crl}
+
+	if reloaders := config.IntervalReloaders(); len(reloaders) != 2 {
+		t.Errorf("without crl_reload_interval: %d reloaders, want certificates and crl", len(reloaders))
+	}
+
+	config.CRLReloadInterval = DEFAULT_CRL_RELOAD_INTERVAL
+	if reloaders := config.IntervalReloaders(); len(reloaders) != 1 || reloaders[0] != Reloader(config.Certificates) {
+		t.Errorf("with crl_reload_interval: %v, want only certificates", reloaders)
+	}
+
+	if reloaders := config.Reloaders(); len(reloaders) != 2 {
+		t.Errorf("SIGHUP reloads %d reloaders, want certificates and crl", len(reloaders))
+	}
+}
@@ -0,0 +1,277 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+/*
+ * 测量数据路径上每个数据报的内存分配: go test -run '^$' -bench . -benchmem
+ * 每个阶段都通过回环地址收发真实的数据报, 一次操作是一个数据报, 按 UDP 批量大小成批收发
+ *
+ * ListenerRead:  源地址 -> Client 的监听 socket -> 查找映射 -> 映射的 writeQueue
+ * ListenerWrite: 映射 -> 监听 socket 的 readQueue -> 批量发送给源地址
+ * UpstreamRead:  Server 的映射批量读取上游返回的数据报
+ * DTLS:          pion/dtls 加密发送并解密读取一个数据报, 作为对比, 这部分的分配不在隧道的代码中
+ */
+
+const BENCH_TIMEOUT = time.Second
+const BENCH_BATCH_SIZE = DEFAULT_UDP_BATCH_SIZE
+const BENCH_DATAGRAM_SIZE = 1200
+
+// newBenchClient 创建只有一个监听 socket 的 Client, 不运行读写协程, 也不连接服务端
+func newBenchClient(b *testing.B) (*Client, *ClientListener) {
+	config := &ClientConfig{}
+	config.Name = "bench"
+	config.PackageBufferSize = BENCH_DATAGRAM_SIZE
+	config.PackageBufferCount = BENCH_BATCH_SIZE
+	config.UDPBatchSize = BENCH_BATCH_SIZE
+	config.UDPOffload = true
+	config.ListenSockets = 1
+	config.ReadTimeout = BENCH_TIMEOUT
+	config.WriteTimeout = BENCH_TIMEOUT
+	config.WriteOverflowPolicy = OVERFLOW_POLICY_DROP_NEWEST
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		config:      config,
+		mappers:     NewMappers(),
+		payloadPool: NewPayloadPool(PayloadCapacity(BENCH_DATAGRAM_SIZE)),
+		cancelFunc:  cancel,
+		ctx:         ctx,
+		wg:          &sync.WaitGroup{},
+		mappersWg:   &sync.WaitGroup{},
+		metrics:     NewTunnelMetrics(config.Name, METRICS_ROLE_CLIENT),
+	}
+
+	listeners, err := openClientListeners(client, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client.listeners = listeners
+
+	return client, listeners[0]
+}
+
+// benchAddrPort 返回 conn 的本地地址, 和 BatchConn 读到的来源地址的形式相同
+func benchAddrPort(conn *net.UDPConn) netip.AddrPort {
+	addrPort := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
+
+func benchDatagrams(addr netip.AddrPort) []Datagram {
+	datagrams := make([]Datagram, BENCH_BATCH_SIZE)
+	for index := range datagrams {
+		datagrams[index] = Datagram{Data: make([]byte, BENCH_DATAGRAM_SIZE), Addr: addr}
+	}
+	return datagrams
+}
+
+// benchBatchCount 返回这一批要处理的数据报数量, 最后一批可能不满
+func benchBatchCount(remaining int) int {
+	if remaining < BENCH_BATCH_SIZE {
+		return remaining
+	}
+	return BENCH_BATCH_SIZE
+}
+
+// benchReadCount 读取 count 个数据报, 回环地址上不应该丢包, 超时说明转发有问题
+func benchReadCount(b *testing.B, conn *net.UDPConn, count int, read func() (int, error)) {
+	for received := 0; received < count; {
+		if err := conn.SetReadDeadline(time.Now().Add(BENCH_TIMEOUT)); err != nil {
+			b.Fatal(err)
+		}
+		n, err := read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		received += n
+	}
+}
+
+func BenchmarkListenerRead(b *testing.B) {
+	client, listener := newBenchClient(b)
+	defer client.closeListener()
+	defer listener.releasePayloads()
+
+	sender, err := net.DialUDP("udp", nil, listener.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sender.Close()
+
+	// 映射已经存在, 只测量转发, 映射不运行, 数据报停在 writeQueue 中
+	mapper := NewClientMapper(client, listener, benchAddrPort(sender), client.ctx)
+	client.mappers.Set(mapper.srcAddress, mapper)
+
+	senderBatch := NewBatchConn(sender, BENCH_BATCH_SIZE, BENCH_DATAGRAM_SIZE, false, true)
+	datagrams := benchDatagrams(netip.AddrPort{})
+	read := listener.readBatch
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for done := 0; done < b.N; {
+		count := benchBatchCount(b.N - done)
+		senderBatch.WriteBatch(datagrams[:count])
+		benchReadCount(b, listener.conn, count, read)
+
+		for len(mapper.writeQueue) > 0 {
+			RecoveryPayload(<-mapper.writeQueue, client.payloadPool)
+		}
+		done += count
+	}
+}
+
+func BenchmarkListenerWrite(b *testing.B) {
+	client, listener := newBenchClient(b)
+	defer client.closeListener()
+
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer receiver.Close()
+
+	receiverBatch := NewBatchConn(receiver, BENCH_BATCH_SIZE, BENCH_DATAGRAM_SIZE, true, false)
+	srcAddress := benchAddrPort(receiver)
+
+	packs := make([]Package, 0, BENCH_BATCH_SIZE)
+	datagrams := make([]Datagram, 0, BENCH_BATCH_SIZE)
+	discard := func(data []byte, addr netip.AddrPort) bool {
+		return true
+	}
+	read := func() (int, error) {
+		return receiverBatch.ReadBatch(discard)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for done := 0; done < b.N; {
+		count := benchBatchCount(b.N - done)
+
+		// 映射的 handleReadQueue 把 payload 和自己的来源地址按值放入 readQueue
+		for index := 0; index < count; index++ {
+			payload, err := client.payloadPool.Get()
+			if err != nil {
+				b.Fatal(err)
+			}
+			payload.Buffer(0, BENCH_DATAGRAM_SIZE)
+			payload.SetLength(BENCH_DATAGRAM_SIZE)
+			listener.HandleRead(NewPackage(srcAddress, payload))
+		}
+
+		packs = packs[:0]
+		for index := 0; index < count; index++ {
+			packs = append(packs, <-listener.readQueue)
+		}
+
+		if err := listener.conn.SetWriteDeadline(time.Now().Add(BENCH_TIMEOUT)); err != nil {
+			b.Fatal(err)
+		}
+		datagrams = listener.writeBatch(packs, datagrams)
+
+		benchReadCount(b, receiver, count, read)
+		done += count
+	}
+}
+
+func BenchmarkUpstreamRead(b *testing.B) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer upstream.Close()
+
+	// 和 ServerMapper 的 destConnection 一样是连接的 socket
+	destConnection, err := net.DialUDP("udp", nil, upstream.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer destConnection.Close()
+
+	upstreamBatch := NewBatchConn(upstream, BENCH_BATCH_SIZE, BENCH_DATAGRAM_SIZE, false, true)
+	batch := NewBatchConn(destConnection, BENCH_BATCH_SIZE, BENCH_DATAGRAM_SIZE, true, true)
+
+	datagrams := benchDatagrams(benchAddrPort(destConnection))
+	discard := func(data []byte, _ netip.AddrPort) bool {
+		return true
+	}
+	read := func() (int, error) {
+		return batch.ReadBatch(discard)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for done := 0; done < b.N; {
+		count := benchBatchCount(b.N - done)
+		upstreamBatch.WriteBatch(datagrams[:count])
+		benchReadCount(b, destConnection, count, read)
+		done += count
+	}
+}
+
+func BenchmarkDTLS(b *testing.B) {
+	config := &dtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return []byte("dtls_tunnel bench"), nil
+		},
+		PSKIdentityHint: []byte("bench"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+	}
+
+	listener, err := dtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan *AcceptResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			err = conn.(*dtls.Conn).Handshake()
+		}
+		accepted <- &AcceptResult{Conn: conn, Err: err}
+	}()
+
+	client, err := dtls.Dial("udp", listener.Addr().(*net.UDPAddr), config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Handshake(); err != nil {
+		b.Fatal(err)
+	}
+
+	result := <-accepted
+	if result.Err != nil {
+		b.Fatal(result.Err)
+	}
+	server := result.Conn
+	defer server.Close()
+
+	data := make([]byte, BENCH_DATAGRAM_SIZE)
+	buffer := make([]byte, BENCH_DATAGRAM_SIZE)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := server.Read(buffer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package dtls_tunnel
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+ * 客户端指定目标地址时, 服务端用白名单检查解析后的 IP 和端口
+ * 没有配置白名单时拒绝所有客户端指定的目标地址
+ */
+
+type PortRange struct {
+	From int
+	To   int
+}
+
+type DestinationRule struct {
+	Network *net.IPNet
+	Ports   []PortRange // 为空时允许所有端口
+}
+
+// ParseDestinationRule 解析 "10.0.0.0/8" 和 "53,5000-6000" 这样的网段和端口
+func ParseDestinationRule(cidr string, ports string) (*DestinationRule, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("invalid cidr %q", cidr)
+	}
+
+	rule := &DestinationRule{Network: network}
+
+	if strings.TrimSpace(ports) == "" {
+		return rule, nil
+	}
+
+	for _, part := range strings.Split(ports, ",") {
+		part = strings.TrimSpace(part)
+		fromStr, toStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			toStr = fromStr
+		}
+
+		from, err := strconv.Atoi(strings.TrimSpace(fromStr))
+		if err != nil || from < 1 || from > 65535 {
+			return nil, MakeErrorWithErrMsg("invalid port %q", part)
+		}
+
+		to, err := strconv.Atoi(strings.TrimSpace(toStr))
+		if err != nil || to < from || to > 65535 {
+			return nil, MakeErrorWithErrMsg("invalid port range %q", part)
+		}
+
+		rule.Ports = append(rule.Ports, PortRange{From: from, To: to})
+	}
+
+	return rule, nil
+}
+
+func (r *DestinationRule) Allow(address *net.UDPAddr) bool {
+	if !r.Network.Contains(address.IP) {
+		return false
+	}
+
+	if len(r.Ports) == 0 {
+		return true
+	}
+
+	for _, portRange := range r.Ports {
+		if address.Port >= portRange.From && address.Port <= portRange.To {
+			return true
+		}
+	}
+
+	return false
+}
+
+type DestinationAllowlist struct {
+	rules []*DestinationRule
+}
+
+func NewDestinationAllowlist(rules []*DestinationRule) *DestinationAllowlist {
+	return &DestinationAllowlist{rules: rules}
+}
+
+func (a *DestinationAllowlist) Allow(address *net.UDPAddr) bool {
+	if a == nil {
+		return false
+	}
+
+	for _, rule := range a.rules {
+		if rule.Allow(address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve 解析客户端发来的 "host:port", 检查的是解析后的地址
+func (a *DestinationAllowlist) Resolve(destination string) (*net.UDPAddr, error) {
+	if a == nil {
+		return nil, MakeErrorWithErrMsg("client selected destination is disabled")
+	}
+
+	address, err := net.ResolveUDPAddr("udp", destination)
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to resolve destination %q: %s", destination, err.Error())
+	}
+
+	if !a.Allow(address) {
+		return nil, MakeErrorWithErrMsg("destination %s is not allowed", address.String())
+	}
+
+	return address, nil
+}
@@ -0,0 +1,113 @@
+package dtls_tunnel
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseDestinationRule(t *testing.T) {
+	rule, err := ParseDestinationRule("10.1.2.3/8", " 53, 5000 - 6000 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 网段按掩码取整
+	if rule.Network.String() != "10.0.0.0/8" {
+		t.Errorf("network = %s, want 10.0.0.0/8", rule.Network.String())
+	}
+
+	if want := []PortRange{{53, 53}, {5000, 6000}}; !reflect.DeepEqual(rule.Ports, want) {
+		t.Errorf("ports = %v, want %v", rule.Ports, want)
+	}
+
+	rule, err = ParseDestinationRule("::1/128", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rule.Ports) != 0 {
+		t.Errorf("empty ports: %v, want all ports", rule.Ports)
+	}
+
+	cases := []struct {
+		cidr  string
+		ports string
+	}{
+		{"10.0.0.1", ""},
+		{"10.0.0.0/33", ""},
+		{"10.0.0.0/8", "0"},
+		{"10.0.0.0/8", "65536"},
+		{"10.0.0.0/8", "dns"},
+		{"10.0.0.0/8", "6000-5000"},
+		{"10.0.0.0/8", "53,"},
+		{"10.0.0.0/8", "5000-"},
+	}
+
+	for _, c := range cases {
+		if _, err := ParseDestinationRule(c.cidr, c.ports); err == nil {
+			t.Errorf("ParseDestinationRule(%q, %q) succeeded, want error", c.cidr, c.ports)
+		}
+	}
+}
+
+func TestDestinationAllowlistAllow(t *testing.T) {
+	dns, _ := ParseDestinationRule("10.0.0.0/8", "53")
+	games, _ := ParseDestinationRule("192.168.1.0/24", "27015-27030")
+	ula, _ := ParseDestinationRule("fd00::/8", "")
+	allowlist := NewDestinationAllowlist([]*DestinationRule{dns, games, ula})
+
+	cases := []struct {
+		address   string
+		isAllowed bool
+	}{
+		{"10.9.9.9:53", true},
+		{"10.9.9.9:54", false},
+		{"11.0.0.1:53", false},
+		{"192.168.1.7:27015", true},
+		{"192.168.1.7:27030", true},
+		{"192.168.1.7:27031", false},
+		{"[fd00::1]:9", true},
+		{"[fe80::1]:9", false},
+	}
+
+	for _, c := range cases {
+		address, err := net.ResolveUDPAddr("udp", c.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if isAllowed := allowlist.Allow(address); isAllowed != c.isAllowed {
+			t.Errorf("Allow(%s) = %v, want %v", c.address, isAllowed, c.isAllowed)
+		}
+	}
+
+	// 没有白名单时拒绝所有地址
+	var nilAllowlist *DestinationAllowlist
+	if nilAllowlist.Allow(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}) {
+		t.Error("nil allowlist allows a destination")
+	}
+}
+
+func TestDestinationAllowlistResolve(t *testing.T) {
+	rule, _ := ParseDestinationRule("127.0.0.0/8", "53")
+	allowlist := NewDestinationAllowlist([]*DestinationRule{rule})
+
+	address, err := allowlist.Resolve("127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.String() != "127.0.0.1:53" {
+		t.Errorf("Resolve() = %s, want 127.0.0.1:53", address.String())
+	}
+
+	for _, destination := range []string{"127.0.0.1:54", "10.0.0.1:53", "127.0.0.1", "127.0.0.1:dns-x"} {
+		if _, err := allowlist.Resolve(destination); err == nil {
+			t.Errorf("Resolve(%q) succeeded, want error", destination)
+		}
+	}
+
+	var nilAllowlist *DestinationAllowlist
+	if _, err := nilAllowlist.Resolve("127.0.0.1:53"); err == nil {
+		t.Error("nil allowlist resolves a destination")
+	}
+}
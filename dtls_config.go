@@ -0,0 +1,135 @@
+package dtls_tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/pion/dtls/v3"
+)
+
+// 服务端分配的 Connection ID 的长度, 客户端只发送不接收 CID, 所以不需要分配
+const DTLS_CONNECTION_ID_SIZE = 8
+
+// PSK 模式下使用的加密套件, 优先使用带前向保密的 ECDHE_PSK
+var pskCipherSuites = []dtls.CipherSuiteID{
+	dtls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256,
+	dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_PSK_WITH_AES_128_CCM,
+}
+
+// sessionCache 为 nil 时不使用会话恢复
+func newClientDTLSConfig(config *ClientConfig, sessionCache *SessionCache) *dtls.Config {
+	dtlsConfig := newClientAuthDTLSConfig(config)
+
+	// 让服务端分配 Connection ID, 客户端换网络或 NAT 重新映射端口后不需要重新握手
+	dtlsConfig.ConnectionIDGenerator = dtls.OnlySendCIDGenerator()
+
+	// pion 按服务端地址查找缓存的会话, 所以同一个缓存可以用于所有服务端
+	if sessionCache != nil {
+		dtlsConfig.SessionStore = sessionCache
+	}
+
+	return dtlsConfig
+}
+
+func newClientAuthDTLSConfig(config *ClientConfig) *dtls.Config {
+	if config.AuthMode == AUTH_MODE_PSK {
+		return &dtls.Config{
+			PSK: func(hint []byte) ([]byte, error) {
+				key, isExist := config.PSKKeys.Get(config.PSKIdentity)
+				if !isExist {
+					return nil, MakeErrorWithErrMsg("no psk for identity %q", config.PSKIdentity)
+				}
+				return key, nil
+			},
+			PSKIdentityHint:      []byte(config.PSKIdentity),
+			CipherSuites:         pskCipherSuites,
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		}
+	}
+
+	// 每次拨号时重新生成配置, 所以根证书取当时最新的即可
+	return &dtls.Config{
+		GetClientCertificate: func(*dtls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return config.Certificates.Certificate(), nil
+		},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		RootCAs:              config.Certificates.RootCerts(),
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return config.CRL.CheckChains(chains)
+		},
+	}
+}
+
+func newServerDTLSConfig(config *ServerConfig, sessionCache *SessionCache) *dtls.Config {
+	dtlsConfig := newServerAuthDTLSConfig(config)
+
+	// 客户端支持时使用 Connection ID (RFC 9146), 客户端的地址变化后连接仍然有效
+	dtlsConfig.ConnectionIDGenerator = dtls.RandomCIDGenerator(DTLS_CONNECTION_ID_SIZE)
+
+	// 在握手阶段拒绝不在 ACL 中的客户端, 客户端能直接看到握手失败
+	if config.ACL != nil {
+		dtlsConfig.VerifyConnection = config.ACL.Authorize
+	}
+
+	// 简化握手不经过 VerifyConnection, 恢复的会话由 ServerMapper 按缓存的 identity 检查 ACL
+	if sessionCache != nil {
+		dtlsConfig.SessionStore = sessionCache
+
+		authorize := dtlsConfig.VerifyConnection
+		dtlsConfig.VerifyConnection = func(state *dtls.State) error {
+			if authorize != nil {
+				if err := authorize(state); err != nil {
+					return err
+				}
+			}
+
+			sessionCache.Bind(state)
+			return nil
+		}
+	}
+
+	return dtlsConfig
+}
+
+func newServerAuthDTLSConfig(config *ServerConfig) *dtls.Config {
+	if config.AuthMode == AUTH_MODE_PSK {
+		return &dtls.Config{
+			// 服务端收到的是客户端的 identity
+			PSK: func(identity []byte) ([]byte, error) {
+				key, isExist := config.PSKKeys.Get(string(identity))
+				if !isExist {
+					logger.Warn(FormatString("Unknown psk identity: %q", identity))
+					return nil, MakeErrorWithErrMsg("unknown psk identity")
+				}
+				return key, nil
+			},
+			PSKIdentityHint:      []byte(config.PSKIdentityHint),
+			CipherSuites:         pskCipherSuites,
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		}
+	}
+
+	// Listener 的配置只生成一次, 证书和根证书都通过回调取最新的
+	// ClientCAs 是固定的, 所以由 VerifyPeerCertificate 自己校验客户端证书
+	return &dtls.Config{
+		GetCertificate: func(*dtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return config.Certificates.Certificate(), nil
+		},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ClientAuth:           dtls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			chains, err := VerifyClientCertificate(rawCerts, config.Certificates.RootCerts())
+			if err != nil {
+				return err
+			}
+
+			if err := config.CRL.CheckChains(chains); err != nil {
+				logger.Warn(FormatString("Rejected revoked client certificate: %s", err.Error()))
+				return err
+			}
+
+			return nil
+		},
+	}
+}
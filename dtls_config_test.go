@@ -0,0 +1,149 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// roamingTestConn 是可以更换本地端口的 net.PacketConn, 模拟客户端换网络或 NAT 重新映射端口
+type roamingTestConn struct {
+	lock         *sync.Mutex
+	conn         *net.UDPConn
+	readDeadline time.Time
+	isClosed     bool
+}
+
+func newRoamingTestConn(t *testing.T) *roamingTestConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roaming := &roamingTestConn{lock: &sync.Mutex{}, conn: conn}
+	t.Cleanup(func() { _ = roaming.Close() })
+	return roaming
+}
+
+// roam 换到一个新的本地端口, 旧的 socket 被关闭
+func (c *roamingTestConn) roam(t *testing.T) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(c.readDeadline)
+
+	c.lock.Lock()
+	old := c.conn
+	c.conn = conn
+	c.lock.Unlock()
+
+	_ = old.Close()
+}
+
+func (c *roamingTestConn) current() (*net.UDPConn, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.conn, c.isClosed
+}
+
+func (c *roamingTestConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	for {
+		conn, _ := c.current()
+		n, addr, err := conn.ReadFrom(buffer)
+
+		// 读取期间换了端口, 在新的 socket 上继续读
+		if current, isClosed := c.current(); err != nil && current != conn && !isClosed {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func (c *roamingTestConn) WriteTo(buffer []byte, addr net.Addr) (int, error) {
+	conn, _ := c.current()
+	return conn.WriteTo(buffer, addr)
+}
+
+func (c *roamingTestConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.isClosed = true
+	return c.conn.Close()
+}
+
+func (c *roamingTestConn) LocalAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.LocalAddr()
+}
+
+func (c *roamingTestConn) SetDeadline(deadline time.Time) error {
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(deadline)
+}
+
+func (c *roamingTestConn) SetReadDeadline(deadline time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = deadline
+	return c.conn.SetReadDeadline(deadline)
+}
+
+func (c *roamingTestConn) SetWriteDeadline(deadline time.Time) error {
+	conn, _ := c.current()
+	return conn.SetWriteDeadline(deadline)
+}
+
+func TestConnectionIDSurvivesPortChange(t *testing.T) {
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+	server := newTestServer(t, serverConfig)
+
+	clientConfig, err := ParseClientConfig(toTestCommonConfig(t, newTestFileConfig(t, "client", serverConfig.Listen)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote, err := net.ResolveUDPAddr("udp", serverConfig.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 和 Client 使用相同的 DTLS 配置, 只是本地 socket 可以更换端口
+	roaming := newRoamingTestConn(t)
+	conn, err := dtls.Client(roaming, remote, newClientDTLSConfig(clientConfig, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_ROUND_TRIP_TIMEOUT)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	testRoundTrip(t, conn, "before")
+	before := roaming.LocalAddr().String()
+
+	// 换端口之后同一个 DTLS 连接继续转发, 不需要重新握手
+	roaming.roam(t)
+	testRoundTrip(t, conn, "after")
+
+	if mappers := server.Mappers(); len(mappers) != 1 {
+		t.Errorf("%d server mappers after roaming from %s, want 1", len(mappers), before)
+	}
+}
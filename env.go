@@ -2,6 +2,43 @@ package dtls_tunnel
 
 import "time"
 
-const ACCEPT_TIMEOUT = time.Second
-const READ_TIMEOUT = time.Second
-const WRITE_TIMEOUT = time.Second
+// 每次读写设置的超时时间, 超时后检查是否需要退出再继续, 并不会关闭映射
+const DEFAULT_READ_TIMEOUT = time.Second
+const DEFAULT_WRITE_TIMEOUT = time.Second
+
+// 映射或 flow 空闲超过 IdleTimeout 后被回收, 每 GCInterval 检查一次
+const DEFAULT_IDLE_TIMEOUT = time.Minute * 30
+const DEFAULT_GC_INTERVAL = time.Second * 5
+
+// 关闭 metrics 和管理接口时等待请求结束的时间
+const HTTP_SHUTDOWN_TIMEOUT = time.Second
+
+// IDLE_POLICY_EITHER: 任意一个方向空闲就回收
+// IDLE_POLICY_BOTH: 两个方向都空闲才回收, 适合 syslog 这类单向的流
+const IDLE_POLICY_EITHER = "either"
+const IDLE_POLICY_BOTH = "both"
+
+// Client 的映射的 writeQueue 满了时怎么处理新的数据报
+// OVERFLOW_POLICY_DROP_NEWEST: 丢弃新的数据报
+// OVERFLOW_POLICY_DROP_OLDEST: 丢弃队列中最早的数据报, 适合只关心最新数据的流
+// OVERFLOW_POLICY_BLOCK: 最多等待 WriteOverflowTimeout, 仍然没有空位时丢弃新的数据报
+// 等待期间所有源地址的数据报都不会被读取, 所以超时应该很短
+const OVERFLOW_POLICY_DROP_NEWEST = "drop_newest"
+const OVERFLOW_POLICY_DROP_OLDEST = "drop_oldest"
+const OVERFLOW_POLICY_BLOCK = "block"
+
+const DEFAULT_WRITE_OVERFLOW_TIMEOUT = time.Millisecond * 10
+
+// payload 池中的 payload 全部被取走时 Get 怎么处理
+// POOL_EXHAUSTED_BLOCK: 最多等待 PayloadPoolConfig.Timeout, 仍然没有归还的 payload 时返回错误
+// POOL_EXHAUSTED_FAIL: 立即返回错误, 调用方丢弃这个数据报
+const POOL_EXHAUSTED_BLOCK = "block"
+const POOL_EXHAUSTED_FAIL = "fail"
+
+const DEFAULT_PAYLOAD_POOL_TIMEOUT = time.Millisecond * 10
+
+// 客户端发送 OPEN 后等待这么久还没有收到 OPEN_ACK 就重发, 最多等待 HandshakeTimeout
+const OPEN_RETRY_INTERVAL = time.Millisecond * 200
+
+// 从隧道读取的协程取不到 payload 时等待这么久再重试, 期间的数据报留在 socket 的缓冲区中
+const PAYLOAD_POOL_RETRY_INTERVAL = time.Millisecond
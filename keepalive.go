@@ -0,0 +1,134 @@
+package dtls_tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 应用层心跳, Client 每个 interval 在 DTLS 连接上发送 PING 帧, Server 回复 PONG 帧
+ * 连续 misses 个 interval 没有收到对端的任何数据报时认为对端已经失效
+ *
+ * PING 和 PONG 的 payload:
+ * +-------------------+-------------+-------------+
+ * | interval ms (u32) | misses (u8) | token (8B)  |
+ * +-------------------+-------------+-------------+
+ *
+ * Server 从 PING 中得到客户端的心跳周期, 同样在对端失效后关闭映射
+ * 非多路复用模式下 DTLS 连接上是原始的数据报, 只有和 PING 完全相同 (包括随机 token) 的数据报才是心跳
+ * 这时 PING 是连接上的第一个数据报, 在 OPEN 帧和数据之前发送
+ */
+
+const KEEPALIVE_PAYLOAD_SIZE = 13
+const KEEPALIVE_FRAME_SIZE = MUX_FRAME_HEADER_SIZE + KEEPALIVE_PAYLOAD_SIZE
+
+type Keepalive struct {
+	interval time.Duration
+	misses   int
+
+	// 编码好的 PING 和 PONG 帧
+	ping []byte
+	pong []byte
+
+	// 最后一次收到对端数据报的时间, UnixNano
+	lastReceived atomic.Int64
+}
+
+func NewKeepalive(interval time.Duration, misses int) (*Keepalive, error) {
+	payload := make([]byte, KEEPALIVE_PAYLOAD_SIZE)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(interval.Milliseconds()))
+	payload[4] = byte(misses)
+
+	if _, err := rand.Read(payload[5:]); err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to generate keepalive token: %s", err.Error())
+	}
+
+	return newKeepalive(interval, misses, payload), nil
+}
+
+// ParseKeepalivePing 从客户端的 PING 帧得到对应的 Keepalive
+func ParseKeepalivePing(datagram []byte) (*Keepalive, bool) {
+	header, payload, err := DecodeMuxFrame(datagram)
+	if err != nil || header.Type != MUX_FRAME_TYPE_PING || header.FlowID != 0 || len(payload) != KEEPALIVE_PAYLOAD_SIZE {
+		return nil, false
+	}
+
+	interval := time.Duration(binary.BigEndian.Uint32(payload[0:4])) * time.Millisecond
+	misses := int(payload[4])
+	if interval <= 0 || misses <= 0 {
+		return nil, false
+	}
+
+	return newKeepalive(interval, misses, payload), true
+}
+
+func newKeepalive(interval time.Duration, misses int, payload []byte) *Keepalive {
+	keepalive := &Keepalive{
+		interval: interval,
+		misses:   misses,
+		ping:     make([]byte, KEEPALIVE_FRAME_SIZE),
+		pong:     make([]byte, KEEPALIVE_FRAME_SIZE),
+	}
+
+	_ = EncodeMuxFrameHeader(keepalive.ping, MUX_FRAME_TYPE_PING, 0)
+	_ = EncodeMuxFrameHeader(keepalive.pong, MUX_FRAME_TYPE_PONG, 0)
+	copy(keepalive.ping[MUX_FRAME_HEADER_SIZE:], payload)
+	copy(keepalive.pong[MUX_FRAME_HEADER_SIZE:], payload)
+
+	keepalive.Received()
+
+	return keepalive
+}
+
+func (k *Keepalive) PingFrame() []byte {
+	return k.ping
+}
+
+// Payload 返回 PING 帧的 payload, 多路复用模式下通过 ClientSession.WriteFrame 发送
+func (k *Keepalive) Payload() []byte {
+	return k.ping[MUX_FRAME_HEADER_SIZE:]
+}
+
+func (k *Keepalive) IsPing(datagram []byte) bool {
+	return bytes.Equal(datagram, k.ping)
+}
+
+func (k *Keepalive) IsPong(datagram []byte) bool {
+	return bytes.Equal(datagram, k.pong)
+}
+
+// Received 在收到对端任何数据报后调用
+func (k *Keepalive) Received() {
+	k.lastReceived.Store(time.Now().UnixNano())
+}
+
+func (k *Keepalive) IsDead() bool {
+	return time.Since(time.Unix(0, k.lastReceived.Load())) > k.interval*time.Duration(k.misses)
+}
+
+// Run 每个 interval 调用一次 ping, 发现对端失效时调用 onDead 后返回
+func (k *Keepalive) Run(ctx context.Context, ping func() error, onDead func()) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if k.IsDead() {
+				onDead()
+				return
+			}
+
+			if err := ping(); err != nil && ctx.Err() == nil {
+				logger.Warn(FormatString("Failed to send keepalive: %s", err.Error()))
+			}
+		}
+	}
+}
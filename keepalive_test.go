@@ -0,0 +1,121 @@
+package dtls_tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestParseKeepalivePing(t *testing.T) {
+	client, err := NewKeepalive(time.Second*5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, isOK := ParseKeepalivePing(client.PingFrame())
+	if !isOK {
+		t.Fatal("ParseKeepalivePing() failed with the client's ping")
+	}
+
+	if server.interval != time.Second*5 || server.misses != 3 {
+		t.Errorf("parsed interval %s and misses %d, want 5s and 3", server.interval, server.misses)
+	}
+
+	// 服务端回复的 PONG 带着客户端的 token
+	if !server.IsPing(client.PingFrame()) || !client.IsPong(server.pong) {
+		t.Error("server and client disagree on the ping and pong frames")
+	}
+
+	if client.IsPing(client.pong) || client.IsPong(client.PingFrame()) {
+		t.Error("ping and pong frames are not distinguished")
+	}
+
+	// 每个 Keepalive 的 token 是随机的
+	other, _ := NewKeepalive(time.Second*5, 3)
+	if bytes.Equal(other.Payload(), client.Payload()) || client.IsPong(other.pong) {
+		t.Error("two keepalives share the same token")
+	}
+}
+
+func TestParseKeepalivePingErrors(t *testing.T) {
+	ping := func(frameType byte, flowID uint32, intervalMs uint32, misses byte, size int) []byte {
+		frame := make([]byte, MUX_FRAME_HEADER_SIZE+size)
+		_ = EncodeMuxFrameHeader(frame, frameType, flowID)
+		if size >= 5 {
+			binary.BigEndian.PutUint32(frame[MUX_FRAME_HEADER_SIZE:], intervalMs)
+			frame[MUX_FRAME_HEADER_SIZE+4] = misses
+		}
+		return frame
+	}
+
+	if _, isOK := ParseKeepalivePing(ping(MUX_FRAME_TYPE_PING, 0, 1000, 3, KEEPALIVE_PAYLOAD_SIZE)); !isOK {
+		t.Fatal("ParseKeepalivePing() failed with a valid ping")
+	}
+
+	cases := map[string][]byte{
+		"pong":          ping(MUX_FRAME_TYPE_PONG, 0, 1000, 3, KEEPALIVE_PAYLOAD_SIZE),
+		"data":          ping(MUX_FRAME_TYPE_DATA, 0, 1000, 3, KEEPALIVE_PAYLOAD_SIZE),
+		"flow id":       ping(MUX_FRAME_TYPE_PING, 1, 1000, 3, KEEPALIVE_PAYLOAD_SIZE),
+		"short":         ping(MUX_FRAME_TYPE_PING, 0, 1000, 3, KEEPALIVE_PAYLOAD_SIZE-1),
+		"long":          ping(MUX_FRAME_TYPE_PING, 0, 1000, 3, KEEPALIVE_PAYLOAD_SIZE+1),
+		"zero interval": ping(MUX_FRAME_TYPE_PING, 0, 0, 3, KEEPALIVE_PAYLOAD_SIZE),
+		"zero misses":   ping(MUX_FRAME_TYPE_PING, 0, 1000, 0, KEEPALIVE_PAYLOAD_SIZE),
+		"header only":   ping(MUX_FRAME_TYPE_PING, 0, 0, 0, 0),
+	}
+
+	for name, datagram := range cases {
+		if _, isOK := ParseKeepalivePing(datagram); isOK {
+			t.Errorf("ParseKeepalivePing() succeeded with %s", name)
+		}
+	}
+}
+
+func TestKeepaliveIsDead(t *testing.T) {
+	keepalive, err := NewKeepalive(time.Millisecond*10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keepalive.IsDead() {
+		t.Error("IsDead() = true right after NewKeepalive")
+	}
+
+	keepalive.lastReceived.Store(time.Now().Add(-time.Millisecond * 30).UnixNano())
+	if !keepalive.IsDead() {
+		t.Error("IsDead() = false after 3 intervals without data")
+	}
+
+	keepalive.Received()
+	if keepalive.IsDead() {
+		t.Error("IsDead() = true after Received")
+	}
+}
+
+func TestKeepaliveRun(t *testing.T) {
+	// 允许的丢失次数留足余量, 第一次 tick 被调度延迟时也不会在发送 PING 之前就判定对端已断开
+	keepalive, err := NewKeepalive(time.Millisecond*10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pings := 0
+	dead := make(chan struct{})
+	go keepalive.Run(context.Background(), func() error {
+		pings++
+		return nil
+	}, func() {
+		close(dead)
+	})
+
+	select {
+	case <-dead:
+	case <-time.After(time.Second):
+		t.Fatal("onDead is not called without data from the peer")
+	}
+
+	if pings == 0 {
+		t.Error("no ping is sent before the peer is dead")
+	}
+}
@@ -1,49 +1,74 @@
 package dtls_tunnel
 
-import "sync"
+import (
+	"net/netip"
+	"sync"
+)
 
+/*
+ * Mappers 按来源地址保存 Client 的映射, 每个数据报都要查找一次
+ * 键使用 netip.AddrPort, 它是可比较的值类型, 查找时不需要把地址格式化成字符串, 也不需要装箱
+ */
 type Mappers interface {
-	Set(string, *ClientMapper)
-	Get(string) *ClientMapper
-	Exist(string) bool
-	Delete(string)
-	Range(func(key string, mapper *ClientMapper) bool)
+	Set(netip.AddrPort, *ClientMapper)
+	Get(netip.AddrPort) *ClientMapper
+	Exist(netip.AddrPort) bool
+	Delete(netip.AddrPort)
+	Range(func(key netip.AddrPort, mapper *ClientMapper) bool)
 }
 
-type MappersBasedSyncMap struct {
-	mappers *sync.Map
+type MappersBasedMap struct {
+	lock    *sync.RWMutex
+	mappers map[netip.AddrPort]*ClientMapper
 }
 
 func NewMappers() Mappers {
-	m := &MappersBasedSyncMap{mappers: &sync.Map{}}
+	m := &MappersBasedMap{
+		lock:    &sync.RWMutex{},
+		mappers: make(map[netip.AddrPort]*ClientMapper),
+	}
 	return m
 }
 
-func (mappers *MappersBasedSyncMap) Set(key string, clientMapper *ClientMapper) {
-	mappers.mappers.Store(key, clientMapper)
+func (mappers *MappersBasedMap) Set(key netip.AddrPort, clientMapper *ClientMapper) {
+	mappers.lock.Lock()
+	defer mappers.lock.Unlock()
+	mappers.mappers[key] = clientMapper
 }
 
-func (mappers *MappersBasedSyncMap) Get(key string) *ClientMapper {
-	cm, isExist := mappers.mappers.Load(key)
-	if !isExist {
-		return nil
-	}
-
-	return cm.(*ClientMapper)
+func (mappers *MappersBasedMap) Get(key netip.AddrPort) *ClientMapper {
+	mappers.lock.RLock()
+	defer mappers.lock.RUnlock()
+	return mappers.mappers[key]
 }
 
-func (mappers *MappersBasedSyncMap) Delete(key string) {
-	mappers.mappers.Delete(key)
+func (mappers *MappersBasedMap) Delete(key netip.AddrPort) {
+	mappers.lock.Lock()
+	defer mappers.lock.Unlock()
+	delete(mappers.mappers, key)
 }
 
-func (mappers *MappersBasedSyncMap) Exist(key string) bool {
-	_, isExist := mappers.mappers.Load(key)
+func (mappers *MappersBasedMap) Exist(key netip.AddrPort) bool {
+	mappers.lock.RLock()
+	defer mappers.lock.RUnlock()
+	_, isExist := mappers.mappers[key]
 	return isExist
 }
 
-func (mappers *MappersBasedSyncMap) Range(f func(key string, mapper *ClientMapper) bool) {
-	withConvert := func(key interface{}, value interface{}) bool {
-		return f(key.(string), value.(*ClientMapper))
+// Range 遍历开始时的快照, f 中可以修改 Mappers
+func (mappers *MappersBasedMap) Range(f func(key netip.AddrPort, mapper *ClientMapper) bool) {
+	mappers.lock.RLock()
+	keys := make([]netip.AddrPort, 0, len(mappers.mappers))
+	values := make([]*ClientMapper, 0, len(mappers.mappers))
+	for key, mapper := range mappers.mappers {
+		keys = append(keys, key)
+		values = append(values, mapper)
+	}
+	mappers.lock.RUnlock()
+
+	for index, key := range keys {
+		if !f(key, values[index]) {
+			return
+		}
 	}
-	mappers.mappers.Range(withConvert)
 }
@@ -0,0 +1,419 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+ * Prometheus 指标, 所有隧道共用一个 registry, 用 tunnel 和 role 标签区分
+ * direction: upstream 是发往目标地址的方向, downstream 是返回源地址的方向
+ * Client 统计本地 UDP 监听上收发的包, Server 统计和目标地址之间收发的包
+ */
+
+const METRICS_ROLE_CLIENT = "client"
+const METRICS_ROLE_SERVER = "server"
+
+const METRICS_DIRECTION_UPSTREAM = "upstream"
+const METRICS_DIRECTION_DOWNSTREAM = "downstream"
+
+const METRICS_QUEUE_READ = "read"   // ClientMapper.readQueue, 从隧道返回的数据
+const METRICS_QUEUE_WRITE = "write" // ClientMapper.writeQueue, 等待写入隧道的数据
+
+// 映射结束的原因, 只记录第一次调用 stopWithReason 时的原因
+const STOP_REASON_SHUTDOWN = "shutdown"
+const STOP_REASON_INIT_ERROR = "init_error"
+const STOP_REASON_IDLE = "idle"
+const STOP_REASON_EOF = "eof"
+const STOP_REASON_READ_ERROR = "read_error"
+const STOP_REASON_WRITE_ERROR = "write_error"
+const STOP_REASON_SESSION_CLOSED = "session_closed"
+const STOP_REASON_REVOKED = "revoked"
+const STOP_REASON_ADMIN = "admin"
+const STOP_REASON_DEAD_PEER = "dead_peer"
+const STOP_REASON_SERVER_DOWN = "server_down"
+const STOP_REASON_PROBE = "probe"
+const STOP_REASON_UNUSED = "unused"
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricMappersActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtls_tunnel_mappers_active",
+		Help: "Number of active mappers.",
+	}, []string{"tunnel", "role"})
+
+	metricMappersCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_mappers_created_total",
+		Help: "Number of mappers created.",
+	}, []string{"tunnel", "role"})
+
+	metricMappersDestroyed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_mappers_destroyed_total",
+		Help: "Number of mappers destroyed by reason.",
+	}, []string{"tunnel", "role", "reason"})
+
+	metricBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_bytes_total",
+		Help: "Payload bytes forwarded by direction.",
+	}, []string{"tunnel", "role", "direction"})
+
+	metricPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_packets_total",
+		Help: "Packets forwarded by direction.",
+	}, []string{"tunnel", "role", "direction"})
+
+	metricPacketsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_packets_dropped_total",
+		Help: "Packets dropped because a queue stayed full.",
+	}, []string{"tunnel", "role", "queue"})
+
+	metricHandshakes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_handshakes_total",
+		Help: "DTLS handshakes by result.",
+	}, []string{"tunnel", "role", "result"})
+
+	metricMappersReconnecting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtls_tunnel_mappers_reconnecting",
+		Help: "Number of client mappers waiting for their tunnel to reconnect.",
+	}, []string{"tunnel", "role"})
+
+	metricOutages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_outages_total",
+		Help: "Tunnel outages of client mappers by result of reconnecting.",
+	}, []string{"tunnel", "role", "result"})
+
+	metricOutageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dtls_tunnel_outage_duration_seconds",
+		Help:    "Duration of tunnel outages that were recovered by reconnecting.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"tunnel", "role"})
+
+	metricServerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtls_tunnel_server_up",
+		Help: "Whether the last probe of a tunnel server succeeded.",
+	}, []string{"tunnel", "role", "server"})
+
+	metricServerRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtls_tunnel_server_handshake_rtt_seconds",
+		Help: "Handshake duration of the last successful probe of a tunnel server.",
+	}, []string{"tunnel", "role", "server"})
+
+	metricUpstreamUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dtls_tunnel_upstream_up",
+		Help: "Whether an upstream of the server is in rotation according to its health check.",
+	}, []string{"tunnel", "role", "upstream"})
+
+	metricSessionResumptions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_session_resumptions_total",
+		Help: "Successful DTLS handshakes with session resumption enabled by result: resumed or full.",
+	}, []string{"tunnel", "role", "result"})
+
+	metricWarmAcquires = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_warm_acquires_total",
+		Help: "New client connections by whether a pre-established warm connection was available: hit or miss.",
+	}, []string{"tunnel", "role", "result"})
+
+	metricRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dtls_tunnel_rate_limited_packets_total",
+		Help: "Packets over a rate limit by scope, direction and action: dropped or queued.",
+	}, []string{"tunnel", "role", "scope", "direction", "action"})
+
+	metricHandshakeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dtls_tunnel_handshake_duration_seconds",
+		Help:    "Duration of successful DTLS handshakes.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"tunnel", "role"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricMappersActive,
+		metricMappersCreated,
+		metricMappersDestroyed,
+		metricBytes,
+		metricPackets,
+		metricPacketsDropped,
+		metricHandshakes,
+		metricHandshakeDuration,
+		metricSessionResumptions,
+		metricWarmAcquires,
+		metricMappersReconnecting,
+		metricOutages,
+		metricOutageDuration,
+		metricServerUp,
+		metricServerRTT,
+		metricUpstreamUp,
+		metricRateLimited,
+	)
+}
+
+// TunnelMetrics 是某个隧道已经绑定好标签的指标, 避免在转发路径上查找标签
+type TunnelMetrics struct {
+	name string
+	role string
+
+	mappersActive  prometheus.Gauge
+	mappersCreated prometheus.Counter
+
+	upstreamBytes     prometheus.Counter
+	upstreamPackets   prometheus.Counter
+	downstreamBytes   prometheus.Counter
+	downstreamPackets prometheus.Counter
+
+	handshakeSuccesses prometheus.Counter
+	handshakeFailures  prometheus.Counter
+	handshakeDuration  prometheus.Observer
+
+	sessionsResumed prometheus.Counter
+	sessionsFull    prometheus.Counter
+}
+
+func NewTunnelMetrics(name string, role string) *TunnelMetrics {
+	return &TunnelMetrics{
+		name: name,
+		role: role,
+
+		mappersActive:  metricMappersActive.WithLabelValues(name, role),
+		mappersCreated: metricMappersCreated.WithLabelValues(name, role),
+
+		upstreamBytes:     metricBytes.WithLabelValues(name, role, METRICS_DIRECTION_UPSTREAM),
+		upstreamPackets:   metricPackets.WithLabelValues(name, role, METRICS_DIRECTION_UPSTREAM),
+		downstreamBytes:   metricBytes.WithLabelValues(name, role, METRICS_DIRECTION_DOWNSTREAM),
+		downstreamPackets: metricPackets.WithLabelValues(name, role, METRICS_DIRECTION_DOWNSTREAM),
+
+		handshakeSuccesses: metricHandshakes.WithLabelValues(name, role, "success"),
+		handshakeFailures:  metricHandshakes.WithLabelValues(name, role, "failure"),
+		handshakeDuration:  metricHandshakeDuration.WithLabelValues(name, role),
+
+		sessionsResumed: metricSessionResumptions.WithLabelValues(name, role, "resumed"),
+		sessionsFull:    metricSessionResumptions.WithLabelValues(name, role, "full"),
+	}
+}
+
+func (m *TunnelMetrics) MapperCreated() {
+	m.mappersCreated.Inc()
+	m.mappersActive.Inc()
+}
+
+func (m *TunnelMetrics) MapperDestroyed(reason string) {
+	m.mappersActive.Dec()
+	metricMappersDestroyed.WithLabelValues(m.name, m.role, reason).Inc()
+}
+
+func (m *TunnelMetrics) Upstream(n int) {
+	m.upstreamPackets.Inc()
+	m.upstreamBytes.Add(float64(n))
+}
+
+func (m *TunnelMetrics) Downstream(n int) {
+	m.downstreamPackets.Inc()
+	m.downstreamBytes.Add(float64(n))
+}
+
+func (m *TunnelMetrics) PacketDropped(queue string) {
+	metricPacketsDropped.WithLabelValues(m.name, m.role, queue).Inc()
+}
+
+// RateLimitCounters 返回一个范围和方向上超过限速被丢弃和等待的数据报的计数器
+func (m *TunnelMetrics) RateLimitCounters(scope string, direction string) (prometheus.Counter, prometheus.Counter) {
+	dropped := metricRateLimited.WithLabelValues(m.name, m.role, scope, direction, "dropped")
+	queued := metricRateLimited.WithLabelValues(m.name, m.role, scope, direction, "queued")
+	return dropped, queued
+}
+
+// Handshake 记录一次握手, start 是开始握手的时间
+func (m *TunnelMetrics) Handshake(start time.Time, err error) {
+	if err != nil {
+		m.handshakeFailures.Inc()
+		return
+	}
+
+	m.handshakeSuccesses.Inc()
+	m.handshakeDuration.Observe(time.Since(start).Seconds())
+}
+
+// SessionResumption 记录开启会话恢复时一次成功的握手是否是恢复的会话
+// 命中率是 resumed / (resumed + full)
+func (m *TunnelMetrics) SessionResumption(isResumed bool) {
+	if isResumed {
+		m.sessionsResumed.Inc()
+		return
+	}
+
+	m.sessionsFull.Inc()
+}
+
+// WarmConnectionAcquired 记录新的连接是否取到了预热的连接
+func (m *TunnelMetrics) WarmConnectionAcquired(isHit bool) {
+	result := "miss"
+	if isHit {
+		result = "hit"
+	}
+	metricWarmAcquires.WithLabelValues(m.name, m.role, result).Inc()
+}
+
+// OutageStarted 在映射开始重新连接时调用
+func (m *TunnelMetrics) OutageStarted() {
+	metricMappersReconnecting.WithLabelValues(m.name, m.role).Inc()
+}
+
+// OutageEnded 在重新连接成功或放弃时调用, start 是开始重新连接的时间
+func (m *TunnelMetrics) OutageEnded(start time.Time, isRecovered bool) {
+	metricMappersReconnecting.WithLabelValues(m.name, m.role).Dec()
+
+	if !isRecovered {
+		metricOutages.WithLabelValues(m.name, m.role, "failure").Inc()
+		return
+	}
+
+	metricOutages.WithLabelValues(m.name, m.role, "success").Inc()
+	metricOutageDuration.WithLabelValues(m.name, m.role).Observe(time.Since(start).Seconds())
+}
+
+// ServerProbed 记录一次服务端探测的结果
+func (m *TunnelMetrics) ServerProbed(server string, rtt time.Duration, err error) {
+	if err != nil {
+		metricServerUp.WithLabelValues(m.name, m.role, server).Set(0)
+		return
+	}
+
+	metricServerUp.WithLabelValues(m.name, m.role, server).Set(1)
+	metricServerRTT.WithLabelValues(m.name, m.role, server).Set(rtt.Seconds())
+}
+
+// UpstreamChecked 记录一次上游健康检查后的状态
+func (m *TunnelMetrics) UpstreamChecked(upstream string, isHealthy bool) {
+	var value float64 = 0
+	if isHealthy {
+		value = 1
+	}
+	metricUpstreamUp.WithLabelValues(m.name, m.role, upstream).Set(value)
+}
+
+// RegisterQueueDepth 注册队列长度指标, depth 在每次抓取时调用
+func (m *TunnelMetrics) RegisterQueueDepth(queue string, depth func() float64) {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "dtls_tunnel_queue_depth",
+		Help:        "Packets waiting in the mapper queues.",
+		ConstLabels: prometheus.Labels{"tunnel": m.name, "role": m.role, "queue": queue},
+	}, depth)
+
+	if err := metricsRegistry.Register(gauge); err != nil {
+		logger.Warn(FormatString("Failed to register queue depth of %s: %s", m.name, err.Error()))
+	}
+}
+
+// RegisterWarmConnections 注册空闲的预热连接数量, count 在每次抓取时调用
+func (m *TunnelMetrics) RegisterWarmConnections(count func() float64) {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "dtls_tunnel_warm_connections",
+		Help:        "Idle pre-established DTLS connections waiting for new client flows.",
+		ConstLabels: prometheus.Labels{"tunnel": m.name, "role": m.role},
+	}, count)
+
+	if err := metricsRegistry.Register(gauge); err != nil {
+		logger.Warn(FormatString("Failed to register warm connections of %s: %s", m.name, err.Error()))
+	}
+}
+
+// RegisterPayloadPool 注册所有隧道共用的 payload 池的统计, stats 在每次抓取时调用
+func RegisterPayloadPool(stats func() PayloadPoolStats) {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "dtls_tunnel_payload_pool_in_use",
+			Help: "Packet buffers currently taken from the payload pool.",
+		}, func() float64 { return float64(stats().InUse) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "dtls_tunnel_payload_pool_peak",
+			Help: "Most packet buffers taken from the payload pool at the same time.",
+		}, func() float64 { return float64(stats().Peak) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "dtls_tunnel_payload_pool_allocated",
+			Help: "Packet buffers allocated by the payload pool.",
+		}, func() float64 { return float64(stats().Allocated) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "dtls_tunnel_payload_pool_limit",
+			Help: "Max packet buffers in use, 0 when the payload pool is unbounded.",
+		}, func() float64 { return float64(stats().Limit) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dtls_tunnel_payload_pool_misses_total",
+			Help: "Gets that found no free packet buffer and had to allocate or wait.",
+		}, func() float64 { return float64(stats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dtls_tunnel_payload_pool_failures_total",
+			Help: "Gets that failed because the payload pool was exhausted.",
+		}, func() float64 { return float64(stats().Failures) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "dtls_tunnel_payload_pool_violations_total",
+			Help: "Packet buffers put twice or written after put.",
+		}, func() float64 { return float64(stats().Violations) }),
+	}
+
+	for _, collector := range collectors {
+		if err := metricsRegistry.Register(collector); err != nil {
+			logger.Warn(FormatString("Failed to register payload pool metrics: %s", err.Error()))
+		}
+	}
+}
+
+// StopReason 记录映射结束的原因, 只保留第一次设置的值
+type StopReason struct {
+	reason atomic.Value
+}
+
+func (r *StopReason) Set(reason string) {
+	r.reason.CompareAndSwap(nil, reason)
+}
+
+// Get 没有设置过原因时返回 STOP_REASON_SHUTDOWN, 即随父 context 一起关闭
+func (r *StopReason) Get() string {
+	if reason, isSet := r.reason.Load().(string); isSet {
+		return reason
+	}
+	return STOP_REASON_SHUTDOWN
+}
+
+// MetricsServer 在 /metrics 上提供 Prometheus 指标
+type MetricsServer struct {
+	server *http.Server
+}
+
+func NewMetricsServer(address string) *MetricsServer {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	return &MetricsServer{
+		server: &http.Server{
+			Addr:              address,
+			Handler:           mux,
+			ReadHeaderTimeout: time.Second * 10,
+		},
+	}
+}
+
+func (m *MetricsServer) Run() error {
+	logger.Info(FormatString("The metrics server is running on %s", m.server.Addr))
+
+	if err := m.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return MakeErrorWithErrMsg("Failed to run metrics server: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (m *MetricsServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	_ = m.server.Shutdown(ctx)
+}
@@ -0,0 +1,124 @@
+package dtls_tunnel
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runTestMetricsServer 在回环地址的空闲端口上启动 MetricsServer, 返回 /metrics 的地址
+func runTestMetricsServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	_ = listener.Close()
+
+	runTestTunnel(t, NewMetricsServer(address))
+	return "http://" + address + "/metrics"
+}
+
+// scrapeTestMetrics 读取文本格式的指标, 键是 `name{label="value",...}`, 标签按名称排序
+func scrapeTestMetrics(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+
+	var response *http.Response
+	var err error
+	deadline := time.Now().Add(TEST_ROUND_TRIP_TIMEOUT)
+	for {
+		// MetricsServer 在 Run 中才监听
+		if response, err = http.Get(url); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(TEST_ROUND_TRIP_RETRY)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		index := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[index+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metric line %q", line)
+		}
+		metrics[line[:index]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return metrics
+}
+
+func TestMetricsAfterTraffic(t *testing.T) {
+	url := runTestMetricsServer(t)
+
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+
+	// registry 是全局的, 每次运行使用不同的隧道名称
+	name := "metrics-" + serverConfig.Listen
+	serverConfig.Name = name
+	newTestServer(t, serverConfig)
+
+	clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+	clientConfig.Name = name
+	newTestClient(t, clientConfig)
+
+	conn := dialTestUDP(t, clientConfig.Listen)
+	testRoundTrip(t, conn, "hello")
+
+	metrics := scrapeTestMetrics(t, url)
+
+	// 同一个来源地址只有一个映射, 每一端一次握手
+	for _, role := range []string{METRICS_ROLE_CLIENT, METRICS_ROLE_SERVER} {
+		labels := `role="` + role + `",tunnel="` + name + `"`
+
+		for _, metric := range []string{"dtls_tunnel_mappers_created_total", "dtls_tunnel_mappers_active"} {
+			if value := metrics[metric+"{"+labels+"}"]; value != 1 {
+				t.Errorf("%s{%s} = %v, want 1", metric, labels, value)
+			}
+		}
+
+		key := `dtls_tunnel_handshakes_total{result="success",` + labels + `}`
+		if value := metrics[key]; value != 1 {
+			t.Errorf("%s = %v, want 1", key, value)
+		}
+	}
+
+	// 重发的数据报也会被统计, 所以只检查下限, 每个包的字节数相同
+	for _, c := range []struct {
+		role      string
+		direction string
+		size      int
+	}{
+		{METRICS_ROLE_CLIENT, METRICS_DIRECTION_UPSTREAM, len("hello")},
+		{METRICS_ROLE_CLIENT, METRICS_DIRECTION_DOWNSTREAM, len("echo:hello")},
+		{METRICS_ROLE_SERVER, METRICS_DIRECTION_UPSTREAM, len("hello")},
+		{METRICS_ROLE_SERVER, METRICS_DIRECTION_DOWNSTREAM, len("echo:hello")},
+	} {
+		labels := `{direction="` + c.direction + `",role="` + c.role + `",tunnel="` + name + `"}`
+		packets := metrics["dtls_tunnel_packets_total"+labels]
+		bytes := metrics["dtls_tunnel_bytes_total"+labels]
+
+		if packets < 1 || bytes != packets*float64(c.size) {
+			t.Errorf("%s: %v packets and %v bytes, want %d bytes per packet", labels, packets, bytes, c.size)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package dtls_tunnel
+
+import "encoding/binary"
+
+/*
+ * 多路复用模式下 DTLS 连接上每个数据报的格式:
+ *
+ * +------+----------------+-------------+
+ * | type | flow id (u32)  | payload ... |
+ * +------+----------------+-------------+
+ */
+
+// 客户端握手完成后先发送 HELLO 帧 (payload 为 MUX_PROTOCOL), 服务端原样回复表示支持
+// 第一个数据报不是 HELLO 帧时, 仍然按一个连接对应一个 UDP 流处理
+// 非多路复用模式下第一个数据报也可以是 flow id 为 0 的 OPEN 帧, 用来指定目标地址
+// 服务端只在允许客户端指定目标地址时识别, 否则当作普通数据报转发
+// 多路复用模式下客户端为每个流发送 OPEN 帧, payload 为空时使用服务端的 remote
+// 服务端建立流之后回复 OPEN_ACK, 客户端收到之前不发送数据, 没有收到时重发 OPEN
+// 允许客户端指定目标地址时, 服务端丢弃没有 OPEN 的流的数据, 不转发到服务端的 remote
+// (pion/dtls v2 的 ConnectionState 不返回 ALPN 协商结果, 所以在握手之后协商)
+const MUX_PROTOCOL = "dtls-tunnel-mux/1"
+
+const MUX_FRAME_HEADER_SIZE = 5
+
+const (
+	MUX_FRAME_TYPE_DATA     byte = 0x01 // 携带 UDP 数据
+	MUX_FRAME_TYPE_CLOSE    byte = 0x02 // 通知对端流已关闭
+	MUX_FRAME_TYPE_HELLO    byte = 0x03 // 协商多路复用模式
+	MUX_FRAME_TYPE_OPEN     byte = 0x04 // 打开流并指定目标地址, payload 为 "host:port", 为空时使用服务端的 remote
+	MUX_FRAME_TYPE_PING     byte = 0x05 // 客户端的心跳, 见 keepalive.go
+	MUX_FRAME_TYPE_PONG     byte = 0x06 // 服务端对心跳的回复
+	MUX_FRAME_TYPE_OPEN_ACK byte = 0x07 // 服务端确认 OPEN, 流已经建立
+)
+
+type MuxFrameHeader struct {
+	Type   byte
+	FlowID uint32
+}
+
+// EncodeMuxFrameHeader 把头部写入 buffer 的前 MUX_FRAME_HEADER_SIZE 个字节
+func EncodeMuxFrameHeader(buffer []byte, frameType byte, flowID uint32) error {
+	if len(buffer) < MUX_FRAME_HEADER_SIZE {
+		return MakeErrorWithErrMsg("Failed to encode frame header: buffer too small")
+	}
+
+	buffer[0] = frameType
+	binary.BigEndian.PutUint32(buffer[1:MUX_FRAME_HEADER_SIZE], flowID)
+
+	return nil
+}
+
+// DecodeMuxFrame 解析帧, 返回的 payload 引用 frame 的底层数组
+func DecodeMuxFrame(frame []byte) (MuxFrameHeader, []byte, error) {
+	if len(frame) < MUX_FRAME_HEADER_SIZE {
+		return MuxFrameHeader{}, nil, MakeErrorWithErrMsg("Failed to decode frame: frame too short (%d bytes)", len(frame))
+	}
+
+	header := MuxFrameHeader{
+		Type:   frame[0],
+		FlowID: binary.BigEndian.Uint32(frame[1:MUX_FRAME_HEADER_SIZE]),
+	}
+
+	return header, frame[MUX_FRAME_HEADER_SIZE:], nil
+}
+
+// IsMuxHello 判断数据报是否是完整的 HELLO 帧
+func IsMuxHello(datagram []byte) bool {
+	header, data, err := DecodeMuxFrame(datagram)
+	if err != nil {
+		return false
+	}
+
+	return header.Type == MUX_FRAME_TYPE_HELLO && header.FlowID == 0 && string(data) == MUX_PROTOCOL
+}
+
+// IsMuxOpenAck 判断数据报是否是 flowID 的 OPEN_ACK 帧
+func IsMuxOpenAck(datagram []byte, flowID uint32) bool {
+	header, data, err := DecodeMuxFrame(datagram)
+	if err != nil {
+		return false
+	}
+
+	return header.Type == MUX_FRAME_TYPE_OPEN_ACK && header.FlowID == flowID && len(data) == 0
+}
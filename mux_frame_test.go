@@ -0,0 +1,121 @@
+package dtls_tunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMuxFrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		frameType byte
+		flowID    uint32
+		payload   []byte
+	}{
+		{MUX_FRAME_TYPE_DATA, 1, []byte("hello")},
+		{MUX_FRAME_TYPE_DATA, 0xffffffff, nil},
+		{MUX_FRAME_TYPE_CLOSE, 42, nil},
+		{MUX_FRAME_TYPE_OPEN, 7, []byte("10.0.0.53:53")},
+	}
+
+	for _, c := range cases {
+		frame := make([]byte, MUX_FRAME_HEADER_SIZE+len(c.payload))
+		if err := EncodeMuxFrameHeader(frame, c.frameType, c.flowID); err != nil {
+			t.Fatal(err)
+		}
+		copy(frame[MUX_FRAME_HEADER_SIZE:], c.payload)
+
+		header, payload, err := DecodeMuxFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Type != c.frameType || header.FlowID != c.flowID {
+			t.Errorf("decoded header %+v, want type %d flow %d", header, c.frameType, c.flowID)
+		}
+
+		if !bytes.Equal(payload, c.payload) {
+			t.Errorf("decoded payload %q, want %q", payload, c.payload)
+		}
+	}
+}
+
+func TestDecodeMuxFrame(t *testing.T) {
+	header, payload, err := DecodeMuxFrame([]byte{MUX_FRAME_TYPE_DATA, 0x01, 0x02, 0x03, 0x04, 0xaa})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flow id 是大端序
+	if header.FlowID != 0x01020304 {
+		t.Errorf("flow id = %#x, want 0x01020304", header.FlowID)
+	}
+
+	// payload 引用原来的数组, 不拷贝
+	frame := []byte{MUX_FRAME_TYPE_DATA, 0, 0, 0, 1, 0xaa}
+	_, payload, _ = DecodeMuxFrame(frame)
+	frame[MUX_FRAME_HEADER_SIZE] = 0xbb
+	if payload[0] != 0xbb {
+		t.Error("payload does not share the frame's array")
+	}
+
+	for _, frame := range [][]byte{nil, {}, {MUX_FRAME_TYPE_DATA, 0, 0, 0}} {
+		if _, _, err := DecodeMuxFrame(frame); err == nil {
+			t.Errorf("DecodeMuxFrame(%v) succeeded, want error for a frame shorter than the header", frame)
+		}
+	}
+}
+
+func TestEncodeMuxFrameHeaderShortBuffer(t *testing.T) {
+	if err := EncodeMuxFrameHeader(make([]byte, MUX_FRAME_HEADER_SIZE-1), MUX_FRAME_TYPE_DATA, 1); err == nil {
+		t.Error("EncodeMuxFrameHeader succeeded with a buffer shorter than the header")
+	}
+}
+
+func TestIsMuxHello(t *testing.T) {
+	hello := make([]byte, MUX_FRAME_HEADER_SIZE+len(MUX_PROTOCOL))
+	_ = EncodeMuxFrameHeader(hello, MUX_FRAME_TYPE_HELLO, 0)
+	copy(hello[MUX_FRAME_HEADER_SIZE:], MUX_PROTOCOL)
+
+	if !IsMuxHello(hello) {
+		t.Error("IsMuxHello(hello) = false")
+	}
+
+	wrongFlow := append([]byte(nil), hello...)
+	wrongFlow[4] = 1
+
+	wrongProtocol := append([]byte(nil), hello...)
+	wrongProtocol[len(wrongProtocol)-1] = '2'
+
+	wrongType := append([]byte(nil), hello...)
+	wrongType[0] = MUX_FRAME_TYPE_DATA
+
+	for name, datagram := range map[string][]byte{
+		"flow id":   wrongFlow,
+		"protocol":  wrongProtocol,
+		"type":      wrongType,
+		"truncated": hello[:len(hello)-1],
+		"short":     hello[:3],
+	} {
+		if IsMuxHello(datagram) {
+			t.Errorf("IsMuxHello() = true with wrong %s", name)
+		}
+	}
+}
+
+func TestIsMuxOpenAck(t *testing.T) {
+	ack := make([]byte, MUX_FRAME_HEADER_SIZE)
+	_ = EncodeMuxFrameHeader(ack, MUX_FRAME_TYPE_OPEN_ACK, 7)
+
+	if !IsMuxOpenAck(ack, 7) {
+		t.Error("IsMuxOpenAck(ack, 7) = false")
+	}
+
+	if IsMuxOpenAck(ack, 0) {
+		t.Error("IsMuxOpenAck() = true with another flow id")
+	}
+
+	// 非多路复用模式下普通的数据报也可能以同样的字节开头
+	if IsMuxOpenAck(append(ack, 'x'), 7) {
+		t.Error("IsMuxOpenAck() = true with data after the header")
+	}
+}
@@ -1,11 +1,20 @@
 package dtls_tunnel
 
-import "net"
+import (
+	"net/netip"
+	"sync/atomic"
+)
 
 type Payload struct {
 	payloadCapacity int
 	container       []byte
 	payloadLength   int
+
+	// 数据从 container[offset] 开始, 前面的空间留给多路复用的帧头, 发送时不需要再拷贝
+	offset int
+
+	// 仅在 payload 池的调试模式下使用, 归还后为 true
+	released atomic.Bool
 }
 
 func NewPayload(payloadCapacity int) *Payload {
@@ -19,24 +28,48 @@ func NewPayload(payloadCapacity int) *Payload {
 
 }
 
+// PayloadCapacity 是 packageBufferSize 的数据报需要的 payload 容量, 包括多路复用的帧头
+func PayloadCapacity(packageBufferSize int) int {
+	return packageBufferSize + MUX_FRAME_HEADER_SIZE
+}
+
 func (p *Payload) Empty() {
 	p.payloadLength = 0
+	p.offset = 0
 }
 
 func (p *Payload) Data() []byte {
-	return p.container[:p.payloadLength]
+	return p.container[p.offset : p.offset+p.payloadLength]
+}
+
+// Buffer 返回在 container 中留出 headroom 之后长度为 size 的读缓冲区, 读到数据后调用 SetLength
+func (p *Payload) Buffer(headroom int, size int) []byte {
+	p.offset = headroom
+	p.payloadLength = 0
+	return p.container[headroom : headroom+size]
+}
+
+func (p *Payload) SetLength(length int) {
+	p.payloadLength = length
+}
+
+// Frame 返回包括帧头在内的多路复用帧, 数据前面没有留出帧头的空间时返回 false
+func (p *Payload) Frame() ([]byte, bool) {
+	if p.offset < MUX_FRAME_HEADER_SIZE {
+		return nil, false
+	}
+	return p.container[p.offset-MUX_FRAME_HEADER_SIZE : p.offset+p.payloadLength], true
 }
 
+// Package 是等待发送给来源地址的数据报, 按值在队列中传递, 不需要单独分配
 type Package struct {
-	SrcAddress  *net.UDPAddr
-	DestAddress *net.UDPAddr
-	Payload     *Payload
+	SrcAddress netip.AddrPort
+	Payload    *Payload
 }
 
-func NewPackage(srcAddr, destAddr *net.UDPAddr, payload *Payload) *Package {
-	return &Package{
-		SrcAddress:  srcAddr,
-		DestAddress: destAddr,
-		Payload:     payload,
+func NewPackage(srcAddr netip.AddrPort, payload *Payload) Package {
+	return Package{
+		SrcAddress: srcAddr,
+		Payload:    payload,
 	}
 }
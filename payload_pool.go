@@ -1,33 +1,161 @@
 package dtls_tunnel
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 调试模式下归还的 payload 用这个值填满, 取出时检查是否被改写
+const PAYLOAD_POISON = 0xdb
 
 type PayloadPooler interface {
 	Get() (*Payload, error)
 	Put(payload *Payload) error
+	Stats() PayloadPoolStats
+}
+
+// PayloadPoolStats 是 payload 池的统计, 由管理接口和指标读取
+type PayloadPoolStats struct {
+	// 最多同时取出的 payload 数量, 0 表示不限
+	Limit int `json:"limit"`
+
+	// 已经分配的 payload 数量, PayloadPool 的空闲 payload 可能被 GC 回收, 这里不减少
+	Allocated uint64 `json:"allocated"`
+
+	InUse int64 `json:"in_use"`
+	Peak  int64 `json:"peak"`
+
+	// Get 时没有空闲 payload 的次数 (需要分配新的或等待), 其中最终返回错误的次数
+	Misses   uint64 `json:"misses"`
+	Failures uint64 `json:"failures"`
+
+	// 调试模式下发现的重复归还和归还后写入的次数
+	Violations uint64 `json:"violations"`
+}
+
+// payloadPoolCounter 记录两种 payload 池共用的统计
+type payloadPoolCounter struct {
+	allocated  atomic.Uint64
+	inUse      atomic.Int64
+	peak       atomic.Int64
+	misses     atomic.Uint64
+	failures   atomic.Uint64
+	violations atomic.Uint64
+}
+
+func (c *payloadPoolCounter) acquired() {
+	inUse := c.inUse.Add(1)
+	for {
+		peak := c.peak.Load()
+		if inUse <= peak || c.peak.CompareAndSwap(peak, inUse) {
+			return
+		}
+	}
+}
+
+func (c *payloadPoolCounter) released() {
+	c.inUse.Add(-1)
+}
+
+// poison 在调试模式下归还时调用, 标记 payload 已经归还并填满 PAYLOAD_POISON
+// payload 已经被归还过时返回错误, 调用方不能再把它放回池中
+func (c *payloadPoolCounter) poison(payload *Payload) error {
+	if !payload.released.CompareAndSwap(false, true) {
+		c.violations.Add(1)
+		return MakeErrorWithErrMsg("payload %p is put twice", payload)
+	}
+
+	for index := range payload.container {
+		payload.container[index] = PAYLOAD_POISON
+	}
+	return nil
 }
 
+// checkPoison 在调试模式下取出时调用, 缓冲区不再是 PAYLOAD_POISON 说明归还后仍然有人写入
+func (c *payloadPoolCounter) checkPoison(payload *Payload) {
+	if !payload.released.Swap(false) {
+		// 新分配的 payload
+		return
+	}
+
+	for index, value := range payload.container {
+		if value != PAYLOAD_POISON {
+			c.violations.Add(1)
+			logger.Error(FormatString("Payload %p is written at offset %d after it was put", payload, index))
+			return
+		}
+	}
+}
+
+func (c *payloadPoolCounter) stats(limit int) PayloadPoolStats {
+	return PayloadPoolStats{
+		Limit:      limit,
+		Allocated:  c.allocated.Load(),
+		InUse:      c.inUse.Load(),
+		Peak:       c.peak.Load(),
+		Misses:     c.misses.Load(),
+		Failures:   c.failures.Load(),
+		Violations: c.violations.Load(),
+	}
+}
+
+// NewPayloadPoolWithConfig 按 config 创建 payload 池, config 为 nil 或 Limit 为 0 时不限制数量
+func NewPayloadPoolWithConfig(payloadCapacity int, config *PayloadPoolConfig) PayloadPooler {
+	if config == nil {
+		return NewPayloadPool(payloadCapacity)
+	}
+
+	if config.Limit > 0 {
+		return NewBoundedPayloadPool(payloadCapacity, config)
+	}
+
+	pool := NewPayloadPool(payloadCapacity).(*PayloadPool)
+	pool.debug = config.Debug
+	return pool
+}
+
+// PayloadPool 基于 sync.Pool, 不限制数量, Get 不会失败
 type PayloadPool struct {
 	payloadPool *sync.Pool
+	counter     *payloadPoolCounter
+	debug       bool
 }
 
 func NewPayloadPool(payloadCapacity int) PayloadPooler {
+	counter := &payloadPoolCounter{}
 	pool := &PayloadPool{
 		payloadPool: &sync.Pool{
 			New: func() any {
+				counter.allocated.Add(1)
+				counter.misses.Add(1)
 				return NewPayload(payloadCapacity)
 			},
 		},
+		counter: counter,
 	}
 	return pool
 }
 
 func (p *PayloadPool) Get() (*Payload, error) {
 	payload := p.payloadPool.Get().(*Payload)
+	if p.debug {
+		p.counter.checkPoison(payload)
+	}
+	p.counter.acquired()
 	return payload, nil
 }
 
 func (p *PayloadPool) Put(payload *Payload) error {
+	if p.debug {
+		if err := p.counter.poison(payload); err != nil {
+			return err
+		}
+	}
 	p.payloadPool.Put(payload)
+	p.counter.released()
 	return nil
 }
+
+func (p *PayloadPool) Stats() PayloadPoolStats {
+	return p.counter.stats(0)
+}
@@ -0,0 +1,117 @@
+package dtls_tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+const TEST_PAYLOAD_CAPACITY = 64
+
+func TestPayloadPoolDoublePut(t *testing.T) {
+	pools := map[string]PayloadPooler{
+		"unbounded": NewPayloadPoolWithConfig(TEST_PAYLOAD_CAPACITY, &PayloadPoolConfig{Debug: true}),
+		"bounded":   NewPayloadPoolWithConfig(TEST_PAYLOAD_CAPACITY, &PayloadPoolConfig{Limit: 2, ExhaustedPolicy: POOL_EXHAUSTED_FAIL, Debug: true}),
+	}
+
+	for name, pool := range pools {
+		payload, err := pool.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := pool.Put(payload); err != nil {
+			t.Fatalf("%s: first Put: %s", name, err.Error())
+		}
+
+		if err := pool.Put(payload); err == nil {
+			t.Errorf("%s: second Put succeeded, want error", name)
+		}
+
+		stats := pool.Stats()
+		if stats.Violations != 1 || stats.InUse != 0 {
+			t.Errorf("%s: %d violations and %d in use, want 1 and 0", name, stats.Violations, stats.InUse)
+		}
+
+		// 重复归还的 payload 没有第二次放回, 不会同时被两个调用方取出
+		first, _ := pool.Get()
+		second, _ := pool.Get()
+		if first == second {
+			t.Errorf("%s: the same payload is taken twice", name)
+		}
+	}
+}
+
+func TestPayloadPoolWriteAfterPut(t *testing.T) {
+	pool := NewPayloadPoolWithConfig(TEST_PAYLOAD_CAPACITY, &PayloadPoolConfig{Limit: 1, ExhaustedPolicy: POOL_EXHAUSTED_FAIL, Debug: true})
+
+	payload, _ := pool.Get()
+	copy(payload.Buffer(0, 5), "hello")
+	payload.SetLength(5)
+	_ = pool.Put(payload)
+
+	// 归还后的缓冲区被填满 PAYLOAD_POISON
+	if payload.Data()[0] != PAYLOAD_POISON {
+		t.Errorf("payload is %x after Put, want poisoned", payload.Data())
+	}
+
+	payload.Data()[1] = 'x'
+	if _, err := pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	if violations := pool.Stats().Violations; violations != 1 {
+		t.Errorf("%d violations after writing to a put payload, want 1", violations)
+	}
+}
+
+func TestBoundedPayloadPoolLimit(t *testing.T) {
+	pool := NewPayloadPoolWithConfig(TEST_PAYLOAD_CAPACITY, &PayloadPoolConfig{Limit: 2, ExhaustedPolicy: POOL_EXHAUSTED_FAIL})
+
+	first, _ := pool.Get()
+	_, _ = pool.Get()
+
+	if _, err := pool.Get(); err == nil {
+		t.Fatal("Get() succeeded with all payloads in use")
+	}
+
+	_ = pool.Put(first)
+	if payload, err := pool.Get(); err != nil || payload != first {
+		t.Errorf("Get() after Put = %p, %v, want the put payload", payload, err)
+	}
+
+	stats := pool.Stats()
+	if stats.Limit != 2 || stats.Allocated != 2 || stats.InUse != 2 || stats.Peak != 2 || stats.Failures != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// 不属于这个池的 payload 不能放入
+	if err := pool.Put(NewPayload(TEST_PAYLOAD_CAPACITY * 2)); err == nil {
+		t.Error("Put() accepted a payload of another capacity")
+	}
+}
+
+func TestBoundedPayloadPoolBlock(t *testing.T) {
+	pool := NewPayloadPoolWithConfig(TEST_PAYLOAD_CAPACITY, &PayloadPoolConfig{Limit: 1, ExhaustedPolicy: POOL_EXHAUSTED_BLOCK, Timeout: time.Millisecond * 20})
+
+	payload, _ := pool.Get()
+
+	start := time.Now()
+	if _, err := pool.Get(); err == nil {
+		t.Fatal("Get() succeeded with all payloads in use")
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*20 {
+		t.Errorf("Get() failed after %s, want to wait for the timeout", elapsed)
+	}
+
+	// 等待期间归还的 payload 直接交给等待的调用方
+	pool = NewPayloadPoolWithConfig(TEST_PAYLOAD_CAPACITY, &PayloadPoolConfig{Limit: 1, ExhaustedPolicy: POOL_EXHAUSTED_BLOCK, Timeout: time.Second})
+	payload, _ = pool.Get()
+	go func() {
+		time.Sleep(time.Millisecond * 5)
+		_ = pool.Put(payload)
+	}()
+
+	if waited, err := pool.Get(); err != nil || waited != payload {
+		t.Errorf("Get() while waiting = %p, %v, want the put payload", waited, err)
+	}
+}
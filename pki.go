@@ -0,0 +1,343 @@
+package dtls_tunnel
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * 简单的 PKI, 所有文件放在同一个目录下
+ * ca.key ca.crt    根证书, 对应 -rc
+ * <name>.key/.crt  服务端和客户端证书, 对应 -key 和 -cert
+ * crl.pem          吊销列表, 对应 -crl
+ * 密钥都是 ECDSA P-256
+ */
+
+const PKI_CA_KEY_FILE = "ca.key"
+const PKI_CA_CERT_FILE = "ca.crt"
+const PKI_CRL_FILE = "crl.pem"
+
+// 吊销列表的有效期, 过期前需要重新签名
+const PKI_CRL_VALIDITY = time.Hour * 24 * 30
+
+const PKI_USAGE_SERVER = "server"
+const PKI_USAGE_CLIENT = "client"
+
+type PKI struct {
+	dir string
+}
+
+func NewPKI(dir string) *PKI {
+	return &PKI{dir: dir}
+}
+
+func (p *PKI) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// CertificateRequest 描述要签发的证书
+type CertificateRequest struct {
+	// 输出文件名, 生成 <Name>.key 和 <Name>.crt
+	Name string
+
+	// PKI_USAGE_SERVER 或 PKI_USAGE_CLIENT
+	Usage string
+
+	CommonName          string
+	OrganizationalUnits []string
+
+	// DNS 名称或者 IP 地址, 自动区分
+	SANs []string
+
+	Validity time.Duration
+}
+
+// InitCA 生成根证书和空的吊销列表
+func (p *PKI) InitCA(commonName string, validity time.Duration, overwrite bool) error {
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return MakeErrorWithErrMsg("Failed to create pki directory: %s", err.Error())
+	}
+
+	if !overwrite {
+		if err := checkNotExist(p.path(PKI_CA_KEY_FILE), p.path(PKI_CA_CERT_FILE), p.path(PKI_CRL_FILE)); err != nil {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to generate key: %s", err.Error())
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to create ca certificate: %s", err.Error())
+	}
+
+	if err := writeKeyAndCertificate(p.path(PKI_CA_KEY_FILE), p.path(PKI_CA_CERT_FILE), key, der); err != nil {
+		return err
+	}
+
+	return p.writeCRL(nil)
+}
+
+// Issue 用根证书签发服务端或客户端证书, 返回密钥和证书的路径
+func (p *PKI) Issue(request *CertificateRequest, overwrite bool) (string, string, error) {
+	if request.Name == "" || strings.ContainsAny(request.Name, `/\`) {
+		return "", "", MakeErrorWithErrMsg("invalid name %q", request.Name)
+	}
+
+	keyPath := p.path(request.Name + ".key")
+	certPath := p.path(request.Name + ".crt")
+
+	if !overwrite {
+		if err := checkNotExist(keyPath, certPath); err != nil {
+			return "", "", err
+		}
+	}
+
+	ca, caKey, err := p.loadCA()
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", MakeErrorWithErrMsg("Failed to generate key: %s", err.Error())
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         request.CommonName,
+			OrganizationalUnit: request.OrganizationalUnits,
+		},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(request.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	switch request.Usage {
+	case PKI_USAGE_SERVER:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case PKI_USAGE_CLIENT:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return "", "", MakeErrorWithErrMsg("bad certificate usage: %q", request.Usage)
+	}
+
+	for _, san := range request.SANs {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+			continue
+		}
+		template.DNSNames = append(template.DNSNames, san)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", MakeErrorWithErrMsg("Failed to create certificate: %s", err.Error())
+	}
+
+	if err := writeKeyAndCertificate(keyPath, certPath, key, der); err != nil {
+		return "", "", err
+	}
+
+	return keyPath, certPath, nil
+}
+
+// Revoke 把证书加入吊销列表并重新签名, 已经吊销的证书不会重复添加
+func (p *PKI) Revoke(certPath string) error {
+	cert, err := loadCertificateFile(certPath)
+	if err != nil {
+		return err
+	}
+
+	entries, err := p.loadRevokedCertificates()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return nil
+		}
+	}
+
+	entries = append(entries, pkix.RevokedCertificate{
+		SerialNumber:   cert.SerialNumber,
+		RevocationTime: time.Now(),
+	})
+
+	return p.writeCRL(entries)
+}
+
+// RefreshCRL 不改变内容, 只重新签名以更新 NextUpdate
+func (p *PKI) RefreshCRL() error {
+	entries, err := p.loadRevokedCertificates()
+	if err != nil {
+		return err
+	}
+
+	return p.writeCRL(entries)
+}
+
+func (p *PKI) writeCRL(entries []pkix.RevokedCertificate) error {
+	ca, caKey, err := p.loadCA()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(PKI_CRL_VALIDITY),
+		RevokedCertificates: entries,
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca, caKey)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to create crl: %s", err.Error())
+	}
+
+	return writePEMFile(p.path(PKI_CRL_FILE), "X509 CRL", der, 0644)
+}
+
+func (p *PKI) loadRevokedCertificates() ([]pkix.RevokedCertificate, error) {
+	lists, err := loadRevocationLists(p.path(PKI_CRL_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to load crl: %s", err.Error())
+	}
+
+	var entries []pkix.RevokedCertificate
+	for _, list := range lists {
+		entries = append(entries, list.list.RevokedCertificates...)
+	}
+
+	return entries, nil
+}
+
+func (p *PKI) loadCA() (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(p.path(PKI_CA_CERT_FILE), p.path(PKI_CA_KEY_FILE))
+	if err != nil {
+		return nil, nil, MakeErrorWithErrMsg("Failed to load ca (run \"pki init\" first?): %s", err.Error())
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, MakeErrorWithErrMsg("Failed to parse ca certificate: %s", err.Error())
+	}
+
+	signer, isSigner := pair.PrivateKey.(crypto.Signer)
+	if !isSigner {
+		return nil, nil, MakeErrorWithErrMsg("ca key cannot sign")
+	}
+
+	return cert, signer, nil
+}
+
+func loadCertificateFile(path string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to read certificate: %s", err.Error())
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, MakeErrorWithErrMsg("no certificate found in %s", path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to parse certificate: %s", err.Error())
+	}
+
+	return cert, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to generate serial number: %s", err.Error())
+	}
+	return serial, nil
+}
+
+func checkNotExist(paths ...string) error {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return MakeErrorWithErrMsg("%s already exists (use -force to overwrite)", path)
+		}
+	}
+	return nil
+}
+
+func writeKeyAndCertificate(keyPath string, certPath string, key *ecdsa.PrivateKey, certDER []byte) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to marshal key: %s", err.Error())
+	}
+
+	if err := writePEMFile(keyPath, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+
+	return writePEMFile(certPath, "CERTIFICATE", certDER, 0644)
+}
+
+func writePEMFile(path string, blockType string, der []byte, perm os.FileMode) error {
+	content := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+
+	// 先写临时文件再改名, 避免正在监视的进程读到一半的文件
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, perm); err != nil {
+		return MakeErrorWithErrMsg("Failed to write %s: %s", path, err.Error())
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return MakeErrorWithErrMsg("Failed to write %s: %s", path, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package dtls_tunnel
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const PKI_USAGE = `usage: dtls_tunnel pki <command> [flags]
+
+commands:
+  init          create ca.key, ca.crt and an empty crl.pem
+  issue-server  issue a server certificate signed by the ca
+  issue-client  issue a client certificate signed by the ca
+  revoke        add a certificate to crl.pem
+  refresh-crl   re-sign crl.pem to extend its next update time
+
+run "dtls_tunnel pki <command> -h" for the flags of each command`
+
+// RunPKICommand 执行 "pki" 子命令, args 不包含 "pki" 本身
+func RunPKICommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, PKI_USAGE)
+		return MakeErrorWithErrMsg("missing pki command")
+	}
+
+	command := args[0]
+	flagSet := flag.NewFlagSet("pki "+command, flag.ContinueOnError)
+
+	var dir string
+	var force bool
+	flagSet.StringVar(&dir, "dir", "pki", "directory of the ca and issued certificates")
+	flagSet.BoolVar(&force, "force", false, "overwrite existing files")
+
+	switch command {
+	case "init":
+		var commonName string
+		var validity time.Duration
+		flagSet.StringVar(&commonName, "cn", "dtls_tunnel CA", "common name of the ca")
+		flagSet.DurationVar(&validity, "valid", time.Hour*24*3650, "validity of the ca certificate")
+
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		if err := NewPKI(dir).InitCA(commonName, validity, force); err != nil {
+			return err
+		}
+
+		fmt.Printf("-rc %s -crl %s\n", NewPKI(dir).path(PKI_CA_CERT_FILE), NewPKI(dir).path(PKI_CRL_FILE))
+		return nil
+
+	case "issue-server", "issue-client":
+		request := &CertificateRequest{Usage: strings.TrimPrefix(command, "issue-")}
+
+		var ous string
+		var sans string
+		flagSet.StringVar(&request.Name, "name", request.Usage, "output file name without extension")
+		flagSet.StringVar(&request.CommonName, "cn", "", "common name (default: -name)")
+		flagSet.StringVar(&ous, "ou", "", "comma separated organizational units")
+		flagSet.StringVar(&sans, "san", "", "comma separated DNS names or IP addresses")
+		flagSet.DurationVar(&request.Validity, "valid", time.Hour*24*365, "validity of the certificate")
+
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		if request.CommonName == "" {
+			request.CommonName = request.Name
+		}
+		request.OrganizationalUnits = splitList(ous)
+		request.SANs = splitList(sans)
+
+		keyPath, certPath, err := NewPKI(dir).Issue(request, force)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("-key %s -cert %s\n", keyPath, certPath)
+		return nil
+
+	case "revoke":
+		var certPath string
+		flagSet.StringVar(&certPath, "cert", "", "path of the certificate to revoke")
+
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		if certPath == "" {
+			return MakeErrorWithErrMsg("-cert is required")
+		}
+
+		return NewPKI(dir).Revoke(certPath)
+
+	case "refresh-crl":
+		if err := flagSet.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		return NewPKI(dir).RefreshCRL()
+
+	default:
+		fmt.Fprintln(os.Stderr, PKI_USAGE)
+		return MakeErrorWithErrMsg("unknown pki command %q", command)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,122 @@
+package dtls_tunnel
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * PSK 密钥文件, 每行一个 "identity:hexkey", # 开头的行为注释
+ * Server 按客户端发来的 identity 选择密钥
+ * Client 使用自己 identity 对应的那一行
+ */
+
+const AUTH_MODE_CERT = "cert"
+const AUTH_MODE_PSK = "psk"
+
+type PSKKeyStore struct {
+	path    string
+	modTime map[string]time.Time
+	keys    map[string][]byte
+	lock    *sync.RWMutex
+}
+
+func NewPSKKeyStore() *PSKKeyStore {
+	return &PSKKeyStore{
+		keys: make(map[string][]byte),
+		lock: &sync.RWMutex{},
+	}
+}
+
+func LoadPSKKeyFile(path string) (*PSKKeyStore, error) {
+	modTime := FileModTimes(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to open psk file: %s", err.Error())
+	}
+	defer file.Close()
+
+	store := NewPSKKeyStore()
+	store.path = path
+	store.modTime = modTime
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		identity, hexKey, isFound := strings.Cut(line, ":")
+		if !isFound || identity == "" {
+			return nil, MakeErrorWithErrMsg("%s:%d: expected \"identity:hexkey\"", path, lineNumber)
+		}
+
+		key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if err != nil {
+			return nil, MakeErrorWithErrMsg("%s:%d: key is not valid hex", path, lineNumber)
+		}
+
+		if len(key) < 16 {
+			return nil, MakeErrorWithErrMsg("%s:%d: key must be at least 16 bytes", path, lineNumber)
+		}
+
+		if _, isExist := store.keys[identity]; isExist {
+			return nil, MakeErrorWithErrMsg("%s:%d: duplicate identity %q", path, lineNumber, identity)
+		}
+
+		store.keys[identity] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, MakeErrorWithErrMsg("Failed to read psk file: %s", err.Error())
+	}
+
+	if len(store.keys) == 0 {
+		return nil, MakeErrorWithErrMsg("%s: no key found", path)
+	}
+
+	return store, nil
+}
+
+func (s *PSKKeyStore) Get(identity string) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key, isExist := s.keys[identity]
+	return key, isExist
+}
+
+// Reload 重新读取密钥文件并替换全部密钥, 读取失败时保留原来的密钥
+func (s *PSKKeyStore) Reload() error {
+	other, err := LoadPSKKeyFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys = other.keys
+	s.modTime = other.modTime
+
+	return nil
+}
+
+func (s *PSKKeyStore) IsChanged() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return IsFilesChanged(s.modTime)
+}
+
+func (s *PSKKeyStore) String() string {
+	return s.path
+}
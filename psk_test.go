@@ -0,0 +1,168 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// 密钥不一致时服务端丢弃无法解密的记录, 客户端只能等到超时
+const TEST_HANDSHAKE_TIMEOUT = time.Second
+
+// testHandshake 在回环地址上握手, 返回客户端一侧的错误和服务端看到的连接状态
+func testHandshake(t *testing.T, serverConfig *dtls.Config, clientConfig *dtls.Config) (dtls.State, error) {
+	t.Helper()
+
+	listener, err := dtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	states := make(chan dtls.State, 1)
+	go func() {
+		defer close(states)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		dtlsConn := conn.(*dtls.Conn)
+		if err := dtlsConn.HandshakeContext(ctx); err != nil {
+			return
+		}
+
+		state, _ := dtlsConn.ConnectionState()
+		states <- state
+	}()
+
+	client, err := dtls.Dial("udp", listener.Addr().(*net.UDPAddr), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.HandshakeContext(ctx); err != nil {
+		return dtls.State{}, err
+	}
+
+	state, isOK := <-states
+	if !isOK {
+		return dtls.State{}, MakeErrorWithErrMsg("server failed to handshake")
+	}
+	return state, nil
+}
+
+func writeTestPSKFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "psk.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPSKKeyFile(t *testing.T) {
+	path := writeTestPSKFile(t, `
+# comment
+alice:000102030405060708090a0b0c0d0e0f
+  bob : 101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f
+`)
+
+	store, err := LoadPSKKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key, isExist := store.Get("alice"); !isExist || len(key) != 16 || key[15] != 0x0f {
+		t.Errorf("alice: key %x, exist %v", key, isExist)
+	}
+
+	// 只去掉整行首尾的空白, 冒号前的空格保留在 identity 中
+	if _, isExist := store.Get("bob "); !isExist {
+		t.Error("bob: not found")
+	}
+
+	if _, isExist := store.Get("carol"); isExist {
+		t.Error("carol: found")
+	}
+}
+
+func TestLoadPSKKeyFileErrors(t *testing.T) {
+	cases := map[string]string{
+		"empty":         "# only a comment\n",
+		"no separator":  "alice 000102030405060708090a0b0c0d0e0f\n",
+		"no identity":   ":000102030405060708090a0b0c0d0e0f\n",
+		"bad hex":       "alice:zz0102030405060708090a0b0c0d0e0f\n",
+		"short key":     "alice:0001020304050607\n",
+		"duplicate":     "alice:000102030405060708090a0b0c0d0e0f\nalice:000102030405060708090a0b0c0d0e0f\n",
+		"missing colon": "000102030405060708090a0b0c0d0e0f\n",
+	}
+
+	for name, content := range cases {
+		if _, err := LoadPSKKeyFile(writeTestPSKFile(t, content)); err == nil {
+			t.Errorf("%s: LoadPSKKeyFile succeeded, want error", name)
+		}
+	}
+
+	if _, err := LoadPSKKeyFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing file: LoadPSKKeyFile succeeded, want error")
+	}
+}
+
+func TestPSKHandshake(t *testing.T) {
+	serverKeys, err := LoadPSKKeyFile(writeTestPSKFile(t, "alice:000102030405060708090a0b0c0d0e0f\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ServerConfig{}
+	serverConfig.AuthMode = AUTH_MODE_PSK
+	serverConfig.PSKKeys = serverKeys
+	serverConfig.PSKIdentityHint = "tunnel"
+
+	cases := []struct {
+		name     string
+		identity string
+		key      string
+		isOK     bool
+	}{
+		{"matching key", "alice", "000102030405060708090a0b0c0d0e0f", true},
+		{"wrong key", "alice", "ff0102030405060708090a0b0c0d0e0f", false},
+		{"unknown identity", "mallory", "000102030405060708090a0b0c0d0e0f", false},
+	}
+
+	for _, c := range cases {
+		clientKeys, err := LoadPSKKeyFile(writeTestPSKFile(t, c.identity+":"+c.key+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clientConfig := &ClientConfig{}
+		clientConfig.AuthMode = AUTH_MODE_PSK
+		clientConfig.PSKKeys = clientKeys
+		clientConfig.PSKIdentity = c.identity
+
+		state, err := testHandshake(t, newServerAuthDTLSConfig(serverConfig), newClientAuthDTLSConfig(clientConfig))
+		if (err == nil) != c.isOK {
+			t.Errorf("%s: handshake error %v, want success %v", c.name, err, c.isOK)
+			continue
+		}
+
+		// 服务端按客户端的 identity 识别身份
+		if c.isOK && PeerIdentityFromState(&state).PSKIdentity != c.identity {
+			t.Errorf("%s: server sees identity %q, want %q", c.name, state.IdentityHint, c.identity)
+		}
+	}
+}
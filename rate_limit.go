@@ -0,0 +1,379 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * 令牌桶限速, 每秒的数据报数量和字节数分别用一个令牌桶, 两个方向 (upstream/downstream) 分开限制
+ * 限速的范围:
+ * global:   整个隧道
+ * source:   Client 的每个源地址, 即每个 ClientMapper
+ * identity: Server 的每个客户端身份, 同一身份的所有连接和 flow 共用
+ * 数据报先经过 source 或 identity 的令牌桶, 再经过 global 的令牌桶, 都取到令牌后才转发
+ *
+ * 超过限制时按 Action 处理:
+ * RATE_LIMIT_ACTION_DROP:  直接丢弃
+ * RATE_LIMIT_ACTION_QUEUE: 在转发的协程中等待令牌, 需要等待超过 MaxDelay 时丢弃
+ * 等待期间后面的数据报留在原来的地方 (Client 映射的队列, DTLS 连接或上游 socket 的接收缓冲区), 满了以后按原来的方式丢弃
+ */
+
+const RATE_LIMIT_ACTION_DROP = "drop"
+const RATE_LIMIT_ACTION_QUEUE = "queue"
+
+const RATE_LIMIT_SCOPE_GLOBAL = "global"
+const RATE_LIMIT_SCOPE_SOURCE = "source"
+const RATE_LIMIT_SCOPE_IDENTITY = "identity"
+
+// 令牌桶最多积累的令牌按速率换算成的时间, 允许这么长时间的突发
+const DEFAULT_RATE_LIMIT_BURST = time.Millisecond * 100
+
+// RATE_LIMIT_ACTION_QUEUE 时一个数据报最长的等待
+const DEFAULT_RATE_LIMIT_MAX_DELAY = time.Millisecond * 50
+
+// Rate 是每秒的数据报数量和字节数, 为 0 的一项不限制
+type Rate struct {
+	Packets int64
+	Bytes   int64
+}
+
+func (r Rate) IsLimited() bool {
+	return r.Packets > 0 || r.Bytes > 0
+}
+
+// RateLimit 是一个隧道的限速配置
+type RateLimit struct {
+	Global   Rate
+	Source   Rate // 仅 Client
+	Identity Rate // 仅 Server
+
+	Action   string
+	Burst    time.Duration
+	MaxDelay time.Duration
+}
+
+// TokenBucket 按 rate 每秒补充令牌, 最多积累 burst 个
+type TokenBucket struct {
+	lock   *sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket 创建装满令牌的令牌桶, burst 至少是一个令牌
+func NewTokenBucket(rate int64, burst time.Duration) *TokenBucket {
+	tokens := float64(rate) * burst.Seconds()
+	if tokens < 1 {
+		tokens = 1
+	}
+
+	return &TokenBucket{
+		lock:   &sync.Mutex{},
+		rate:   float64(rate),
+		burst:  tokens,
+		tokens: tokens,
+		last:   time.Now(),
+	}
+}
+
+// reserve 取出 n 个令牌, 不够时预支并返回需要等待的时间, 需要等待超过 maxDelay 时不取出并返回 false
+// 比 burst 大的数据报按 burst 计算, 否则永远取不到
+func (b *TokenBucket) reserve(now time.Time, n float64, maxDelay time.Duration) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if n > b.burst {
+		n = b.burst
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+
+	delay := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if delay > maxDelay {
+		return 0, false
+	}
+
+	b.tokens -= n
+	return delay, true
+}
+
+// cancel 退还 reserve 取出的令牌, 用于外层的令牌桶拒绝了这个数据报
+func (b *TokenBucket) cancel(n float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if n > b.burst {
+		n = b.burst
+	}
+
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// RateLimiter 限制一个范围内一个方向的流量, parent 是外层范围的 RateLimiter, 例如 source 的 parent 是 global
+// 为 nil 时不限制
+type RateLimiter struct {
+	scope     string
+	key       string // source 是源地址, identity 是客户端身份, global 为空
+	direction string
+	rate      Rate
+
+	packets  *TokenBucket // 不限制数量时为 nil
+	bytes    *TokenBucket // 不限制字节数时为 nil
+	maxDelay time.Duration
+	parent   *RateLimiter
+
+	// 因为这个范围的限制被丢弃和等待过的数据报, 管理接口并发读取
+	dropped atomic.Uint64
+	queued  atomic.Uint64
+
+	droppedCounter prometheus.Counter
+	queuedCounter  prometheus.Counter
+}
+
+func NewRateLimiter(config *RateLimit, scope string, key string, direction string, rate Rate, parent *RateLimiter, metrics *TunnelMetrics) *RateLimiter {
+	limiter := &RateLimiter{
+		scope:     scope,
+		key:       key,
+		direction: direction,
+		rate:      rate,
+		parent:    parent,
+	}
+
+	if config.Action == RATE_LIMIT_ACTION_QUEUE {
+		limiter.maxDelay = config.MaxDelay
+	}
+
+	if rate.Packets > 0 {
+		limiter.packets = NewTokenBucket(rate.Packets, config.Burst)
+	}
+	if rate.Bytes > 0 {
+		limiter.bytes = NewTokenBucket(rate.Bytes, config.Burst)
+	}
+
+	limiter.droppedCounter, limiter.queuedCounter = metrics.RateLimitCounters(scope, direction)
+
+	return limiter
+}
+
+// Wait 为一个 n 字节的数据报取令牌, 需要等待时在这里等待, 返回 false 时调用方丢弃这个数据报
+func (l *RateLimiter) Wait(ctx context.Context, n int) bool {
+	if l == nil {
+		return true
+	}
+
+	delay, cause, isAllowed := l.reserve(time.Now(), n)
+	if !isAllowed {
+		cause.dropped.Add(1)
+		cause.droppedCounter.Inc()
+		return false
+	}
+
+	if delay <= 0 {
+		return true
+	}
+
+	cause.queued.Add(1)
+	cause.queuedCounter.Inc()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// reserve 依次在这一层和外层取令牌, 任何一层拒绝时退还已经取出的令牌
+// 返回最长的等待时间, cause 是需要等待最久或者拒绝了数据报的一层
+func (l *RateLimiter) reserve(now time.Time, n int) (time.Duration, *RateLimiter, bool) {
+	var maxDelay time.Duration = 0
+	var cause *RateLimiter = nil
+
+	for limiter := l; limiter != nil; limiter = limiter.parent {
+		delay, isAllowed := limiter.reserveOne(now, n)
+		if !isAllowed {
+			for reserved := l; reserved != limiter; reserved = reserved.parent {
+				reserved.cancelOne(n)
+			}
+			return 0, limiter, false
+		}
+
+		if delay > maxDelay {
+			maxDelay = delay
+			cause = limiter
+		}
+	}
+
+	return maxDelay, cause, true
+}
+
+func (l *RateLimiter) reserveOne(now time.Time, n int) (time.Duration, bool) {
+	var delay time.Duration = 0
+
+	if l.packets != nil {
+		packetDelay, isAllowed := l.packets.reserve(now, 1, l.maxDelay)
+		if !isAllowed {
+			return 0, false
+		}
+		delay = packetDelay
+	}
+
+	if l.bytes != nil {
+		byteDelay, isAllowed := l.bytes.reserve(now, float64(n), l.maxDelay)
+		if !isAllowed {
+			if l.packets != nil {
+				l.packets.cancel(1)
+			}
+			return 0, false
+		}
+		if byteDelay > delay {
+			delay = byteDelay
+		}
+	}
+
+	return delay, true
+}
+
+func (l *RateLimiter) cancelOne(n int) {
+	if l.packets != nil {
+		l.packets.cancel(1)
+	}
+	if l.bytes != nil {
+		l.bytes.cancel(float64(n))
+	}
+}
+
+func (l *RateLimiter) Info() *RateLimiterInfo {
+	return &RateLimiterInfo{
+		Scope:            l.scope,
+		Key:              l.key,
+		Direction:        l.direction,
+		PacketsPerSecond: l.rate.Packets,
+		BytesPerSecond:   l.rate.Bytes,
+		Dropped:          l.dropped.Load(),
+		Queued:           l.queued.Load(),
+	}
+}
+
+// RateLimiters 是一个范围内两个方向的 RateLimiter, 为 nil 时不限制
+type RateLimiters struct {
+	upstream   *RateLimiter
+	downstream *RateLimiter
+}
+
+// NewRateLimiters 创建一个范围的 RateLimiters, 没有配置限速或者这个范围不限制时直接返回 parent
+func NewRateLimiters(config *RateLimit, scope string, key string, rate Rate, parent *RateLimiters, metrics *TunnelMetrics) *RateLimiters {
+	if config == nil || !rate.IsLimited() {
+		return parent
+	}
+
+	return &RateLimiters{
+		upstream:   NewRateLimiter(config, scope, key, METRICS_DIRECTION_UPSTREAM, rate, parent.Upstream(), metrics),
+		downstream: NewRateLimiter(config, scope, key, METRICS_DIRECTION_DOWNSTREAM, rate, parent.Downstream(), metrics),
+	}
+}
+
+// Upstream 限制发往目标地址的方向
+func (l *RateLimiters) Upstream() *RateLimiter {
+	if l == nil {
+		return nil
+	}
+	return l.upstream
+}
+
+// Downstream 限制返回源地址的方向
+func (l *RateLimiters) Downstream() *RateLimiter {
+	if l == nil {
+		return nil
+	}
+	return l.downstream
+}
+
+func (l *RateLimiters) Infos() []*RateLimiterInfo {
+	if l == nil {
+		return []*RateLimiterInfo{}
+	}
+	return []*RateLimiterInfo{l.upstream.Info(), l.downstream.Info()}
+}
+
+// RateLimiterGroup 按键共用 RateLimiters, 第一个使用者创建, 最后一个使用者释放后删除
+type RateLimiterGroup struct {
+	lock    *sync.Mutex
+	entries map[string]*rateLimiterEntry
+}
+
+type rateLimiterEntry struct {
+	limiters *RateLimiters
+	refs     int
+}
+
+func NewRateLimiterGroup() *RateLimiterGroup {
+	return &RateLimiterGroup{
+		lock:    &sync.Mutex{},
+		entries: make(map[string]*rateLimiterEntry),
+	}
+}
+
+// Acquire 返回 key 的 RateLimiters, 不存在时用 create 创建, 用完后调用 Release
+func (g *RateLimiterGroup) Acquire(key string, create func() *RateLimiters) *RateLimiters {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	entry, isExist := g.entries[key]
+	if !isExist {
+		entry = &rateLimiterEntry{limiters: create()}
+		g.entries[key] = entry
+	}
+
+	entry.refs++
+	return entry.limiters
+}
+
+func (g *RateLimiterGroup) Release(key string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	entry, isExist := g.entries[key]
+	if !isExist {
+		return
+	}
+
+	entry.refs--
+	if entry.refs <= 0 {
+		delete(g.entries, key)
+	}
+}
+
+func (g *RateLimiterGroup) Infos() []*RateLimiterInfo {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	infos := make([]*RateLimiterInfo, 0, len(g.entries)*2)
+	for _, entry := range g.entries {
+		infos = append(infos, entry.limiters.Infos()...)
+	}
+	return infos
+}
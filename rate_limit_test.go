@@ -0,0 +1,180 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	// 每秒 100 个令牌, 最多积累 10 个
+	bucket := NewTokenBucket(100, time.Millisecond*100)
+	now := bucket.last
+
+	for index := 0; index < 10; index++ {
+		if delay, isOK := bucket.reserve(now, 1, 0); !isOK || delay != 0 {
+			t.Fatalf("reserve %d within burst: delay %s, ok %v", index, delay, isOK)
+		}
+	}
+
+	// 令牌用完后不允许等待时拒绝, 并且不取出令牌
+	if _, isOK := bucket.reserve(now, 1, 0); isOK {
+		t.Fatal("reserve succeeded with an empty bucket and no delay allowed")
+	}
+
+	// 允许等待时预支, 下一个令牌在 10ms 后补充
+	if delay, isOK := bucket.reserve(now, 1, time.Millisecond*50); !isOK || delay != time.Millisecond*10 {
+		t.Errorf("reserve with delay: delay %s, ok %v, want 10ms", delay, isOK)
+	}
+	if delay, isOK := bucket.reserve(now, 1, time.Millisecond*50); !isOK || delay != time.Millisecond*20 {
+		t.Errorf("second reserve with delay: delay %s, ok %v, want 20ms", delay, isOK)
+	}
+
+	// 补充的令牌不超过 burst
+	now = now.Add(time.Second)
+	for index := 0; index < 10; index++ {
+		if _, isOK := bucket.reserve(now, 1, 0); !isOK {
+			t.Fatalf("reserve %d after refill failed", index)
+		}
+	}
+	if _, isOK := bucket.reserve(now, 1, 0); isOK {
+		t.Error("more tokens than burst after a long pause")
+	}
+}
+
+func TestTokenBucketLargeReserve(t *testing.T) {
+	// 比 burst 大的数据报按 burst 计算, 装满时可以通过
+	bucket := NewTokenBucket(1000, time.Millisecond*100)
+	if _, isOK := bucket.reserve(bucket.last, 1500, 0); !isOK {
+		t.Error("a reserve larger than burst fails with a full bucket")
+	}
+
+	bucket.cancel(1500)
+	if bucket.tokens != bucket.burst {
+		t.Errorf("tokens %f after cancel, want burst %f", bucket.tokens, bucket.burst)
+	}
+
+	// 速率很低时 burst 至少是一个令牌
+	if bucket := NewTokenBucket(1, time.Millisecond); bucket.burst != 1 {
+		t.Errorf("burst = %f, want 1", bucket.burst)
+	}
+}
+
+func newTestRateLimiter(action string, rate Rate, parent *RateLimiter) *RateLimiter {
+	config := &RateLimit{
+		Action:   action,
+		Burst:    time.Second,
+		MaxDelay: time.Millisecond * 50,
+	}
+	return NewRateLimiter(config, RATE_LIMIT_SCOPE_SOURCE, "", METRICS_DIRECTION_UPSTREAM, rate, parent, NewTunnelMetrics("test", "client"))
+}
+
+func TestRateLimiterDrop(t *testing.T) {
+	limiter := newTestRateLimiter(RATE_LIMIT_ACTION_DROP, Rate{Packets: 2}, nil)
+
+	for index := 0; index < 2; index++ {
+		if !limiter.Wait(context.Background(), 100) {
+			t.Fatalf("packet %d within burst is dropped", index)
+		}
+	}
+
+	if limiter.Wait(context.Background(), 100) {
+		t.Error("packet over the limit is not dropped")
+	}
+
+	if info := limiter.Info(); info.Dropped != 1 || info.Queued != 0 {
+		t.Errorf("dropped %d, queued %d, want 1 and 0", info.Dropped, info.Queued)
+	}
+
+	var nilLimiter *RateLimiter
+	if !nilLimiter.Wait(context.Background(), 100) {
+		t.Error("nil limiter drops a packet")
+	}
+}
+
+func TestRateLimiterQueue(t *testing.T) {
+	// 每秒 100 个, 令牌用完时下一个数据报需要等 10ms
+	limiter := newTestRateLimiter(RATE_LIMIT_ACTION_QUEUE, Rate{Packets: 100}, nil)
+	limiter.packets.tokens = 0
+	limiter.packets.last = time.Now()
+
+	start := time.Now()
+	if !limiter.Wait(context.Background(), 100) {
+		t.Fatal("packet within max delay is dropped")
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*5 {
+		t.Errorf("waited %s, want about 10ms", elapsed)
+	}
+
+	// 需要等待超过 MaxDelay 时丢弃
+	limiter.packets.tokens = -10
+	if limiter.Wait(context.Background(), 100) {
+		t.Error("packet over max delay is not dropped")
+	}
+
+	// 等待期间取消时丢弃
+	limiter.packets.tokens = -1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if limiter.Wait(ctx, 100) {
+		t.Error("packet is forwarded after the context is canceled")
+	}
+
+	if info := limiter.Info(); info.Queued != 2 || info.Dropped != 1 {
+		t.Errorf("queued %d, dropped %d, want 2 and 1", info.Queued, info.Dropped)
+	}
+}
+
+func TestRateLimiterParent(t *testing.T) {
+	// 早于令牌桶创建的时间不补充令牌
+	now := time.Now()
+	global := newTestRateLimiter(RATE_LIMIT_ACTION_DROP, Rate{Bytes: 1000}, nil)
+	source := newTestRateLimiter(RATE_LIMIT_ACTION_DROP, Rate{Packets: 10, Bytes: 10000}, global)
+
+	if _, _, isAllowed := source.reserve(now, 800); !isAllowed {
+		t.Fatal("first packet is dropped")
+	}
+
+	// 外层拒绝时退还内层已经取出的令牌, 拒绝的原因是外层
+	_, cause, isAllowed := source.reserve(now, 800)
+	if isAllowed || cause != global {
+		t.Fatalf("second packet: allowed %v, cause %v, want dropped by global", isAllowed, cause)
+	}
+
+	if source.packets.tokens != 9 || source.bytes.tokens != 9200 {
+		t.Errorf("source has %f packets and %f bytes, want 9 and 9200", source.packets.tokens, source.bytes.tokens)
+	}
+
+	if global.bytes.tokens != 200 {
+		t.Errorf("global has %f bytes, want 200", global.bytes.tokens)
+	}
+}
+
+func TestRateLimiterGroup(t *testing.T) {
+	group := NewRateLimiterGroup()
+	created := 0
+	create := func() *RateLimiters {
+		created++
+		return NewRateLimiters(&RateLimit{Burst: time.Second}, RATE_LIMIT_SCOPE_IDENTITY, "alice", Rate{Packets: 10}, nil, NewTunnelMetrics("test", "server"))
+	}
+
+	first := group.Acquire("alice", create)
+	second := group.Acquire("alice", create)
+	if first != second || created != 1 {
+		t.Fatalf("created %d limiters for one key, want 1 shared", created)
+	}
+
+	group.Release("alice")
+	if len(group.Infos()) != 2 {
+		t.Error("limiters are deleted while still in use")
+	}
+
+	group.Release("alice")
+	if len(group.Infos()) != 0 {
+		t.Error("limiters are not deleted after the last release")
+	}
+
+	if limiters := NewRateLimiters(&RateLimit{}, RATE_LIMIT_SCOPE_IDENTITY, "alice", Rate{}, first, nil); limiters != first {
+		t.Error("an unlimited scope does not return its parent")
+	}
+}
@@ -0,0 +1,27 @@
+package dtls_tunnel
+
+import (
+	"math/rand"
+	"time"
+)
+
+/*
+ * Client 的连接断开后, 映射保持源地址的绑定并重新连接
+ * 每次失败后等待的时间按指数增长, 并在 [d/2, d) 之间随机, 避免服务端重启后所有映射同时重连
+ */
+
+const RECONNECT_INITIAL_BACKOFF = time.Millisecond * 100
+const RECONNECT_MAX_BACKOFF = time.Second * 5
+
+// ReconnectBackoff 返回第 attempt 次 (从 0 开始) 失败后等待的时间
+func ReconnectBackoff(attempt int) time.Duration {
+	backoff := RECONNECT_MAX_BACKOFF
+	if attempt < 16 {
+		backoff = RECONNECT_INITIAL_BACKOFF << attempt
+		if backoff > RECONNECT_MAX_BACKOFF {
+			backoff = RECONNECT_MAX_BACKOFF
+		}
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
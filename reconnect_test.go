@@ -0,0 +1,28 @@
+package dtls_tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	cases := []struct {
+		attempt int
+		backoff time.Duration
+	}{
+		{0, RECONNECT_INITIAL_BACKOFF},
+		{1, RECONNECT_INITIAL_BACKOFF * 2},
+		{3, RECONNECT_INITIAL_BACKOFF * 8},
+		{6, RECONNECT_MAX_BACKOFF},
+		// 很大的 attempt 不会因为移位溢出
+		{64, RECONNECT_MAX_BACKOFF},
+	}
+
+	for _, c := range cases {
+		for index := 0; index < 100; index++ {
+			if backoff := ReconnectBackoff(c.attempt); backoff < c.backoff/2 || backoff >= c.backoff {
+				t.Fatalf("ReconnectBackoff(%d) = %s, want in [%s, %s)", c.attempt, backoff, c.backoff/2, c.backoff)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// Reloader 是可以在运行时重新加载的认证材料, 如证书和 PSK 密钥
+type Reloader interface {
+	Reload() error
+	IsChanged() bool
+	String() string
+}
+
+// ReloadAll 重新加载所有材料, 一个失败不影响其他的
+func ReloadAll(reloaders []Reloader) error {
+	var errMsgs []string
+	for _, reloader := range reloaders {
+		if err := reloader.Reload(); err != nil {
+			errMsgs = append(errMsgs, FormatString("%s: %s", reloader.String(), err.Error()))
+		}
+	}
+
+	if len(errMsgs) > 0 {
+		return MakeErrorWithErrMsg("Failed to reload %s", strings.Join(errMsgs, "; "))
+	}
+
+	return nil
+}
+
+// WatchReloaders 定时检查文件, 有变化时重新加载, 直到 ctx 结束
+// onReload 不为 nil 时在任何一个重新加载成功后调用
+func WatchReloaders(ctx context.Context, reloaders []Reloader, interval time.Duration, onReload func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			isReloaded := false
+
+			for _, reloader := range reloaders {
+				if !reloader.IsChanged() {
+					continue
+				}
+
+				if err := reloader.Reload(); err != nil {
+					logger.Warn(FormatString("Failed to reload %s: %s", reloader.String(), err.Error()))
+					continue
+				}
+
+				logger.Info(FormatString("Reloaded %s", reloader.String()))
+				isReloaded = true
+			}
+
+			if isReloaded && onReload != nil {
+				onReload()
+			}
+		}
+	}
+}
+
+func FileModTimes(paths ...string) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// IsFilesChanged 和 FileModTimes 记录的修改时间比较
+func IsFilesChanged(modTimes map[string]time.Time) bool {
+	for path, modTime := range modTimes {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package dtls_tunnel
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const IS_REUSE_PORT_SUPPORTED = true
+
+// setReusePort 用于 net.ListenConfig.Control, 在 bind 之前打开 SO_REUSEPORT
+func setReusePort(network string, address string, rawConn syscall.RawConn) error {
+	var sockErr error = nil
+	err := rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
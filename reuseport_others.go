@@ -0,0 +1,12 @@
+//go:build !linux
+
+package dtls_tunnel
+
+import "syscall"
+
+// 其他平台上的 SO_REUSEPORT 不按四元组分配数据报, 只支持一个监听 socket
+const IS_REUSE_PORT_SUPPORTED = false
+
+func setReusePort(network string, address string, rawConn syscall.RawConn) error {
+	return MakeErrorWithErrMsg("SO_REUSEPORT is not supported on this platform")
+}
@@ -2,20 +2,37 @@ package dtls_tunnel
 
 import (
 	"context"
-	"crypto/tls"
-	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v3"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	config     *ServerConfig
-	listener   net.Listener
+	dtlsConfig *dtls.Config
+	listener   net.Listener // 只负责分发 UDP 数据报, 握手由 handshake 并发完成
 	mappersWg  *sync.WaitGroup
+	mappers    *sync.Map // 初始化完成的 *ServerMapper -> struct{}, 用于管理接口和关闭证书被吊销的映射
 	wg         *sync.WaitGroup
 	ctx        context.Context
 	cancelFunc context.CancelFunc
+
+	// ACL 规则没有指定上游地址时使用
+	defaultUpstreams *Upstreams
+
+	// 所有客户端的会话, 未开启会话恢复时为 nil
+	sessionCache *SessionCache
+
+	metrics *TunnelMetrics
+
+	// 整个隧道的限速和按客户端身份共用的限速, 未配置时都为 nil
+	rateLimiters     *RateLimiters
+	identityLimiters *RateLimiterGroup
+
+	// 排空时不再接受新的连接, 现有的映射全部结束后关闭
+	draining atomic.Bool
 }
 
 type AcceptResult struct {
@@ -23,36 +40,47 @@ type AcceptResult struct {
 	Err  error
 }
 
+// 映射和流的数量由远端决定, 它们的读缓冲区各自分配, 不占用共用的 payload 池
 func NewServer(config *ServerConfig) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	server := &Server{
 		config:     config,
 		mappersWg:  &sync.WaitGroup{},
+		mappers:    &sync.Map{},
 		wg:         &sync.WaitGroup{},
 		ctx:        ctx,
 		cancelFunc: cancel,
+
+		defaultUpstreams: NewUpstreams(config.UpstreamPolicy, config.RemoteAddresses...),
+
+		metrics: NewTunnelMetrics(config.Name, METRICS_ROLE_SERVER),
 	}
+
+	if len(config.RemoteAddresses) == 0 {
+		server.defaultUpstreams = NewUpstreams(config.UpstreamPolicy, config.RemoteAddress)
+	}
+
+	if config.SessionTTL > 0 && config.AuthMode == AUTH_MODE_PSK {
+		server.sessionCache = NewSessionCache(config.SessionTTL)
+	}
+
+	if config.RateLimit != nil {
+		server.rateLimiters = NewRateLimiters(config.RateLimit, RATE_LIMIT_SCOPE_GLOBAL, "", config.RateLimit.Global, nil, server.metrics)
+		if config.RateLimit.Identity.IsLimited() {
+			server.identityLimiters = NewRateLimiterGroup()
+		}
+	}
+
 	return server
 }
 
 func (s *Server) initListener() error {
-	config := &dtls.Config{
-		Certificates:         []tls.Certificate{s.config.Cert},
-		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
-		ClientAuth:           dtls.RequireAndVerifyClientCert,
-		ClientCAs:            s.config.RootCerts,
-		ConnectContextMaker: func() (context.Context, func()) {
-			// TODO:等待时间动态设置
-			return context.WithTimeout(s.ctx, 30*time.Second)
-		},
-	}
-
-	listener, err := dtls.Listen(
-		"udp",
-		s.config.ListenAddress,
-		config,
-	)
+	s.dtlsConfig = newServerDTLSConfig(s.config, s.sessionCache)
+
+	// dtls.Listen 只为握手包创建新连接, Accept 返回的连接还没有握手
+	// 开启了 Connection ID, 之后的数据报按 CID 分发, 客户端地址变化后仍然交给原来的连接
+	listener, err := dtls.Listen("udp", s.config.ListenAddress, s.dtlsConfig)
 	if err != nil {
 		return MakeErrorWithErrMsg("Failed to init listener: %s", err.Error())
 	}
@@ -106,6 +134,12 @@ func (s *Server) handleConnection() {
 				continue
 			}
 
+			if s.draining.Load() {
+				logger.Info(FormatString("Reject %s: the server is draining", conn.RemoteAddr().String()))
+				_ = conn.Close()
+				continue
+			}
+
 			logger.Info(FormatString("New mapper: %s", conn.RemoteAddr().String()))
 
 			mapper := NewServerMapper(
@@ -114,8 +148,9 @@ func (s *Server) handleConnection() {
 				s.ctx,
 			)
 
+			s.metrics.MapperCreated()
+			s.mappersWg.Add(1)
 			go func() {
-				s.mappersWg.Add(1)
 				if err := mapper.Run(s.mappersWg); err != nil {
 					logger.Error(FormatString("Failed to run mapper: %s", err.Error()))
 				}
@@ -127,13 +162,63 @@ func (s *Server) handleConnection() {
 func (s *Server) handleAccept(acceptChannel chan *AcceptResult) {
 	for {
 		conn, err := s.listener.Accept()
-		acceptChannel <- &AcceptResult{
-			Conn: conn,
-			Err:  err,
+		if err != nil {
+			select {
+			case acceptChannel <- &AcceptResult{Err: err}:
+				continue
+			case <-s.ctx.Done():
+				return
+			}
 		}
+
+		// 每个握手在独立的携程中进行, 一个慢的客户端不会阻塞其他客户端
+		go s.handshake(conn, acceptChannel)
 	}
 }
 
+func (s *Server) handshake(conn net.Conn, acceptChannel chan *AcceptResult) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.config.HandshakeTimeout)
+	defer cancel()
+
+	dtlsConn := conn.(*dtls.Conn)
+
+	start := time.Now()
+	err := dtlsConn.HandshakeContext(ctx)
+	if err == nil && s.sessionCache != nil {
+		err = s.resolveSession(dtlsConn, start)
+	}
+	s.metrics.Handshake(start, err)
+
+	if err != nil {
+		_ = conn.Close()
+		err = MakeErrorWithErrMsg("handshake error with %s: %s", conn.RemoteAddr().String(), err.Error())
+		dtlsConn = nil
+	}
+
+	select {
+	case acceptChannel <- &AcceptResult{Conn: dtlsConn, Err: err}:
+	case <-s.ctx.Done():
+		if dtlsConn != nil {
+			_ = dtlsConn.Close()
+		}
+	}
+}
+
+// resolveSession 记录握手是否恢复了会话, 恢复的会话找不到客户端的 identity 时拒绝连接
+// 同时从缓存中删除会话, 客户端下次连接时只能做完整握手
+func (s *Server) resolveSession(conn *dtls.Conn, start time.Time) error {
+	state, _ := conn.ConnectionState()
+
+	isResumed, err := s.sessionCache.Resolve(&state, start)
+	if err != nil {
+		_ = s.sessionCache.Del(state.SessionID)
+		return MakeErrorWithErrMsg("Failed to resume session: %s", err.Error())
+	}
+
+	s.metrics.SessionResumption(isResumed)
+	return nil
+}
+
 func (s *Server) clean() error {
 	s.mappersWg.Wait()
 	s.wg.Wait()
@@ -147,13 +232,28 @@ func (s *Server) clean() error {
 
 func (s *Server) Run() error {
 	if err := s.init(); err != nil {
-		return MakeErrorWithErrMsg("Failed to run mapper", err.Error())
+		return MakeErrorWithErrMsg("Failed to run server: %s", err.Error())
 	}
 
 	s.wg.Add(1)
 
 	go s.handleConnection()
 
+	if s.config.ReloadInterval > 0 {
+		s.wg.Add(1)
+		go s.reloadWatcher()
+	}
+
+	if s.config.CRL != nil && s.config.CRLReloadInterval > 0 {
+		s.wg.Add(1)
+		go s.crlWatcher()
+	}
+
+	if s.config.HealthCheck != nil {
+		s.wg.Add(1)
+		go s.healthChecker()
+	}
+
 	logger.Info(FormatString("The server is running on %s", s.config.ListenAddress.String()))
 
 	s.wg.Wait()
@@ -163,7 +263,7 @@ func (s *Server) Run() error {
 		return err
 	}
 
-	logger.Info(FormatString("The client is shutdown"))
+	logger.Info(FormatString("The server is shutdown"))
 
 	return nil
 }
@@ -171,3 +271,145 @@ func (s *Server) Run() error {
 func (s *Server) Shutdown() {
 	s.cancelFunc()
 }
+
+// Reload 重新加载证书, CRL 或 PSK 密钥
+// 新的握手使用新的材料, 已经建立的映射只有在对端证书被吊销时才会关闭
+func (s *Server) Reload() error {
+	err := ReloadAll(s.config.Reloaders())
+
+	s.handleReload()
+
+	return err
+}
+
+func (s *Server) reloadWatcher() {
+	defer s.wg.Done()
+	WatchReloaders(s.ctx, s.config.IntervalReloaders(), s.config.ReloadInterval, s.handleReload)
+}
+
+// crlWatcher 检查 CRL 的变化, 重新加载后关闭对端证书已被吊销的映射
+func (s *Server) crlWatcher() {
+	defer s.wg.Done()
+	WatchReloaders(s.ctx, []Reloader{s.config.CRL}, s.config.CRLReloadInterval, s.handleReload)
+}
+
+// handleReload 在重新加载认证材料后调用, 缓存的会话可能来自已经更换的密钥
+func (s *Server) handleReload() {
+	s.sessionCache.Clear()
+	s.closeRevokedMappers()
+}
+
+// healthChecker 检查默认的上游和 ACL 规则中的上游
+func (s *Server) healthChecker() {
+	defer s.wg.Done()
+
+	pools := append([]*Upstreams{s.defaultUpstreams}, s.config.ACL.Upstreams()...)
+
+	s.config.HealthCheck.Run(s.ctx, pools, func(upstream *Upstream, err error) {
+		s.metrics.UpstreamChecked(upstream.String(), upstream.IsHealthy())
+	})
+}
+
+// closeRevokedMappers 关闭对端证书已经被吊销的映射
+func (s *Server) closeRevokedMappers() {
+	if s.config.CRL == nil {
+		return
+	}
+
+	s.mappers.Range(func(key, value any) bool {
+		mapper := key.(*ServerMapper)
+		if err := mapper.checkRevoked(); err != nil {
+			logger.Warn(FormatString("Mapper %s is closed: %s", mapper.srcConnection.RemoteAddr().String(), err.Error()))
+			mapper.stopWithReason(STOP_REASON_REVOKED)
+		}
+		return true
+	})
+}
+
+func (s *Server) handleMapperReady(mapper *ServerMapper) {
+	s.mappers.Store(mapper, struct{}{})
+}
+
+func (s *Server) handleMapperDestroy(mapper *ServerMapper) {
+	s.mappers.Delete(mapper)
+
+	if s.draining.Load() && s.mapperCount() == 0 {
+		logger.Info(FormatString("The server is drained"))
+		s.Shutdown()
+	}
+}
+
+// acquireRateLimiters 返回客户端身份的限速, 同一身份的所有映射共用, 映射结束后调用 releaseRateLimiters
+func (s *Server) acquireRateLimiters(identity string) *RateLimiters {
+	if s.identityLimiters == nil {
+		return s.rateLimiters
+	}
+
+	return s.identityLimiters.Acquire(identity, func() *RateLimiters {
+		return NewRateLimiters(s.config.RateLimit, RATE_LIMIT_SCOPE_IDENTITY, identity, s.config.RateLimit.Identity, s.rateLimiters, s.metrics)
+	})
+}
+
+func (s *Server) releaseRateLimiters(identity string) {
+	if s.identityLimiters != nil {
+		s.identityLimiters.Release(identity)
+	}
+}
+
+func (s *Server) mapperCount() int {
+	var count int = 0
+	s.mappers.Range(func(key, value any) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// Mappers 返回所有初始化完成的映射的状态
+func (s *Server) Mappers() []*MapperInfo {
+	infos := make([]*MapperInfo, 0)
+	s.mappers.Range(func(key, value any) bool {
+		infos = append(infos, key.(*ServerMapper).Info())
+		return true
+	})
+	return infos
+}
+
+// RateLimiters 返回整个隧道和每个客户端身份的限速
+func (s *Server) RateLimiters() []*RateLimiterInfo {
+	infos := s.rateLimiters.Infos()
+	if s.identityLimiters != nil {
+		infos = append(infos, s.identityLimiters.Infos()...)
+	}
+	return infos
+}
+
+// CloseMapper 关闭来源地址为 id 的映射, 没有找到时返回 false
+func (s *Server) CloseMapper(id string) bool {
+	var isFound bool = false
+	s.mappers.Range(func(key, value any) bool {
+		mapper := key.(*ServerMapper)
+		if mapper.srcConnection.RemoteAddr().String() != id {
+			return true
+		}
+
+		logger.Info(FormatString("Close mapper %s by admin", id))
+		mapper.stopWithReason(STOP_REASON_ADMIN)
+		isFound = true
+		return false
+	})
+	return isFound
+}
+
+// Drain 不再接受新的连接, 现有的映射全部结束后关闭服务端
+func (s *Server) Drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+
+	logger.Info(FormatString("The server is draining"))
+
+	if s.mapperCount() == 0 {
+		s.Shutdown()
+	}
+}
@@ -0,0 +1,186 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 多路复用模式下, ServerMapper 为每个 flow id 建立一个独立的 UDP 连接
+ * src -> dest 由 ServerMapper 解帧后调用 Write
+ * dest -> src 由 ServerFlow 自己读取后加上帧头写回 ServerMapper
+ */
+
+type ServerFlow struct {
+	mapper         *ServerMapper
+	flowID         uint32
+	upstream       *Upstream
+	destConnection *net.UDPConn
+	ctx            context.Context
+	cancelFunc     context.CancelFunc
+	activeRecorder *ActiveRecorder
+
+	// 对端主动关闭时不需要再回发 CLOSE, 在 ServerMapper 的读协程中设置, 在 flow 退出时读取
+	closedByPeer atomic.Bool
+}
+
+func NewServerFlow(mapper *ServerMapper, flowID uint32, upstream *Upstream, parentCtx context.Context) *ServerFlow {
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	flow := &ServerFlow{
+		mapper:         mapper,
+		flowID:         flowID,
+		upstream:       upstream,
+		ctx:            ctx,
+		cancelFunc:     cancel,
+		activeRecorder: NewActiveRecorder(time.Now(), time.Now()),
+	}
+
+	return flow
+}
+
+func (f *ServerFlow) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	f.handleRead()
+
+	f.mapper.handleFlowDestroy(f)
+
+	if err := f.unInit(); err != nil {
+		logger.Warn(FormatString("Failed to clean flow %d: %s", f.flowID, err.Error()))
+	}
+}
+
+func (f *ServerFlow) Stop() {
+	f.cancelFunc()
+}
+
+func (f *ServerFlow) init() error {
+	destConnection, err := net.DialUDP(
+		"udp",
+		nil,
+		f.upstream.Address(),
+	)
+
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to init dest connection: %s", err.Error())
+	}
+
+	f.upstream.Acquire()
+	f.destConnection = destConnection
+
+	return nil
+}
+
+func (f *ServerFlow) unInit() error {
+	f.upstream.Release()
+
+	if err := f.destConnection.Close(); err != nil {
+		return MakeErrorWithErrMsg("Failed to close dest connection: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Write 把解帧后的数据写往目标地址
+func (f *ServerFlow) Write(data []byte) error {
+	if err := f.destConnection.SetWriteDeadline(time.Now().Add(f.mapper.server.config.WriteTimeout)); err != nil {
+		return MakeErrorWithErrMsg("Failed to set write deadline: %s", err.Error())
+	}
+
+	n, err := f.destConnection.Write(data)
+	if os.IsTimeout(err) {
+		return nil
+	}
+
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to write to dest conn: %s", err.Error())
+	}
+
+	f.activeRecorder.RecordWrite(n)
+	f.mapper.server.metrics.Upstream(n)
+
+	return nil
+}
+
+// handleRead 批量读取目标地址返回的数据报, 加上帧头后逐个写入 DTLS 连接
+// 每个缓冲区在数据前面预留帧头, 读到的数据直接跟在后面, 写入时不需要拷贝
+// 反方向由 ServerMapper 每次从 DTLS 连接读到一个数据报, 所以 Write 仍然逐个发送
+func (f *ServerFlow) handleRead() {
+	config := f.mapper.server.config
+
+	// 读缓冲区属于这个流, 不占用 payload 池
+	var batchSize int = config.UDPBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	batch := NewBatchConn(f.destConnection, batchSize, config.PackageBufferSize, false, false)
+	buffers := make([][]byte, batchSize)
+	datagrams := make([]Datagram, batchSize)
+	for index := range buffers {
+		buffers[index] = make([]byte, PayloadCapacity(config.PackageBufferSize))
+	}
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+
+		default:
+			if err := f.destConnection.SetReadDeadline(time.Now().Add(config.ReadTimeout)); err != nil {
+				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
+				f.Stop()
+				return
+			}
+
+			// ReadBatchInto 把 Data 截断为读到的长度, 每次读取前重新设置
+			for index := range datagrams {
+				datagrams[index].Data = buffers[index][MUX_FRAME_HEADER_SIZE:]
+			}
+
+			n, err := batch.ReadBatchInto(datagrams)
+
+			if os.IsTimeout(err) {
+				continue
+			}
+
+			if err != nil {
+				logger.Error(FormatString("Failed to read from dest conn: %s", err.Error()))
+				f.Stop()
+				return
+			}
+
+			for index := range datagrams[:n] {
+				if !f.handleDatagram(buffers[index][:MUX_FRAME_HEADER_SIZE+len(datagrams[index].Data)]) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleDatagram 把 frame 中帧头之后的数据写回 DTLS 连接, 写入失败时停止映射并返回 false
+func (f *ServerFlow) handleDatagram(frame []byte) bool {
+	n := len(frame) - MUX_FRAME_HEADER_SIZE
+
+	f.activeRecorder.RecordRead(n)
+	f.mapper.server.metrics.Downstream(n)
+
+	// 超过限速的数据报丢弃后继续处理这一批剩下的
+	if !f.mapper.rateLimiters.Downstream().Wait(f.ctx, n) {
+		return true
+	}
+
+	if err := f.mapper.writeFrame(frame, MUX_FRAME_TYPE_DATA, f.flowID); err != nil {
+		logger.Error(err.Error())
+		f.mapper.stopWithReason(STOP_REASON_WRITE_ERROR)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,30 @@
+package dtls_tunnel
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestServerFlowReadBatch(t *testing.T) {
+	destination := newTestEchoUpstream(t)
+
+	serverConfig := newTestFileConfig(t, "server", destination.LocalAddr().String())
+	serverConfig.AllowDestinations = []DestinationRuleFileConfig{{CIDR: "127.0.0.0/8"}}
+	serverConfig.UDPBatchSize = 4
+	newTestServer(t, serverConfig)
+
+	conn := dialTestDTLS(t, serverConfig.Listen)
+
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_HELLO, 0, MUX_PROTOCOL)
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_HELLO, 0, MUX_PROTOCOL)
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_OPEN, 1, destination.LocalAddr().String())
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_OPEN_ACK, 1, "")
+
+	// 比一批更多的数据报, 回显按顺序带着各自的帧头返回
+	for index := 0; index < 10; index++ {
+		writeTestFrame(t, conn, MUX_FRAME_TYPE_DATA, 1, fmt.Sprintf("datagram %d", index))
+	}
+	for index := 0; index < 10; index++ {
+		expectTestFrame(t, conn, MUX_FRAME_TYPE_DATA, 1, fmt.Sprintf("echo:datagram %d", index))
+	}
+}
@@ -2,11 +2,13 @@ package dtls_tunnel
 
 import (
 	"context"
-	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v3"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +20,41 @@ type ServerMapper struct {
 	cancelFunc     context.CancelFunc
 	wg             *sync.WaitGroup // 转发携程的同步等待组
 	activeRecorder *ActiveRecorder
+
+	// 客户端身份和按 ACL 选出的上游地址, 以及允许客户端指定的目标地址
+	peerIdentity         PeerIdentity
+	peerCertificates     [][]byte
+	upstreams            *Upstreams
+	destinationAllowlist *DestinationAllowlist
+
+	// 非多路复用模式下 destConnection 对应的上游
+	upstream *Upstream
+
+	// 客户端身份的限速, 同一身份的映射共用, 外层是整个隧道的限速
+	// 初始化完成后设置, 协商时读到的第一个数据报不经过限速
+	rateLimiters *RateLimiters
+
+	// 非多路复用模式下, 协商时读到的第一个数据报, 目标连接建立后转发
+	pending []byte
+
+	// 非多路复用模式下客户端通过 OPEN 帧指定的目标地址
+	destination string
+
+	// 多路复用模式下 flow id -> *ServerFlow
+	multiplexed bool
+	flows       *sync.Map
+	rejected    *sync.Map // OPEN 被拒绝或没有 OPEN 就发送 DATA 的 flow id, 之后的 DATA 直接丢弃
+	flowsWg     *sync.WaitGroup
+	writeLock   *sync.Mutex // 多个 ServerFlow 会同时往 srcConnection 写入
+
+	// 客户端开启心跳时按第一个 PING 设置, 之后 GarbageCollector 据此判断客户端是否失效
+	keepalive atomic.Pointer[Keepalive]
+
+	stopReason StopReason
+	createdAt  time.Time
+
+	// 上次检查时客户端的地址, 通过 Connection ID 漫游后 srcConnection.RemoteAddr 会变化, 只在 GarbageCollector 中使用
+	remoteAddress string
 }
 
 func NewServerMapper(server *Server, src *dtls.Conn, parentCtx context.Context) *ServerMapper {
@@ -30,6 +67,12 @@ func NewServerMapper(server *Server, src *dtls.Conn, parentCtx context.Context)
 		cancelFunc:     cancel,
 		wg:             &sync.WaitGroup{},
 		activeRecorder: NewActiveRecorder(time.Now(), time.Now()),
+		flows:          &sync.Map{},
+		rejected:       &sync.Map{},
+		flowsWg:        &sync.WaitGroup{},
+		writeLock:      &sync.Mutex{},
+		createdAt:      time.Now(),
+		remoteAddress:  src.RemoteAddr().String(),
 	}
 
 	return serverMapper
@@ -37,11 +80,31 @@ func NewServerMapper(server *Server, src *dtls.Conn, parentCtx context.Context)
 
 func (sm *ServerMapper) Run(wg *sync.WaitGroup) error {
 	if err := sm.init(); err != nil {
+		wg.Done()
+		sm.Stop()
+		_ = sm.closeSrcConnection()
+		_ = sm.closeDestConnection()
+
+		// 客户端的探测和没有用上的预热连接没有发送数据就关闭, 不算初始化失败
+		if reason := sm.stopReason.Get(); reason == STOP_REASON_PROBE || reason == STOP_REASON_UNUSED {
+			sm.server.metrics.MapperDestroyed(reason)
+			return nil
+		}
+
+		sm.server.metrics.MapperDestroyed(STOP_REASON_INIT_ERROR)
 		return MakeErrorWithErrMsg("Failed to run server mapper: %s", err.Error())
 	}
 
+	identity := sm.peerIdentity.String()
+	sm.rateLimiters = sm.server.acquireRateLimiters(identity)
+	sm.server.handleMapperReady(sm)
+
 	sm.runInLoop(wg)
 
+	sm.server.handleMapperDestroy(sm)
+	sm.server.releaseRateLimiters(identity)
+	sm.server.metrics.MapperDestroyed(sm.stopReason.Get())
+
 	if err := sm.clean(); err != nil {
 		return err
 	}
@@ -53,9 +116,16 @@ func (sm *ServerMapper) Stop() {
 	sm.cancelFunc()
 }
 
+// stopWithReason 记录原因后关闭, 用于统计映射结束的原因
+func (sm *ServerMapper) stopWithReason(reason string) {
+	sm.stopReason.Set(reason)
+	sm.Stop()
+}
+
 func (sm *ServerMapper) clean() error {
 
 	sm.wg.Wait()
+	sm.flowsWg.Wait()
 
 	if err := sm.unInit(); err != nil {
 		return MakeErrorWithErrMsg("Failed to stop server mapper: %s", err.Error())
@@ -65,10 +135,173 @@ func (sm *ServerMapper) clean() error {
 }
 
 func (sm *ServerMapper) init() error {
+	if err := sm.authorize(); err != nil {
+		return MakeErrorWithErrMsg("Failed to init server mapper: %s", err.Error())
+	}
+
+	if err := sm.negotiate(); err != nil {
+		return MakeErrorWithErrMsg("Failed to init server mapper: %s", err.Error())
+	}
+
+	// 多路复用模式下目标连接随 flow 按需建立
+	if sm.multiplexed {
+		return nil
+	}
+
+	if sm.destination != "" {
+		address, err := sm.destinationAllowlist.Resolve(sm.destination)
+		if err != nil {
+			return MakeErrorWithErrMsg("Failed to init server mapper: %s", err.Error())
+		}
+		sm.upstreams = NewUpstreams(UPSTREAM_POLICY_ROUND_ROBIN, address)
+	}
+
 	if err := sm.initDestConnection(); err != nil {
 		return MakeErrorWithErrMsg("Failed to init server mapper: %s", err.Error())
 	}
 
+	if err := sm.flushPending(); err != nil {
+		return MakeErrorWithErrMsg("Failed to init server mapper: %s", err.Error())
+	}
+
+	// 目标连接建立后才确认, 客户端收到之前不发送数据
+	if sm.destination != "" {
+		if err := sm.ackOpen(0); err != nil {
+			return MakeErrorWithErrMsg("Failed to init server mapper: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (sm *ServerMapper) authorize() error {
+	state := sm.server.sessionCache.ConnectionState(sm.srcConnection)
+	sm.peerIdentity = PeerIdentityFromState(&state)
+	sm.peerCertificates = state.PeerCertificates
+
+	rule, isAllowed := sm.server.config.ACL.Evaluate(sm.peerIdentity)
+	if !isAllowed {
+		return MakeErrorWithErrMsg("%s is not allowed", sm.peerIdentity.String())
+	}
+
+	sm.upstreams = sm.server.defaultUpstreams
+	if rule != nil && rule.Upstreams != nil {
+		sm.upstreams = rule.Upstreams
+	}
+
+	sm.destinationAllowlist = sm.server.config.DestinationAllowlist
+	if rule != nil {
+		sm.destinationAllowlist = rule.DestinationAllowlist
+	}
+
+	logger.Info(FormatString("Mapper %s is authorized as %s", sm.srcConnection.RemoteAddr().String(), sm.peerIdentity.String()))
+
+	return nil
+}
+
+// checkRevoked 用当前的根证书和 CRL 重新检查对端证书, 用于 CRL 更新后关闭已吊销的映射
+func (sm *ServerMapper) checkRevoked() error {
+	if len(sm.peerCertificates) == 0 {
+		return nil
+	}
+
+	// 根证书更换后链无法验证时不在这里处理, 只关心吊销
+	chains, err := VerifyClientCertificate(sm.peerCertificates, sm.server.config.Certificates.RootCerts())
+	if err != nil {
+		return nil
+	}
+
+	return sm.server.config.CRL.CheckChains(chains)
+}
+
+// negotiate 读取第一个数据报, 是 HELLO 帧则进入多路复用模式
+func (sm *ServerMapper) negotiate() error {
+	var buffer []byte = make([]byte, sm.server.config.PackageBufferSize+MUX_FRAME_HEADER_SIZE)
+
+	for {
+		select {
+		case <-sm.ctx.Done():
+			return MakeErrorWithErrMsg("Failed to negotiate: mapper is stopped")
+
+		default:
+			if err := sm.srcConnection.SetReadDeadline(time.Now().Add(sm.server.config.ReadTimeout)); err != nil {
+				return MakeErrorWithErrMsg("Failed to set read deadline: %s", err.Error())
+			}
+
+			n, err := sm.srcConnection.Read(buffer)
+
+			if os.IsTimeout(err) {
+				if sm.activeRecorder.IsTimeout(sm.server.config.HandshakeTimeout) {
+					return MakeErrorWithErrMsg("Failed to negotiate: no data from %s", sm.srcConnection.RemoteAddr().String())
+				}
+				continue
+			}
+
+			// 只发送了心跳就关闭的是客户端的探测, 什么都没发送就关闭的是客户端没有用上的预热连接
+			if err == io.EOF && sm.keepalive.Load() != nil {
+				sm.stopReason.Set(STOP_REASON_PROBE)
+				return MakeErrorWithErrMsg("Failed to negotiate: closed after keepalive")
+			}
+
+			if err == io.EOF {
+				sm.stopReason.Set(STOP_REASON_UNUSED)
+				return MakeErrorWithErrMsg("Failed to negotiate: closed before sending data")
+			}
+
+			if err != nil {
+				return MakeErrorWithErrMsg("Failed to read from src conn: %s", err.Error())
+			}
+
+			if keepalive, isPing := ParseKeepalivePing(buffer[:n]); isPing {
+				sm.keepalive.Store(keepalive)
+				if err := sm.replyKeepalive(buffer[:n]); err != nil {
+					return err
+				}
+				continue
+			}
+
+			sm.activeRecorder.RefreshLastWrite()
+
+			// 普通的数据报也可能以 OPEN 帧头开头 (例如 WireGuard), 只在允许客户端指定目标地址时识别, 否则按数据转发
+			if sm.destinationAllowlist != nil {
+				if header, data, err := DecodeMuxFrame(buffer[:n]); err == nil && header.Type == MUX_FRAME_TYPE_OPEN && header.FlowID == 0 {
+					sm.destination = string(data)
+					return nil
+				}
+			}
+
+			if !IsMuxHello(buffer[:n]) {
+				sm.pending = buffer[:n]
+				return nil
+			}
+
+			sm.multiplexed = true
+			return sm.writeFrame(buffer[:n], MUX_FRAME_TYPE_HELLO, 0)
+		}
+	}
+}
+
+func (sm *ServerMapper) flushPending() error {
+	if sm.pending == nil {
+		return nil
+	}
+
+	if err := sm.destConnection.SetWriteDeadline(time.Now().Add(sm.server.config.WriteTimeout)); err != nil {
+		return MakeErrorWithErrMsg("Failed to set write deadline: %s", err.Error())
+	}
+
+	n, err := sm.destConnection.Write(sm.pending)
+	if err != nil && !os.IsTimeout(err) {
+		return MakeErrorWithErrMsg("Failed to write to dest conn: %s", err.Error())
+	}
+
+	if err == nil {
+		sm.activeRecorder.RecordWrite(n)
+		sm.server.metrics.Upstream(n)
+	}
+
+	sm.pending = nil
+
 	return nil
 }
 
@@ -85,22 +318,31 @@ func (sm *ServerMapper) unInit() error {
 }
 
 func (sm *ServerMapper) initDestConnection() error {
+	upstream := sm.upstreams.Select(sm.peerIdentity.String())
+
 	destConnection, err := net.DialUDP(
 		"udp",
 		nil,
-		sm.server.config.RemoteAddress,
+		upstream.Address(),
 	)
 
 	if err != nil {
 		return MakeErrorWithErrMsg("Failed to init dest connection: %s", err.Error())
 	}
 
+	upstream.Acquire()
+	sm.upstream = upstream
 	sm.destConnection = destConnection
 
 	return nil
 }
 
 func (sm *ServerMapper) closeDestConnection() error {
+	if sm.destConnection == nil {
+		return nil
+	}
+
+	sm.upstream.Release()
 
 	if err := sm.destConnection.Close(); err != nil {
 		return MakeErrorWithErrMsg("Failed to close dest connection: %s", err.Error())
@@ -119,11 +361,16 @@ func (sm *ServerMapper) closeSrcConnection() error {
 func (sm *ServerMapper) runInLoop(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	sm.wg.Add(3)
-
-	go sm.GarbageCollector()
-	go sm.handleWrite()
-	go sm.handleRead()
+	if sm.multiplexed {
+		sm.wg.Add(2)
+		go sm.GarbageCollector()
+		go sm.handleMuxWrite()
+	} else {
+		sm.wg.Add(3)
+		go sm.GarbageCollector()
+		go sm.handleWrite()
+		go sm.handleRead()
+	}
 
 	sm.wg.Wait()
 }
@@ -131,7 +378,7 @@ func (sm *ServerMapper) runInLoop(wg *sync.WaitGroup) {
 func (sm *ServerMapper) GarbageCollector() {
 	defer sm.wg.Done()
 
-	ticker := time.NewTicker(time.Second * 5)
+	ticker := time.NewTicker(sm.server.config.GCInterval)
 	defer ticker.Stop()
 
 	for {
@@ -140,20 +387,73 @@ func (sm *ServerMapper) GarbageCollector() {
 			return
 
 		case <-ticker.C:
-			if sm.activeRecorder.IsTimeout(time.Minute * 30) {
-				sm.Stop()
+			if remoteAddress := sm.srcConnection.RemoteAddr().String(); remoteAddress != sm.remoteAddress {
+				logger.Info(FormatString("Client of mapper %s moved to %s", sm.remoteAddress, remoteAddress))
+				sm.remoteAddress = remoteAddress
+			}
+
+			if keepalive := sm.keepalive.Load(); keepalive != nil && keepalive.IsDead() {
+				sm.stopWithReason(STOP_REASON_DEAD_PEER)
+				logger.Info(FormatString("Client of mapper %s is not responding", sm.srcConnection.RemoteAddr().String()))
+			}
+
+			if sm.activeRecorder.IsIdle(sm.server.config.IdleTimeout, sm.server.config.IdlePolicy) {
+				sm.stopWithReason(STOP_REASON_IDLE)
 				logger.Info(FormatString("Clean mapper: %s", sm.srcConnection.RemoteAddr().String()))
 			}
+
+			sm.flows.Range(func(key, value any) bool {
+				flow := value.(*ServerFlow)
+				if flow.activeRecorder.IsIdle(sm.server.config.IdleTimeout, sm.server.config.IdlePolicy) {
+					flow.Stop()
+					logger.Info(FormatString("Clean flow: %s#%d", sm.srcConnection.RemoteAddr().String(), flow.flowID))
+				}
+				return true
+			})
 		}
 	}
 }
 
+// handleRead 批量读取上游返回的数据报, 逐个写入 DTLS 连接
+// 反方向的 handleWrite 每次只能从 DTLS 连接读到一个数据报, 所以写上游仍然逐个发送
+// 数据在回调中直接写入 DTLS 连接, 不需要排队, 所以读缓冲区属于 BatchConn, 不占用 payload 池 (GRO 时也放不进 payload)
 func (sm *ServerMapper) handleRead() {
 	defer sm.wg.Done()
 
-	var buffer []byte = make([]byte, sm.server.config.PackageBufferSize)
-	var n int = 0
-	var err error = nil
+	config := sm.server.config
+	batch := NewBatchConn(sm.destConnection, config.UDPBatchSize, config.PackageBufferSize, config.UDPOffload, config.UDPOffload)
+
+	// 写 DTLS 连接失败时结束这一批, reason 不为空时停止映射
+	var reason string = ""
+	handle := func(data []byte, _ netip.AddrPort) bool {
+		sm.activeRecorder.RecordRead(len(data))
+		sm.server.metrics.Downstream(len(data))
+
+		// 超过限速的数据报丢弃后继续处理这一批剩下的
+		if !sm.rateLimiters.Downstream().Wait(sm.ctx, len(data)) {
+			return true
+		}
+
+		if err := sm.srcConnection.SetWriteDeadline(time.Now().Add(config.WriteTimeout)); err != nil {
+			logger.Error(FormatString("Failed to set write deadline: %s", err.Error()))
+			reason = STOP_REASON_WRITE_ERROR
+			return false
+		}
+
+		_, err := sm.srcConnection.Write(data)
+
+		if os.IsTimeout(err) {
+			return false
+		}
+
+		if err != nil {
+			logger.Error(FormatString("Failed to write to src conn: %s", err.Error()))
+			reason = STOP_REASON_WRITE_ERROR
+			return false
+		}
+
+		return true
+	}
 
 	for {
 		select {
@@ -161,13 +461,13 @@ func (sm *ServerMapper) handleRead() {
 			return
 
 		default:
-			if err := sm.destConnection.SetReadDeadline(time.Now().Add(READ_TIMEOUT)); err != nil {
+			if err := sm.destConnection.SetReadDeadline(time.Now().Add(config.ReadTimeout)); err != nil {
 				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
-				sm.Stop()
+				sm.stopWithReason(STOP_REASON_READ_ERROR)
 				return
 			}
 
-			n, err = sm.destConnection.Read(buffer)
+			_, err := batch.ReadBatch(handle)
 
 			if os.IsTimeout(err) {
 				continue
@@ -175,27 +475,12 @@ func (sm *ServerMapper) handleRead() {
 
 			if err != nil {
 				logger.Error(FormatString("Failed to read from dest conn: %s", err.Error()))
-				sm.Stop()
-				return
-			}
-
-			sm.activeRecorder.RefreshLastRead()
-
-			if err := sm.srcConnection.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT)); err != nil {
-				logger.Error(FormatString("Failed to set write deadline: %s", err.Error()))
-				sm.Stop()
+				sm.stopWithReason(STOP_REASON_READ_ERROR)
 				return
 			}
 
-			n, err = sm.srcConnection.Write(buffer[:n])
-
-			if os.IsTimeout(err) {
-				continue
-			}
-
-			if err != nil {
-				logger.Error(FormatString("Failed to write to src conn: %s", err.Error()))
-				sm.Stop()
+			if reason != "" {
+				sm.stopWithReason(reason)
 				return
 			}
 		}
@@ -215,9 +500,9 @@ func (sm *ServerMapper) handleWrite() {
 			return
 
 		default:
-			if err := sm.srcConnection.SetReadDeadline(time.Now().Add(READ_TIMEOUT)); err != nil {
+			if err := sm.srcConnection.SetReadDeadline(time.Now().Add(sm.server.config.ReadTimeout)); err != nil {
 				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
-				sm.Stop()
+				sm.stopWithReason(STOP_REASON_READ_ERROR)
 				return
 			}
 
@@ -228,21 +513,44 @@ func (sm *ServerMapper) handleWrite() {
 			}
 
 			if err == io.EOF {
-				sm.Stop()
+				sm.stopWithReason(STOP_REASON_EOF)
 				return
 			}
 
 			if err != nil {
 				logger.Error(FormatString("Failed to read from src conn: %s", err.Error()))
-				sm.Stop()
+				sm.stopWithReason(STOP_REASON_READ_ERROR)
 				return
 			}
 
-			sm.activeRecorder.RefreshLastWrite()
+			if keepalive := sm.keepalive.Load(); keepalive != nil {
+				keepalive.Received()
+
+				if keepalive.IsPing(buffer[:n]) {
+					if err := sm.replyKeepalive(buffer[:n]); err != nil {
+						logger.Warn(err.Error())
+					}
+					continue
+				}
+			}
+
+			// 客户端没有收到 OPEN_ACK 时重发的 OPEN 不转发, 再确认一次
+			if sm.isOpenRetry(buffer[:n]) {
+				if err := sm.ackOpen(0); err != nil {
+					logger.Warn(err.Error())
+				}
+				continue
+			}
+
+			sm.activeRecorder.RecordWrite(n)
+
+			if !sm.rateLimiters.Upstream().Wait(sm.ctx, n) {
+				continue
+			}
 
-			if err := sm.destConnection.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT)); err != nil {
+			if err := sm.destConnection.SetWriteDeadline(time.Now().Add(sm.server.config.WriteTimeout)); err != nil {
 				logger.Error(FormatString("Failed to set write deadline: %s", err.Error()))
-				sm.Stop()
+				sm.stopWithReason(STOP_REASON_WRITE_ERROR)
 				return
 			}
 			n, err = sm.destConnection.Write(buffer[:n])
@@ -253,9 +561,272 @@ func (sm *ServerMapper) handleWrite() {
 
 			if err != nil {
 				logger.Error(FormatString("Failed to write to dest conn: %s", err.Error()))
-				sm.Stop()
+				sm.stopWithReason(STOP_REASON_WRITE_ERROR)
 				return
 			}
+
+			sm.server.metrics.Upstream(n)
 		}
 	}
 }
+
+func (sm *ServerMapper) handleMuxWrite() {
+	defer sm.wg.Done()
+
+	var buffer []byte = make([]byte, PayloadCapacity(sm.server.config.PackageBufferSize))
+
+	for {
+		select {
+		case <-sm.ctx.Done():
+			return
+
+		default:
+			if err := sm.srcConnection.SetReadDeadline(time.Now().Add(sm.server.config.ReadTimeout)); err != nil {
+				logger.Error(FormatString("Failed to set read deadline: %s", err.Error()))
+				sm.stopWithReason(STOP_REASON_READ_ERROR)
+				return
+			}
+
+			n, err := sm.srcConnection.Read(buffer)
+
+			if os.IsTimeout(err) {
+				continue
+			}
+
+			if err == io.EOF {
+				sm.stopWithReason(STOP_REASON_EOF)
+				return
+			}
+
+			if err != nil {
+				logger.Error(FormatString("Failed to read from src conn: %s", err.Error()))
+				sm.stopWithReason(STOP_REASON_READ_ERROR)
+				return
+			}
+
+			keepalive := sm.keepalive.Load()
+			if keepalive != nil {
+				keepalive.Received()
+			}
+
+			header, data, err := DecodeMuxFrame(buffer[:n])
+			if err != nil {
+				logger.Warn(err.Error())
+				continue
+			}
+
+			// 心跳不算作流量, 否则空闲的映射永远不会被回收
+			if header.Type == MUX_FRAME_TYPE_PING {
+				if parsed, isPing := ParseKeepalivePing(buffer[:n]); isPing && keepalive == nil {
+					sm.keepalive.Store(parsed)
+				}
+
+				if err := sm.replyKeepalive(buffer[:n]); err != nil {
+					logger.Warn(err.Error())
+				}
+				continue
+			}
+
+			sm.activeRecorder.RecordWrite(len(data))
+
+			switch header.Type {
+			case MUX_FRAME_TYPE_DATA:
+				if _, isRejected := sm.rejected.Load(header.FlowID); isRejected {
+					continue
+				}
+
+				flow, err := sm.getOrCreateFlow(header.FlowID)
+				if err != nil {
+					sm.rejectFlow(header.FlowID, err)
+					continue
+				}
+
+				// 等待令牌时这个连接上的其他流也在等待, 它们属于同一个客户端身份, 共用同一组令牌桶
+				if !sm.rateLimiters.Upstream().Wait(sm.ctx, len(data)) {
+					continue
+				}
+
+				if err := flow.Write(data); err != nil {
+					logger.Error(err.Error())
+					flow.Stop()
+				}
+
+			case MUX_FRAME_TYPE_OPEN:
+				if _, isRejected := sm.rejected.Load(header.FlowID); isRejected {
+					continue
+				}
+
+				// 客户端没有收到 OPEN_ACK 时会重发 OPEN, 流已经建立时再确认一次
+				if _, isExist := sm.flows.Load(header.FlowID); !isExist {
+					if err := sm.openFlow(header.FlowID, string(data)); err != nil {
+						sm.rejectFlow(header.FlowID, err)
+						continue
+					}
+				}
+
+				if err := sm.ackOpen(header.FlowID); err != nil {
+					logger.Warn(err.Error())
+				}
+
+			case MUX_FRAME_TYPE_CLOSE:
+				sm.rejected.Delete(header.FlowID)
+
+				if value, isExist := sm.flows.Load(header.FlowID); isExist {
+					flow := value.(*ServerFlow)
+					flow.closedByPeer.Store(true)
+					flow.Stop()
+				}
+			}
+		}
+	}
+}
+
+func (sm *ServerMapper) getOrCreateFlow(flowID uint32) (*ServerFlow, error) {
+	if value, isExist := sm.flows.Load(flowID); isExist {
+		return value.(*ServerFlow), nil
+	}
+
+	// 允许客户端指定目标地址时, 没有 OPEN 的流可能是 OPEN 丢失或者迟到, 转发到服务端的 remote 会发错地方
+	if sm.destinationAllowlist != nil {
+		return nil, MakeErrorWithErrMsg("Failed to create flow %s#%d: flow is not opened", sm.srcConnection.RemoteAddr().String(), flowID)
+	}
+
+	return sm.createFlow(flowID, sm.upstreams.Select(sm.peerIdentity.String()))
+}
+
+// openFlow 处理 OPEN 帧, 按客户端指定的目标地址建立流, 没有指定时使用服务端的 remote
+func (sm *ServerMapper) openFlow(flowID uint32, destination string) error {
+	if destination == "" {
+		_, err := sm.createFlow(flowID, sm.upstreams.Select(sm.peerIdentity.String()))
+		return err
+	}
+
+	address, err := sm.destinationAllowlist.Resolve(destination)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to open flow %s#%d: %s", sm.srcConnection.RemoteAddr().String(), flowID, err.Error())
+	}
+
+	_, err = sm.createFlow(flowID, NewUpstream(address))
+	return err
+}
+
+func (sm *ServerMapper) createFlow(flowID uint32, upstream *Upstream) (*ServerFlow, error) {
+	flow := NewServerFlow(sm, flowID, upstream, sm.ctx)
+	if err := flow.init(); err != nil {
+		flow.Stop()
+		return nil, MakeErrorWithErrMsg("Failed to create flow %d: %s", flowID, err.Error())
+	}
+
+	logger.Info(FormatString("New flow: %s#%d -> %s", sm.srcConnection.RemoteAddr().String(), flowID, upstream.String()))
+
+	sm.flows.Store(flowID, flow)
+	sm.flowsWg.Add(1)
+	go flow.Run(sm.flowsWg)
+
+	return flow, nil
+}
+
+func (sm *ServerMapper) handleFlowDestroy(flow *ServerFlow) {
+	sm.flows.Delete(flow.flowID)
+
+	if flow.closedByPeer.Load() || sm.ctx.Err() != nil {
+		return
+	}
+
+	var header [MUX_FRAME_HEADER_SIZE]byte
+	if err := sm.writeFrame(header[:], MUX_FRAME_TYPE_CLOSE, flow.flowID); err != nil {
+		logger.Warn(FormatString("Failed to notify flow close: %s", err.Error()))
+	}
+}
+
+// rejectFlow 丢弃这个流之后的 DATA 并通知客户端关闭
+func (sm *ServerMapper) rejectFlow(flowID uint32, reason error) {
+	logger.Warn(reason.Error())
+	sm.rejected.Store(flowID, struct{}{})
+
+	var frame [MUX_FRAME_HEADER_SIZE]byte
+	if err := sm.writeFrame(frame[:], MUX_FRAME_TYPE_CLOSE, flowID); err != nil {
+		logger.Warn(FormatString("Failed to notify flow close: %s", err.Error()))
+	}
+}
+
+// ackOpen 确认 OPEN, 非多路复用模式下 flow id 为 0
+func (sm *ServerMapper) ackOpen(flowID uint32) error {
+	var frame [MUX_FRAME_HEADER_SIZE]byte
+	if err := sm.writeFrame(frame[:], MUX_FRAME_TYPE_OPEN_ACK, flowID); err != nil {
+		return MakeErrorWithErrMsg("Failed to ack open: %s", err.Error())
+	}
+	return nil
+}
+
+// isOpenRetry 判断非多路复用模式下的数据报是否是客户端重发的 OPEN 帧
+func (sm *ServerMapper) isOpenRetry(datagram []byte) bool {
+	if sm.destination == "" {
+		return false
+	}
+
+	header, data, err := DecodeMuxFrame(datagram)
+	return err == nil && header.Type == MUX_FRAME_TYPE_OPEN && header.FlowID == 0 && string(data) == sm.destination
+}
+
+// replyKeepalive 把 PING 帧原地改为 PONG 帧后回复
+func (sm *ServerMapper) replyKeepalive(ping []byte) error {
+	if err := sm.writeFrame(ping, MUX_FRAME_TYPE_PONG, 0); err != nil {
+		return MakeErrorWithErrMsg("Failed to reply keepalive: %s", err.Error())
+	}
+	return nil
+}
+
+// writeFrame 把帧头写入 frame 的前 MUX_FRAME_HEADER_SIZE 个字节后发送给客户端
+func (sm *ServerMapper) writeFrame(frame []byte, frameType byte, flowID uint32) error {
+	if err := EncodeMuxFrameHeader(frame, frameType, flowID); err != nil {
+		return err
+	}
+
+	sm.writeLock.Lock()
+	defer sm.writeLock.Unlock()
+
+	if err := sm.srcConnection.SetWriteDeadline(time.Now().Add(sm.server.config.WriteTimeout)); err != nil {
+		return MakeErrorWithErrMsg("Failed to set write deadline: %s", err.Error())
+	}
+
+	_, err := sm.srcConnection.Write(frame)
+	if os.IsTimeout(err) {
+		return nil
+	}
+
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to write to src conn: %s", err.Error())
+	}
+
+	// 多路复用模式下返回的数据都经过这里, 否则映射会因为没有读取而被回收
+	if frameType == MUX_FRAME_TYPE_DATA {
+		sm.activeRecorder.RecordRead(len(frame) - MUX_FRAME_HEADER_SIZE)
+	}
+
+	return nil
+}
+
+func (sm *ServerMapper) Info() *MapperInfo {
+	info := &MapperInfo{
+		ID:              sm.srcConnection.RemoteAddr().String(),
+		Peer:            sm.peerIdentity.String(),
+		CreatedAt:       sm.createdAt,
+		LastRead:        sm.activeRecorder.LastRead(),
+		LastWrite:       sm.activeRecorder.LastWrite(),
+		UpstreamBytes:   sm.activeRecorder.WriteBytes(),
+		DownstreamBytes: sm.activeRecorder.ReadBytes(),
+		Multiplexed:     sm.multiplexed,
+	}
+
+	if sm.destConnection != nil {
+		info.Destination = sm.destConnection.RemoteAddr().String()
+	}
+
+	sm.flows.Range(func(key, value any) bool {
+		info.Flows++
+		return true
+	})
+
+	return info
+}
@@ -0,0 +1,148 @@
+package dtls_tunnel
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDestinationServer 启动允许客户端指定回环地址的服务端, 服务端的 remote 只接收不回复
+// 返回服务端的配置, 客户端可以指定的回显上游, 以及 remote 收到的数据报数量
+func newTestDestinationServer(t *testing.T) (*FileConfig, *net.UDPConn, *atomic.Int32) {
+	t.Helper()
+
+	remote, received := newTestSinkUpstream(t)
+	destination := newTestEchoUpstream(t)
+
+	serverConfig := newTestFileConfig(t, "server", remote.LocalAddr().String())
+	serverConfig.AllowDestinations = []DestinationRuleFileConfig{{CIDR: "127.0.0.0/8"}}
+	newTestServer(t, serverConfig)
+
+	return serverConfig, destination, received
+}
+
+func writeTestFrame(t *testing.T, conn net.Conn, frameType byte, flowID uint32, data string) {
+	t.Helper()
+
+	frame := make([]byte, MUX_FRAME_HEADER_SIZE+len(data))
+	_ = EncodeMuxFrameHeader(frame, frameType, flowID)
+	copy(frame[MUX_FRAME_HEADER_SIZE:], data)
+
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestDatagram 读取一个数据报, 超时返回 nil
+func readTestDatagram(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+
+	buffer := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(TEST_ROUND_TRIP_TIMEOUT))
+
+	n, err := conn.Read(buffer)
+	if os.IsTimeout(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer[:n]
+}
+
+func expectTestFrame(t *testing.T, conn net.Conn, frameType byte, flowID uint32, data string) {
+	t.Helper()
+
+	datagram := readTestDatagram(t, conn)
+	header, payload, err := DecodeMuxFrame(datagram)
+	if err != nil || header.Type != frameType || header.FlowID != flowID || string(payload) != data {
+		t.Fatalf("received %x, want frame type %d, flow %d and data %q", datagram, frameType, flowID, data)
+	}
+}
+
+func TestServerMapperOpenAck(t *testing.T) {
+	serverConfig, destination, received := newTestDestinationServer(t)
+	conn := dialTestDTLS(t, serverConfig.Listen)
+
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_HELLO, 0, MUX_PROTOCOL)
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_HELLO, 0, MUX_PROTOCOL)
+
+	// OPEN 丢失时的 DATA 不转发到服务端的 remote, 通知客户端关闭这个流
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_DATA, 1, "lost open")
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_CLOSE, 1, "")
+
+	// 重发的 OPEN 再确认一次, 不会被当作重复的流拒绝
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_OPEN, 2, destination.LocalAddr().String())
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_OPEN_ACK, 2, "")
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_OPEN, 2, destination.LocalAddr().String())
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_OPEN_ACK, 2, "")
+
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_DATA, 2, "hello")
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_DATA, 2, "echo:hello")
+
+	// 不允许的目标地址
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_OPEN, 3, "192.0.2.1:53")
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_CLOSE, 3, "")
+
+	if count := received.Load(); count != 0 {
+		t.Errorf("server remote received %d datagrams of unopened flows", count)
+	}
+}
+
+func TestServerMapperOpenAckWithoutMultiplex(t *testing.T) {
+	serverConfig, destination, received := newTestDestinationServer(t)
+	conn := dialTestDTLS(t, serverConfig.Listen)
+
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_OPEN, 0, destination.LocalAddr().String())
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_OPEN_ACK, 0, "")
+
+	// 重发的 OPEN 只确认, 不转发到目标地址
+	writeTestFrame(t, conn, MUX_FRAME_TYPE_OPEN, 0, destination.LocalAddr().String())
+	expectTestFrame(t, conn, MUX_FRAME_TYPE_OPEN_ACK, 0, "")
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readTestDatagram(t, conn); string(reply) != "echo:hello" {
+		t.Errorf("received %q, want the echo of hello", reply)
+	}
+
+	if count := received.Load(); count != 0 {
+		t.Errorf("server remote received %d datagrams", count)
+	}
+}
+
+func TestClientOpenDestination(t *testing.T) {
+	for _, isMultiplexed := range []bool{false, true} {
+		serverConfig, destination, received := newTestDestinationServer(t)
+
+		clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+		clientConfig.Multiplex = isMultiplexed
+		clientConfig.Destination = destination.LocalAddr().String()
+		newTestClient(t, clientConfig)
+
+		conn := dialTestUDP(t, clientConfig.Listen)
+		testRoundTrip(t, conn, "hello")
+
+		if count := received.Load(); count != 0 {
+			t.Errorf("multiplex %v: server remote received %d datagrams", isMultiplexed, count)
+		}
+	}
+}
+
+func TestClientOpenWithoutDestination(t *testing.T) {
+	// 允许客户端指定目标地址的服务端, 没有指定目标地址的流仍然使用服务端的 remote
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+	serverConfig.AllowDestinations = []DestinationRuleFileConfig{{CIDR: "192.0.2.0/24"}}
+	newTestServer(t, serverConfig)
+
+	clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+	clientConfig.Multiplex = true
+	newTestClient(t, clientConfig)
+
+	conn := dialTestUDP(t, clientConfig.Listen)
+	testRoundTrip(t, conn, "hello")
+}
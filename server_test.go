@@ -0,0 +1,32 @@
+package dtls_tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerReadBuffersOutsidePayloadPool(t *testing.T) {
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+
+	// 只有一个 payload 的池, 映射的读缓冲区如果从中取出, 第二个客户端就无法转发
+	manager, err := NewTunnelManager([]*CommonConfig{toTestCommonConfig(t, serverConfig)}, &PayloadPoolConfig{
+		Limit:           1,
+		ExhaustedPolicy: POOL_EXHAUSTED_FAIL,
+		Timeout:         time.Millisecond * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestTunnel(t, manager)
+
+	// 所有连接同时保持打开, 每个连接对应一个映射
+	for index := 0; index < 3; index++ {
+		conn := dialTestDTLS(t, serverConfig.Listen)
+		testRoundTrip(t, conn, FormatString("client %d", index))
+	}
+
+	if stats := manager.PayloadPoolStats(); stats.InUse != 0 || stats.Failures != 0 {
+		t.Errorf("server took payloads from the shared pool: %+v", stats)
+	}
+}
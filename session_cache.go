@@ -0,0 +1,205 @@
+package dtls_tunnel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+/*
+ * DTLS 会话恢复, 重新连接时用缓存的 master secret 做简化握手, 省去密钥交换和一次往返
+ * Client 按服务端地址缓存自己的会话, Server 按 session id 缓存所有客户端的会话
+ * 简化握手不发送 PSK identity, 所以完整握手后把对端的 identity 也存进缓存, 恢复的连接用它识别身份
+ * 重新加载认证材料时清空缓存, 之后的连接使用新的密钥做完整握手
+ *
+ * 只在 PSK 模式下使用: pion/dtls 的服务端不为出示了证书的客户端保存会话 (CVE-2016-5419)
+ * 证书模式要求双向认证, 服务端永远不会恢复会话
+ */
+
+// 缓存的会话数量上限, 超出时淘汰最早过期的会话
+const SESSION_CACHE_SIZE = 10000
+
+type sessionCacheEntry struct {
+	session dtls.Session
+
+	// 对端的 PSK identity (Client 上是服务端的 hint), 完整握手完成后记录
+	identity []byte
+
+	created time.Time
+	expires time.Time
+}
+
+// SessionCache 实现 dtls.SessionStore
+type SessionCache struct {
+	ttl time.Duration
+
+	lock    *sync.Mutex
+	entries map[string]*sessionCacheEntry
+
+	// session id -> key, Client 的 key 是服务端地址, Server 的 key 就是 session id
+	keys map[string]string
+}
+
+func NewSessionCache(ttl time.Duration) *SessionCache {
+	return &SessionCache{
+		ttl:     ttl,
+		lock:    &sync.Mutex{},
+		entries: make(map[string]*sessionCacheEntry),
+		keys:    make(map[string]string),
+	}
+}
+
+func (c *SessionCache) Set(key []byte, session dtls.Session) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.delete(string(key))
+	if len(c.entries) >= SESSION_CACHE_SIZE {
+		c.evict()
+	}
+
+	now := time.Now()
+	c.entries[string(key)] = &sessionCacheEntry{
+		session: session,
+		created: now,
+		expires: now.Add(c.ttl),
+	}
+	c.keys[string(session.ID)] = string(key)
+
+	return nil
+}
+
+// Get 没有缓存或已经过期时返回空的 Session, 此时做完整握手
+func (c *SessionCache) Get(key []byte) (dtls.Session, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, isExist := c.entries[string(key)]
+	if !isExist {
+		return dtls.Session{}, nil
+	}
+
+	if time.Now().After(entry.expires) {
+		c.delete(string(key))
+		return dtls.Session{}, nil
+	}
+
+	return entry.session, nil
+}
+
+// Del 的参数可能是 key 也可能是 session id, 服务端拒绝恢复时 pion 在客户端用 session id 删除
+func (c *SessionCache) Del(key []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if mapped, isExist := c.keys[string(key)]; isExist {
+		c.delete(mapped)
+	}
+	c.delete(string(key))
+
+	return nil
+}
+
+// Clear 删除所有会话, c 为 nil 时什么都不做
+func (c *SessionCache) Clear() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[string]*sessionCacheEntry)
+	c.keys = make(map[string]string)
+}
+
+func (c *SessionCache) delete(key string) {
+	entry, isExist := c.entries[key]
+	if !isExist {
+		return
+	}
+
+	delete(c.entries, key)
+	delete(c.keys, string(entry.session.ID))
+}
+
+// evict 先删除所有过期的会话, 仍然满时删除最早过期的一个
+func (c *SessionCache) evict() {
+	now := time.Now()
+	oldestKey := ""
+	var oldest *sessionCacheEntry = nil
+
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			c.delete(key)
+			continue
+		}
+
+		if oldest == nil || entry.expires.Before(oldest.expires) {
+			oldestKey = key
+			oldest = entry
+		}
+	}
+
+	if len(c.entries) >= SESSION_CACHE_SIZE && oldest != nil {
+		c.delete(oldestKey)
+	}
+}
+
+func (c *SessionCache) lookup(sessionID []byte) *sessionCacheEntry {
+	return c.entries[c.keys[string(sessionID)]]
+}
+
+// Bind 记录完整握手中对端的 identity
+// Server 在 VerifyConnection 中调用, 保证客户端收到最后一个握手消息之前 identity 已经存入缓存
+func (c *SessionCache) Bind(state *dtls.State) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry := c.lookup(state.SessionID); entry != nil {
+		entry.identity = state.IdentityHint
+	}
+}
+
+// Resolve 在握手完成后调用, start 是开始握手的时间, 返回是否是恢复的会话
+// 会话在握手开始之前就已经缓存说明是恢复的, 这时把缓存的 identity 填回 state, 找不到 identity 时返回错误
+func (c *SessionCache) Resolve(state *dtls.State, start time.Time) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := c.lookup(state.SessionID)
+	if entry == nil || !entry.created.Before(start) {
+		if entry != nil {
+			entry.identity = state.IdentityHint
+		}
+		return false, nil
+	}
+
+	if len(state.IdentityHint) == 0 {
+		state.IdentityHint = entry.identity
+	}
+
+	if len(state.IdentityHint) == 0 {
+		return true, MakeErrorWithErrMsg("unknown identity of session %x", state.SessionID)
+	}
+
+	return true, nil
+}
+
+// ConnectionState 返回连接的状态, 恢复的会话带上缓存的 identity, c 为 nil 时直接返回
+func (c *SessionCache) ConnectionState(conn *dtls.Conn) dtls.State {
+	state, _ := conn.ConnectionState()
+	if c == nil || len(state.IdentityHint) > 0 {
+		return state
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry := c.lookup(state.SessionID); entry != nil {
+		state.IdentityHint = entry.identity
+	}
+
+	return state
+}
@@ -0,0 +1,149 @@
+package dtls_tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	"github.com/pion/dtls/v3/pkg/crypto/selfsign"
+)
+
+func TestSessionCacheGetSet(t *testing.T) {
+	cache := NewSessionCache(time.Hour)
+	key := []byte("10.0.0.1:443")
+
+	if session, _ := cache.Get(key); len(session.ID) != 0 {
+		t.Fatal("Get() returns a session before Set")
+	}
+
+	_ = cache.Set(key, dtls.Session{ID: []byte{1}, Secret: []byte("secret")})
+	if session, _ := cache.Get(key); !bytes.Equal(session.ID, []byte{1}) {
+		t.Fatalf("Get() = session %x, want 01", session.ID)
+	}
+
+	// 同一个 key 的新会话替换旧的, 旧的 session id 不再指向它
+	_ = cache.Set(key, dtls.Session{ID: []byte{2}})
+	if len(cache.entries) != 1 || len(cache.keys) != 1 {
+		t.Errorf("%d entries and %d session ids after replacing, want 1", len(cache.entries), len(cache.keys))
+	}
+
+	// pion 在服务端拒绝恢复时用 session id 删除
+	_ = cache.Del([]byte{2})
+	if session, _ := cache.Get(key); len(session.ID) != 0 {
+		t.Error("Get() returns a session deleted by its session id")
+	}
+
+	_ = cache.Set(key, dtls.Session{ID: []byte{3}})
+	cache.Clear()
+	if session, _ := cache.Get(key); len(session.ID) != 0 {
+		t.Error("Get() returns a session after Clear")
+	}
+
+	var nilCache *SessionCache
+	nilCache.Clear()
+}
+
+func TestSessionCacheExpire(t *testing.T) {
+	cache := NewSessionCache(time.Hour)
+	key := []byte("10.0.0.1:443")
+	_ = cache.Set(key, dtls.Session{ID: []byte{1}})
+	cache.entries[string(key)].expires = time.Now().Add(-time.Second)
+
+	if session, _ := cache.Get(key); len(session.ID) != 0 {
+		t.Error("Get() returns an expired session")
+	}
+
+	if len(cache.entries) != 0 || len(cache.keys) != 0 {
+		t.Error("the expired session is not deleted")
+	}
+}
+
+func TestSessionCacheEvict(t *testing.T) {
+	cache := NewSessionCache(time.Hour)
+	for index := 0; index < SESSION_CACHE_SIZE; index++ {
+		key := []byte(FormatString("%d", index))
+		_ = cache.Set(key, dtls.Session{ID: key})
+	}
+
+	// 第一个会话最早过期, 缓存满时被淘汰
+	cache.entries["0"].expires = time.Now().Add(time.Minute)
+	_ = cache.Set([]byte("new"), dtls.Session{ID: []byte("new")})
+
+	if len(cache.entries) != SESSION_CACHE_SIZE {
+		t.Errorf("%d sessions, want %d", len(cache.entries), SESSION_CACHE_SIZE)
+	}
+
+	if _, isExist := cache.entries["0"]; isExist {
+		t.Error("the session closest to expiry is not evicted")
+	}
+}
+
+func TestSessionCacheResolve(t *testing.T) {
+	cache := NewSessionCache(time.Hour)
+	sessionID := []byte{0xaa}
+
+	// 完整握手: 会话在握手开始之后才存入缓存
+	start := time.Now()
+	_ = cache.Set(sessionID, dtls.Session{ID: sessionID})
+	cache.Bind(&dtls.State{SessionID: sessionID, IdentityHint: []byte("alice")})
+
+	isResumed, err := cache.Resolve(&dtls.State{SessionID: sessionID, IdentityHint: []byte("alice")}, start)
+	if err != nil || isResumed {
+		t.Fatalf("full handshake: resumed %v, error %v", isResumed, err)
+	}
+
+	// 恢复的会话没有 identity, 从缓存中取回
+	cache.entries[string(sessionID)].created = start.Add(-time.Second)
+	state := &dtls.State{SessionID: sessionID}
+	isResumed, err = cache.Resolve(state, start)
+	if err != nil || !isResumed {
+		t.Fatalf("resumed handshake: resumed %v, error %v", isResumed, err)
+	}
+	if string(state.IdentityHint) != "alice" {
+		t.Errorf("resumed identity %q, want alice", state.IdentityHint)
+	}
+
+	cache.entries[string(sessionID)].identity = nil
+	if _, err := cache.Resolve(&dtls.State{SessionID: sessionID}, start); err == nil {
+		t.Error("Resolve() succeeded for a resumed session without identity")
+	}
+}
+
+func TestSessionCacheCertificateNotStored(t *testing.T) {
+	certificate, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(clientAuth dtls.ClientAuthType, clientCertificates []tls.Certificate) int {
+		cache := NewSessionCache(time.Hour)
+		serverConfig := &dtls.Config{
+			Certificates:         []tls.Certificate{certificate},
+			ClientAuth:           clientAuth,
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+			SessionStore:         cache,
+		}
+		clientConfig := &dtls.Config{
+			Certificates:         clientCertificates,
+			InsecureSkipVerify:   true,
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		}
+
+		if _, err := testHandshake(t, serverConfig, clientConfig); err != nil {
+			t.Fatal(err)
+		}
+		return len(cache.entries)
+	}
+
+	if count := handshake(dtls.NoClientCert, nil); count != 1 {
+		t.Fatalf("server cached %d sessions without client certificates, want 1", count)
+	}
+
+	// session_ttl 只支持 PSK 的原因: 客户端出示证书时 pion/dtls 的服务端不保存会话, 之后无法恢复
+	// 如果这里失败, 说明 pion/dtls 已经支持, 可以去掉 Validate 中对证书模式的限制
+	if count := handshake(dtls.RequireAnyClientCert, []tls.Certificate{certificate}); count != 0 {
+		t.Errorf("server cached %d sessions of a client with a certificate, want 0", count)
+	}
+}
@@ -1,25 +1,34 @@
 package dtls_tunnel
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
+// ActiveRecorder 记录最后一次读写的时间和读写的字节数
+// 转发携程写入, 垃圾回收和管理接口并发读取, 所以都用原子操作
+// read 是返回源地址的方向, write 是发往目标地址的方向
 type ActiveRecorder struct {
-	lastRead  time.Time
-	lastWrite time.Time
+	lastRead  atomic.Int64 // UnixNano
+	lastWrite atomic.Int64 // UnixNano
+
+	readBytes  atomic.Uint64
+	writeBytes atomic.Uint64
 }
 
 func NewActiveRecorder(lastRead, lastWrite time.Time) *ActiveRecorder {
-	return &ActiveRecorder{
-		lastRead:  lastRead,
-		lastWrite: lastWrite,
-	}
+	ar := &ActiveRecorder{}
+	ar.SetLastRead(lastRead)
+	ar.SetLastWrite(lastWrite)
+	return ar
 }
 
 func (ar *ActiveRecorder) SetLastRead(lastRead time.Time) {
-	ar.lastRead = lastRead
+	ar.lastRead.Store(lastRead.UnixNano())
 }
 
 func (ar *ActiveRecorder) SetLastWrite(lastWrite time.Time) {
-	ar.lastWrite = lastWrite
+	ar.lastWrite.Store(lastWrite.UnixNano())
 }
 
 func (ar *ActiveRecorder) RefreshLastRead() {
@@ -30,6 +39,47 @@ func (ar *ActiveRecorder) RefreshLastWrite() {
 	ar.SetLastWrite(time.Now())
 }
 
+// RecordRead 刷新最后读取的时间并累加字节数
+func (ar *ActiveRecorder) RecordRead(n int) {
+	ar.RefreshLastRead()
+	ar.readBytes.Add(uint64(n))
+}
+
+// RecordWrite 刷新最后写入的时间并累加字节数
+func (ar *ActiveRecorder) RecordWrite(n int) {
+	ar.RefreshLastWrite()
+	ar.writeBytes.Add(uint64(n))
+}
+
+func (ar *ActiveRecorder) LastRead() time.Time {
+	return time.Unix(0, ar.lastRead.Load())
+}
+
+func (ar *ActiveRecorder) LastWrite() time.Time {
+	return time.Unix(0, ar.lastWrite.Load())
+}
+
+func (ar *ActiveRecorder) ReadBytes() uint64 {
+	return ar.readBytes.Load()
+}
+
+func (ar *ActiveRecorder) WriteBytes() uint64 {
+	return ar.writeBytes.Load()
+}
+
 func (ar *ActiveRecorder) IsTimeout(timeout time.Duration) bool {
-	return ar.lastRead.Add(timeout).Before(time.Now()) || ar.lastWrite.Add(timeout).Before(time.Now())
+	return ar.IsIdle(timeout, IDLE_POLICY_EITHER)
+}
+
+// IsIdle 按 policy 判断是否空闲超过 timeout, policy 为 IDLE_POLICY_EITHER 或 IDLE_POLICY_BOTH
+func (ar *ActiveRecorder) IsIdle(timeout time.Duration, policy string) bool {
+	deadline := time.Now().Add(-timeout)
+	isReadIdle := ar.LastRead().Before(deadline)
+	isWriteIdle := ar.LastWrite().Before(deadline)
+
+	if policy == IDLE_POLICY_BOTH {
+		return isReadIdle && isWriteIdle
+	}
+
+	return isReadIdle || isWriteIdle
 }
@@ -0,0 +1,58 @@
+package dtls_tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActiveRecorderIsIdle(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Minute)
+
+	cases := []struct {
+		name      string
+		lastRead  time.Time
+		lastWrite time.Time
+		isEither  bool
+		isBoth    bool
+	}{
+		{"both active", now, now, false, false},
+		// syslog 这类单向的流只有写入
+		{"write only", old, now, true, false},
+		{"read only", now, old, true, false},
+		{"both idle", old, old, true, true},
+	}
+
+	for _, c := range cases {
+		ar := NewActiveRecorder(c.lastRead, c.lastWrite)
+
+		if isIdle := ar.IsIdle(time.Second*30, IDLE_POLICY_EITHER); isIdle != c.isEither {
+			t.Errorf("%s: IsIdle(either) = %v, want %v", c.name, isIdle, c.isEither)
+		}
+
+		if isIdle := ar.IsIdle(time.Second*30, IDLE_POLICY_BOTH); isIdle != c.isBoth {
+			t.Errorf("%s: IsIdle(both) = %v, want %v", c.name, isIdle, c.isBoth)
+		}
+
+		if isTimeout := ar.IsTimeout(time.Second * 30); isTimeout != c.isEither {
+			t.Errorf("%s: IsTimeout() = %v, want the either policy", c.name, isTimeout)
+		}
+	}
+}
+
+func TestActiveRecorderRecord(t *testing.T) {
+	old := time.Now().Add(-time.Minute)
+	ar := NewActiveRecorder(old, old)
+
+	ar.RecordRead(100)
+	ar.RecordRead(20)
+	ar.RecordWrite(7)
+
+	if ar.ReadBytes() != 120 || ar.WriteBytes() != 7 {
+		t.Errorf("read %d bytes, write %d bytes, want 120 and 7", ar.ReadBytes(), ar.WriteBytes())
+	}
+
+	if !ar.LastRead().After(old) || !ar.LastWrite().After(old) {
+		t.Error("RecordRead and RecordWrite do not refresh the last active time")
+	}
+}
@@ -0,0 +1,251 @@
+package dtls_tunnel
+
+import "sync"
+
+/*
+ * TunnelManager 在一个进程内运行多个隧道
+ * 每个隧道在独立的携程中运行并各自管理生命周期, 一个隧道失败不影响其他隧道
+ * 所有 Client 共用一个 payloadPool, Server 的读缓冲区不从池中取出
+ */
+
+type Tunneler interface {
+	Run() error // block
+	Shutdown()
+	Reload() error
+
+	// 管理接口使用
+	Mappers() []*MapperInfo
+	RateLimiters() []*RateLimiterInfo
+	CloseMapper(id string) bool
+	Drain()
+}
+
+type namedTunnel struct {
+	name    string
+	role    string
+	tunnel  Tunneler
+	address string
+}
+
+type TunnelManager struct {
+	tunnels     []*namedTunnel
+	payloadPool PayloadPooler
+	wg          *sync.WaitGroup
+
+	lock   *sync.Mutex
+	failed []string
+}
+
+// NewTunnelManager 创建所有隧道, payloadPoolConfig 为 nil 时使用不限数量的 payload 池
+func NewTunnelManager(configs []*CommonConfig, payloadPoolConfig *PayloadPoolConfig) (*TunnelManager, error) {
+	if len(configs) == 0 {
+		return nil, MakeErrorWithErrMsg("Failed to create tunnel manager: no tunnel configured")
+	}
+
+	var payloadCapacity int = 0
+	for _, config := range configs {
+		if PayloadCapacity(config.PackageBufferSize) > payloadCapacity {
+			payloadCapacity = PayloadCapacity(config.PackageBufferSize)
+		}
+	}
+
+	manager := &TunnelManager{
+		tunnels:     make([]*namedTunnel, 0, len(configs)),
+		payloadPool: NewPayloadPoolWithConfig(payloadCapacity, payloadPoolConfig),
+		wg:          &sync.WaitGroup{},
+		lock:        &sync.Mutex{},
+	}
+	RegisterPayloadPool(manager.payloadPool.Stats)
+
+	for index, config := range configs {
+		// 名字也用作指标的 tunnel 标签
+		if config.Name == "" {
+			config.Name = FormatString("%s-%d", config.RunMethod, index)
+		}
+		name := config.Name
+
+		tunnel, err := manager.newTunnel(config)
+		if err != nil {
+			return nil, MakeErrorWithErrMsg("Failed to create tunnel %q: %s", name, err.Error())
+		}
+
+		manager.tunnels = append(manager.tunnels, &namedTunnel{
+			name:    name,
+			role:    config.RunMethod,
+			tunnel:  tunnel,
+			address: config.ListenAddress.String(),
+		})
+	}
+
+	return manager, nil
+}
+
+func (m *TunnelManager) newTunnel(commonConfig *CommonConfig) (Tunneler, error) {
+	switch commonConfig.RunMethod {
+	case "server":
+		config, err := ParseServerConfig(commonConfig)
+		if err != nil {
+			return nil, err
+		}
+		return NewServer(config), nil
+
+	case "client":
+		config, err := ParseClientConfig(commonConfig)
+		if err != nil {
+			return nil, err
+		}
+		return NewClientWithPayloadPool(config, m.payloadPool), nil
+
+	default:
+		return nil, MakeErrorWithErrMsg("bad run type: %q", commonConfig.RunMethod)
+	}
+}
+
+// Run 启动所有隧道并等待它们全部退出, 有隧道失败时返回错误
+func (m *TunnelManager) Run() error {
+	m.wg.Add(len(m.tunnels))
+	for _, tunnel := range m.tunnels {
+		go m.runTunnel(tunnel)
+	}
+
+	m.wg.Wait()
+
+	if len(m.failed) > 0 {
+		return MakeErrorWithErrMsg("Tunnels failed: %v", m.failed)
+	}
+
+	return nil
+}
+
+func (m *TunnelManager) Shutdown() {
+	for _, tunnel := range m.tunnels {
+		tunnel.tunnel.Shutdown()
+	}
+}
+
+// Reload 重新加载所有隧道的证书或 PSK 密钥, 已经建立的连接不受影响
+func (m *TunnelManager) Reload() {
+	for _, tunnel := range m.tunnels {
+		if err := tunnel.tunnel.Reload(); err != nil {
+			logger.Warn(FormatString("Failed to reload tunnel %s: %s", tunnel.name, err.Error()))
+			continue
+		}
+
+		logger.Info(FormatString("Tunnel %s is reloaded", tunnel.name))
+	}
+}
+
+func (m *TunnelManager) PayloadPoolStats() PayloadPoolStats {
+	return m.payloadPool.Stats()
+}
+
+func (m *TunnelManager) TunnelInfos() []*TunnelInfo {
+	infos := make([]*TunnelInfo, 0, len(m.tunnels))
+	for _, tunnel := range m.tunnels {
+		infos = append(infos, &TunnelInfo{
+			Name:    tunnel.name,
+			Role:    tunnel.role,
+			Address: tunnel.address,
+			Mappers: len(tunnel.tunnel.Mappers()),
+		})
+	}
+	return infos
+}
+
+// MapperInfos 返回指定隧道的映射, name 为空时返回所有隧道的映射
+func (m *TunnelManager) MapperInfos(name string) ([]*MapperInfo, error) {
+	tunnels, err := m.selectTunnels(name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*MapperInfo, 0)
+	for _, tunnel := range tunnels {
+		for _, info := range tunnel.tunnel.Mappers() {
+			info.Tunnel = tunnel.name
+			infos = append(infos, info)
+		}
+	}
+
+	return infos, nil
+}
+
+// RateLimiterInfos 返回指定隧道的限速范围, name 为空时返回所有隧道的
+func (m *TunnelManager) RateLimiterInfos(name string) ([]*RateLimiterInfo, error) {
+	tunnels, err := m.selectTunnels(name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*RateLimiterInfo, 0)
+	for _, tunnel := range tunnels {
+		for _, info := range tunnel.tunnel.RateLimiters() {
+			info.Tunnel = tunnel.name
+			infos = append(infos, info)
+		}
+	}
+
+	return infos, nil
+}
+
+func (m *TunnelManager) CloseMapper(name string, id string) error {
+	tunnels, err := m.selectTunnels(name)
+	if err != nil {
+		return err
+	}
+
+	if !tunnels[0].tunnel.CloseMapper(id) {
+		return MakeErrorWithErrMsg("mapper %q not found in tunnel %q", id, name)
+	}
+
+	return nil
+}
+
+// Drain 排空指定隧道, name 为空时排空所有隧道
+func (m *TunnelManager) Drain(name string) error {
+	tunnels, err := m.selectTunnels(name)
+	if err != nil {
+		return err
+	}
+
+	for _, tunnel := range tunnels {
+		tunnel.tunnel.Drain()
+	}
+
+	return nil
+}
+
+func (m *TunnelManager) selectTunnels(name string) ([]*namedTunnel, error) {
+	if name == "" {
+		return m.tunnels, nil
+	}
+
+	for _, tunnel := range m.tunnels {
+		if tunnel.name == name {
+			return []*namedTunnel{tunnel}, nil
+		}
+	}
+
+	return nil, MakeErrorWithErrMsg("tunnel %q not found", name)
+}
+
+func (m *TunnelManager) runTunnel(tunnel *namedTunnel) {
+	defer m.wg.Done()
+
+	logger.Info(FormatString("Tunnel %s is starting on %s", tunnel.name, tunnel.address))
+
+	if err := tunnel.tunnel.Run(); err != nil {
+		logger.Error(FormatString("Tunnel %s stopped with error: %s", tunnel.name, err.Error()))
+		m.markFailed(tunnel.name)
+		return
+	}
+
+	logger.Info(FormatString("Tunnel %s is stopped", tunnel.name))
+}
+
+func (m *TunnelManager) markFailed(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.failed = append(m.failed, name)
+}
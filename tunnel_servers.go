@@ -0,0 +1,169 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Client 可以配置多个服务端, 按 strategy 为新的连接选择服务端
+ * priority:    按配置顺序选择第一个健康的服务端
+ * round_robin: 在健康的服务端之间轮询, 每个新的映射 (多路复用模式下每个新的 session) 选择一次
+ * lowest_rtt:  选择最近一次握手耗时最短的健康服务端
+ *
+ * 配置了多个服务端时每 ProbeInterval 对所有服务端做一次握手和心跳探测
+ * 探测失败的服务端不再用于新的连接, 已经在上面的连接会被断开, 重新连接时选择其他服务端
+ * 所有服务端都不健康时仍然按 strategy 依次尝试
+ */
+
+const SERVER_STRATEGY_PRIORITY = "priority"
+const SERVER_STRATEGY_ROUND_ROBIN = "round_robin"
+const SERVER_STRATEGY_LOWEST_RTT = "lowest_rtt"
+
+const DEFAULT_PROBE_INTERVAL = time.Second * 10
+
+type TunnelServer struct {
+	address *net.UDPAddr
+
+	healthy atomic.Bool
+
+	// 最近一次成功握手的耗时, 还没有测量过时为 0
+	rtt atomic.Int64
+}
+
+func (s *TunnelServer) Address() *net.UDPAddr {
+	return s.address
+}
+
+func (s *TunnelServer) String() string {
+	return s.address.String()
+}
+
+func (s *TunnelServer) IsHealthy() bool {
+	return s.healthy.Load()
+}
+
+func (s *TunnelServer) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+type TunnelServers struct {
+	servers  []*TunnelServer
+	strategy string
+	next     atomic.Uint32
+}
+
+func NewTunnelServers(strategy string, addresses ...*net.UDPAddr) *TunnelServers {
+	servers := make([]*TunnelServer, 0, len(addresses))
+	for _, address := range addresses {
+		server := &TunnelServer{address: address}
+		server.healthy.Store(true)
+		servers = append(servers, server)
+	}
+
+	return &TunnelServers{
+		servers:  servers,
+		strategy: strategy,
+	}
+}
+
+func (t *TunnelServers) Servers() []*TunnelServer {
+	return t.servers
+}
+
+// Candidates 返回本次连接依次尝试的服务端, 健康的服务端在前并按 strategy 排序
+func (t *TunnelServers) Candidates() []*TunnelServer {
+	healthy := make([]*TunnelServer, 0, len(t.servers))
+	unhealthy := make([]*TunnelServer, 0)
+
+	for _, server := range t.servers {
+		if server.IsHealthy() {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+
+	switch t.strategy {
+	case SERVER_STRATEGY_ROUND_ROBIN:
+		if len(healthy) > 1 {
+			offset := int(t.next.Add(1)-1) % len(healthy)
+			rotated := make([]*TunnelServer, 0, len(t.servers))
+			rotated = append(rotated, healthy[offset:]...)
+			healthy = append(rotated, healthy[:offset]...)
+		}
+
+	case SERVER_STRATEGY_LOWEST_RTT:
+		sortByRTT(healthy)
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// sortByRTT 按握手耗时升序排列, 没有测量过的排在最后, 耗时相同时保持配置顺序
+func sortByRTT(servers []*TunnelServer) {
+	rtt := func(server *TunnelServer) int64 {
+		if value := server.rtt.Load(); value > 0 {
+			return value
+		}
+		return math.MaxInt64
+	}
+
+	// 服务端的数量很少, 插入排序即可
+	for i := 1; i < len(servers); i++ {
+		for j := i; j > 0 && rtt(servers[j]) < rtt(servers[j-1]); j-- {
+			servers[j], servers[j-1] = servers[j-1], servers[j]
+		}
+	}
+}
+
+// Report 记录一次握手或探测的结果, 返回服务端是否从健康变为不健康
+func (t *TunnelServers) Report(server *TunnelServer, rtt time.Duration, err error) bool {
+	if err != nil {
+		return server.healthy.Swap(false)
+	}
+
+	server.rtt.Store(int64(rtt))
+	if !server.healthy.Swap(true) {
+		logger.Info(FormatString("Server %s is reachable again", server.String()))
+	}
+
+	return false
+}
+
+// Probe 每 interval 并发探测所有服务端, 服务端变为不健康时调用 onDown
+func (t *TunnelServers) Probe(ctx context.Context, interval time.Duration, probe func(ctx context.Context, server *TunnelServer) (time.Duration, error), onDown func(server *TunnelServer)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			wg := &sync.WaitGroup{}
+			for _, server := range t.servers {
+				wg.Add(1)
+				go func(server *TunnelServer) {
+					defer wg.Done()
+
+					rtt, err := probe(ctx, server)
+					if ctx.Err() != nil {
+						return
+					}
+
+					if t.Report(server, rtt, err) {
+						logger.Warn(FormatString("Server %s is unreachable: %s", server.String(), err.Error()))
+						onDown(server)
+					}
+				}(server)
+			}
+			wg.Wait()
+		}
+	}
+}
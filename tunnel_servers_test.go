@@ -0,0 +1,98 @@
+package dtls_tunnel
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestTunnelServers(strategy string) *TunnelServers {
+	return NewTunnelServers(strategy,
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443},
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443},
+		&net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 443},
+	)
+}
+
+func candidateNames(servers []*TunnelServer) []string {
+	names := make([]string, 0, len(servers))
+	for _, server := range servers {
+		names = append(names, server.String())
+	}
+	return names
+}
+
+func checkCandidates(t *testing.T, name string, servers []*TunnelServer, want ...int) {
+	t.Helper()
+
+	got := candidateNames(servers)
+	if len(got) != len(want) {
+		t.Errorf("%s: candidates %v, want %d servers", name, got, len(want))
+		return
+	}
+
+	for index, server := range want {
+		if wantName := FormatString("10.0.0.%d:443", server); got[index] != wantName {
+			t.Errorf("%s: candidates %v, want %v at %d", name, got, wantName, index)
+		}
+	}
+}
+
+func TestTunnelServersPriority(t *testing.T) {
+	servers := newTestTunnelServers(SERVER_STRATEGY_PRIORITY)
+	checkCandidates(t, "all healthy", servers.Candidates(), 1, 2, 3)
+
+	// 不健康的服务端排在最后, 仍然可以尝试
+	servers.Report(servers.Servers()[0], 0, errors.New("timeout"))
+	checkCandidates(t, "first down", servers.Candidates(), 2, 3, 1)
+
+	servers.Report(servers.Servers()[0], time.Millisecond, nil)
+	checkCandidates(t, "first back", servers.Candidates(), 1, 2, 3)
+}
+
+func TestTunnelServersRoundRobin(t *testing.T) {
+	servers := newTestTunnelServers(SERVER_STRATEGY_ROUND_ROBIN)
+	checkCandidates(t, "first", servers.Candidates(), 1, 2, 3)
+	checkCandidates(t, "second", servers.Candidates(), 2, 3, 1)
+	checkCandidates(t, "third", servers.Candidates(), 3, 1, 2)
+	checkCandidates(t, "fourth", servers.Candidates(), 1, 2, 3)
+
+	// 只在健康的服务端之间轮询
+	servers.Report(servers.Servers()[1], 0, errors.New("timeout"))
+	checkCandidates(t, "second down", servers.Candidates(), 1, 3, 2)
+	checkCandidates(t, "second down again", servers.Candidates(), 3, 1, 2)
+}
+
+func TestTunnelServersLowestRTT(t *testing.T) {
+	servers := newTestTunnelServers(SERVER_STRATEGY_LOWEST_RTT)
+
+	// 没有测量过的服务端排在测量过的后面, 之间保持配置顺序
+	servers.Report(servers.Servers()[2], time.Millisecond*30, nil)
+	checkCandidates(t, "one measured", servers.Candidates(), 3, 1, 2)
+
+	servers.Report(servers.Servers()[0], time.Millisecond*50, nil)
+	servers.Report(servers.Servers()[1], time.Millisecond*10, nil)
+	checkCandidates(t, "all measured", servers.Candidates(), 2, 3, 1)
+
+	servers.Report(servers.Servers()[1], 0, errors.New("timeout"))
+	checkCandidates(t, "fastest down", servers.Candidates(), 3, 1, 2)
+}
+
+func TestTunnelServersReport(t *testing.T) {
+	servers := newTestTunnelServers(SERVER_STRATEGY_PRIORITY)
+	server := servers.Servers()[0]
+
+	if !servers.Report(server, 0, errors.New("timeout")) {
+		t.Error("Report() = false when a healthy server goes down")
+	}
+
+	// 只在状态变化时返回 true, 避免重复断开连接
+	if servers.Report(server, 0, errors.New("timeout")) {
+		t.Error("Report() = true when the server is already down")
+	}
+
+	if servers.Report(server, time.Millisecond*20, nil) || !server.IsHealthy() || server.RTT() != time.Millisecond*20 {
+		t.Errorf("after a successful probe: healthy %v, rtt %s", server.IsHealthy(), server.RTT())
+	}
+}
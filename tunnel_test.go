@@ -0,0 +1,288 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+const TEST_PSK_IDENTITY = "alice"
+const TEST_PSK_KEY = "000102030405060708090a0b0c0d0e0f"
+
+// 握手和建立映射期间的数据报可能丢失, 往返测试在这段时间内重发
+const TEST_ROUND_TRIP_TIMEOUT = time.Second * 5
+const TEST_ROUND_TRIP_RETRY = time.Millisecond * 100
+
+// runner 是 Server, Client 和 TunnelManager 共有的生命周期
+type runner interface {
+	Run() error
+	Shutdown()
+}
+
+// newTestEchoUpstream 启动回环地址上的 UDP 上游, 把收到的数据报加上 "echo:" 前缀发回
+func newTestEchoUpstream(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(append([]byte("echo:"), buffer[:n]...), addr)
+		}
+	}()
+
+	return conn
+}
+
+// newTestSinkUpstream 启动只接收不回复的 UDP 上游, 返回收到的数据报数量
+func newTestSinkUpstream(t *testing.T) (*net.UDPConn, *atomic.Int32) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	received := &atomic.Int32{}
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			if _, _, err := conn.ReadFromUDP(buffer); err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+
+	return conn, received
+}
+
+// freeTestUDPAddress 返回一个当前没有被占用的回环地址
+// 隧道在 Run 中才监听, 所以地址要事先确定
+func freeTestUDPAddress(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
+
+// newTestFileConfig 返回回环地址上使用 PSK 认证的配置, 各个测试在此基础上修改
+func newTestFileConfig(t *testing.T, mode string, remote string) *FileConfig {
+	t.Helper()
+
+	config := DefaultFileConfig()
+	config.Mode = mode
+	config.Listen = freeTestUDPAddress(t)
+	config.Remote = remote
+	config.Auth = AUTH_MODE_PSK
+	config.PSKFile = writeTestPSKFile(t, TEST_PSK_IDENTITY+":"+TEST_PSK_KEY+"\n")
+	if mode == "client" {
+		config.PSKIdentity = TEST_PSK_IDENTITY
+	}
+
+	// 读超时决定了关闭时各个协程多久能退出
+	config.ReadTimeout = Duration(time.Millisecond * 50)
+
+	return config
+}
+
+func toTestCommonConfig(t *testing.T, fileConfig *FileConfig) *CommonConfig {
+	t.Helper()
+
+	config, err := fileConfig.ToCommonConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// runTestTunnel 在后台运行隧道, 测试结束时关闭并等待 Run 返回
+func runTestTunnel(t *testing.T, tunnel runner) {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tunnel.Run()
+	}()
+
+	t.Cleanup(func() {
+		tunnel.Shutdown()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Run() = %s", err.Error())
+			}
+		case <-time.After(TEST_ROUND_TRIP_TIMEOUT):
+			t.Error("tunnel is not stopped after Shutdown")
+		}
+	})
+}
+
+func newTestServer(t *testing.T, fileConfig *FileConfig) *Server {
+	t.Helper()
+
+	config, err := ParseServerConfig(toTestCommonConfig(t, fileConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(config)
+	runTestTunnel(t, server)
+	return server
+}
+
+func newTestClient(t *testing.T, fileConfig *FileConfig) *Client {
+	t.Helper()
+
+	config, err := ParseClientConfig(toTestCommonConfig(t, fileConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(config)
+	runTestTunnel(t, client)
+	return client
+}
+
+// dialTestUDP 返回连向 address 的 UDP socket, 模拟隧道客户端一侧的应用
+func dialTestUDP(t *testing.T, address string) *net.UDPConn {
+	t.Helper()
+
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// dialTestDTLS 直接用 PSK 连接服务端, 不经过 Client
+func dialTestDTLS(t *testing.T, address string) *dtls.Conn {
+	t.Helper()
+
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := hex.DecodeString(TEST_PSK_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &dtls.Config{
+		PSK: func([]byte) ([]byte, error) {
+			return key, nil
+		},
+		PSKIdentityHint:      []byte(TEST_PSK_IDENTITY),
+		CipherSuites:         pskCipherSuites,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_ROUND_TRIP_TIMEOUT)
+	defer cancel()
+
+	for {
+		conn, err := dtls.Dial("udp", remote, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 服务端还没有开始监听时收到 ICMP 端口不可达
+		err = conn.HandshakeContext(ctx)
+		if errors.Is(err, syscall.ECONNREFUSED) && ctx.Err() == nil {
+			_ = conn.Close()
+			time.Sleep(TEST_ROUND_TRIP_RETRY)
+			continue
+		}
+		if err != nil {
+			_ = conn.Close()
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+
+		return conn
+	}
+}
+
+// testRoundTrip 发送 message 并等待上游的回显, 没有回复时重发
+func testRoundTrip(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+
+	want := "echo:" + message
+	buffer := make([]byte, 2048)
+	deadline := time.Now().Add(TEST_ROUND_TRIP_TIMEOUT)
+
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write([]byte(message)); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("Write(%q): %s", message, err.Error())
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(TEST_ROUND_TRIP_RETRY))
+		for {
+			n, err := conn.Read(buffer)
+			if os.IsTimeout(err) {
+				break
+			}
+
+			// 隧道还没有开始监听时收到 ICMP 端口不可达
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				time.Sleep(TEST_ROUND_TRIP_RETRY)
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read() waiting for %q: %s", want, err.Error())
+			}
+
+			// 重发可能带来之前的回显
+			if string(buffer[:n]) == want {
+				return
+			}
+		}
+	}
+
+	t.Fatalf("no echo of %q within %s", message, TEST_ROUND_TRIP_TIMEOUT)
+}
+
+func TestTunnelRoundTrip(t *testing.T) {
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+	newTestServer(t, serverConfig)
+
+	clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+	newTestClient(t, clientConfig)
+
+	conn := dialTestUDP(t, clientConfig.Listen)
+	testRoundTrip(t, conn, "hello")
+	testRoundTrip(t, conn, "world")
+}
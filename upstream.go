@@ -0,0 +1,244 @@
+package dtls_tunnel
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Server 转发的上游地址池, 新的映射 (多路复用模式下新的 flow) 按 policy 选择一个上游
+ * round_robin: 在健康的上游之间轮询
+ * hash:        按客户端身份做 rendezvous hash, 同一个客户端固定到同一个上游, 上游增减时只影响其上的客户端
+ * least_flows: 选择当前映射和 flow 最少的上游
+ *
+ * 配置了健康检查时每 interval 向所有上游发送 payload, 在 timeout 内收到以 expect 开头的回复算成功
+ * 连续 failures 次失败的上游不再用于新的映射和 flow, 一次成功后恢复, 已经建立的连接不受影响
+ * 所有上游都不健康时仍然在全部上游中选择, 避免健康检查本身的问题中断所有流量
+ */
+
+const UPSTREAM_POLICY_ROUND_ROBIN = "round_robin"
+const UPSTREAM_POLICY_HASH = "hash"
+const UPSTREAM_POLICY_LEAST_FLOWS = "least_flows"
+
+const DEFAULT_HEALTH_CHECK_TIMEOUT = time.Second
+const DEFAULT_HEALTH_CHECK_FAILURES = 2
+
+type Upstream struct {
+	address *net.UDPAddr
+
+	healthy  atomic.Bool
+	failures atomic.Int32 // 连续失败的次数
+
+	// 转发到这个上游的映射和 flow 的数量
+	flows atomic.Int32
+}
+
+func NewUpstream(address *net.UDPAddr) *Upstream {
+	upstream := &Upstream{address: address}
+	upstream.healthy.Store(true)
+	return upstream
+}
+
+func (u *Upstream) Address() *net.UDPAddr {
+	return u.address
+}
+
+func (u *Upstream) String() string {
+	return u.address.String()
+}
+
+func (u *Upstream) IsHealthy() bool {
+	return u.healthy.Load()
+}
+
+func (u *Upstream) Flows() int {
+	return int(u.flows.Load())
+}
+
+// Acquire 在建立到上游的连接后调用, 连接关闭时调用 Release
+func (u *Upstream) Acquire() {
+	u.flows.Add(1)
+}
+
+func (u *Upstream) Release() {
+	u.flows.Add(-1)
+}
+
+// Upstreams 是一组上游地址, 新的映射按 policy 选择
+type Upstreams struct {
+	upstreams []*Upstream
+	policy    string
+	next      atomic.Uint32
+}
+
+func NewUpstreams(policy string, addresses ...*net.UDPAddr) *Upstreams {
+	upstreams := make([]*Upstream, 0, len(addresses))
+	for _, address := range addresses {
+		upstreams = append(upstreams, NewUpstream(address))
+	}
+
+	return &Upstreams{
+		upstreams: upstreams,
+		policy:    policy,
+	}
+}
+
+func (u *Upstreams) Upstreams() []*Upstream {
+	return u.upstreams
+}
+
+// Select 选择一个上游, key 是客户端的身份, 只在 hash 策略下使用
+func (u *Upstreams) Select(key string) *Upstream {
+	candidates := make([]*Upstream, 0, len(u.upstreams))
+	for _, upstream := range u.upstreams {
+		if upstream.IsHealthy() {
+			candidates = append(candidates, upstream)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = u.upstreams
+	}
+
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch u.policy {
+	case UPSTREAM_POLICY_HASH:
+		return selectByHash(candidates, key)
+
+	case UPSTREAM_POLICY_LEAST_FLOWS:
+		// 从轮询的位置开始找, flow 数量相同时不会总是选择第一个
+		offset := int(u.next.Add(1) - 1)
+		var selected *Upstream = nil
+		for index := range candidates {
+			upstream := candidates[(offset+index)%len(candidates)]
+			if selected == nil || upstream.Flows() < selected.Flows() {
+				selected = upstream
+			}
+		}
+		return selected
+
+	default:
+		index := u.next.Add(1) - 1
+		return candidates[int(index)%len(candidates)]
+	}
+}
+
+func selectByHash(candidates []*Upstream, key string) *Upstream {
+	var selected *Upstream = nil
+	var maxScore uint64 = 0
+
+	for _, upstream := range candidates {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(key))
+		_, _ = hash.Write([]byte(upstream.String()))
+
+		if score := hash.Sum64(); selected == nil || score > maxScore {
+			selected = upstream
+			maxScore = score
+		}
+	}
+
+	return selected
+}
+
+type HealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// 发送的探测数据和期望的回复前缀, Expect 为空时收到任何回复都算成功
+	Payload []byte
+	Expect  []byte
+
+	// 连续失败多少次后认为上游不健康
+	Failures int
+}
+
+// Check 向上游发送一次探测并等待回复
+func (hc *HealthCheck) Check(address *net.UDPAddr) error {
+	conn, err := net.DialUDP("udp", nil, address)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to dial: %s", err.Error())
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(hc.Timeout)); err != nil {
+		return MakeErrorWithErrMsg("Failed to set deadline: %s", err.Error())
+	}
+
+	if _, err := conn.Write(hc.Payload); err != nil {
+		return MakeErrorWithErrMsg("Failed to send probe: %s", err.Error())
+	}
+
+	buffer := make([]byte, 65535)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return MakeErrorWithErrMsg("Failed to read reply: %s", err.Error())
+	}
+
+	if !bytes.HasPrefix(buffer[:n], hc.Expect) {
+		return MakeErrorWithErrMsg("unexpected reply")
+	}
+
+	return nil
+}
+
+// Run 每 Interval 并发检查所有上游, 每次检查后调用 report
+func (hc *HealthCheck) Run(ctx context.Context, pools []*Upstreams, report func(upstream *Upstream, err error)) {
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			wg := &sync.WaitGroup{}
+			for _, pool := range pools {
+				for _, upstream := range pool.Upstreams() {
+					wg.Add(1)
+					go func(upstream *Upstream) {
+						defer wg.Done()
+
+						err := hc.Check(upstream.Address())
+						if ctx.Err() != nil {
+							return
+						}
+
+						hc.update(upstream, err)
+						report(upstream, err)
+					}(upstream)
+				}
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func (hc *HealthCheck) update(upstream *Upstream, err error) {
+	if err == nil {
+		upstream.failures.Store(0)
+		if !upstream.healthy.Swap(true) {
+			logger.Info(FormatString("Upstream %s is healthy again", upstream.String()))
+		}
+		return
+	}
+
+	if int(upstream.failures.Add(1)) < hc.Failures {
+		return
+	}
+
+	if upstream.healthy.Swap(false) {
+		logger.Warn(FormatString("Upstream %s is unhealthy: %s", upstream.String(), err.Error()))
+	}
+}
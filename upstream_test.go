@@ -0,0 +1,171 @@
+package dtls_tunnel
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestUpstreams(policy string) *Upstreams {
+	return NewUpstreams(policy,
+		&net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 53},
+		&net.UDPAddr{IP: net.IPv4(10, 0, 1, 2), Port: 53},
+		&net.UDPAddr{IP: net.IPv4(10, 0, 1, 3), Port: 53},
+	)
+}
+
+func TestUpstreamsRoundRobin(t *testing.T) {
+	upstreams := newTestUpstreams(UPSTREAM_POLICY_ROUND_ROBIN)
+	all := upstreams.Upstreams()
+
+	for index := 0; index < 6; index++ {
+		if selected := upstreams.Select(""); selected != all[index%3] {
+			t.Errorf("select %d: %s, want %s", index, selected.String(), all[index%3].String())
+		}
+	}
+
+	// 不健康的上游不参与轮询
+	all[1].healthy.Store(false)
+	for index := 0; index < 6; index++ {
+		if selected := upstreams.Select(""); selected == all[1] {
+			t.Fatalf("select %d: unhealthy upstream %s", index, selected.String())
+		}
+	}
+}
+
+func TestUpstreamsHash(t *testing.T) {
+	upstreams := newTestUpstreams(UPSTREAM_POLICY_HASH)
+	all := upstreams.Upstreams()
+
+	keys := []string{"CN=alice", "CN=bob", "CN=carol", "psk:edge-1", "psk:edge-2", "psk:edge-3"}
+	selected := make(map[string]*Upstream)
+	used := make(map[*Upstream]bool)
+	for _, key := range keys {
+		selected[key] = upstreams.Select(key)
+		used[selected[key]] = true
+
+		if again := upstreams.Select(key); again != selected[key] {
+			t.Errorf("%s: selected %s then %s", key, selected[key].String(), again.String())
+		}
+	}
+
+	if len(used) < 2 {
+		t.Errorf("%d keys are all selected to the same upstream", len(keys))
+	}
+
+	// 上游不健康时只有其上的客户端换到别的上游
+	down := selected[keys[0]]
+	down.healthy.Store(false)
+	for _, key := range keys {
+		next := upstreams.Select(key)
+		if next == down {
+			t.Errorf("%s: selected the unhealthy upstream", key)
+		}
+		if selected[key] != down && next != selected[key] {
+			t.Errorf("%s: moved from %s to %s although its upstream is healthy", key, selected[key].String(), next.String())
+		}
+	}
+
+	for _, upstream := range all {
+		upstream.healthy.Store(true)
+	}
+	if again := upstreams.Select(keys[0]); again != down {
+		t.Errorf("%s: selected %s after recovery, want %s", keys[0], again.String(), down.String())
+	}
+}
+
+func TestUpstreamsLeastFlows(t *testing.T) {
+	upstreams := newTestUpstreams(UPSTREAM_POLICY_LEAST_FLOWS)
+	all := upstreams.Upstreams()
+
+	all[0].Acquire()
+	all[0].Acquire()
+	all[2].Acquire()
+
+	if selected := upstreams.Select(""); selected != all[1] {
+		t.Errorf("selected %s, want %s with no flows", selected.String(), all[1].String())
+	}
+
+	// flow 数量相同时轮流选择
+	all[1].Acquire()
+	all[0].Release()
+	counts := make(map[*Upstream]int)
+	for index := 0; index < 6; index++ {
+		counts[upstreams.Select("")]++
+	}
+	if len(counts) != 3 {
+		t.Errorf("upstreams with the same number of flows are selected %v times", counts)
+	}
+}
+
+func TestUpstreamsAllUnhealthy(t *testing.T) {
+	upstreams := newTestUpstreams(UPSTREAM_POLICY_ROUND_ROBIN)
+	for _, upstream := range upstreams.Upstreams() {
+		upstream.healthy.Store(false)
+	}
+
+	// 所有上游都不健康时仍然在全部上游中选择
+	if upstreams.Select("") == nil {
+		t.Error("Select() = nil when every upstream is unhealthy")
+	}
+}
+
+func TestHealthCheckUpdate(t *testing.T) {
+	hc := &HealthCheck{Failures: 2}
+	upstream := NewUpstream(&net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 53})
+	timeout := errors.New("timeout")
+
+	hc.update(upstream, timeout)
+	if !upstream.IsHealthy() {
+		t.Fatal("unhealthy after 1 failure, want 2")
+	}
+
+	hc.update(upstream, timeout)
+	if upstream.IsHealthy() {
+		t.Fatal("healthy after 2 failures")
+	}
+
+	// 一次成功后恢复, 并重新计算连续失败的次数
+	hc.update(upstream, nil)
+	hc.update(upstream, timeout)
+	if !upstream.IsHealthy() {
+		t.Error("unhealthy after recovery and 1 failure")
+	}
+}
+
+func TestHealthCheckCheck(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteToUDP(append([]byte("pong:"), buffer[:n]...), addr)
+		}
+	}()
+
+	address := server.LocalAddr().(*net.UDPAddr)
+
+	hc := &HealthCheck{Timeout: time.Second, Payload: []byte("ping"), Expect: []byte("pong:ping")}
+	if err := hc.Check(address); err != nil {
+		t.Errorf("Check() with the expected reply: %s", err.Error())
+	}
+
+	hc.Expect = []byte("ok")
+	if err := hc.Check(address); err == nil {
+		t.Error("Check() succeeded with an unexpected reply")
+	}
+
+	hc.Expect = nil
+	if err := hc.Check(address); err != nil {
+		t.Errorf("Check() without expect: %s", err.Error())
+	}
+}
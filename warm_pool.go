@@ -0,0 +1,200 @@
+package dtls_tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+/*
+ * 预热连接池, Client 在后台维持 size 个已经握手完成的空闲 DTLS 连接
+ * 新的映射 (多路复用模式下新的 session) 直接取走一个, 第一个数据报不用等待握手
+ * 取走后立即在后台补充, 建立失败时按 ReconnectBackoff 重试
+ *
+ * 服务端在 handshake_timeout 内收不到数据会关闭连接, 所以空闲超过 maxIdle 的连接被关闭并重新建立
+ * 每 maxIdle/4 检查一次, maxIdle 加上检查的间隔应该小于服务端的 handshake_timeout
+ * 服务端被探测为不可用时, 上面的空闲连接也一起关闭
+ */
+
+const DEFAULT_WARM_MAX_IDLE = time.Second * 20
+
+type warmTunnel struct {
+	tunnel  *dtls.Conn
+	server  *TunnelServer
+	created time.Time
+}
+
+func (t *warmTunnel) close() {
+	_ = t.tunnel.Close()
+}
+
+type WarmPool struct {
+	client  *Client
+	size    int
+	maxIdle time.Duration
+
+	// 按建立的时间排列, 先取最早的
+	lock    *sync.Mutex
+	tunnels []*warmTunnel
+
+	refill chan struct{}
+}
+
+func NewWarmPool(client *Client, size int, maxIdle time.Duration) *WarmPool {
+	return &WarmPool{
+		client:  client,
+		size:    size,
+		maxIdle: maxIdle,
+		lock:    &sync.Mutex{},
+		tunnels: make([]*warmTunnel, 0, size),
+		refill:  make(chan struct{}, 1),
+	}
+}
+
+// Acquire 取走一个可用的空闲连接, 没有时返回 false, 由调用方自己建立连接
+func (p *WarmPool) Acquire() (*dtls.Conn, *TunnelServer, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	defer p.notify()
+
+	for len(p.tunnels) > 0 {
+		tunnel := p.tunnels[0]
+		p.tunnels = p.tunnels[1:]
+
+		if p.isUsable(tunnel) {
+			return tunnel.tunnel, tunnel.server, true
+		}
+		tunnel.close()
+	}
+
+	return nil, nil, false
+}
+
+func (p *WarmPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.tunnels)
+}
+
+func (p *WarmPool) isUsable(tunnel *warmTunnel) bool {
+	return time.Since(tunnel.created) < p.maxIdle && tunnel.server.IsHealthy()
+}
+
+func (p *WarmPool) notify() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// handleServerDown 关闭服务端上的空闲连接, 补充时选择其他服务端
+func (p *WarmPool) handleServerDown(server *TunnelServer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	tunnels := make([]*warmTunnel, 0, p.size)
+	for _, tunnel := range p.tunnels {
+		if tunnel.server == server {
+			tunnel.close()
+			continue
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	p.tunnels = tunnels
+
+	p.notify()
+}
+
+// Run 补充连接并关闭过期的连接, 直到 ctx 结束后关闭所有空闲连接
+func (p *WarmPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.maxIdle / 4)
+	defer ticker.Stop()
+
+	defer p.closeAll()
+
+	var attempt int = 0
+	var retryTimer <-chan time.Time = nil
+
+	p.notify()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			p.expire()
+
+		case <-retryTimer:
+			retryTimer = nil
+			p.notify()
+
+		case <-p.refill:
+			if retryTimer != nil {
+				continue
+			}
+
+			if err := p.fill(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				logger.Warn(FormatString("Failed to open warm connection: %s", err.Error()))
+				retryTimer = time.After(ReconnectBackoff(attempt))
+				attempt++
+				continue
+			}
+			attempt = 0
+		}
+	}
+}
+
+// fill 逐个建立连接直到数量达到 size
+func (p *WarmPool) fill(ctx context.Context) error {
+	for p.Len() < p.size {
+		tunnel, server, err := p.client.dial(ctx)
+		if err != nil {
+			return err
+		}
+
+		p.lock.Lock()
+		p.tunnels = append(p.tunnels, &warmTunnel{tunnel: tunnel, server: server, created: time.Now()})
+		p.lock.Unlock()
+	}
+
+	return nil
+}
+
+// expire 关闭过期和服务端不可用的连接, 有连接被关闭时触发补充
+func (p *WarmPool) expire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	tunnels := make([]*warmTunnel, 0, p.size)
+	for _, tunnel := range p.tunnels {
+		if p.isUsable(tunnel) {
+			tunnels = append(tunnels, tunnel)
+			continue
+		}
+		tunnel.close()
+	}
+
+	if len(tunnels) < len(p.tunnels) {
+		p.notify()
+	}
+	p.tunnels = tunnels
+}
+
+func (p *WarmPool) closeAll() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, tunnel := range p.tunnels {
+		tunnel.close()
+	}
+	p.tunnels = nil
+}
@@ -0,0 +1,166 @@
+package dtls_tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// newTestWarmClient 启动保持两个预热连接的客户端
+func newTestWarmClient(t *testing.T, maxIdle time.Duration) *Client {
+	t.Helper()
+
+	upstream := newTestEchoUpstream(t)
+	serverConfig := newTestFileConfig(t, "server", upstream.LocalAddr().String())
+	newTestServer(t, serverConfig)
+
+	clientConfig := newTestFileConfig(t, "client", serverConfig.Listen)
+	clientConfig.WarmConnections = 2
+	clientConfig.WarmMaxIdle = Duration(maxIdle)
+	return newTestClient(t, clientConfig)
+}
+
+// waitTestWarmPool 等待预热连接的数量变为 size
+func waitTestWarmPool(t *testing.T, pool *WarmPool, size int) {
+	t.Helper()
+
+	deadline := time.Now().Add(TEST_ROUND_TRIP_TIMEOUT)
+	for pool.Len() != size {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d warm connections, want %d", pool.Len(), size)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// idleTestWarmTunnels 返回当前的空闲连接
+func idleTestWarmTunnels(pool *WarmPool) []*dtls.Conn {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	tunnels := make([]*dtls.Conn, 0, len(pool.tunnels))
+	for _, tunnel := range pool.tunnels {
+		tunnels = append(tunnels, tunnel.tunnel)
+	}
+	return tunnels
+}
+
+// expectTestTunnelsClosed 检查连接都已经关闭
+func expectTestTunnelsClosed(t *testing.T, tunnels []*dtls.Conn) {
+	t.Helper()
+
+	for _, tunnel := range tunnels {
+		if _, err := tunnel.Write([]byte("ping")); err == nil {
+			t.Errorf("warm connection %s is not closed", tunnel.LocalAddr().String())
+		}
+	}
+}
+
+func TestWarmPoolRefillsAfterAcquire(t *testing.T) {
+	client := newTestWarmClient(t, time.Minute)
+	waitTestWarmPool(t, client.warmPool, 2)
+
+	tunnel, server, isExist := client.warmPool.Acquire()
+	if !isExist {
+		t.Fatal("no warm connection acquired")
+	}
+	defer tunnel.Close()
+
+	if server != client.servers.Servers()[0] {
+		t.Errorf("acquired connection of %s", server.String())
+	}
+
+	waitTestWarmPool(t, client.warmPool, 2)
+	for _, idle := range idleTestWarmTunnels(client.warmPool) {
+		if idle == tunnel {
+			t.Error("acquired connection is still in the pool")
+		}
+	}
+}
+
+func TestWarmPoolDiscardsStaleTunnels(t *testing.T) {
+	client := newTestWarmClient(t, time.Minute)
+	pool := client.warmPool
+	waitTestWarmPool(t, pool, 2)
+
+	// 空闲太久的连接在 Acquire 时被跳过并关闭
+	pool.lock.Lock()
+	stale := pool.tunnels[0]
+	stale.created = time.Now().Add(-pool.maxIdle)
+	pool.lock.Unlock()
+
+	tunnel, _, isExist := pool.Acquire()
+	if !isExist {
+		t.Fatal("no warm connection acquired")
+	}
+	defer tunnel.Close()
+
+	if tunnel == stale.tunnel {
+		t.Error("stale connection acquired")
+	}
+	expectTestTunnelsClosed(t, []*dtls.Conn{stale.tunnel})
+
+	// 定期检查时关闭过期的连接并补充
+	waitTestWarmPool(t, pool, 2)
+	idle := idleTestWarmTunnels(pool)
+
+	pool.lock.Lock()
+	for _, tunnel := range pool.tunnels {
+		tunnel.created = time.Now().Add(-pool.maxIdle)
+	}
+	pool.lock.Unlock()
+
+	pool.expire()
+	expectTestTunnelsClosed(t, idle)
+	waitTestWarmPool(t, pool, 2)
+}
+
+func TestWarmPoolDiscardsTunnelsOfDownServer(t *testing.T) {
+	client := newTestWarmClient(t, time.Minute)
+	pool := client.warmPool
+	server := client.servers.Servers()[0]
+	waitTestWarmPool(t, pool, 2)
+
+	// 服务端被探测为不可用时关闭上面的空闲连接
+	idle := idleTestWarmTunnels(pool)
+	pool.handleServerDown(server)
+	expectTestTunnelsClosed(t, idle)
+
+	// 不可用的服务端上的连接不会被取走
+	waitTestWarmPool(t, pool, 2)
+	idle = idleTestWarmTunnels(pool)
+	server.healthy.Store(false)
+
+	if tunnel, _, isExist := pool.Acquire(); isExist {
+		_ = tunnel.Close()
+		t.Error("acquired connection of a down server")
+	}
+	expectTestTunnelsClosed(t, idle)
+
+	// 补充时握手成功, 服务端重新被标记为可用
+	waitTestWarmPool(t, pool, 2)
+	if tunnel, _, isExist := pool.Acquire(); !isExist {
+		t.Error("no warm connection acquired after the server is up")
+	} else {
+		_ = tunnel.Close()
+	}
+}
+
+func TestWarmPoolStopsAfterShutdown(t *testing.T) {
+	client := newTestWarmClient(t, time.Minute)
+	waitTestWarmPool(t, client.warmPool, 2)
+
+	idle := idleTestWarmTunnels(client.warmPool)
+	client.Shutdown()
+
+	// 关闭后空闲连接全部关闭, 之后不再补充
+	waitTestWarmPool(t, client.warmPool, 0)
+	expectTestTunnelsClosed(t, idle)
+
+	client.warmPool.notify()
+	time.Sleep(time.Millisecond * 200)
+	if size := client.warmPool.Len(); size != 0 {
+		t.Errorf("%d warm connections after shutdown", size)
+	}
+}